@@ -0,0 +1,160 @@
+package solvere
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cachedApex is the apex of the zone containing a name, as found by
+// zoneApex
+type cachedApex struct {
+	apex    string
+	expires time.Time
+}
+
+// cachedZoneApex returns the cached apex of the zone containing name, if
+// there is one and it hasn't expired
+func (rr *RecursiveResolver) cachedZoneApex(name string) (string, bool) {
+	rr.apexesMu.Lock()
+	defer rr.apexesMu.Unlock()
+	ca, present := rr.apexes[strings.ToLower(name)]
+	if !present || !rr.Clock.Now().Before(ca.expires) {
+		return "", false
+	}
+	return ca.apex, true
+}
+
+// cacheZoneApex caches the apex of the zone containing name for ttl seconds,
+// once MaxCachedZones apexes are cached they are pruned
+func (rr *RecursiveResolver) cacheZoneApex(name, apex string, ttl uint32) {
+	rr.apexesMu.Lock()
+	defer rr.apexesMu.Unlock()
+	now := rr.Clock.Now()
+	if rr.apexes == nil {
+		rr.apexes = make(map[string]cachedApex)
+	}
+	if max := rr.maxCachedZones(); len(rr.apexes) >= max {
+		for n, ca := range rr.apexes {
+			if !now.Before(ca.expires) {
+				delete(rr.apexes, n)
+			}
+		}
+		for n := range rr.apexes {
+			if len(rr.apexes) < pruneSize(max) {
+				break
+			}
+			delete(rr.apexes, n)
+		}
+	}
+	rr.apexes[strings.ToLower(name)] = cachedApex{apex: apex, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// zoneApex finds the apex of the zone containing name by sending a SOA query
+// for it to auth, the SOA record is either the answer, if name is the apex,
+// or in the authority section of the negative response. The apex must be in
+// the zone of auth. The response isn't validated, the apex it identifies is
+// only trusted once a chain of trust to it has been built. If the resolver
+// has a cache the apex is cached for the TTL of the SOA record.
+func (rr *RecursiveResolver) zoneApex(ctx context.Context, name string, auth *Nameserver) (string, *LookupLog, error) {
+	if apex, present := rr.cachedZoneApex(name); present {
+		return apex, nil, nil
+	}
+	r, log, err := rr.query(ctx, &Question{Name: name, Type: dns.TypeSOA}, auth, LookupOptions{NoCache: true})
+	if err != nil {
+		log.Error = err.Error()
+		return "", log, err
+	}
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, record := range section {
+			soa, ok := record.(*dns.SOA)
+			if !ok || !dns.IsSubDomain(soa.Hdr.Name, name) || !dns.IsSubDomain(auth.Zone, soa.Hdr.Name) {
+				continue
+			}
+			apex := strings.ToLower(soa.Hdr.Name)
+			if rr.cache != nil {
+				rr.cacheZoneApex(name, apex, soa.Hdr.Ttl)
+			}
+			return apex, log, nil
+		}
+	}
+	log.Error = ErrNoSOA.Error()
+	return "", log, ErrNoSOA
+}
+
+// childSigner returns the name of the zone that signed the records in a
+// message if it is below zone, which happens when the nameservers of zone
+// are also authoritative for the child zone so a referral to it is never
+// received
+func childSigner(m *dns.Msg, zone string) (string, bool) {
+	signer := ""
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, r := range extractRRSet(section, "", dns.TypeRRSIG) {
+			name := dns.Fqdn(strings.ToLower(r.(*dns.RRSIG).SignerName))
+			if signer != "" && name != signer {
+				return "", false
+			}
+			signer = name
+		}
+	}
+	if signer == "" || strings.EqualFold(signer, zone) || !dns.IsSubDomain(zone, signer) {
+		return "", false
+	}
+	return signer, true
+}
+
+// hiddenZoneCut checks that the child zone that signed m is a real zone
+// whose apex is served by auth, by finding the apex of the zone containing
+// the signer name, and fetches the DS RRset for it from auth, which is
+// validated using the keys of the zone of auth. The nameserver to use for the
+// child zone and its DS RRset are returned, so the chain of trust can be
+// continued into it.
+func (rr *RecursiveResolver) hiddenZoneCut(ctx context.Context, m *dns.Msg, auth *Nameserver, siblings []Nameserver, parentDSSet []dns.RR) (*Nameserver, []dns.RR, []*LookupLog, error) {
+	signer, ok := childSigner(m, auth.Zone)
+	if !ok {
+		return nil, nil, nil, ErrUntrustedSigner
+	}
+	var logs []*LookupLog
+	apex, apexLog, err := rr.zoneApex(ctx, signer, auth)
+	if apexLog != nil {
+		logs = append(logs, apexLog)
+	}
+	if err != nil {
+		return nil, nil, logs, err
+	}
+	if apex != signer {
+		return nil, nil, logs, ErrUntrustedSigner
+	}
+
+	r, dsLog, err := rr.query(ctx, &Question{Name: apex, Type: dns.TypeDS}, auth, LookupOptions{NoCache: true})
+	logs = append(logs, dsLog)
+	if err != nil {
+		dsLog.Error = err.Error()
+		return nil, nil, logs, err
+	}
+	dsSet := extractRRSet(r.Answer, apex, dns.TypeDS)
+	if r.Rcode != dns.RcodeSuccess || len(dsSet) == 0 {
+		// without a DS RRset the child zone can't be linked to the chain
+		// of trust
+		dsLog.Error = ErrUntrustedSigner.Error()
+		return nil, nil, logs, ErrUntrustedSigner
+	}
+	if _, err := signerZone(r, auth.Zone); err != nil {
+		// the DS RRset must be signed by the parent zone, checking this
+		// here also stops a child signer being followed again
+		dsLog.Error = err.Error()
+		return nil, nil, logs, err
+	}
+	dkLog, err := rr.checkSignatures(ctx, r, auth, siblings, parentDSSet)
+	if dkLog != nil {
+		dsLog.Composites = append(dsLog.Composites, dkLog)
+	}
+	if err != nil {
+		dsLog.Error = err.Error()
+		return nil, nil, logs, err
+	}
+	dsLog.DNSSECValid = true
+	return &Nameserver{Name: auth.Name, Addr: auth.Addr, Zone: apex}, dsSet, logs, nil
+}
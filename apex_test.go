@@ -0,0 +1,114 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChildSigner(t *testing.T) {
+	sig := func(signer string) dns.RR {
+		return &dns.RRSIG{Hdr: dns.RR_Header{Name: "a.sub.example.", Rrtype: dns.TypeRRSIG}, SignerName: signer}
+	}
+	for _, tc := range []struct {
+		sigs   []dns.RR
+		signer string
+	}{
+		{[]dns.RR{sig("sub.example.")}, "sub.example."},
+		{[]dns.RR{sig("example.")}, ""},
+		{[]dns.RR{sig("other.")}, ""},
+		{[]dns.RR{sig("sub.example."), sig("example.")}, ""},
+		{nil, ""},
+	} {
+		signer, ok := childSigner(&dns.Msg{Answer: tc.sigs}, "example.")
+		if signer != tc.signer || ok != (tc.signer != "") {
+			t.Fatalf("childSigner returned %q for %v, expected %q", signer, tc.sigs, tc.signer)
+		}
+	}
+}
+
+func TestLookupDetectZoneApex(t *testing.T) {
+	// sub.example. is served by the nameserver for example. so there is no
+	// referral to it, the delegation suggests example. is the apex of the
+	// zone containing a.sub.example. but the answer is signed by sub.example.
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.3", true, `a.sub.example. 300 IN A 1.2.3.4
+b.sub.example. 300 IN A 1.2.3.4`)
+	example.records = append(example.records, sub.key.ToDS(dns.SHA256))
+	example.hosted = []*testZone{sub}
+	root.delegate(example)
+	questions := recordQuestions(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	_, _, err := rr.Lookup(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA})
+	if !errors.Is(err, ErrUntrustedSigner) {
+		t.Fatalf("Lookup without DetectZoneApex didn't fail with ErrUntrustedSigner: %v", err)
+	}
+
+	rr = newTestResolver(root, NewBasicCache())
+	rr.DetectZoneApex = true
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup with DetectZoneApex failed: %s", err)
+	}
+	if !answer.Authenticated || len(extractRRSet(answer.Answer, "a.sub.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup with DetectZoneApex returned wrong answer: %+v", answer)
+	}
+	if apex, present := rr.cachedZoneApex("sub.example."); !present || apex != "sub.example." {
+		t.Fatalf("Lookup didn't cache the detected apex: %q", apex)
+	}
+
+	countSOA := func() int {
+		n := 0
+		for _, q := range questions(example) {
+			if q == "sub.example. SOA" {
+				n++
+			}
+		}
+		return n
+	}
+	sent := countSOA()
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "b.sub.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup with DetectZoneApex failed: %s", err)
+	}
+	if countSOA() != sent {
+		t.Fatal("Lookup didn't use the cached apex")
+	}
+}
+
+func TestLookupDetectZoneApexWithoutDS(t *testing.T) {
+	// the child zone isn't linked to the parent by a DS RRset so its
+	// signatures can't be trusted
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.3", true, "a.sub.example. 300 IN A 1.2.3.4")
+	example.hosted = []*testZone{sub}
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	rr.DetectZoneApex = true
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA}); !errors.Is(err, ErrUntrustedSigner) {
+		t.Fatalf("Lookup of child zone without DS didn't fail with ErrUntrustedSigner: %v", err)
+	}
+}
+
+func TestCacheZoneApexLimit(t *testing.T) {
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	rr.MaxCachedZones = 8
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("a.z%d.", i)
+		rr.cacheZoneApex(name, name[2:], 300)
+		if len(rr.apexes) > rr.MaxCachedZones {
+			t.Fatalf("%d apexes cached, more than MaxCachedZones", len(rr.apexes))
+		}
+		if _, present := rr.cachedZoneApex(name); !present {
+			t.Fatalf("Apex for %s wasn't cached", name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package solvere
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isZoneApex checks if a negative answer for name shows that name is the apex
+// of its zone, in which case the SOA record in the authority section will be
+// owned by name
+func isZoneApex(name string, a *Answer) bool {
+	for _, r := range a.Answer {
+		if t := r.Header().Rrtype; t == dns.TypeCNAME || t == dns.TypeDNAME {
+			// the authority section describes the zone of the alias target
+			return false
+		}
+	}
+	return len(extractRRSet(a.Authority, name, dns.TypeSOA)) > 0
+}
+
+// LookupCAA returns the CAA records relevant to name using the tree-climbing
+// algorithm from RFC 6844. If name has no CAA records its parent is checked,
+// and so on until records are found or the apex of the zone is reached. Any
+// aliases are followed when looking up a name but the climb always continues
+// from the parent of the original name rather than the alias target (RFC 6844
+// errata 5065). The returned bool indicates if every answer used was
+// authenticated.
+func (rr *RecursiveResolver) LookupCAA(ctx context.Context, name string) ([]*dns.CAA, bool, error) {
+	authenticated := true
+	labels := dns.SplitDomainName(dns.Fqdn(name))
+	for i := range labels {
+		current := dns.Fqdn(strings.Join(labels[i:], "."))
+		answer, _, err := rr.Lookup(ctx, Question{Name: current, Type: dns.TypeCAA})
+		if err != nil {
+			return nil, false, err
+		}
+		if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+			return nil, false, fmt.Errorf("solvere: CAA lookup failed for %s: %s", current, dns.RcodeToString[answer.Rcode])
+		}
+		authenticated = authenticated && answer.Authenticated
+		var records []*dns.CAA
+		for _, r := range answer.Answer {
+			if caa, ok := r.(*dns.CAA); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 {
+			return records, authenticated, nil
+		}
+		if isZoneApex(current, answer) {
+			break
+		}
+	}
+	return nil, authenticated, nil
+}
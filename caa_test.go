@@ -0,0 +1,31 @@
+package solvere
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLookupCAA(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `
+example. 300 IN CAA 0 issue "ca.example"
+a.b.example. 300 IN A 1.2.3.4
+alias.example. 300 IN CNAME a.b.example.
+`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	for _, name := range []string{"a.b.example.", "alias.example."} {
+		records, authenticated, err := rr.LookupCAA(context.Background(), name)
+		if err != nil {
+			t.Fatalf("LookupCAA failed for %s: %s", name, err)
+		}
+		if !authenticated {
+			t.Fatalf("LookupCAA result for %s wasn't authenticated", name)
+		}
+		if len(records) != 1 || records[0].Hdr.Name != "example." || records[0].Value != "ca.example" {
+			t.Fatalf("LookupCAA returned wrong records for %s: %v", name, records)
+		}
+	}
+}
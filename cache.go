@@ -1,8 +1,12 @@
 package solvere
 
 import (
+	"container/list"
 	"crypto/sha1"
+	"encoding/json"
+	"io"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -20,15 +24,21 @@ const (
 	year68 = int64(1 << 31)
 )
 
-func minTTL(a []dns.RR, clk clock.Clock) int {
+// minTTL returns the lowest TTL of a set of records. If a RRSIG expires before
+// then the time until it expires is used instead, so that expired signatures
+// aren't served from the cache, and the returned bool is true. OPT records are
+// ignored since their TTL field holds the extended rcode and flags.
+func minTTL(a []dns.RR, clk clock.Clock) (int, bool) {
 	var min *uint32
+	sigLimited := false
 	for _, r := range a {
-		if min == nil {
-			min = &r.Header().Ttl
+		if r.Header().Rrtype == dns.TypeOPT {
 			continue
 		}
-		if r.Header().Ttl < *min {
-			min = &r.Header().Ttl
+		if min == nil || r.Header().Ttl < *min {
+			ttl := r.Header().Ttl
+			min = &ttl
+			sigLimited = false
 		}
 		if r.Header().Rrtype == dns.TypeRRSIG {
 			// if expiration is lower than Ttl then use that instead so we always
@@ -37,17 +47,63 @@ func minTTL(a []dns.RR, clk clock.Clock) int {
 			n := clk.Now().UTC().Unix()
 			mod := (int64(rr.Expiration) - n) / year68
 			t := int64(rr.Expiration) + (mod * year68)
-			expiresIn := (t - n) / 1000000000 // convert to seconds
+			expiresIn := t - n
 			if expiresIn > 0 && expiresIn < math.MaxUint32 && uint32(expiresIn) < *min {
 				uei := uint32(expiresIn)
 				min = &uei
+				sigLimited = true
 			}
 		}
 	}
 	if min == nil {
-		return 0
+		return 0, false
 	}
-	return int(*min)
+	return int(*min), sigLimited
+}
+
+// isNegative checks if a answer is a denial of existence, either a name
+// error or a NODATA response
+func isNegative(a *Answer) bool {
+	return a.Rcode == dns.RcodeNameError || (a.Rcode == dns.RcodeSuccess && len(a.Answer) == 0)
+}
+
+// negativeTTL returns the TTL a negative answer should be cached for, the
+// minimum of the SOA TTL and its MINIMUM field (RFC 2308 Section 5). If there
+// is no SOA record false is returned and the answer shouldn't be cached.
+func negativeTTL(a *Answer) (int, bool) {
+	for _, r := range a.Authority {
+		if soa, ok := r.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return int(soa.Minttl), true
+			}
+			return int(soa.Hdr.Ttl), true
+		}
+	}
+	return 0, false
+}
+
+// hasRecords checks if a answer contains any records other than OPT records
+func hasRecords(a *Answer) bool {
+	for _, section := range [][]dns.RR{a.Answer, a.Authority, a.Additional} {
+		for _, r := range section {
+			if r.Header().Rrtype != dns.TypeOPT {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// answerSize estimates the memory used by a answer using the wire length of
+// its records
+func answerSize(a *Answer) int {
+	size := 0
+	for _, section := range [][]dns.RR{a.Answer, a.Authority, a.Additional} {
+		for _, r := range section {
+			size += dns.Len(r)
+		}
+	}
+	return size
 }
 
 type cacheEntry struct {
@@ -56,24 +112,84 @@ type cacheEntry struct {
 	modified time.Time
 	forever  bool
 	mu       sync.Mutex
+	// sigLimited indicates ttl was lowered to the time until a RRSIG in
+	// the answer expires
+	sigLimited bool
+	// hits is the number of times the answer has been returned by Get
+	// since it was added, and prefetching indicates OnPrefetch has been
+	// called for it
+	hits        int
+	prefetching bool
+
+	id   [sha1.Size]byte
+	q    Question
+	size int
+	elem *list.Element
 }
 
-func (ce *cacheEntry) update(answer *Answer, ttl int, clk clock.Clock) {
+func (ce *cacheEntry) update(answer *Answer, ttl int, sigLimited, forever bool, clk clock.Clock) {
 	ce.mu.Lock()
 	defer ce.mu.Unlock()
 	// just overwrite the previous one...
 	ce.answer = answer
 	ce.ttl = ttl
+	ce.forever = forever
+	ce.sigLimited = sigLimited
 	ce.modified = clk.Now()
+	ce.hits = 0
+	ce.prefetching = false
 }
 
-func (ce *cacheEntry) expired(clk clock.Clock) bool {
+// decremented returns a copy of a negative answer with the TTLs of its
+// authority records reduced by the time the entry has been cached, so clients
+// don't cache the denial for longer than its remaining lifetime. ce.mu must
+// be held.
+func (ce *cacheEntry) decremented(clk clock.Clock) *Answer {
+	elapsed := int(clk.Now().Sub(ce.modified) / time.Second)
+	remaining := ce.ttl - elapsed
+	if remaining < 0 {
+		remaining = 0
+	}
+	a := *ce.answer
+	a.Authority = make([]dns.RR, len(ce.answer.Authority))
+	for i, r := range ce.answer.Authority {
+		r = dns.Copy(r)
+		if int(r.Header().Ttl) > remaining {
+			r.Header().Ttl = uint32(remaining)
+		}
+		a.Authority[i] = r
+	}
+	return &a
+}
+
+// expired checks if the entry has been expired for longer than grace
+func (ce *cacheEntry) expired(clk clock.Clock, grace time.Duration) bool {
 	ce.mu.Lock()
 	defer ce.mu.Unlock()
 	if ce.forever {
 		return false
 	}
-	return clk.Now().After(ce.modified.Add(time.Second * time.Duration(ce.ttl)))
+	return clk.Now().After(ce.modified.Add(time.Second*time.Duration(ce.ttl) + grace))
+}
+
+// stale returns a copy of the entry's answer, flagged as stale, with the
+// TTLs of all of its records set to StaleTTL. ce.mu must be held.
+func (ce *cacheEntry) stale() *Answer {
+	a := *ce.answer
+	a.Stale = true
+	sections := []*[]dns.RR{&a.Answer, &a.Authority, &a.Additional}
+	for _, section := range sections {
+		records := make([]dns.RR, len(*section))
+		for i, r := range *section {
+			r = dns.Copy(r)
+			if r.Header().Rrtype != dns.TypeOPT {
+				r.Header().Ttl = StaleTTL
+			}
+			records[i] = r
+		}
+		*section = records
+	}
+	return &a
 }
 
 // QuestionAnswerCache is used to cache responses to queries. The internal implementation
@@ -83,15 +199,157 @@ type QuestionAnswerCache interface {
 	Add(q *Question, answer *Answer, forever bool)
 }
 
+var (
+	// StaleTTL is the TTL set on records in stale answers (RFC 8767 Section 4)
+	StaleTTL uint32 = 30
+
+	// DefaultMaxNegativeTTL is the maximum time in seconds a negative answer
+	// is cached for if BasicCache.MaxNegativeTTL isn't set
+	DefaultMaxNegativeTTL uint32 = 900
+
+	// ZeroTTLMinimum is the time in seconds answers with a TTL of zero are
+	// cached for if BasicCache.CacheZeroTTL is set
+	ZeroTTLMinimum = 1
+
+	// DefaultPrefetchFraction is the fraction of the TTL of a entry that
+	// must remain for it to be prefetched if BasicCache.PrefetchFraction
+	// isn't set
+	DefaultPrefetchFraction = 0.1
+)
+
+// StaleAnswerCache is a QuestionAnswerCache that keeps answers for some time
+// after they have expired so they can be used when fresh answers can't be
+// retrieved
+type StaleAnswerCache interface {
+	QuestionAnswerCache
+	// GetStale returns the answer for a question even if it has expired,
+	// if it is expired the Stale field of the answer is set and the TTLs of
+	// its records are set to StaleTTL
+	GetStale(q *Question) *Answer
+}
+
+// AgeCache is a QuestionAnswerCache that can report how long answers have
+// been cached for
+type AgeCache interface {
+	QuestionAnswerCache
+	// Age returns the time since the answer for a question was added to
+	// the cache, or last replaced
+	Age(q *Question) (time.Duration, bool)
+}
+
+// CacheStats describes the current state of a BasicCache
+type CacheStats struct {
+	Entries   int
+	Bytes     int
+	Evictions int
+	// Suspicious is the number of answers added with a TTL above
+	// SuspiciousTTL
+	Suspicious int
+}
+
 // BasicCache is a basic implementation of the QuestionAnswerCache interface
 type BasicCache struct {
+	// MaxStale is how long entries are kept after they expire so they can be
+	// returned by GetStale
+	MaxStale time.Duration
+
+	// MaxBytes is the approximate maximum amount of memory, based on the wire
+	// length of cached records, that the cache will use. When it is exceeded
+	// the least recently used entries are evicted. If it is zero there is no
+	// limit. Entries that are cached forever are never evicted.
+	MaxBytes int
+
+	// MaxEntries is the maximum number of entries the cache will hold, when
+	// it is exceeded the least recently used entries are evicted. If it is
+	// zero there is no limit. Entries that are cached forever are never
+	// evicted and aren't counted.
+	MaxEntries int
+
+	// SuspiciousTTL is the TTL above which answers are considered suspicious,
+	// since a extremely long TTL can be used to pin poisoned data in the cache.
+	// If it is zero TTLs aren't checked. Suspicious answers are counted in
+	// Stats and passed to OnSuspiciousTTL if it is set. If
+	// RejectSuspiciousTTL is set they also aren't cached.
+	SuspiciousTTL       uint32
+	RejectSuspiciousTTL bool
+	OnSuspiciousTTL     func(q Question, ttl uint32)
+
+	// MaxNegativeTTL caps the time in seconds a negative answer is cached
+	// for, regardless of the TTL derived from its SOA record, so that newly
+	// created names aren't hidden for long. If it is zero
+	// DefaultMaxNegativeTTL is used.
+	MaxNegativeTTL uint32
+
+	// CacheZeroTTL caches answers with a TTL of zero for ZeroTTLMinimum
+	// seconds, so that bursts of identical queries can be answered from the
+	// cache. By default they aren't cached at all, since a TTL of zero means
+	// the records should only be used for the transaction in progress (RFC
+	// 1035 Section 3.2.1).
+	CacheZeroTTL bool
+
+	// MinTTL and MaxTTL, if non-zero, bound the time in seconds answers are
+	// cached for, regardless of the TTLs of their records, so that zones
+	// serving very short TTLs don't defeat the cache and zones serving
+	// very long TTLs don't pin answers in it. MinTTL also applies to answers
+	// with a TTL of zero. A answer is still cached for less than MinTTL if
+	// one of its RRSIGs expires sooner, so that expired signatures aren't
+	// served. These are normally set with NewBasicCacheWithConfig.
+	MinTTL uint32
+	MaxTTL uint32
+
+	// Prefetch causes popular entries to be refreshed before they expire,
+	// so that clients don't see a cache miss for them. When Get returns a
+	// entry that has been returned more than PrefetchHits times since it was
+	// added, and less than PrefetchFraction of its TTL remains, OnPrefetch
+	// is called with its question in a new goroutine, once per entry. The
+	// refreshed answer is expected to be passed to Add. If PrefetchFraction
+	// is zero DefaultPrefetchFraction is used. NewRecursiveResolver sets
+	// OnPrefetch, if it isn't already set, to a function that resolves the
+	// question again.
+	Prefetch         bool
+	PrefetchHits     int
+	PrefetchFraction float64
+	OnPrefetch       func(q Question)
+
 	mu    sync.RWMutex
 	cache map[[sha1.Size]byte]*cacheEntry
 	clk   clock.Clock
+
+	// lru orders entries that can be evicted from most to least recently used
+	lru        *list.List
+	bytes      int
+	evictions  int
+	suspicious int
 }
 
 var defaultPruneInterval = time.Minute
 
+// CacheConfig contains optional settings for a BasicCache created by
+// NewBasicCacheWithConfig, zero values use the defaults of NewBasicCache
+type CacheConfig struct {
+	// MinTTL and MaxTTL bound the time in seconds answers are cached for,
+	// see BasicCache.MinTTL and BasicCache.MaxTTL
+	MinTTL uint32
+	MaxTTL uint32
+}
+
+// NewBasicCacheWithConfig returns an initialized BasicCache configured by
+// config
+func NewBasicCacheWithConfig(config CacheConfig) *BasicCache {
+	bc := NewBasicCache()
+	bc.MinTTL = config.MinTTL
+	bc.MaxTTL = config.MaxTTL
+	return bc
+}
+
+// NewBasicCacheWithSize returns an initialized BasicCache that holds at most
+// max entries, see MaxEntries
+func NewBasicCacheWithSize(max int) *BasicCache {
+	bc := NewBasicCache()
+	bc.MaxEntries = max
+	return bc
+}
+
 // NewBasicCache returns an initialized BasicCache
 func NewBasicCache() *BasicCache {
 	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
@@ -104,17 +362,46 @@ func NewBasicCache() *BasicCache {
 	return bc
 }
 
+// Stats returns the number of entries in the cache, their approximate size,
+// and how many entries have been evicted to stay under MaxBytes and
+// MaxEntries
+func (bc *BasicCache) Stats() CacheStats {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return CacheStats{Entries: len(bc.cache), Bytes: bc.bytes, Evictions: bc.evictions, Suspicious: bc.suspicious}
+}
+
 func (bc *BasicCache) del(id [sha1.Size]byte) {
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
-	delete(bc.cache, id)
+	if entry, present := bc.cache[id]; present {
+		bc.remove(entry)
+	}
+}
+
+// remove deletes a entry from the cache, bc.mu must be held
+func (bc *BasicCache) remove(entry *cacheEntry) {
+	if entry.elem != nil {
+		bc.lru.Remove(entry.elem)
+	}
+	bc.bytes -= entry.size
+	delete(bc.cache, entry.id)
+}
+
+// evict removes the least recently used entries until the cache is
+// under MaxBytes and MaxEntries, bc.mu must be held
+func (bc *BasicCache) evict() {
+	for bc.lru.Len() > 0 && ((bc.MaxBytes > 0 && bc.bytes > bc.MaxBytes) || (bc.MaxEntries > 0 && bc.lru.Len() > bc.MaxEntries)) {
+		bc.remove(bc.lru.Back().Value.(*cacheEntry))
+		bc.evictions++
+	}
 }
 
 func (bc *BasicCache) fullPrune() {
 	ids := [][sha1.Size]byte{}
 	bc.mu.RLock()
 	for id, a := range bc.cache {
-		if a.expired(bc.clk) {
+		if a.expired(bc.clk, bc.MaxStale) {
 			ids = append(ids, id)
 		}
 	}
@@ -124,54 +411,320 @@ func (bc *BasicCache) fullPrune() {
 	}
 }
 
-// Add adds a response to the cache using a index based on the question
+// clampTTL bounds the TTL a answer is cached for by MinTTL and MaxTTL, a TTL
+// limited by the expiration of a signature isn't raised to MinTTL
+func (bc *BasicCache) clampTTL(ttl int, sigLimited bool) (int, bool) {
+	if bc.MaxTTL > 0 && ttl > int(bc.MaxTTL) {
+		return int(bc.MaxTTL), false
+	}
+	if bc.MinTTL > 0 && ttl < int(bc.MinTTL) && !sigLimited {
+		return int(bc.MinTTL), false
+	}
+	return ttl, sigLimited
+}
+
+// suspiciousTTL checks if any of the records in a answer have a TTL above
+// SuspiciousTTL, and if so records it
+func (bc *BasicCache) suspiciousTTL(q *Question, answer *Answer) bool {
+	var max uint32
+	for _, section := range [][]dns.RR{answer.Answer, answer.Authority, answer.Additional} {
+		for _, r := range section {
+			if r.Header().Rrtype != dns.TypeOPT && r.Header().Ttl > max {
+				max = r.Header().Ttl
+			}
+		}
+	}
+	if max <= bc.SuspiciousTTL {
+		return false
+	}
+	bc.mu.Lock()
+	bc.suspicious++
+	bc.mu.Unlock()
+	if bc.OnSuspiciousTTL != nil {
+		bc.OnSuspiciousTTL(*q, max)
+	}
+	return true
+}
+
+// Add adds a response to the cache using a index based on the question. If
+// forever is set the response never expires and is never evicted or pruned,
+// it replaces any existing response for the question but can only be
+// replaced itself by another response added with forever set, so that
+// refreshed root keys can replace the old ones.
 func (bc *BasicCache) Add(q *Question, answer *Answer, forever bool) {
 	id := hashQuestion(q)
 	var ttl int
+	var sigLimited bool
 	if !forever {
-		ttl = minTTL(append(answer.Answer, append(answer.Additional, answer.Authority...)...), bc.clk)
+		if !hasRecords(answer) {
+			// there is nothing to derive a TTL from
+			return
+		}
+		ttl, sigLimited = minTTL(append(answer.Answer, append(answer.Additional, answer.Authority...)...), bc.clk)
+		if isNegative(answer) {
+			nttl, ok := negativeTTL(answer)
+			if !ok {
+				return
+			}
+			max := bc.MaxNegativeTTL
+			if max == 0 {
+				max = DefaultMaxNegativeTTL
+			}
+			if nttl > int(max) {
+				nttl = int(max)
+			}
+			if nttl < ttl {
+				ttl = nttl
+				sigLimited = false
+			}
+		}
+		ttl, sigLimited = bc.clampTTL(ttl, sigLimited)
 		if ttl == 0 {
+			if !bc.CacheZeroTTL {
+				return
+			}
+			ttl = ZeroTTLMinimum
+		}
+		if bc.SuspiciousTTL > 0 && bc.suspiciousTTL(q, answer) && bc.RejectSuspiciousTTL {
 			return
 		}
 	}
+	size := answerSize(answer)
+	if !forever && bc.MaxBytes > 0 && size > bc.MaxBytes {
+		return
+	}
 	// should filter out OPT records here
 	bc.mu.Lock()
 	defer bc.mu.Unlock()
-	if _, present := bc.cache[id]; present {
-		bc.cache[id].update(answer, ttl, bc.clk)
+	if bc.lru == nil {
+		bc.lru = list.New()
+	}
+	if entry, present := bc.cache[id]; present {
+		if entry.forever && !forever {
+			// a entry cached forever, such as the root keys, can only be
+			// replaced by another entry cached forever
+			return
+		}
+		entry.update(answer, ttl, sigLimited, forever, bc.clk)
+		bc.bytes += size - entry.size
+		entry.size = size
+		if forever && entry.elem != nil {
+			bc.lru.Remove(entry.elem)
+			entry.elem = nil
+		} else if entry.elem != nil {
+			bc.lru.MoveToFront(entry.elem)
+		}
+		bc.evict()
 		return
 	}
-	bc.cache[id] = &cacheEntry{
-		answer,
-		ttl,
-		bc.clk.Now(),
-		forever,
-		sync.Mutex{},
+	entry := &cacheEntry{
+		answer:     answer,
+		ttl:        ttl,
+		modified:   bc.clk.Now(),
+		forever:    forever,
+		sigLimited: sigLimited,
+		id:         id,
+		q:          *q,
+		size:       size,
 	}
+	bc.cache[id] = entry
+	bc.bytes += size
 	if forever {
 		return
 	}
+	entry.elem = bc.lru.PushFront(entry)
+	bc.evict()
 	// go bc.prune(q, id, ttl)
 }
 
+// EntryTTL describes the lifetime of a cached answer
+type EntryTTL struct {
+	// TTL is the time in seconds the answer is cached for, calculated when
+	// it was added, and Remaining how much of it is left
+	TTL       int
+	Remaining int
+	// SignatureLimited indicates TTL was lowered because a RRSIG in the
+	// answer expires before its records do
+	SignatureLimited bool
+	Forever          bool
+}
+
+// Age returns the time since the answer for a question was added to the
+// cache, or last replaced, without marking it as recently used
+func (bc *BasicCache) Age(q *Question) (time.Duration, bool) {
+	bc.mu.RLock()
+	entry, present := bc.cache[hashQuestion(q)]
+	bc.mu.RUnlock()
+	if !present {
+		return 0, false
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return bc.clk.Now().Sub(entry.modified), true
+}
+
+// PeekTTL returns the lifetime of the cached answer for a question, if there
+// is one, without marking it as recently used. It is intended for debugging
+// why answers expire when they do.
+func (bc *BasicCache) PeekTTL(q *Question) (EntryTTL, bool) {
+	bc.mu.RLock()
+	entry, present := bc.cache[hashQuestion(q)]
+	bc.mu.RUnlock()
+	if !present {
+		return EntryTTL{}, false
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.forever {
+		return EntryTTL{Forever: true}, true
+	}
+	remaining := int(entry.modified.Add(time.Second*time.Duration(entry.ttl)).Sub(bc.clk.Now()) / time.Second)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return EntryTTL{TTL: entry.ttl, Remaining: remaining, SignatureLimited: entry.sigLimited}, true
+}
+
 func (bc *BasicCache) getEntry(q *Question) (*cacheEntry, bool) {
 	id := hashQuestion(q)
-	bc.mu.RLock()
-	defer bc.mu.RUnlock()
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	entry, present := bc.cache[id]
+	if present && entry.elem != nil {
+		bc.lru.MoveToFront(entry.elem)
+	}
 	return entry, present
 }
 
 // Get returns the response for a question if it exists in the cache
 func (bc *BasicCache) Get(q *Question) *Answer {
 	if entry, present := bc.getEntry(q); present {
-		if entry.expired(bc.clk) {
-			bc.del(hashQuestion(q))
+		if entry.expired(bc.clk, 0) {
+			if entry.expired(bc.clk, bc.MaxStale) {
+				bc.del(hashQuestion(q))
+			}
 			return nil
 		}
 		entry.mu.Lock()
 		defer entry.mu.Unlock()
+		entry.hits++
+		bc.maybePrefetch(entry)
+		if isNegative(entry.answer) {
+			return entry.decremented(bc.clk)
+		}
 		return entry.answer
 	}
 	return nil
 }
+
+// maybePrefetch calls OnPrefetch for a entry if prefetching is enabled, it
+// is popular enough, and is close enough to expiring. entry.mu must be held.
+func (bc *BasicCache) maybePrefetch(entry *cacheEntry) {
+	if !bc.Prefetch || bc.OnPrefetch == nil || entry.forever || entry.prefetching || entry.hits <= bc.PrefetchHits {
+		return
+	}
+	fraction := bc.PrefetchFraction
+	if fraction == 0 {
+		fraction = DefaultPrefetchFraction
+	}
+	remaining := entry.modified.Add(time.Second * time.Duration(entry.ttl)).Sub(bc.clk.Now())
+	if remaining >= time.Duration(float64(time.Second*time.Duration(entry.ttl))*fraction) {
+		return
+	}
+	entry.prefetching = true
+	go bc.OnPrefetch(entry.q)
+}
+
+// GetStale returns the response for a question if it exists in the cache and
+// hasn't been expired for longer than MaxStale, expired responses are
+// flagged as stale
+func (bc *BasicCache) GetStale(q *Question) *Answer {
+	entry, present := bc.getEntry(q)
+	if !present {
+		return nil
+	}
+	if !entry.expired(bc.clk, 0) {
+		return bc.Get(q)
+	}
+	if entry.expired(bc.clk, bc.MaxStale) {
+		bc.del(hashQuestion(q))
+		return nil
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.stale()
+}
+
+type dumpedEntry struct {
+	Name          string
+	Type          string
+	Rcode         string
+	Answer        []string `json:",omitempty"`
+	Authority     []string `json:",omitempty"`
+	Additional    []string `json:",omitempty"`
+	Authenticated bool
+	Forever       bool `json:",omitempty"`
+	TTL           int  `json:",omitempty"`
+	RemainingTTL  int  `json:",omitempty"`
+	// SignatureLimited indicates TTL was lowered because a RRSIG in the
+	// answer expires before its records do
+	SignatureLimited bool `json:",omitempty"`
+}
+
+func recordStrings(records []dns.RR) []string {
+	var out []string
+	for _, r := range records {
+		if r.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, r.String())
+	}
+	return out
+}
+
+// DumpJSON writes a human readable JSON description of every live entry in
+// the cache to w, sorted by name and type. The cache is only locked while
+// the list of entries is copied.
+func (bc *BasicCache) DumpJSON(w io.Writer) error {
+	bc.mu.RLock()
+	entries := make([]*cacheEntry, 0, len(bc.cache))
+	for _, entry := range bc.cache {
+		entries = append(entries, entry)
+	}
+	bc.mu.RUnlock()
+
+	dumped := []dumpedEntry{}
+	now := bc.clk.Now()
+	for _, entry := range entries {
+		entry.mu.Lock()
+		d := dumpedEntry{
+			Name:          entry.q.Name,
+			Type:          typeString(entry.q.Type),
+			Rcode:         dns.RcodeToString[entry.answer.Rcode],
+			Answer:        recordStrings(entry.answer.Answer),
+			Authority:     recordStrings(entry.answer.Authority),
+			Additional:    recordStrings(entry.answer.Additional),
+			Authenticated: entry.answer.Authenticated,
+			Forever:       entry.forever,
+		}
+		if !entry.forever {
+			d.TTL, d.SignatureLimited = entry.ttl, entry.sigLimited
+			d.RemainingTTL = int(entry.modified.Add(time.Second*time.Duration(entry.ttl)).Sub(now) / time.Second)
+		}
+		entry.mu.Unlock()
+		if d.RemainingTTL < 0 {
+			// expired but not yet pruned
+			continue
+		}
+		dumped = append(dumped, d)
+	}
+	sort.Slice(dumped, func(i, j int) bool {
+		if dumped[i].Name != dumped[j].Name {
+			return dumped[i].Name < dumped[j].Name
+		}
+		return dumped[i].Type < dumped[j].Type
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dumped)
+}
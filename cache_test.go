@@ -1,8 +1,12 @@
 package solvere
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/json"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,16 +21,17 @@ func TestMinTTL(t *testing.T) {
 		&dns.A{Hdr: dns.RR_Header{Ttl: 5}},
 		&dns.A{Hdr: dns.RR_Header{Ttl: 1}},
 	}
-	min := minTTL(rrSet, clock.Default())
-	if min != 1 {
+	min, sigLimited := minTTL(rrSet, clock.Default())
+	if min != 1 || sigLimited {
 		t.Fatalf("minTTL produced the wrong TTL: expected %d, got %d", 1, min)
 	}
-	if minTTL([]dns.RR{}, clock.Default()) != 0 {
+	if min, _ := minTTL([]dns.RR{}, clock.Default()); min != 0 {
 		t.Fatalf("minTTL produced a non-zero TTL with a empty RR set")
 	}
 
 	fc := clock.NewFake()
-	n := time.Now().Add(time.Second).UTC().Unix()
+	fc.Set(time.Now())
+	n := fc.Now().Add(time.Second).UTC().Unix()
 	mod := (n / year68) - 1
 	if mod < 0 {
 		mod = 0
@@ -36,10 +41,97 @@ func TestMinTTL(t *testing.T) {
 		&dns.A{Hdr: dns.RR_Header{Ttl: 5}},
 		&dns.RRSIG{Hdr: dns.RR_Header{Ttl: 4, Rrtype: dns.TypeRRSIG}, Expiration: e},
 	}
-	min = minTTL(rrSet, fc)
-	if min != 1 {
+	min, sigLimited = minTTL(rrSet, fc)
+	if min != 1 || !sigLimited {
 		t.Fatalf("minTTL didn't account for RRSIG expiring before TTL: wanted %d, got %d", 1, min)
 	}
+
+	// OPT records are ignored
+	if min, _ = minTTL([]dns.RR{&dns.OPT{Hdr: dns.RR_Header{Rrtype: dns.TypeOPT}}, &dns.A{Hdr: dns.RR_Header{Ttl: 5}}}, fc); min != 5 {
+		t.Fatalf("minTTL used TTL of OPT record: got %d", min)
+	}
+
+	// a record with a lower TTL than the RRSIG expiry takes precedence
+	rrSet = append(rrSet, &dns.A{Hdr: dns.RR_Header{Ttl: 0}})
+	if min, sigLimited = minTTL(rrSet, fc); min != 0 || sigLimited {
+		t.Fatalf("minTTL used RRSIG expiry over lower TTL: got %d", min)
+	}
+}
+
+func TestCachePeekTTL(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	q := &Question{Name: "example.com.", Type: dns.TypeA}
+	if _, present := bc.PeekTTL(q); present {
+		t.Fatal("PeekTTL returned TTL for missing entry")
+	}
+
+	// the signature expires a minute from now, well before the record TTL
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		TypeCovered: dns.TypeA,
+		Expiration:  uint32(fc.Now().Add(time.Minute).Unix()),
+	}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.IP{1, 2, 3, 4}}
+	bc.Add(q, &Answer{Answer: []dns.RR{a, sig}, Rcode: dns.RcodeSuccess}, false)
+	et, present := bc.PeekTTL(q)
+	if !present {
+		t.Fatal("PeekTTL didn't return TTL for cached entry")
+	}
+	if et.TTL != 60 || !et.SignatureLimited {
+		t.Fatalf("PeekTTL returned wrong TTL for entry with expiring signature: %#v", et)
+	}
+	fc.Add(time.Second * 20)
+	if et, _ = bc.PeekTTL(q); et.Remaining != 40 {
+		t.Fatalf("PeekTTL returned wrong remaining TTL: %d", et.Remaining)
+	}
+
+	// without the signature the record TTL is used
+	bc.Add(q, &Answer{Answer: []dns.RR{a}, Rcode: dns.RcodeSuccess}, false)
+	if et, _ = bc.PeekTTL(q); et.TTL != 3600 || et.SignatureLimited {
+		t.Fatalf("PeekTTL returned wrong TTL for entry without signature: %#v", et)
+	}
+}
+
+func TestCacheZeroTTL(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	q := &Question{Name: "example.com.", Type: dns.TypeA}
+	// the TTL of a OPT record without the DO bit set is zero, it shouldn't
+	// prevent the answer being cached
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}}
+	bc.Add(q, &Answer{Answer: []dns.RR{a}, Additional: []dns.RR{opt}, Rcode: dns.RcodeSuccess}, false)
+	if et, present := bc.PeekTTL(q); !present || et.TTL != 300 {
+		t.Fatalf("Answer with OPT record wasn't cached with the record TTL: %#v", et)
+	}
+
+	zq := &Question{Name: "dynamic.example.com.", Type: dns.TypeA}
+	zero := &Answer{Answer: []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "dynamic.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}, A: net.IP{1, 2, 3, 4}},
+	}, Rcode: dns.RcodeSuccess}
+	bc.Add(zq, zero, false)
+	if bc.Get(zq) != nil {
+		t.Fatal("Answer with zero TTL was cached")
+	}
+
+	bc.CacheZeroTTL = true
+	bc.Add(zq, zero, false)
+	if et, present := bc.PeekTTL(zq); !present || et.TTL != ZeroTTLMinimum {
+		t.Fatalf("Answer with zero TTL wasn't cached for ZeroTTLMinimum: %#v", et)
+	}
+	fc.Add(time.Second * time.Duration(ZeroTTLMinimum+1))
+	if bc.Get(zq) != nil {
+		t.Fatal("Answer with zero TTL was cached past ZeroTTLMinimum")
+	}
+	// answers without any records still can't be cached
+	onlyOPT := &Answer{Additional: []dns.RR{opt}, Rcode: dns.RcodeServerFailure}
+	bc.Add(&Question{Name: "broken.example.com.", Type: dns.TypeA}, onlyOPT, false)
+	if bc.Get(&Question{Name: "broken.example.com.", Type: dns.TypeA}) != nil {
+		t.Fatal("Answer containing only a OPT record was cached")
+	}
 }
 
 func TestCache(t *testing.T) {
@@ -105,3 +197,415 @@ func TestCache(t *testing.T) {
 	}
 
 }
+
+func TestCacheMaxBytes(t *testing.T) {
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.NewFake(), MaxBytes: 4096}
+
+	txt := &dns.TXT{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{strings.Repeat("a", 255), strings.Repeat("b", 255)},
+	}
+	a := &Answer{Answer: []dns.RR{txt}}
+	size := answerSize(a)
+	first := &Question{Name: "0.example.", Type: dns.TypeTXT}
+	for i := 0; i < 20; i++ {
+		cache.Add(&Question{Name: fmt.Sprintf("%d.example.", i), Type: dns.TypeTXT}, a, false)
+		// keep the first entry in use so it isn't evicted
+		cache.Get(first)
+		stats := cache.Stats()
+		if stats.Bytes > cache.MaxBytes {
+			t.Fatalf("Cache usage exceeded MaxBytes: %d > %d", stats.Bytes, cache.MaxBytes)
+		}
+		if stats.Bytes != stats.Entries*size {
+			t.Fatalf("Cache usage doesn't match entries: %d bytes for %d entries", stats.Bytes, stats.Entries)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Evictions == 0 {
+		t.Fatal("Cache didn't evict any entries")
+	}
+	if cache.Get(first) == nil {
+		t.Fatal("Cache evicted recently used entry")
+	}
+	if cache.Get(&Question{Name: "1.example.", Type: dns.TypeTXT}) != nil {
+		t.Fatal("Cache didn't evict least recently used entry")
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	fc := clock.NewFake()
+	cache := NewBasicCacheWithSize(5)
+	cache.clk = fc
+	keys := &Question{Name: ".", Type: dns.TypeDNSKEY}
+	cache.Add(keys, &Answer{Answer: []dns.RR{&dns.DNSKEY{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET}}}}, true)
+
+	a := &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}}}}
+	first := &Question{Name: "0.example.", Type: dns.TypeA}
+	for i := 0; i < 20; i++ {
+		cache.Add(&Question{Name: fmt.Sprintf("%d.example.", i), Type: dns.TypeA}, a, false)
+		// keep the first entry in use so it isn't evicted
+		cache.Get(first)
+		// the forever entry isn't counted
+		if stats := cache.Stats(); stats.Entries > cache.MaxEntries+1 {
+			t.Fatalf("Cache entries exceeded MaxEntries: %d > %d", stats.Entries-1, cache.MaxEntries)
+		}
+	}
+	if stats := cache.Stats(); stats.Evictions != 15 {
+		t.Fatalf("Cache evicted %d entries, expected 15", stats.Evictions)
+	}
+	if cache.Get(keys) == nil {
+		t.Fatal("Cache evicted entry cached forever")
+	}
+	if cache.Get(first) == nil {
+		t.Fatal("Cache evicted recently used entry")
+	}
+	if cache.Get(&Question{Name: "1.example.", Type: dns.TypeA}) != nil {
+		t.Fatal("Cache didn't evict least recently used entry")
+	}
+	if cache.Get(&Question{Name: "19.example.", Type: dns.TypeA}) == nil {
+		t.Fatal("Cache evicted most recently added entry")
+	}
+
+	// entries still expire before they are evicted
+	fc.Add(301 * time.Second)
+	if cache.Get(first) != nil {
+		t.Fatal("Cache returned expired entry")
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+
+	q := Question{Name: "nx.example.", Type: dns.TypeA}
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: 300,
+	}
+	a := &Answer{Authority: []dns.RR{soa}, Rcode: dns.RcodeNameError}
+	cache.Add(&q, a, false)
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		ttl     uint32
+	}{
+		{0, 300},
+		{time.Second * 100, 200},
+		{time.Second * 199, 1},
+	} {
+		fc.Add(tc.elapsed)
+		ca := cache.Get(&q)
+		if ca == nil {
+			t.Fatal("Cache didn't return negative answer")
+		}
+		if ca.Rcode != dns.RcodeNameError {
+			t.Fatalf("Cache returned wrong rcode for negative answer: %d", ca.Rcode)
+		}
+		if ttl := ca.Authority[0].Header().Ttl; ttl != tc.ttl {
+			t.Fatalf("Cache returned SOA with wrong TTL: expected %d, got %d", tc.ttl, ttl)
+		}
+	}
+	if soa.Hdr.Ttl != 3600 {
+		t.Fatal("Serving negative answer modified the cached records")
+	}
+
+	fc.Add(time.Second * 2)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Cache returned expired negative answer: %#v", ca)
+	}
+
+	// negative answers without a SOA record can't be cached
+	cache.Add(&q, &Answer{Rcode: dns.RcodeNameError}, false)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatalf("Cache returned negative answer without SOA: %#v", ca)
+	}
+}
+
+func TestCacheMaxNegativeTTL(t *testing.T) {
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+
+	q := Question{Name: "nx.example.", Type: dns.TypeA}
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 86400},
+		Minttl: 86400,
+	}
+	a := &Answer{Authority: []dns.RR{soa}, Rcode: dns.RcodeNameError}
+	cache.Add(&q, a, false)
+	ca := cache.Get(&q)
+	if ca == nil {
+		t.Fatal("Cache didn't return negative answer")
+	}
+	if ttl := ca.Authority[0].Header().Ttl; ttl != DefaultMaxNegativeTTL {
+		t.Fatalf("Cache returned SOA with wrong TTL: expected %d, got %d", DefaultMaxNegativeTTL, ttl)
+	}
+	fc.Add(time.Duration(DefaultMaxNegativeTTL+1) * time.Second)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatal("Cache returned negative answer after DefaultMaxNegativeTTL passed")
+	}
+
+	cache.MaxNegativeTTL = 60
+	cache.Add(&q, a, false)
+	fc.Add(time.Second * 59)
+	if ca := cache.Get(&q); ca == nil || ca.Authority[0].Header().Ttl != 1 {
+		t.Fatalf("Cache returned wrong negative answer before MaxNegativeTTL passed: %v", ca)
+	}
+	fc.Add(time.Second * 2)
+	if ca := cache.Get(&q); ca != nil {
+		t.Fatal("Cache returned negative answer after MaxNegativeTTL passed")
+	}
+
+	// positive answers aren't capped
+	pq := Question{Name: "a.example.", Type: dns.TypeA}
+	cache.Add(&pq, &Answer{Answer: []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IP{1, 2, 3, 4},
+	}}}, false)
+	fc.Add(time.Second * 120)
+	if ca := cache.Get(&pq); ca == nil {
+		t.Fatal("Cache applied MaxNegativeTTL to positive answer")
+	}
+}
+
+func TestCacheDumpJSON(t *testing.T) {
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	a := &Answer{
+		Answer:        []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}}},
+		Authenticated: true,
+	}
+	cache.Add(&Question{Name: "expired.example.", Type: dns.TypeA}, &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 5}}}}, false)
+	fc.Add(time.Second * 10)
+	cache.Add(&Question{Name: "a.example.", Type: dns.TypeA}, a, false)
+	fc.Add(time.Second * 100)
+
+	buf := new(bytes.Buffer)
+	if err := cache.DumpJSON(buf); err != nil {
+		t.Fatalf("DumpJSON failed: %s", err)
+	}
+	var dumped []dumpedEntry
+	if err := json.Unmarshal(buf.Bytes(), &dumped); err != nil {
+		t.Fatalf("Failed to parse dump: %s", err)
+	}
+	if len(dumped) != 1 {
+		t.Fatalf("Expected one live entry in dump, got %d: %s", len(dumped), buf.String())
+	}
+	d := dumped[0]
+	if d.Name != "a.example." || d.Type != "A" || d.RemainingTTL != 200 || !d.Authenticated || len(d.Answer) != 1 || d.Answer[0] != a.Answer[0].String() {
+		t.Fatalf("Dump has wrong entry: %s", buf.String())
+	}
+}
+
+func TestCacheSuspiciousTTL(t *testing.T) {
+	var reported []uint32
+	cache := &BasicCache{
+		cache:         make(map[[sha1.Size]byte]*cacheEntry),
+		clk:           clock.NewFake(),
+		SuspiciousTTL: 86400,
+		OnSuspiciousTTL: func(q Question, ttl uint32) {
+			reported = append(reported, ttl)
+		},
+	}
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	normal := &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Ttl: 300}, A: net.IP{1, 2, 3, 4}}}}
+	suspicious := &Answer{Answer: []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Ttl: 300}, A: net.IP{1, 2, 3, 4}},
+		&dns.A{Hdr: dns.RR_Header{Ttl: 1 << 30}, A: net.IP{1, 2, 3, 5}},
+	}}
+
+	cache.Add(&q, normal, false)
+	if cache.Stats().Suspicious != 0 || len(reported) != 0 {
+		t.Fatal("Answer with normal TTL reported as suspicious")
+	}
+	cache.Add(&q, suspicious, false)
+	if cache.Stats().Suspicious != 1 || len(reported) != 1 || reported[0] != 1<<30 {
+		t.Fatal("Answer with suspicious TTL wasn't reported")
+	}
+	if cache.Get(&q) != suspicious {
+		t.Fatal("Answer with suspicious TTL wasn't cached without RejectSuspiciousTTL")
+	}
+
+	cache.RejectSuspiciousTTL = true
+	q = Question{Name: "b.example.", Type: dns.TypeA}
+	cache.Add(&q, suspicious, false)
+	if cache.Get(&q) != nil {
+		t.Fatal("Answer with suspicious TTL was cached with RejectSuspiciousTTL")
+	}
+	if cache.Stats().Suspicious != 2 {
+		t.Fatal("Rejected answer with suspicious TTL wasn't counted")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	fc := clock.NewFake()
+	prefetched := make(chan Question, 10)
+	cache := &BasicCache{
+		cache:        make(map[[sha1.Size]byte]*cacheEntry),
+		clk:          fc,
+		Prefetch:     true,
+		PrefetchHits: 2,
+		OnPrefetch:   func(q Question) { prefetched <- q },
+	}
+	q := Question{Name: "example.", Type: dns.TypeA}
+	a := &Answer{Answer: []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+		A:   net.IP{1, 2, 3, 4},
+	}}}
+	cache.Add(&q, a, false)
+	expectPrefetch := func(expected bool) {
+		t.Helper()
+		select {
+		case pq := <-prefetched:
+			if !expected {
+				t.Fatal("Entry was unexpectedly prefetched")
+			}
+			if pq != q {
+				t.Fatalf("Wrong question prefetched: %v", pq)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if expected {
+				t.Fatal("Entry wasn't prefetched")
+			}
+		}
+	}
+
+	// popular but not close to expiring
+	for i := 0; i < 3; i++ {
+		cache.Get(&q)
+	}
+	expectPrefetch(false)
+
+	// close to expiring, it has been returned enough times to be prefetched
+	// but only once
+	fc.Add(95 * time.Second)
+	cache.Get(&q)
+	cache.Get(&q)
+	expectPrefetch(true)
+	expectPrefetch(false)
+
+	// the refreshed answer resets the hit count
+	cache.Add(&q, a, false)
+	fc.Add(95 * time.Second)
+	cache.Get(&q)
+	cache.Get(&q)
+	expectPrefetch(false)
+	cache.Get(&q)
+	expectPrefetch(true)
+}
+
+func TestCacheReplaceForever(t *testing.T) {
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc, MaxEntries: 1}
+	q := Question{Name: ".", Type: dns.TypeDNSKEY}
+	answer := func(ttl uint32) *Answer {
+		return &Answer{Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IP{1, 2, 3, 4},
+		}}}
+	}
+
+	// a entry that isn't cached forever can be replaced by one that is
+	cache.Add(&q, answer(10), false)
+	old, replaced := answer(0), answer(0)
+	cache.Add(&q, old, true)
+	if cache.Get(&q) != old {
+		t.Fatal("Entry wasn't replaced by a entry cached forever")
+	}
+	cache.Add(&q, replaced, true)
+	if cache.Get(&q) != replaced {
+		t.Fatal("Entry cached forever wasn't replaced by another entry cached forever")
+	}
+	cache.Add(&q, answer(10), false)
+	if cache.Get(&q) != replaced {
+		t.Fatal("Entry cached forever was replaced by a entry that isn't")
+	}
+
+	// the entry is never evicted or pruned
+	for i := 0; i < 3; i++ {
+		cache.Add(&Question{Name: fmt.Sprintf("%d.example.", i), Type: dns.TypeA}, answer(10), false)
+	}
+	fc.Add(time.Hour)
+	cache.fullPrune()
+	if cache.Get(&q) != replaced {
+		t.Fatal("Entry cached forever was evicted or pruned")
+	}
+	if stats := cache.Stats(); stats.Entries != 1 {
+		t.Fatalf("Cache has wrong number of entries after pruning: %d", stats.Entries)
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	q := Question{Name: "example.", Type: dns.TypeA}
+	if _, present := cache.Age(&q); present {
+		t.Fatal("Age returned a age for a question that isn't cached")
+	}
+	a := &Answer{Answer: []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IP{1, 2, 3, 4},
+	}}}
+	cache.Add(&q, a, false)
+	fc.Add(30 * time.Second)
+	if age, present := cache.Age(&q); !present || age != 30*time.Second {
+		t.Fatalf("Age returned wrong age: %s", age)
+	}
+
+	rr := NewRecursiveResolver(false, false, nil, nil, cache)
+	_, ql, ok := rr.cachedResponse(&q, LookupOptions{})
+	if !ok {
+		t.Fatal("cachedResponse didn't return the cached answer")
+	}
+	if ql.CacheAge != 30*time.Second {
+		t.Fatalf("Lookup log has wrong cache age: %s", ql.CacheAge)
+	}
+
+	// replacing the answer resets its age
+	cache.Add(&q, a, false)
+	fc.Add(10 * time.Second)
+	if _, ql, _ = rr.cachedResponse(&q, LookupOptions{}); ql.CacheAge != 10*time.Second {
+		t.Fatalf("Lookup log has wrong cache age after answer was replaced: %s", ql.CacheAge)
+	}
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	config := CacheConfig{MinTTL: 60, MaxTTL: 3600}
+	if bc := NewBasicCacheWithConfig(config); bc.MinTTL != 60 || bc.MaxTTL != 3600 {
+		t.Fatalf("NewBasicCacheWithConfig didn't apply config: %d %d", bc.MinTTL, bc.MaxTTL)
+	}
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	bc := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc, MinTTL: config.MinTTL, MaxTTL: config.MaxTTL}
+	add := func(name string, ttl uint32, extra ...dns.RR) *Question {
+		q := &Question{Name: name, Type: dns.TypeA}
+		records := append([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IP{1, 2, 3, 4}}}, extra...)
+		bc.Add(q, &Answer{Answer: records, Rcode: dns.RcodeSuccess}, false)
+		return q
+	}
+	for _, tc := range []struct {
+		ttl      uint32
+		expected int
+	}{
+		{0, 60},
+		{5, 60},
+		{300, 300},
+		{86400 * 7, 3600},
+	} {
+		q := add(fmt.Sprintf("%d.example.", tc.ttl), tc.ttl)
+		if et, present := bc.PeekTTL(q); !present || et.TTL != tc.expected {
+			t.Fatalf("Answer with TTL %d cached with wrong TTL: %#v", tc.ttl, et)
+		}
+	}
+
+	// a signature expiring before MinTTL still limits the TTL
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "signed.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		TypeCovered: dns.TypeA,
+		Expiration:  uint32(fc.Now().Unix() + 10),
+	}
+	q := add("signed.example.", 300, sig)
+	if et, present := bc.PeekTTL(q); !present || et.TTL != 10 || !et.SignatureLimited {
+		t.Fatalf("Answer with expiring signature was cached past its expiration: %#v", et)
+	}
+}
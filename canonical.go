@@ -0,0 +1,191 @@
+package solvere
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// canonicalNameLess reports whether a sorts before b in canonical DNS name
+// order, labels are compared case insensitively starting from the rightmost
+// label (RFC 4034 Section 6.1)
+func canonicalNameLess(a, b string) bool {
+	al, bl := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(al[i], bl[j]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(al) < len(bl)
+}
+
+// canonicalRdata returns the uncompressed wire format RDATA of a record with
+// any embedded names lowercased, if the record can't be packed its
+// presentation format is used instead. It is used to sort and compare
+// records, signatures are reconstructed using signatureRdata.
+func canonicalRdata(r dns.RR) []byte {
+	r = dns.Copy(r)
+	switch rr := r.(type) {
+	case *dns.NS:
+		rr.Ns = strings.ToLower(rr.Ns)
+	case *dns.CNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.DNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.PTR:
+		rr.Ptr = strings.ToLower(rr.Ptr)
+	case *dns.MX:
+		rr.Mx = strings.ToLower(rr.Mx)
+	case *dns.SRV:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.SOA:
+		rr.Ns = strings.ToLower(rr.Ns)
+		rr.Mbox = strings.ToLower(rr.Mbox)
+	case *dns.RRSIG:
+		rr.SignerName = strings.ToLower(rr.SignerName)
+	case *dns.NSEC:
+		rr.NextDomain = strings.ToLower(rr.NextDomain)
+	}
+	return packRdata(r)
+}
+
+// packRdata returns the uncompressed wire format RDATA of r, which may be
+// modified, if the record can't be packed its presentation format is used
+// instead
+func packRdata(r dns.RR) []byte {
+	// packing the record with the root as its owner name leaves a fixed
+	// size header before the RDATA
+	const headerLen = 1 + 2 + 2 + 4 + 2
+	r.Header().Name = "."
+	buf := make([]byte, dns.Len(r)+headerLen)
+	off, err := dns.PackRR(r, buf, 0, nil, false)
+	if err != nil || off < headerLen {
+		return []byte(r.String())
+	}
+	return buf[headerLen:off]
+}
+
+// SortRecords sorts records into canonical order, by owner name, then type,
+// then RDATA (RFC 4034 Section 6), so that semantically equal sets of records
+// have the same ordering
+func SortRecords(records []dns.RR) {
+	rdata := make(map[dns.RR][]byte, len(records))
+	for _, r := range records {
+		rdata[r] = canonicalRdata(r)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i].Header(), records[j].Header()
+		if !strings.EqualFold(a.Name, b.Name) {
+			return canonicalNameLess(a.Name, b.Name)
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return bytes.Compare(rdata[records[i]], rdata[records[j]]) < 0
+	})
+}
+
+// sortRRsets sorts the records of each RRset into canonical order, keeping
+// the RRsets in the order they first appear so that alias chains stay in the
+// order they were followed. RRSIGs are grouped by the type they cover.
+func sortRRsets(records []dns.RR) {
+	var order []setKey
+	sets := map[setKey][]dns.RR{}
+	for _, r := range records {
+		k := setKeyOf(r)
+		if _, present := sets[k]; !present {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], r)
+	}
+	i := 0
+	for _, k := range order {
+		SortRecords(sets[k])
+		i += copy(records[i:], sets[k])
+	}
+}
+
+// sortAnswer sorts the records of each RRset in the answer section into
+// canonical order, and the authority and additional sections entirely
+func sortAnswer(a *Answer) {
+	sortRRsets(a.Answer)
+	SortRecords(a.Authority)
+	SortRecords(a.Additional)
+}
+
+// dedupRecords returns records with any that have already been seen removed,
+// records are identified by their owner name, type, class, and canonical
+// RDATA so duplicates with differing TTLs or name case are also removed
+func dedupRecords(records []dns.RR, seen map[string]struct{}) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, r := range records {
+		h := r.Header()
+		id := fmt.Sprintf("%s/%d/%d/%s", strings.ToLower(h.Name), h.Rrtype, h.Class, canonicalRdata(r))
+		if _, present := seen[id]; present {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, r)
+	}
+	return out
+}
+
+// dedupMsg removes duplicate records from each section of a message, records
+// in the authority section that also appear in the answer section, such as
+// RRSIGs some servers include in both, are removed from the authority section
+func dedupMsg(m *dns.Msg) {
+	seen := map[string]struct{}{}
+	m.Answer = dedupRecords(m.Answer, seen)
+	m.Ns = dedupRecords(m.Ns, seen)
+	m.Extra = dedupRecords(m.Extra, map[string]struct{}{})
+}
+
+// setKey identifies the RRset a record belongs to, RRSIGs are grouped by the
+// type they cover
+type setKey struct {
+	name    string
+	t       uint16
+	class   uint16
+	covered uint16
+}
+
+func setKeyOf(r dns.RR) setKey {
+	h := r.Header()
+	k := setKey{name: strings.ToLower(h.Name), t: h.Rrtype, class: h.Class}
+	if sig, ok := r.(*dns.RRSIG); ok {
+		k.covered = sig.TypeCovered
+	}
+	return k
+}
+
+// normalizeTTLs sets the TTL of each record in a RRset to the lowest TTL in the
+// set, since all of the records in a RRset should have the same TTL (RFC 2181
+// Section 5.2). RRSIGs are grouped by the type they cover.
+func normalizeTTLs(records []dns.RR) {
+	min := map[setKey]uint32{}
+	for _, r := range records {
+		if r.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := setKeyOf(r)
+		if ttl, present := min[k]; !present || r.Header().Ttl < ttl {
+			min[k] = r.Header().Ttl
+		}
+	}
+	for _, r := range records {
+		if r.Header().Rrtype != dns.TypeOPT {
+			r.Header().Ttl = min[setKeyOf(r)]
+		}
+	}
+}
+
+// normalizeAnswer normalizes the TTLs of the RRsets in each section of a
+// answer
+func normalizeAnswer(a *Answer) {
+	normalizeTTLs(a.Answer)
+	normalizeTTLs(a.Authority)
+	normalizeTTLs(a.Additional)
+}
@@ -0,0 +1,158 @@
+package solvere
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalNameLess(t *testing.T) {
+	// ordered example from RFC 4034 Section 6.1
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"*.z.example.",
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		if !canonicalNameLess(ordered[i], ordered[i+1]) {
+			t.Fatalf("Expected %s to sort before %s", ordered[i], ordered[i+1])
+		}
+		if canonicalNameLess(ordered[i+1], ordered[i]) {
+			t.Fatalf("Expected %s to sort after %s", ordered[i+1], ordered[i])
+		}
+	}
+}
+
+func TestSortRecords(t *testing.T) {
+	parse := func(records ...string) []dns.RR {
+		rrs := []dns.RR{}
+		for _, s := range records {
+			r, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("Failed to parse record: %s", err)
+			}
+			rrs = append(rrs, r)
+		}
+		return rrs
+	}
+	a := parse(
+		"b.example. 300 IN A 1.2.3.4",
+		"a.example. 300 IN MX 10 mail.example.",
+		"a.example. 300 IN A 10.0.0.1",
+		"a.example. 300 IN A 2.2.2.2",
+		"example. 300 IN NS ns.example.",
+	)
+	b := parse(
+		"a.example. 300 IN A 2.2.2.2",
+		"example. 300 IN NS NS.example.",
+		"a.example. 300 IN A 10.0.0.1",
+		"A.example. 300 IN MX 10 mail.example.",
+		"b.example. 300 IN A 1.2.3.4",
+	)
+	SortRecords(a)
+	SortRecords(b)
+	expected := []string{
+		"example.\t300\tIN\tNS\tns.example.",
+		"a.example.\t300\tIN\tA\t2.2.2.2",
+		"a.example.\t300\tIN\tA\t10.0.0.1",
+		"a.example.\t300\tIN\tMX\t10 mail.example.",
+		"b.example.\t300\tIN\tA\t1.2.3.4",
+	}
+	for i := range expected {
+		if a[i].String() != expected[i] {
+			t.Fatalf("Unexpected record order: %s", a)
+		}
+		if !strings.EqualFold(a[i].String(), b[i].String()) {
+			t.Fatalf("Sorted records don't match: %s, %s", a, b)
+		}
+	}
+}
+
+func TestSortAnswerAliasChain(t *testing.T) {
+	a := &Answer{Answer: zoneToRecords(t, `z.example. 300 IN CNAME a.example.
+a.example. 300 IN CNAME b.example.
+b.example. 300 IN A 10.0.0.1
+b.example. 300 IN A 2.2.2.2`)}
+	sortAnswer(a)
+	expected := []string{
+		"z.example.\t300\tIN\tCNAME\ta.example.",
+		"a.example.\t300\tIN\tCNAME\tb.example.",
+		"b.example.\t300\tIN\tA\t2.2.2.2",
+		"b.example.\t300\tIN\tA\t10.0.0.1",
+	}
+	for i := range expected {
+		if a.Answer[i].String() != expected[i] {
+			t.Fatalf("Unexpected record order: %s", a.Answer)
+		}
+	}
+}
+
+func TestDedupMsg(t *testing.T) {
+	m := new(dns.Msg)
+	for _, s := range []string{"a.example. 300 IN A 1.2.3.4", "A.EXAMPLE. 60 IN A 1.2.3.4", "a.example. 300 IN A 5.6.7.8"} {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse record: %s", err)
+		}
+		m.Answer = append(m.Answer, r)
+	}
+	m.Ns = []dns.RR{dns.Copy(m.Answer[2])}
+	dedupMsg(m)
+	if len(m.Answer) != 2 || m.Answer[0].String() != "a.example.\t300\tIN\tA\t1.2.3.4" {
+		t.Fatalf("dedupMsg returned wrong answer section: %s", m.Answer)
+	}
+	if len(m.Ns) != 0 {
+		t.Fatalf("dedupMsg didn't remove records repeated in authority section: %s", m.Ns)
+	}
+}
+
+func TestNormalizeTTLs(t *testing.T) {
+	records := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}},
+		&dns.A{Hdr: dns.RR_Header{Name: "A.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{1, 2, 3, 5}},
+		&dns.A{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IP{1, 2, 3, 6}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600}, Txt: []string{"a"}},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 200}, TypeCovered: dns.TypeA},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600}, TypeCovered: dns.TypeTXT},
+	}
+	normalizeTTLs(records)
+	for i, expected := range []uint32{60, 60, 60, 3600, 200, 3600} {
+		if ttl := records[i].Header().Ttl; ttl != expected {
+			t.Fatalf("normalizeTTLs set wrong TTL for %s: expected %d, got %d", records[i], expected, ttl)
+		}
+	}
+}
+
+func TestLookupNormalizeTTLs(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `a.example. 300 IN A 1.2.3.4
+a.example. 60 IN A 1.2.3.5`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	a, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 2 || a.Answer[0].Header().Ttl != 300 || a.Answer[1].Header().Ttl != 60 {
+		t.Fatalf("Lookup modified TTLs without NormalizeTTLs: %v", a.Answer)
+	}
+
+	rr.NormalizeTTLs = true
+	a, _, err = rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 2 || a.Answer[0].Header().Ttl != 60 || a.Answer[1].Header().Ttl != 60 {
+		t.Fatalf("Lookup didn't normalize mismatched TTLs: %v", a.Answer)
+	}
+}
@@ -0,0 +1,75 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNoResolvers is returned by ChainResolver.Lookup if it has no
+	// resolvers
+	ErrNoResolvers = errors.New("solvere: No resolvers in chain")
+	// ErrNoAnswer is returned by ChainResolver.Lookup if the last resolver
+	// in the chain returned neither a answer nor a error
+	ErrNoAnswer = errors.New("solvere: Resolver returned no answer")
+)
+
+// Resolver is the interface implemented by types that can answer a Question,
+// such as RecursiveResolver
+type Resolver interface {
+	Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error)
+}
+
+var (
+	_ Resolver = &RecursiveResolver{}
+	_ Resolver = &ChainResolver{}
+	_ Resolver = &ForwardingResolver{}
+)
+
+// ChainResolver answers questions using a list of resolvers, if a resolver
+// returns a error, no answer, or a SERVFAIL answer the next one in the list is
+// tried
+type ChainResolver struct {
+	resolvers []Resolver
+}
+
+// NewChainResolver returns a ChainResolver that tries each of the resolvers in
+// the order they are provided
+func NewChainResolver(resolvers ...Resolver) *ChainResolver {
+	return &ChainResolver{resolvers: resolvers}
+}
+
+// Lookup returns the first successful answer from the resolvers in the chain.
+// The logs from each of the resolvers tried are included as composites of the
+// returned log. If every resolver fails the result of the last is returned.
+func (cr *ChainResolver) Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	ll := newLookupLog(&q, nil)
+	defer func() {
+		ll.Latency = time.Since(ll.Started)
+	}()
+	var answer *Answer
+	err := ErrNoResolvers
+	for _, r := range cr.resolvers {
+		var log *LookupLog
+		answer, log, err = r.Lookup(ctx, q)
+		if log != nil {
+			ll.Composites = append(ll.Composites, log)
+		}
+		if err == nil && answer == nil {
+			err = ErrNoAnswer
+		}
+		if err == nil && answer.Rcode != dns.RcodeServerFailure {
+			break
+		}
+	}
+	if err != nil {
+		ll.Error = err.Error()
+		return nil, ll, err
+	}
+	ll.Rcode = answer.Rcode
+	ll.DNSSECValid = answer.Authenticated
+	return answer, ll, nil
+}
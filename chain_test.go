@@ -0,0 +1,68 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type fakeResolver struct {
+	answer  *Answer
+	err     error
+	queried bool
+}
+
+func (fr *fakeResolver) Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	fr.queried = true
+	return fr.answer, newLookupLog(&q, nil), fr.err
+}
+
+func TestChainResolver(t *testing.T) {
+	answer := &Answer{Answer: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA}, A: net.IP{1, 2, 3, 4}}}}
+	failing := &fakeResolver{err: errors.New("broken")}
+	servfail := &fakeResolver{answer: &Answer{Rcode: dns.RcodeServerFailure}}
+	fallback := &fakeResolver{answer: answer}
+	unused := &fakeResolver{err: errors.New("shouldn't be used")}
+
+	cr := NewChainResolver(failing, servfail, fallback, unused)
+	a, log, err := cr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a != answer {
+		t.Fatalf("Lookup returned wrong answer: %#v", a)
+	}
+	if len(log.Composites) != 3 {
+		t.Fatalf("Expected logs from 3 resolvers, got %d", len(log.Composites))
+	}
+	if unused.queried {
+		t.Fatal("Lookup tried resolver after getting a answer")
+	}
+
+	cr = NewChainResolver(servfail, failing)
+	_, log, err = cr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != failing.err {
+		t.Fatalf("Lookup didn't return error from last resolver: %v", err)
+	}
+	if log.Error != failing.err.Error() {
+		t.Fatalf("Lookup log has wrong error: %q", log.Error)
+	}
+
+	// a resolver that returns neither a answer nor a error has failed
+	empty := &fakeResolver{}
+	cr = NewChainResolver(empty, fallback)
+	a, _, err = cr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a != answer {
+		t.Fatalf("Lookup returned wrong answer: %#v", a)
+	}
+	cr = NewChainResolver(empty)
+	if _, _, err = cr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA}); err != ErrNoAnswer {
+		t.Fatalf("Lookup didn't fail with ErrNoAnswer: %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,9 +15,57 @@ import (
 
 func main() {
 	listenAddr := flag.String("listen", "127.0.0.1:53", "")
+	debugAddr := flag.String("debug-listen", "", "Address to serve debugging endpoints on, such as /debug/cache")
+	iface := flag.String("interface", "", "Name of the interface to send queries from")
+	anchorFile := flag.String("anchor-file", "", "File to keep the root trust anchor state in, enables RFC 5011 root key rollover")
+	primeRoot := flag.Bool("prime-root", false, "Replace the compiled root hints with the root NS set fetched by a priming query at startup")
+	serveStale := flag.Duration("serve-stale", 0, "How long after they expire answers are served while they are refreshed, zero disables serving stale answers")
+	prefetch := flag.Bool("prefetch", false, "Refresh popular answers in the cache before they expire")
+	minTTL := flag.Uint("cache-min-ttl", 0, "Minimum time in seconds answers are cached for")
+	maxTTL := flag.Uint("cache-max-ttl", 0, "Maximum time in seconds answers are cached for")
 	flag.Parse()
 
-	s := &server{solvere.NewRecursiveResolver(false, true, hints.RootNameservers, hints.RootKeys, solvere.NewBasicCache())}
+	cache := solvere.NewBasicCacheWithConfig(solvere.CacheConfig{MinTTL: uint32(*minTTL), MaxTTL: uint32(*maxTTL)})
+	cache.Prefetch = *prefetch
+	s := &server{solvere.NewRecursiveResolver(false, true, hints.RootNameservers, hints.RootKeys, cache)}
+	if *serveStale > 0 {
+		cache.MaxStale = *serveStale
+		s.rr.ServeStale = true
+		s.rr.RefreshStale = true
+	}
+	if *iface != "" {
+		if err := s.rr.BindToInterface(*iface); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if *primeRoot {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s.rr.PrimeRoot(ctx); err != nil {
+			fmt.Println("err priming root, using compiled hints:", err)
+		}
+		cancel()
+	}
+	if *anchorFile != "" {
+		err := s.rr.StartRootRefresh(context.Background(), &solvere.FileAnchorStore{Path: *anchorFile}, 0, func(err error) {
+			fmt.Println("err refreshing root keys:", err)
+		})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if *debugAddr != "" {
+		http.HandleFunc("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := cache.DumpJSON(w); err != nil {
+				fmt.Println("err dumping cache:", err)
+			}
+		})
+		go func() {
+			fmt.Println(http.ListenAndServe(*debugAddr, nil))
+		}()
+	}
 	dns.HandleFunc(".", s.handler)
 	dnsServer := &dns.Server{
 		Addr:         *listenAddr,
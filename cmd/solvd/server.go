@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 
 	"github.com/miekg/dns"
 
@@ -26,10 +27,10 @@ func (s *server) handler(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
-	q := solvere.Question{r.Question[0].Name, r.Question[0].Qtype}
+	q := solvere.Question{Name: r.Question[0].Name, Type: r.Question[0].Qtype}
 	ctx := context.TODO()
 
-	a, log, err := s.rr.Lookup(ctx, q)
+	a, log, err := s.rr.LookupWithOptions(ctx, q, solvere.LookupOptions{CheckingDisabled: r.CheckingDisabled})
 	if err != nil {
 		fmt.Println("Query failed:", err)
 	}
@@ -47,15 +48,43 @@ func (s *server) handler(w dns.ResponseWriter, r *dns.Msg) {
 		// 	dns.TypeToString[q.Type],
 		// 	err,
 		// )
-		m.Rcode = dns.RcodeServerFailure
+		m.Rcode = a.Rcode
+		addExtendedError(m, r, a)
 		w.WriteMsg(m)
 		return
 	}
 	m.Rcode = a.Rcode
+	m.CheckingDisabled = r.CheckingDisabled
 	m.AuthenticatedData = a.Authenticated
 	m.Answer = a.Answer
 	m.Ns = a.Authority
 	m.Extra = a.Additional
+	addExtendedError(m, r, a)
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		solvere.TruncateReply(m, r)
+	}
 	w.WriteMsg(m)
 	return
 }
+
+// addExtendedError adds the extended DNS error describing a to the reply m, if
+// there is one and the request r used EDNS
+func addExtendedError(m, r *dns.Msg, a *solvere.Answer) {
+	opt := r.IsEdns0()
+	if opt == nil || a.ExtendedError == nil {
+		return
+	}
+	// the additional section may contain the OPT record from the upstream
+	// response, which is shared with the cache so it is replaced rather
+	// than modified
+	extra := make([]dns.RR, 0, len(m.Extra)+1)
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	m.SetEdns0(4096, opt.Do())
+	eOpt := m.Extra[len(m.Extra)-1].(*dns.OPT)
+	eOpt.Option = append(eOpt.Option, a.ExtendedError.Option())
+}
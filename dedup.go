@@ -0,0 +1,119 @@
+package solvere
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recentKey identifies duplicate lookups, lookups with different options may
+// have different answers so aren't duplicates. Only the options of lookups
+// that use the cache are included, since other lookups aren't deduplicated.
+type recentKey struct {
+	q                Question
+	requireValidated bool
+	transport        Transport
+	requestExpire    bool
+	separateAliases  bool
+}
+
+// newRecentKey returns the recentKey for a lookup of q with opts
+func newRecentKey(q Question, opts LookupOptions) recentKey {
+	return recentKey{
+		q:                q,
+		requireValidated: opts.RequireValidated,
+		transport:        opts.Transport,
+		requestExpire:    opts.RequestExpire,
+		separateAliases:  opts.SeparateAliases,
+	}
+}
+
+// recentLookup is a lookup that started recently, duplicates of it that start
+// within DedupWindow wait for its answer rather than resolving the question
+// themselves
+type recentLookup struct {
+	started time.Time
+	done    chan struct{}
+	answer  *Answer
+}
+
+// finish records a copy of the answer of the lookup, which is nil if it
+// failed, and wakes any duplicates waiting for it
+func (rl *recentLookup) finish(answer *Answer) {
+	if answer != nil {
+		answer = copyAnswer(answer)
+	}
+	rl.answer = answer
+	close(rl.done)
+}
+
+// copyAnswer returns a copy of a with copies of its records, so that callers
+// modifying the records of one of the answers returned for duplicate lookups
+// don't affect the others
+func copyAnswer(a *Answer) *Answer {
+	c := *a
+	for _, section := range []*[]dns.RR{&c.Answer, &c.Authority, &c.Additional, &c.Aliases} {
+		if *section == nil {
+			continue
+		}
+		records := make([]dns.RR, len(*section))
+		for i, r := range *section {
+			records[i] = dns.Copy(r)
+		}
+		*section = records
+	}
+	c.Delegations = append([]ZoneCut(nil), c.Delegations...)
+	return &c
+}
+
+// claimLookup returns the lookup of q with opts that started within the last
+// DedupWindow, if there is one, otherwise a new one is recorded and returned
+// and the returned bool is true, in which case the caller must resolve the
+// question and call finish
+func (rr *RecursiveResolver) claimLookup(q Question, opts LookupOptions) (*recentLookup, bool) {
+	rr.recentMu.Lock()
+	defer rr.recentMu.Unlock()
+	now := rr.Clock.Now()
+	if rr.recent == nil {
+		rr.recent = make(map[recentKey]*recentLookup)
+	}
+	key := newRecentKey(q, opts)
+	if rl, present := rr.recent[key]; present && now.Sub(rl.started) < rr.DedupWindow {
+		return rl, false
+	}
+	for k, rl := range rr.recent {
+		if now.Sub(rl.started) >= rr.DedupWindow {
+			delete(rr.recent, k)
+		}
+	}
+	rl := &recentLookup{started: now, done: make(chan struct{})}
+	rr.recent[key] = rl
+	return rl, true
+}
+
+// awaitLookup waits for a recent duplicate lookup of q to finish, until the
+// DedupWindow since it started has passed. If it succeeded a copy of its
+// answer is returned, otherwise false is returned and q should be resolved
+// normally.
+func (rr *RecursiveResolver) awaitLookup(ctx context.Context, q *Question, rl *recentLookup) (*Answer, *LookupLog, bool) {
+	timer := rr.Clock.NewTimer(rr.DedupWindow - rr.Clock.Since(rl.started))
+	defer timer.Stop()
+	select {
+	case <-rl.done:
+	case <-timer.C:
+		return nil, nil, false
+	case <-ctx.Done():
+		return nil, nil, false
+	}
+	if rl.answer == nil {
+		return nil, nil, false
+	}
+	answer := copyAnswer(rl.answer)
+	ll := newLookupLog(q, nil)
+	ll.Deduplicated = true
+	ll.DNSSECValid = answer.Authenticated
+	ll.Rcode = answer.Rcode
+	ll.Latency = time.Since(ll.Started)
+	return answer, ll, true
+}
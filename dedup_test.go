@@ -0,0 +1,79 @@
+package solvere
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestLookupDedupWindow(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	var queries int32
+	example.onQuery = func(q dns.Question) {
+		if q.Name == "a.example." && q.Qtype == dns.TypeA {
+			atomic.AddInt32(&queries, 1)
+			// hold the first lookup open so the second arrives while
+			// it is in progress
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	defer startTestZones(t, root, example)()
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := newTestResolver(root, nil)
+	rr.Clock = fc
+	rr.ParallelQueries = 1
+	rr.DedupWindow = time.Second
+	var wg sync.WaitGroup
+	answers := make([]*Answer, 2)
+	logs := make([]*LookupLog, 2)
+	errs := make([]error, 2)
+	for i := range answers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answers[i], logs[i], errs[i] = rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+		}(i)
+	}
+	wg.Wait()
+	for i := range answers {
+		if errs[i] != nil {
+			t.Fatalf("Lookup failed: %s", errs[i])
+		}
+		if len(answers[i].Answer) != 1 {
+			t.Fatalf("Lookup returned wrong answer: %+v", answers[i])
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("duplicate lookups sent %d queries, expected 1", n)
+	}
+	if logs[0].Deduplicated == logs[1].Deduplicated {
+		t.Fatal("exactly one of the lookups should be marked as deduplicated")
+	}
+	// the deduplicated lookup gets its own copy of the records
+	if answers[0].Answer[0] == answers[1].Answer[0] {
+		t.Fatal("Deduplicated lookup shares records with the original lookup")
+	}
+	answers[0].Answer[0].Header().Ttl = 1
+	if answers[1].Answer[0].Header().Ttl == 1 {
+		t.Fatal("Modifying one answer changed the other")
+	}
+
+	// once the window has passed lookups resolve the question themselves
+	fc.Add(time.Second)
+	if _, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA}); err != nil || ll.Deduplicated {
+		t.Fatalf("Lookup after the window was deduplicated: %v", err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Fatalf("Lookup after the window didn't send a query, %d sent", n)
+	}
+}
@@ -0,0 +1,201 @@
+package solvere
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNotCached is returned by DelegationChain when the answer for a question,
+// or the keys of a secure zone it was resolved through, aren't cached
+var ErrNotCached = errors.New("solvere: Answer and its delegation chain aren't cached")
+
+// DefaultMaxCachedZones is the number of zones delegations, zone apexes, and
+// retained keys are kept for if RecursiveResolver.MaxCachedZones isn't set
+var DefaultMaxCachedZones = 10000
+
+// maxCachedZones returns the number of zones delegations, apexes, and
+// retained keys are kept for
+func (rr *RecursiveResolver) maxCachedZones() int {
+	if rr.MaxCachedZones > 0 {
+		return rr.MaxCachedZones
+	}
+	return DefaultMaxCachedZones
+}
+
+// pruneSize returns the number of entries a full map of zones is pruned to,
+// pruning below the limit means the sweep only happens once every few
+// insertions rather than on each of them
+func pruneSize(max int) int {
+	return max - max/4
+}
+
+// ZoneCut describes a zone traversed while resolving a answer
+type ZoneCut struct {
+	Zone string
+	// Nameservers are the known nameservers for the zone, from the
+	// referral to it or the root hints
+	Nameservers []Nameserver
+	// Secure indicates there was a unbroken chain of trust from the root
+	// to the zone
+	Secure bool
+}
+
+// DelegationChain returns the zones that were traversed to resolve the cached
+// answer for q, starting at the root, without sending any queries. If the
+// answer isn't cached, or the DNSKEYs of any of the secure zones in the chain
+// have expired from the cache, ErrNotCached is returned.
+func (rr *RecursiveResolver) DelegationChain(q Question) ([]ZoneCut, error) {
+	answer, present := rr.PeekCache(q)
+	if !present || len(answer.Delegations) == 0 {
+		return nil, ErrNotCached
+	}
+	for _, cut := range answer.Delegations {
+		if !cut.Secure {
+			continue
+		}
+		if _, present := rr.PeekCache(Question{Name: cut.Zone, Type: dns.TypeDNSKEY}); !present {
+			return nil, ErrNotCached
+		}
+	}
+	return answer.Delegations, nil
+}
+
+// cachedDelegation is a referral to a zone that can be used to start later
+// lookups for names in the zone without walking the chain from the root
+type cachedDelegation struct {
+	// chain is the zones traversed to reach the zone, ending with the zone
+	// itself
+	chain []ZoneCut
+	// dsSet is the DS RRset for the zone from the parent, if it is secure
+	dsSet   []dns.RR
+	expires time.Time
+}
+
+// bailiwickServers returns the nameservers whose addresses came from glue for
+// names inside parent, the zone that sent the referral. The parent isn't
+// authoritative for glue outside of it so it could be used to poison the
+// addresses of other zones' nameservers.
+func bailiwickServers(servers []Nameserver, parent string) []Nameserver {
+	var in []Nameserver
+	for _, s := range servers {
+		if dns.IsSubDomain(parent, s.Name) {
+			in = append(in, s)
+		}
+	}
+	return in
+}
+
+// delegationTTL returns the lowest TTL of the NS and DS records for zone in a
+// referral and the glue for servers
+func delegationTTL(auths, extras []dns.RR, zone string, servers []Nameserver) uint32 {
+	records := extractRRSet(auths, zone, dns.TypeNS, dns.TypeDS)
+	for _, s := range servers {
+		records = append(records, extractRRSet(extras, s.Name, dns.TypeA, dns.TypeAAAA)...)
+	}
+	var min uint32
+	for i, r := range records {
+		if i == 0 || r.Header().Ttl < min {
+			min = r.Header().Ttl
+		}
+	}
+	return min
+}
+
+// cacheDelegation caches the referral to the last zone in chain, from the
+// nameservers of parent, so lookups for names in the zone can start from it.
+// Only the nameservers with in-bailiwick glue are cached and the delegation
+// expires when the first of the NS, DS, or glue records it was built from
+// does. Once MaxCachedZones delegations are cached they are pruned.
+func (rr *RecursiveResolver) cacheDelegation(r *dns.Msg, parent string, chain []ZoneCut, dsSet []dns.RR) {
+	cut := chain[len(chain)-1]
+	servers := bailiwickServers(cut.Nameservers, parent)
+	if len(servers) == 0 {
+		return
+	}
+	ttl := delegationTTL(r.Ns, r.Extra, cut.Zone, servers)
+	if ttl == 0 {
+		return
+	}
+	chain = append([]ZoneCut{}, chain...)
+	chain[len(chain)-1].Nameservers = servers
+
+	rr.delegationsMu.Lock()
+	defer rr.delegationsMu.Unlock()
+	now := rr.Clock.Now()
+	if rr.delegations == nil {
+		rr.delegations = make(map[string]*cachedDelegation)
+	}
+	if max := rr.maxCachedZones(); len(rr.delegations) >= max {
+		for zone, d := range rr.delegations {
+			if !now.Before(d.expires) {
+				delete(rr.delegations, zone)
+			}
+		}
+		for zone := range rr.delegations {
+			if len(rr.delegations) < pruneSize(max) {
+				break
+			}
+			delete(rr.delegations, zone)
+		}
+	}
+	rr.delegations[strings.ToLower(cut.Zone)] = &cachedDelegation{
+		chain:   chain,
+		dsSet:   dsSet,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// closestDelegation returns the cached delegation to the deepest zone
+// containing name, if there is one
+func (rr *RecursiveResolver) closestDelegation(name string) *cachedDelegation {
+	rr.delegationsMu.Lock()
+	defer rr.delegationsMu.Unlock()
+	now := rr.Clock.Now()
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, present := rr.delegations[name[off:]]; present && now.Before(d.expires) {
+			return d
+		}
+	}
+	return nil
+}
+
+// startingPoint returns the nameservers resolution of name should start
+// from, the chain of zones leading to them, whether there is a chain of trust
+// to the zone, and the DS set for it. If roots isn't nil resolution starts from
+// them, otherwise if the resolver has a cache the deepest cached delegation
+// containing name is used, or the root nameservers are.
+func (rr *RecursiveResolver) startingPoint(name string, roots []Nameserver) ([]Nameserver, []ZoneCut, bool, []dns.RR) {
+	if rr.cache != nil && roots == nil {
+		if d := rr.closestDelegation(name); d != nil {
+			cuts := append([]ZoneCut{}, d.chain...)
+			secure := cuts[len(cuts)-1].Secure
+			for _, cut := range cuts {
+				// validation may have been disabled since the
+				// delegation was cached
+				if rr.validationDisabled(cut.Zone) {
+					secure = false
+				}
+			}
+			var dsSet []dns.RR
+			if secure {
+				dsSet = d.dsSet
+			}
+			if anchor, present := rr.trustAnchor(cuts[len(cuts)-1].Zone); present {
+				// a trust anchor may have been added since the
+				// delegation was cached
+				secure, dsSet = true, anchor
+			}
+			return cuts[len(cuts)-1].Nameservers, cuts, secure, dsSet
+		}
+	}
+	secure := rr.useDNSSEC && !rr.validationDisabled(".")
+	anchor, _ := rr.trustAnchor(".")
+	if roots == nil {
+		roots = rr.roots()
+	}
+	return roots, []ZoneCut{{Zone: ".", Nameservers: roots, Secure: secure}}, secure, anchor
+}
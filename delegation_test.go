@@ -0,0 +1,161 @@
+package solvere
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestDelegationChain(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := NewBasicCache()
+	rr := newTestResolver(root, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	if _, err := rr.DelegationChain(q); err != ErrNotCached {
+		t.Fatalf("DelegationChain didn't return ErrNotCached for uncached question: %v", err)
+	}
+
+	answer, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(answer.Delegations) != 2 {
+		t.Fatalf("Lookup returned wrong delegations: %+v", answer.Delegations)
+	}
+
+	var chain []ZoneCut
+	for i := 0; i < 100; i++ {
+		if chain, err = rr.DelegationChain(q); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatalf("DelegationChain failed for cached answer: %s", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("DelegationChain returned %d zones, expected 2", len(chain))
+	}
+	for i, expected := range []*testZone{root, example} {
+		cut := chain[i]
+		if cut.Zone != expected.name || !cut.Secure {
+			t.Fatalf("DelegationChain returned wrong zone cut: %+v", cut)
+		}
+		if len(cut.Nameservers) != 1 || cut.Nameservers[0].Addr != expected.addr {
+			t.Fatalf("DelegationChain returned wrong nameservers for %s: %+v", cut.Zone, cut.Nameservers)
+		}
+	}
+
+	// the chain can't be trusted once the keys of a zone in it have expired
+	cache.del(hashQuestion(&Question{Name: "example.", Type: dns.TypeDNSKEY}))
+	if _, err := rr.DelegationChain(q); err != ErrNotCached {
+		t.Fatalf("DelegationChain didn't return ErrNotCached without cached DNSKEYs: %v", err)
+	}
+}
+
+func TestLookupCachedDelegation(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.4", true, `a.sub.example. 300 IN A 1.2.3.4
+b.sub.example. 300 IN A 1.2.3.4`)
+	root.delegate(example)
+	example.delegate(sub)
+	questions := recordQuestions(root, example, sub)
+	defer startTestZones(t, root, example, sub)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	rootQueries, exampleQueries := len(questions(root)), len(questions(example))
+
+	// the second lookup should start from the cached delegation to
+	// sub.example. and still be validated
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "b.sub.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(answer.Answer) == 0 || !answer.Authenticated {
+		t.Fatalf("Lookup from cached delegation returned wrong answer: %+v", answer)
+	}
+	if len(questions(root)) != rootQueries || len(questions(example)) != exampleQueries {
+		t.Fatalf("Lookup didn't start from cached delegation: root was sent %v, example. was sent %v", questions(root), questions(example))
+	}
+	if len(answer.Delegations) != 3 || answer.Delegations[0].Zone != "." || answer.Delegations[2].Zone != "sub.example." {
+		t.Fatalf("Lookup from cached delegation returned wrong delegations: %+v", answer.Delegations)
+	}
+}
+
+func TestLookupCachedDelegationGlue(t *testing.T) {
+	// the glue for ns.example. expires well before the NS records, and the
+	// glue for ns.other. is outside of example. so can't be trusted
+	root := newTestZone(t, ".", "127.0.0.2", false, `example. 3600 IN NS ns.example.
+ns.example. 60 IN A 127.0.0.3`)
+	example := newTestZone(t, "example.", "127.0.0.3", false, `a.example. 300 IN A 1.2.3.4
+b.example. 300 IN A 1.2.3.4
+c.example. 300 IN A 1.2.3.4
+sub.example. 3600 IN NS ns.other.
+ns.other. 3600 IN A 127.0.0.4`)
+	sub := newTestZone(t, "sub.example.", "127.0.0.4", false, `a.sub.example. 300 IN A 1.2.3.4
+b.sub.example. 300 IN A 1.2.3.4`)
+	questions := recordQuestions(root, example, sub)
+	defer startTestZones(t, root, example, sub)()
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := newTestResolver(root, NewBasicCache())
+	rr.Clock = fc
+	lookup := func(name string) {
+		if _, _, err := rr.Lookup(context.Background(), Question{Name: name, Type: dns.TypeA}); err != nil {
+			t.Fatalf("Lookup of %s failed: %s", name, err)
+		}
+	}
+
+	lookup("a.example.")
+	lookup("b.example.")
+	if len(questions(root)) != 1 {
+		t.Fatalf("Lookup didn't use cached delegation to example.: %v", questions(root))
+	}
+	fc.Add(61 * time.Second)
+	lookup("c.example.")
+	if len(questions(root)) != 2 {
+		t.Fatalf("Lookup used cached delegation to example. after its glue expired: %v", questions(root))
+	}
+
+	lookup("a.sub.example.")
+	exampleQueries := len(questions(example))
+	lookup("b.sub.example.")
+	if len(questions(example)) == exampleQueries {
+		t.Fatal("Lookup used cached delegation with out of bailiwick glue")
+	}
+}
+
+func TestCacheDelegationLimit(t *testing.T) {
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	rr.MaxCachedZones = 8
+	for i := 0; i < 100; i++ {
+		zone := fmt.Sprintf("z%d.", i)
+		ns := Nameserver{Name: "ns." + zone, Addr: "127.0.0.1", Zone: zone}
+		r := &dns.Msg{
+			Ns:    []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Ttl: 300}, Ns: ns.Name}},
+			Extra: []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: ns.Name, Rrtype: dns.TypeA, Ttl: 300}, A: net.ParseIP(ns.Addr)}},
+		}
+		rr.cacheDelegation(r, ".", []ZoneCut{{Zone: "."}, {Zone: zone, Nameservers: []Nameserver{ns}}}, nil)
+		if len(rr.delegations) > rr.MaxCachedZones {
+			t.Fatalf("%d delegations cached, more than MaxCachedZones", len(rr.delegations))
+		}
+		if rr.closestDelegation(zone) == nil {
+			t.Fatalf("Delegation to %s wasn't cached", zone)
+		}
+	}
+}
@@ -2,10 +2,15 @@ package solvere
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
-	"time"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
 )
 
 var (
@@ -13,21 +18,70 @@ var (
 	ErrMissingKSK             = errors.New("solvere: No KSK DNSKEY found for DS records")
 	ErrFailedToConvertKSK     = errors.New("solvere: Failed to convert KSK DNSKEY record to DS record")
 	ErrMismatchingDS          = errors.New("solvere: KSK DNSKEY record does not match DS record from parent zone")
+	ErrMismatchingKeyTag      = errors.New("solvere: DNSKEY record key tag does not match DS record key tag")
 	ErrNoSignatures           = errors.New("solvere: No RRSIG records for zone that should be signed")
 	ErrMissingDNSKEY          = errors.New("solvere: No matching DNSKEY found for RRSIG records")
 	ErrInvalidSignaturePeriod = errors.New("solvere: Incorrect signature validity period")
 	ErrBadAnswer              = errors.New("solvere: Response contained a non-zero RCODE")
 	ErrMissingSigned          = errors.New("solvere: Signed records are missing")
+	ErrKeysUnavailableOffline = errors.New("solvere: DNSKEY records not in cache and resolver is offline")
+	ErrMissingAlgorithm       = errors.New("solvere: RRset isn't signed with every algorithm in the DNSKEY set")
+	ErrUntrustedSigner        = errors.New("solvere: RRSIG signer isn't the zone being queried or a trusted parent zone")
+	ErrUnsignedDS             = errors.New("solvere: DS records in referral aren't signed by the parent zone")
+	ErrNoSupportedAlgorithm   = errors.New("solvere: RRset is only signed with algorithms that aren't allowed")
+	ErrDNSKEYDenied           = errors.New("solvere: NSEC/NSEC3 records deny the DNSKEY RRset for zone that should be signed")
+	ErrTooManyDNSKEYs         = errors.New("solvere: DNSKEY RRset contains too many records")
+	ErrAlgorithmDowngrade     = errors.New("solvere: RRset isn't signed with every algorithm in the DS set")
+	ErrInvalidTrustAnchor     = errors.New("solvere: Trust anchor must be a non-empty set of DS records owned by the zone")
+)
+
+// DefaultMaxDNSKEYs is the largest DNSKEY RRset accepted by default, which
+// leaves plenty of room for the keys needed during key and algorithm
+// rollovers
+const DefaultMaxDNSKEYs = 16
+
+var (
+	// understoodAlgorithms are the DNSSEC algorithms dns.RRSIG.Verify
+	// supports, plus Ed25519 which is verified by verifyEd25519. RSAMD5 is
+	// left out since it must not be used for validation (RFC 6725)
+	understoodAlgorithms = []uint8{dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, AlgorithmED25519}
+	// understoodDSDigests are the DS digest types dns.DNSKEY.ToDS supports
+	understoodDSDigests = []uint8{dns.SHA1, dns.SHA256, dns.SHA384}
+	// understoodNSEC3Hashes are the NSEC3 hash algorithms dns.HashName
+	// supports
+	understoodNSEC3Hashes = []uint8{dns.SHA1}
 )
 
-func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver) (map[uint16]*dns.DNSKEY, *LookupLog, func(), error) {
+// understoodOptions returns the DAU, DHU, and N3U EDNS0 options used to
+// signal which algorithms can be validated (RFC 6975). Only the understood
+// algorithms that are also in allowed, if it is set, are listed in DAU.
+func understoodOptions(allowed []uint8) []dns.EDNS0 {
+	algs := []uint8{}
+	for _, alg := range understoodAlgorithms {
+		if algorithmAllowed(alg, allowed) {
+			algs = append(algs, alg)
+		}
+	}
+	return []dns.EDNS0{
+		&dns.EDNS0_DAU{Code: dns.EDNS0DAU, AlgCode: algs},
+		&dns.EDNS0_DHU{Code: dns.EDNS0DHU, AlgCode: understoodDSDigests},
+		&dns.EDNS0_N3U{Code: dns.EDNS0N3U, AlgCode: understoodNSEC3Hashes},
+	}
+}
+
+// lookupDNSKEY retrieves and verifies the DNSKEY set for the zone of auth. If
+// auth fails to respond, or responds with a non-success rcode, the query is
+// retried against the other nameservers for the zone in siblings. The zone is
+// expected to be signed, so a response without any DNSKEY records is an
+// error, ErrDNSKEYDenied if it contains NSEC or NSEC3 records claiming the
+// RRset doesn't exist, which indicates either a attack or a broken zone, or
+// ErrNoDNSKEY otherwise. If no nameserver responds the transport error is
+// returned, and if they all respond with a non-success rcode ErrBadAnswer is.
+func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver, siblings []Nameserver) (map[uint16]*dns.DNSKEY, *LookupLog, func(), error) {
 	q := &Question{Name: auth.Zone, Type: dns.TypeDNSKEY}
 	var r *dns.Msg
 	var log *LookupLog
 	var err error
-	if rr.cache != nil {
-
-	}
 	if rr.cache != nil {
 		if a := rr.cache.Get(q); a != nil {
 			r = new(dns.Msg)
@@ -42,16 +96,50 @@ func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver)
 		}
 	}
 	if r == nil {
-		r, log, err = rr.query(ctx, q, auth)
+		if rr.Offline {
+			log = newLookupLog(q, nil)
+			log.Error = ErrKeysUnavailableOffline.Error()
+			return nil, log, nil, ErrKeysUnavailableOffline
+		}
+		servers := []*Nameserver{auth}
+		for i := range siblings {
+			if siblings[i].Addr != auth.Addr {
+				servers = append(servers, &Nameserver{Name: siblings[i].Name, Addr: siblings[i].Addr, Zone: auth.Zone})
+			}
+		}
+		var failed []*LookupLog
+		for _, ns := range servers {
+			r, log, err = rr.query(ctx, q, ns, LookupOptions{})
+			if err == nil && r.Rcode != dns.RcodeSuccess {
+				err = ErrBadAnswer
+			}
+			if err == nil {
+				break
+			}
+			log.Error = err.Error()
+			failed = append(failed, log)
+		}
 		if err != nil {
+			log.Composites = append(log.Composites, failed[:len(failed)-1]...)
 			return nil, log, nil, err
 		}
+		// include the failed attempts against other nameservers
+		log.Composites = append(log.Composites, failed...)
 
-		if len(r.Answer) == 0 || r.Rcode != dns.RcodeSuccess {
+		if len(extractRRSet(r.Answer, "", dns.TypeDNSKEY)) == 0 {
+			if len(denialRecords(r.Ns)) > 0 {
+				return nil, log, nil, ErrDNSKEYDenied
+			}
 			return nil, log, nil, ErrNoDNSKEY
 		}
 	}
 
+	log.DNSKEYCount = len(extractRRSet(r.Answer, "", dns.TypeDNSKEY))
+	if rr.MaxDNSKEYs > 0 && log.DNSKEYCount > rr.MaxDNSKEYs {
+		log.Error = ErrTooManyDNSKEYs.Error()
+		return nil, log, nil, ErrTooManyDNSKEYs
+	}
+
 	keyMap := make(map[uint16]*dns.DNSKEY)
 	// Extract DNSKEYs based on type
 	for _, a := range r.Answer {
@@ -70,15 +158,21 @@ func (rr *RecursiveResolver) lookupDNSKEY(ctx context.Context, auth *Nameserver)
 
 	// Verify RRSIGs from the message passed in using the KSK keys
 	if auth.Zone != "." {
-		err = verifyRRSIG(r, keyMap)
+		err = verifyRRSIG(r, keyMap, rr.Clock, rr.AllowedAlgorithms, nil)
 		if err != nil {
 			return nil, log, nil, err
 		}
+		if rr.StrictAlgorithms {
+			err = verifyAlgorithms(r, keyMap, rr.Clock, rr.AllowedAlgorithms)
+			if err != nil {
+				return nil, log, nil, err
+			}
+		}
 	}
 
 	addCache := func() {
 		if rr.cache != nil && !log.CacheHit {
-			rr.cache.Add(q, &Answer{r.Answer, r.Ns, r.Extra, dns.RcodeSuccess, true}, false)
+			rr.cache.Add(q, &Answer{Answer: r.Answer, Authority: r.Ns, Additional: r.Extra, Rcode: dns.RcodeSuccess, Authenticated: true}, false)
 		}
 	}
 
@@ -95,66 +189,615 @@ func checkDS(keyMap map[uint16]*dns.DNSKEY, parentDSSet []dns.RR) error {
 		if !present {
 			continue
 		}
-		ds := ksk.ToDS(parentDS.DigestType)
-		if ds == nil {
-			return ErrFailedToConvertKSK
+		return VerifyDSMatch(ksk, parentDS)
+	}
+	return ErrMissingKSK
+}
+
+// VerifyDSMatch checks that ds is a valid DS record for key. If the key
+// tags don't match ErrMismatchingKeyTag is returned, if key can't be
+// converted to a DS record using the digest type of ds
+// ErrFailedToConvertKSK is returned, and if the algorithm or digest don't
+// match ErrMismatchingDS is returned.
+func VerifyDSMatch(key *dns.DNSKEY, ds *dns.DS) error {
+	if key.KeyTag() != ds.KeyTag {
+		return ErrMismatchingKeyTag
+	}
+	converted := key.ToDS(ds.DigestType)
+	if converted == nil {
+		return ErrFailedToConvertKSK
+	}
+	if converted.Algorithm != ds.Algorithm || !strings.EqualFold(converted.Digest, ds.Digest) {
+		return ErrMismatchingDS
+	}
+	return nil
+}
+
+// typeString returns the mnemonic for a RR type, or the generic TYPEnnn form
+// from RFC 3597 if it is unknown
+func typeString(t uint16) string {
+	if s, present := dns.TypeToString[t]; present {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// RRSetError describes why a single RRset failed validation
+type RRSetError struct {
+	Name string
+	Type uint16
+	Err  error
+}
+
+func (e RRSetError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Name, typeString(e.Type), e.Err)
+}
+
+// MarshalJSON implements json.Marshaler
+func (e RRSetError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name   string
+		Type   string
+		Reason string
+	}{e.Name, typeString(e.Type), e.Err.Error()})
+}
+
+// ValidationError is returned when one or more of the RRsets in a message
+// could not be validated
+type ValidationError struct {
+	Failures []RRSetError
+}
+
+func (ve *ValidationError) Error() string {
+	failures := make([]string, len(ve.Failures))
+	for i, f := range ve.Failures {
+		failures[i] = f.Error()
+	}
+	return fmt.Sprintf("solvere: RRset validation failed: %s", strings.Join(failures, ", "))
+}
+
+// bogusErrors are the errors, other than a ValidationError, that show a
+// response failed validation. Other errors, like failing to fetch the DNSKEY
+// RRset, don't say anything about whether the response is bogus.
+var bogusErrors = []error{
+	ErrNoDNSKEY,
+	ErrMissingKSK,
+	ErrFailedToConvertKSK,
+	ErrMismatchingDS,
+	ErrMismatchingKeyTag,
+	ErrNoSignatures,
+	ErrMissingDNSKEY,
+	ErrInvalidSignaturePeriod,
+	ErrMissingSigned,
+	ErrMissingAlgorithm,
+	ErrUntrustedSigner,
+	ErrUnsignedDS,
+	ErrNoSupportedAlgorithm,
+	ErrDNSKEYDenied,
+	ErrTooManyDNSKEYs,
+	ErrAlgorithmDowngrade,
+	ErrNSECMismatch,
+	ErrNSECTypeExists,
+	ErrNSECMultipleCoverage,
+	ErrNSECMissingCoverage,
+	ErrNSECBadDelegation,
+	ErrNSECNSMissing,
+	ErrNSECOptOut,
+	ErrMalformedNSEC3,
+	dns.ErrSig,
+	dns.ErrKey,
+}
+
+// isBogusError checks if err shows a response failed validation
+func isBogusError(err error) bool {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return true
+	}
+	for _, e := range bogusErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+type rrsetKey struct {
+	name string
+	t    uint16
+}
+
+func verifySignature(sig *dns.RRSIG, section []dns.RR, keyMap map[uint16]*dns.DNSKEY, clk clock.Clock) error {
+	rest := extractRRSet(section, sig.Header().Name, sig.TypeCovered)
+	if len(rest) == 0 {
+		return ErrMissingSigned
+	}
+	k, present := keyMap[sig.KeyTag]
+	if !present {
+		return ErrMissingDNSKEY
+	}
+	var err error
+	if sig.Algorithm == AlgorithmED25519 {
+		err = verifyEd25519(sig, k, rest)
+	} else {
+		err = sig.Verify(k, rest)
+	}
+	if err != nil {
+		return err
+	}
+	if !sig.ValidityPeriod(clk.Now()) {
+		return ErrInvalidSignaturePeriod
+	}
+	return nil
+}
+
+// algorithmAllowed checks if signatures using alg can be used for validation,
+// if allowed is nil every algorithm is allowed
+func algorithmAllowed(alg uint8, allowed []uint8) bool {
+	if allowed == nil {
+		return true
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsetKeys returns the keys of the RRsets in a section, other than RRSIGs,
+// in the order they first appear
+func rrsetKeys(section []dns.RR) []rrsetKey {
+	var keys []rrsetKey
+	seen := map[rrsetKey]struct{}{}
+	for _, r := range section {
+		if r.Header().Rrtype == dns.TypeRRSIG {
+			continue
 		}
-		if ds.Digest != parentDS.Digest {
-			return ErrMismatchingDS
+		key := rrsetKey{r.Header().Name, r.Header().Rrtype}
+		if _, present := seen[key]; !present {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
 		}
-		return nil
 	}
-	return ErrMissingKSK
+	return keys
 }
 
-func verifyRRSIG(msg *dns.Msg, keyMap map[uint16]*dns.DNSKEY) error {
-	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
-		if len(section) == 0 {
+// keysZone returns the zone a set of DNSKEYs belong to
+func keysZone(keyMap map[uint16]*dns.DNSKEY) string {
+	for _, k := range keyMap {
+		return k.Header().Name
+	}
+	return ""
+}
+
+// unsignedByDesign checks if a RRset isn't expected to be signed by zone even
+// though the zone is signed. NS records at a delegation point are only
+// authoritative in the child zone so aren't signed by the parent (RFC 4035
+// Section 2.2).
+func unsignedByDesign(key rrsetKey, authority bool, zone string) bool {
+	return authority && zone != "" && key.t == dns.TypeNS && !strings.EqualFold(key.name, zone)
+}
+
+// requiredAlgorithms returns the algorithms that each RRset signed by the
+// keys in keyMap must have a valid signature for, which are the algorithms of
+// the DS records in dsSet that the DNSKEY set contains a key for. A zone must
+// sign each RRset with every algorithm in its DS set (RFC 6840 Section 5.11),
+// so requiring them stops a attacker stripping the signatures using strong
+// algorithms and leaving only a weak one. Algorithms that can't be validated,
+// or aren't in allowed, are left out.
+func requiredAlgorithms(keyMap map[uint16]*dns.DNSKEY, dsSet []dns.RR, allowed []uint8) []uint8 {
+	var required []uint8
+	seen := map[uint8]bool{}
+	for _, r := range dsSet {
+		ds, ok := r.(*dns.DS)
+		if !ok || seen[ds.Algorithm] || !algorithmAllowed(ds.Algorithm, understoodAlgorithms) || !algorithmAllowed(ds.Algorithm, allowed) {
 			continue
 		}
-		sigs := extractRRSet(section, "", dns.TypeRRSIG)
-		if len(sigs) == 0 {
-			return ErrNoSignatures
+		for _, k := range keyMap {
+			if k.Algorithm == ds.Algorithm {
+				seen[ds.Algorithm] = true
+				required = append(required, ds.Algorithm)
+				break
+			}
+		}
+	}
+	return required
+}
+
+// signedWith checks if algs contains each of the algorithms in required
+func signedWith(algs map[uint8]bool, required []uint8) bool {
+	for _, a := range required {
+		if !algs[a] {
+			return false
 		}
-		for _, sigRR := range sigs {
+	}
+	return true
+}
+
+// verifyRRSIG verifies the signatures for each of the RRsets in the answer
+// and authority sections of a message. A RRset is valid if at least one of
+// the signatures covering it can be verified, RRsets without any signatures
+// are only valid if they aren't expected to be signed by the zone the keys
+// belong to. Signatures using algorithms that aren't in allowed are skipped
+// as if they were absent, RRsets only signed with them fail with
+// ErrNoSupportedAlgorithm. RRsets must also have a valid signature for each
+// of the algorithms in required, otherwise they fail with
+// ErrAlgorithmDowngrade. If any RRsets are invalid a *ValidationError listing
+// all of them is returned. The validity periods of the signatures are checked
+// against the time provided by clk.
+func verifyRRSIG(msg *dns.Msg, keyMap map[uint16]*dns.DNSKEY, clk clock.Clock, allowed, required []uint8) error {
+	ve := &ValidationError{}
+	zone := keysZone(keyMap)
+	for i, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		order := rrsetKeys(section)
+		failures := map[rrsetKey]error{}
+		// verified holds the algorithms of the valid signatures for each
+		// RRset
+		verified := map[rrsetKey]map[uint8]bool{}
+		skipped := map[rrsetKey]bool{}
+		for _, sigRR := range extractRRSet(section, "", dns.TypeRRSIG) {
 			sig := sigRR.(*dns.RRSIG)
-			rest := extractRRSet(section, sig.Header().Name, sig.TypeCovered)
-			if len(rest) == 0 {
-				return ErrMissingSigned
+			key := rrsetKey{sig.Header().Name, sig.TypeCovered}
+			if algs, present := verified[key]; present && (algs[sig.Algorithm] || signedWith(algs, required)) {
+				continue
 			}
-			k, present := keyMap[sig.KeyTag]
-			if !present {
-				return ErrMissingDNSKEY
+			if !algorithmAllowed(sig.Algorithm, allowed) {
+				skipped[key] = true
+				continue
 			}
-			err := sig.Verify(k, rest)
+			if _, present := failures[key]; !present {
+				if len(extractRRSet(section, key.name, key.t)) == 0 {
+					// signatures for records that aren't present
+					order = append(order, key)
+				}
+			}
+			err := verifySignature(sig, section, keyMap, clk)
 			if err != nil {
-				return err
+				failures[key] = err
+				continue
 			}
-			if !sig.ValidityPeriod(time.Time{}) {
-				return ErrInvalidSignaturePeriod
+			if verified[key] == nil {
+				verified[key] = map[uint8]bool{}
+			}
+			verified[key][sig.Algorithm] = true
+		}
+		for _, key := range order {
+			if algs, present := verified[key]; present {
+				if !signedWith(algs, required) {
+					ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, ErrAlgorithmDowngrade})
+				}
+				continue
+			}
+			if err, present := failures[key]; present {
+				ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, err})
+			} else if unsignedByDesign(key, i == 1, zone) {
+				continue
+			} else if skipped[key] {
+				ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, ErrNoSupportedAlgorithm})
+			} else {
+				ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, ErrNoSignatures})
+			}
+		}
+	}
+	if len(ve.Failures) > 0 {
+		return ve
+	}
+	return nil
+}
+
+// verifyDS checks that each DS RRset in the authority section of a referral
+// from parent has a valid signature from the keys of parent, so that a forged
+// DS set can't be used to build the chain of trust to the child zone. A DS set
+// signed by a ancestor of parent is rejected since only the parent zone is
+// authoritative for it.
+func verifyDS(msg *dns.Msg, parent string, keyMap map[uint16]*dns.DNSKEY, clk clock.Clock) error {
+	ve := &ValidationError{}
+	for _, key := range rrsetKeys(msg.Ns) {
+		if key.t != dns.TypeDS {
+			continue
+		}
+		signed := false
+		for _, sigRR := range extractRRSet(msg.Ns, key.name, dns.TypeRRSIG) {
+			sig := sigRR.(*dns.RRSIG)
+			if sig.TypeCovered != dns.TypeDS || !strings.EqualFold(sig.SignerName, parent) {
+				continue
+			}
+			if verifySignature(sig, msg.Ns, keyMap, clk) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, ErrUnsignedDS})
+		}
+	}
+	if len(ve.Failures) > 0 {
+		return ve
+	}
+	return nil
+}
+
+// unsignedRRSets returns the RRsets in a message that aren't covered by any
+// signatures, and so can't be trusted even if the message was successfully
+// validated. This includes any glue in the additional section, which is
+// never signed.
+func unsignedRRSets(msg *dns.Msg) []RRSetError {
+	var unsigned []RRSetError
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		signed := map[rrsetKey]bool{}
+		for _, sigRR := range extractRRSet(section, "", dns.TypeRRSIG) {
+			sig := sigRR.(*dns.RRSIG)
+			signed[rrsetKey{sig.Header().Name, sig.TypeCovered}] = true
+		}
+		for _, key := range rrsetKeys(section) {
+			if !signed[key] && key.t != dns.TypeOPT {
+				unsigned = append(unsigned, RRSetError{key.name, key.t, ErrNoSignatures})
 			}
 		}
 	}
+	return unsigned
+}
+
+// verifyAlgorithms checks that each of the RRsets in the answer and authority
+// sections of a message has a valid signature for every algorithm used by the
+// keys in the DNSKEY set. During a algorithm rollover a zone must sign its
+// RRsets with both the old and new algorithms (RFC 6840 Section 5.11), so a
+// missing algorithm indicates a broken rollover. Keys using algorithms that
+// aren't in allowed are ignored.
+func verifyAlgorithms(msg *dns.Msg, keyMap map[uint16]*dns.DNSKEY, clk clock.Clock, allowed []uint8) error {
+	algorithms := map[uint8]struct{}{}
+	for _, k := range keyMap {
+		if algorithmAllowed(k.Algorithm, allowed) {
+			algorithms[k.Algorithm] = struct{}{}
+		}
+	}
+	ve := &ValidationError{}
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		var order []rrsetKey
+		signed := map[rrsetKey]map[uint8]bool{}
+		for _, r := range section {
+			if r.Header().Rrtype == dns.TypeRRSIG {
+				continue
+			}
+			key := rrsetKey{r.Header().Name, r.Header().Rrtype}
+			if _, present := signed[key]; !present {
+				order = append(order, key)
+				signed[key] = map[uint8]bool{}
+			}
+		}
+		for _, sigRR := range extractRRSet(section, "", dns.TypeRRSIG) {
+			sig := sigRR.(*dns.RRSIG)
+			algs, present := signed[rrsetKey{sig.Header().Name, sig.TypeCovered}]
+			if !present || algs[sig.Algorithm] {
+				continue
+			}
+			if verifySignature(sig, section, keyMap, clk) == nil {
+				algs[sig.Algorithm] = true
+			}
+		}
+		for _, key := range order {
+			for alg := range algorithms {
+				if !signed[key][alg] {
+					ve.Failures = append(ve.Failures, RRSetError{key.name, key.t, ErrMissingAlgorithm})
+					break
+				}
+			}
+		}
+	}
+	if len(ve.Failures) > 0 {
+		return ve
+	}
 	return nil
 }
 
-func (rr *RecursiveResolver) checkSignatures(ctx context.Context, m *dns.Msg, auth *Nameserver, parentDSSet []dns.RR) (*LookupLog, error) {
-	keyMap, log, addCache, err := rr.lookupDNSKEY(ctx, auth)
+// signerZone returns the zone that signed the records in a message, taken
+// from the signer name of its RRSIG records. The signer must be zone or one
+// of its parents, and all of the RRSIGs must have the same signer. If there
+// are no RRSIGs zone is returned.
+func signerZone(m *dns.Msg, zone string) (string, error) {
+	signer := ""
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, r := range extractRRSet(section, "", dns.TypeRRSIG) {
+			name := dns.Fqdn(strings.ToLower(r.(*dns.RRSIG).SignerName))
+			if signer != "" && name != signer {
+				return "", ErrUntrustedSigner
+			}
+			signer = name
+		}
+	}
+	if signer == "" {
+		return zone, nil
+	}
+	if !dns.IsSubDomain(signer, zone) {
+		return "", ErrUntrustedSigner
+	}
+	return signer, nil
+}
+
+// DisableValidationFor disables DNSSEC validation for zone and any names
+// below it. Answers from these zones are treated as insecure, so their
+// DNSKEYs aren't fetched and delegations to them don't need to be proven
+// insecure by the parent zone, but they are never authenticated. Answers for
+// names below zone that are served by a parent zone are also used without
+// being validated.
+func (rr *RecursiveResolver) DisableValidationFor(zone string) {
+	rr.unvalidatedMu.Lock()
+	defer rr.unvalidatedMu.Unlock()
+	if rr.unvalidatedZones == nil {
+		rr.unvalidatedZones = make(map[string]struct{})
+	}
+	rr.unvalidatedZones[strings.ToLower(dns.Fqdn(zone))] = struct{}{}
+}
+
+// AddNegativeTrustAnchor adds a negative trust anchor (RFC 7646) for zone, so
+// that answers for names at or below it are returned as insecure instead of
+// failing validation. This is the same as DisableValidationFor, it is intended
+// to temporarily work around a misconfigured zone and should be removed with
+// RemoveNegativeTrustAnchor once the zone has been fixed.
+func (rr *RecursiveResolver) AddNegativeTrustAnchor(zone string) {
+	rr.DisableValidationFor(zone)
+}
+
+// RemoveNegativeTrustAnchor removes the negative trust anchor for zone,
+// added with AddNegativeTrustAnchor or DisableValidationFor, re-enabling
+// validation for it. It returns false if there was no anchor for zone.
+// Answers that were cached while the anchor was in place aren't removed from
+// the cache.
+func (rr *RecursiveResolver) RemoveNegativeTrustAnchor(zone string) bool {
+	rr.unvalidatedMu.Lock()
+	defer rr.unvalidatedMu.Unlock()
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if _, present := rr.unvalidatedZones[zone]; !present {
+		return false
+	}
+	delete(rr.unvalidatedZones, zone)
+	return true
+}
+
+// NegativeTrustAnchors returns the zones validation is disabled for, in
+// sorted order
+func (rr *RecursiveResolver) NegativeTrustAnchors() []string {
+	rr.unvalidatedMu.RLock()
+	defer rr.unvalidatedMu.RUnlock()
+	zones := make([]string, 0, len(rr.unvalidatedZones))
+	for zone := range rr.unvalidatedZones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// validationDisabled checks if DNSSEC validation has been disabled for zone
+// or one of its parents
+func (rr *RecursiveResolver) validationDisabled(zone string) bool {
+	rr.unvalidatedMu.RLock()
+	defer rr.unvalidatedMu.RUnlock()
+	for disabled := range rr.unvalidatedZones {
+		if dns.IsSubDomain(disabled, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTrustAnchor configures ds as the DS RRset for zone, which is used to
+// authenticate the DNSKEYs of the zone instead of the DS RRset from its
+// parent. When a referral to zone is followed it is treated as secure even if
+// the parent zone isn't, so that zones without a chain of trust from the root,
+// such as private zones, can be validated. Zones that validation has been
+// disabled for with DisableValidationFor are still treated as insecure.
+func (rr *RecursiveResolver) AddTrustAnchor(zone string, ds []dns.RR) error {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if len(ds) == 0 {
+		return ErrInvalidTrustAnchor
+	}
+	for _, r := range ds {
+		if _, ok := r.(*dns.DS); !ok || !strings.EqualFold(r.Header().Name, zone) {
+			return ErrInvalidTrustAnchor
+		}
+	}
+	rr.trustAnchorsMu.Lock()
+	defer rr.trustAnchorsMu.Unlock()
+	if rr.trustAnchors == nil {
+		rr.trustAnchors = make(map[string][]dns.RR)
+	}
+	rr.trustAnchors[zone] = append([]dns.RR{}, ds...)
+	return nil
+}
+
+// trustAnchor returns the DS RRset configured for zone with AddTrustAnchor,
+// if there is one and validation hasn't been disabled for the zone
+func (rr *RecursiveResolver) trustAnchor(zone string) ([]dns.RR, bool) {
+	rr.trustAnchorsMu.RLock()
+	ds, present := rr.trustAnchors[strings.ToLower(zone)]
+	rr.trustAnchorsMu.RUnlock()
+	if !present || !rr.useDNSSEC || rr.validationDisabled(zone) {
+		return nil, false
+	}
+	return ds, true
+}
+
+func (rr *RecursiveResolver) checkSignatures(ctx context.Context, m *dns.Msg, auth *Nameserver, siblings []Nameserver, parentDSSet []dns.RR) (*LookupLog, error) {
+	zone, err := signerZone(m, auth.Zone)
+	var apexLogs []*LookupLog
+	if err != nil && rr.DetectZoneApex {
+		// the records may have been signed by a child zone served by the
+		// same nameservers, in which case the chain of trust continues
+		// into the child zone
+		var child *Nameserver
+		child, parentDSSet, apexLogs, err = rr.hiddenZoneCut(ctx, m, auth, siblings, parentDSSet)
+		if err == nil {
+			auth, zone = child, child.Zone
+		}
+	}
+	if err != nil {
+		if len(apexLogs) > 0 {
+			log := newLookupLog(&Question{Name: auth.Zone, Type: dns.TypeDNSKEY}, auth)
+			log.Error = err.Error()
+			log.Composites = apexLogs
+			return log, err
+		}
+		return nil, err
+	}
+	keyAuth := auth
+	if zone != auth.Zone {
+		// the records were signed by a parent of the zone the authority was
+		// delegated, so the keys need to be fetched from that zone
+		keyAuth = &Nameserver{Name: auth.Name, Addr: auth.Addr, Zone: zone}
+	}
+	keyMap, log, addCache, err := rr.lookupDNSKEY(ctx, keyAuth, siblings)
+	if log != nil {
+		log.Composites = append(apexLogs, log.Composites...)
+	}
 	if err != nil {
 		return log, err
 	}
 
-	if len(parentDSSet) > 0 {
+	var required []uint8
+	// keyDS is the DS RRset the keys were authenticated with, if they were
+	// authenticated by this response rather than previously
+	var keyDS []dns.RR
+	if zone != auth.Zone {
+		// the parent DS set describes the keys of the delegated zone rather
+		// than the signer, so the signers keys must already have been
+		// authenticated while following the chain of trust through its zone
+		if !log.CacheHit || !log.DNSSECValid {
+			return log, ErrUntrustedSigner
+		}
+	} else if len(parentDSSet) > 0 {
 		err = checkDS(keyMap, parentDSSet)
 		if err != nil {
 			return log, err
 		}
+		keyDS = parentDSSet
+		if rr.StrictAlgorithms {
+			required = requiredAlgorithms(keyMap, parentDSSet, rr.AllowedAlgorithms)
+		}
 	}
 
-	err = verifyRRSIG(m, keyMap)
+	// signatures made by recently authenticated keys that have been
+	// removed from the DNSKEY RRset during a rollover are still accepted
+	sigKeys := keyMap
+	if rr.cache != nil {
+		sigKeys = rr.withRetainedKeys(zone, keyMap, keyDS)
+	}
+	if isReferral(m) {
+		err = verifyDS(m, auth.Zone, sigKeys, rr.Clock)
+		if err != nil {
+			return log, err
+		}
+	}
+	err = verifyRRSIG(m, sigKeys, rr.Clock, rr.AllowedAlgorithms, required)
 	if err != nil {
 		return log, err
 	}
+	if rr.StrictAlgorithms {
+		err = verifyAlgorithms(m, sigKeys, rr.Clock, rr.AllowedAlgorithms)
+		if err != nil {
+			return log, err
+		}
+	}
 
 	log.DNSSECValid = true
 
@@ -162,6 +805,7 @@ func (rr *RecursiveResolver) checkSignatures(ctx context.Context, m *dns.Msg, au
 	if !log.CacheHit {
 		if rr.cache != nil {
 			addCache()
+			rr.retainKeys(zone, keyMap, keyDS)
 		}
 	}
 
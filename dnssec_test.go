@@ -5,8 +5,10 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -134,11 +136,11 @@ func TestLookupDNSKEY(t *testing.T) {
 		}
 	}()
 
-	rr := RecursiveResolver{useDNSSEC: true, c: new(dns.Client)}
+	rr := RecursiveResolver{useDNSSEC: true, Clock: clock.Default()}
 	auth := &Nameserver{Zone: "example.", Addr: "127.0.0.1"}
 
 	// Valid response
-	keyMap, _, addToCache, err := rr.lookupDNSKEY(context.Background(), auth)
+	keyMap, _, addToCache, err := rr.lookupDNSKEY(context.Background(), auth, nil)
 	if err != nil {
 		t.Fatalf("lookupDNSKEY failed with a valid response with no DS set: %s", err)
 	}
@@ -154,37 +156,37 @@ func TestLookupDNSKEY(t *testing.T) {
 	addToCache()
 
 	// Invalid response, empty answer
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: ".", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: ".", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a empty answer")
 	}
 
 	// Invalid response, bad rcode
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad.", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a bad rcode")
 	}
 
 	// Invalid response, wrong types returned
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a no keys")
 	}
 
 	// Invalid response, bad rcode
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "no-keys-weird.", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with a no keys")
 	}
 
 	// Invalid response, out of bailiwick records
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "out-of-bailiwick.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "out-of-bailiwick.", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with out of bailiwick records")
 	}
 
 	// Invalid response, invalid signature
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad-sig.", Addr: "127.0.0.1"})
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), &Nameserver{Zone: "bad-sig.", Addr: "127.0.0.1"}, nil)
 	if err == nil {
 		t.Fatalf("lookupDNSKEY didn't fail with bad signature")
 	}
@@ -194,7 +196,7 @@ func TestLookupDNSKEY(t *testing.T) {
 	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
 	rr.cache = cache
 
-	_, _, addToCache, err = rr.lookupDNSKEY(context.Background(), auth)
+	_, _, addToCache, err = rr.lookupDNSKEY(context.Background(), auth, nil)
 	if err != nil {
 		t.Fatalf("lookupDNSKEY failed with a valid response: %s", err)
 	}
@@ -205,7 +207,7 @@ func TestLookupDNSKEY(t *testing.T) {
 	eMu.Lock()
 	exampleKeySig.Signature = ""
 	eMu.Unlock()
-	_, _, _, err = rr.lookupDNSKEY(context.Background(), auth)
+	_, _, _, err = rr.lookupDNSKEY(context.Background(), auth, nil)
 	eMu.Lock()
 	exampleKeySig.Signature = goodSig
 	eMu.Unlock()
@@ -249,6 +251,48 @@ func TestCheckDS(t *testing.T) {
 	}
 }
 
+func TestVerifyDSMatch(t *testing.T) {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example."}, Algorithm: dns.RSASHA256, Flags: 257, Protocol: 3}
+	_, err := k.Generate(512)
+	if err != nil {
+		t.Fatalf("Failed to generate DNSKEY: %s", err)
+	}
+
+	ds := k.ToDS(dns.SHA256)
+	if err = VerifyDSMatch(k, ds); err != nil {
+		t.Fatalf("VerifyDSMatch failed to verify a valid key and DS combination: %s", err)
+	}
+	lower := *ds
+	lower.Digest = strings.ToLower(ds.Digest)
+	if err = VerifyDSMatch(k, &lower); err != nil {
+		t.Fatalf("VerifyDSMatch failed to verify a DS record with a lowercase digest: %s", err)
+	}
+
+	wrongTag := *ds
+	wrongTag.KeyTag++
+	if err = VerifyDSMatch(k, &wrongTag); err != ErrMismatchingKeyTag {
+		t.Fatalf("VerifyDSMatch didn't fail with mismatching key tag: %v", err)
+	}
+
+	wrongDigest := *ds
+	wrongDigest.DigestType = dns.SHA1
+	if err = VerifyDSMatch(k, &wrongDigest); err != ErrMismatchingDS {
+		t.Fatalf("VerifyDSMatch didn't fail with mismatching DS record: %v", err)
+	}
+
+	wrongAlgorithm := *ds
+	wrongAlgorithm.Algorithm = dns.ECDSAP256SHA256
+	if err = VerifyDSMatch(k, &wrongAlgorithm); err != ErrMismatchingDS {
+		t.Fatalf("VerifyDSMatch didn't fail with mismatching algorithm: %v", err)
+	}
+
+	unknownDigest := *ds
+	unknownDigest.DigestType = 200
+	if err = VerifyDSMatch(k, &unknownDigest); err != ErrFailedToConvertKSK {
+		t.Fatalf("VerifyDSMatch didn't fail with unsupported digest type: %v", err)
+	}
+}
+
 func TestVerifyRRSIG(t *testing.T) {
 	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "org."}, Algorithm: dns.RSASHA256, Protocol: 3}
 	pk, err := k.Generate(512)
@@ -307,28 +351,28 @@ func TestVerifyRRSIG(t *testing.T) {
 
 	// Valid signatures
 	m := &dns.Msg{Answer: append(nsSet, sigB)}
-	err = verifyRRSIG(m, keyMap)
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to verify valid RRSIGs: %s", err)
 	}
 
 	// Missing signatures
 	m = &dns.Msg{Answer: aSet}
-	err = verifyRRSIG(m, keyMap)
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing signatures")
 	}
 
 	// Missing signed records
 	m = &dns.Msg{Answer: []dns.RR{sigA}}
-	err = verifyRRSIG(m, keyMap)
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing signed records")
 	}
 
 	// Missing key
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, make(map[uint16]*dns.DNSKEY))
+	err = verifyRRSIG(m, make(map[uint16]*dns.DNSKEY), clock.Default(), nil, nil)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with missing DNSKEY")
 	}
@@ -336,7 +380,7 @@ func TestVerifyRRSIG(t *testing.T) {
 	// Invalid signature
 	sigA.Signature = ""
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, keyMap)
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with invalid signature")
 	}
@@ -348,12 +392,600 @@ func TestVerifyRRSIG(t *testing.T) {
 		t.Fatalf("Failed to sign aSet: %s", err)
 	}
 	m = &dns.Msg{Answer: append(aSet, sigA)}
-	err = verifyRRSIG(m, keyMap)
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
 	if err == nil {
 		t.Fatal("verifyRRSIG didn't fail with invalid validity period")
 	}
 }
 
+func TestVerifyRRSIGFailures(t *testing.T) {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "org.", Class: dns.ClassINET}, Algorithm: dns.ECDSAP256SHA256, Protocol: 3}
+	pk, err := k.Generate(256)
+	if err != nil {
+		t.Fatalf("Failed to generate DNSKEY: %s", err)
+	}
+	keyMap := map[uint16]*dns.DNSKEY{k.KeyTag(): k}
+	sign := func(set []dns.RR) *dns.RRSIG {
+		sig := &dns.RRSIG{
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:     k.KeyTag(),
+			SignerName: "org.",
+			Algorithm:  dns.ECDSAP256SHA256,
+		}
+		if err := sig.Sign(pk.(crypto.Signer), set); err != nil {
+			t.Fatalf("Failed to sign RRset: %s", err)
+		}
+		return sig
+	}
+
+	aSet := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IP{1, 2, 3, 4}}}
+	txtSet := []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"hello"}}}
+	aSig := sign(aSet)
+	badTXTSig := sign(txtSet)
+	badTXTSig.Signature = aSig.Signature
+
+	m := &dns.Msg{Answer: []dns.RR{aSet[0], aSig, txtSet[0], badTXTSig}}
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
+	if err == nil {
+		t.Fatal("verifyRRSIG didn't fail with a bogus RRset")
+	}
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("verifyRRSIG didn't return a *ValidationError: %s", err)
+	}
+	if len(ve.Failures) != 1 {
+		t.Fatalf("verifyRRSIG returned unexpected number of failures: %s", ve)
+	}
+	if ve.Failures[0].Name != "a.org." || ve.Failures[0].Type != dns.TypeTXT {
+		t.Fatalf("verifyRRSIG identified the wrong RRset as bogus: %s", ve.Failures[0])
+	}
+
+	// a RRset with a valid signature should validate even if another
+	// signature covering it is bogus
+	m = &dns.Msg{Answer: []dns.RR{aSet[0], aSig, badTXTSig, txtSet[0], sign(txtSet)}}
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
+	if err != nil {
+		t.Fatalf("verifyRRSIG failed with one valid and one bogus signature for a RRset: %s", err)
+	}
+}
+
+func TestVerifyRRSIGMixedSection(t *testing.T) {
+	k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "org.", Class: dns.ClassINET}, Algorithm: dns.ECDSAP256SHA256, Protocol: 3}
+	pk, err := k.Generate(256)
+	if err != nil {
+		t.Fatalf("Failed to generate DNSKEY: %s", err)
+	}
+	keyMap := map[uint16]*dns.DNSKEY{k.KeyTag(): k}
+	sign := func(set ...dns.RR) *dns.RRSIG {
+		sig := &dns.RRSIG{
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:     k.KeyTag(),
+			SignerName: "org.",
+			Algorithm:  dns.ECDSAP256SHA256,
+		}
+		if err := sig.Sign(pk.(crypto.Signer), set); err != nil {
+			t.Fatalf("Failed to sign RRset: %s", err)
+		}
+		return sig
+	}
+
+	// a signed referral, the NS records at the delegation point aren't
+	// signed by the parent but the DS records are
+	ds := &dns.DS{Hdr: dns.RR_Header{Name: "child.org.", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 1, Algorithm: dns.ECDSAP256SHA256, DigestType: dns.SHA256, Digest: "aa"}
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: "child.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.child.org."}
+	glue := &dns.A{Hdr: dns.RR_Header{Name: "ns.child.org.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IP{1, 2, 3, 4}}
+	m := &dns.Msg{Ns: []dns.RR{ns, ds, sign(ds)}, Extra: []dns.RR{glue}}
+	if err := verifyRRSIG(m, keyMap, clock.Default(), nil, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed for signed referral with unsigned delegation NS records: %s", err)
+	}
+	unsigned := unsignedRRSets(m)
+	if len(unsigned) != 2 || unsigned[0].Name != "child.org." || unsigned[0].Type != dns.TypeNS || unsigned[1].Type != dns.TypeA {
+		t.Fatalf("unsignedRRSets didn't mark delegation NS records and glue as unsigned: %v", unsigned)
+	}
+
+	// unsigned NS records at the zone apex should be signed
+	apexNS := &dns.NS{Hdr: dns.RR_Header{Name: "org.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.org."}
+	m = &dns.Msg{Ns: []dns.RR{apexNS, ds, sign(ds)}}
+	if err := verifyRRSIG(m, keyMap, clock.Default(), nil, nil); err == nil {
+		t.Fatal("verifyRRSIG didn't fail with unsigned NS records at the zone apex")
+	}
+
+	// a unsigned RRset in a section that contains a signed one
+	a := &dns.A{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IP{1, 2, 3, 4}}
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: "a.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"hello"}}
+	m = &dns.Msg{Answer: []dns.RR{a, sign(a), txt}}
+	err = verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("verifyRRSIG didn't fail with unsigned RRset alongside signed one: %v", err)
+	}
+	if len(ve.Failures) != 1 || ve.Failures[0].Type != dns.TypeTXT || ve.Failures[0].Err != ErrNoSignatures {
+		t.Fatalf("verifyRRSIG returned wrong failures for mixed section: %s", ve)
+	}
+}
+
 func TestCheckSignatures(t *testing.T) {
 
 }
+
+func TestOfflineValidation(t *testing.T) {
+	z := newTestZone(t, "example.", "127.0.0.2", true, "a.example. 300 IN A 1.2.3.4")
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
+	rr := NewRecursiveResolver(false, true, nil, nil, cache)
+	rr.Offline = true
+	auth := &Nameserver{Addr: "127.0.0.2", Zone: "example."}
+	m := &dns.Msg{Answer: z.sign(z.rrset("a.example.", dns.TypeA))}
+
+	// no server is listening so any attempt to fetch the keys would fail
+	_, err := rr.checkSignatures(context.Background(), m, auth, nil, nil)
+	if err != ErrKeysUnavailableOffline {
+		t.Fatalf("checkSignatures without cached keys didn't return ErrKeysUnavailableOffline: %v", err)
+	}
+
+	cache.Add(&Question{Name: "example.", Type: dns.TypeDNSKEY}, &Answer{Answer: z.sign(z.rrset("example.", dns.TypeDNSKEY))}, true)
+	_, err = rr.checkSignatures(context.Background(), m, auth, nil, []dns.RR{z.key.ToDS(dns.SHA256)})
+	if err != nil {
+		t.Fatalf("checkSignatures failed with cached keys: %s", err)
+	}
+}
+
+func TestRRSetErrorUnknownType(t *testing.T) {
+	e := RRSetError{Name: "a.example.", Type: 65280, Err: ErrNoSignatures}
+	expected := "a.example. TYPE65280: " + ErrNoSignatures.Error()
+	if e.Error() != expected {
+		t.Fatalf("RRSetError with unknown type has wrong message: expected %q, got %q", expected, e.Error())
+	}
+}
+
+func TestVerifyRRSIGClock(t *testing.T) {
+	z := newTestZone(t, "example.", "127.0.0.2", true, "a.example. 300 IN A 1.2.3.4")
+	signedAt := time.Now().Add(-time.Hour * 24 * 30)
+	set := z.rrset("a.example.", dns.TypeA)
+	sig := &dns.RRSIG{
+		Inception:  uint32(signedAt.Add(-time.Hour).Unix()),
+		Expiration: uint32(signedAt.Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+	}
+	if err := sig.Sign(z.signer, set); err != nil {
+		t.Fatalf("Failed to sign RRset: %s", err)
+	}
+	m := &dns.Msg{Answer: append(set, sig)}
+	keyMap := map[uint16]*dns.DNSKEY{z.key.KeyTag(): z.key}
+
+	err := verifyRRSIG(m, keyMap, clock.Default(), nil, nil)
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Failures) != 1 || ve.Failures[0].Err != ErrInvalidSignaturePeriod {
+		t.Fatalf("verifyRRSIG didn't reject expired signature: %v", err)
+	}
+
+	fc := clock.NewFake()
+	fc.Set(signedAt)
+	if err := verifyRRSIG(m, keyMap, fc, nil, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed with clock set inside the validity period: %s", err)
+	}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	oldKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	newKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP384SHA384,
+	}
+	oldPK, err := oldKey.Generate(256)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	newPK, err := newKey.Generate(384)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	keyMap := map[uint16]*dns.DNSKEY{oldKey.KeyTag(): oldKey, newKey.KeyTag(): newKey}
+
+	set := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}}}
+	sign := func(k *dns.DNSKEY, pk crypto.PrivateKey) *dns.RRSIG {
+		sig := &dns.RRSIG{
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:     k.KeyTag(),
+			SignerName: "example.",
+			Algorithm:  k.Algorithm,
+		}
+		if err := sig.Sign(pk.(crypto.Signer), set); err != nil {
+			t.Fatalf("Failed to sign RRset: %s", err)
+		}
+		return sig
+	}
+	oldSig, newSig := sign(oldKey, oldPK), sign(newKey, newPK)
+
+	m := &dns.Msg{Answer: append(set, oldSig)}
+	if err := verifyRRSIG(m, keyMap, clock.Default(), nil, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed: %s", err)
+	}
+	err = verifyAlgorithms(m, keyMap, clock.Default(), nil)
+	ve, ok := err.(*ValidationError)
+	if !ok || len(ve.Failures) != 1 || ve.Failures[0].Err != ErrMissingAlgorithm {
+		t.Fatalf("verifyAlgorithms didn't catch missing algorithm: %v", err)
+	}
+
+	m = &dns.Msg{Answer: append(set, oldSig, newSig)}
+	if err := verifyAlgorithms(m, keyMap, clock.Default(), nil); err != nil {
+		t.Fatalf("verifyAlgorithms failed with signatures for every algorithm: %s", err)
+	}
+
+	// only the algorithms in the DS set are required, and only if the
+	// DNSKEY set contains a key for them
+	ed448DS := &dns.DS{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDS}, Algorithm: 16}
+	missingDS := &dns.DS{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDS}, Algorithm: dns.RSASHA256}
+	required := requiredAlgorithms(keyMap, []dns.RR{oldKey.ToDS(dns.SHA256), newKey.ToDS(dns.SHA256), ed448DS, missingDS}, nil)
+	if len(required) != 2 || required[0] != dns.ECDSAP256SHA256 || required[1] != dns.ECDSAP384SHA384 {
+		t.Fatalf("requiredAlgorithms returned wrong algorithms: %v", required)
+	}
+	if required := requiredAlgorithms(keyMap, []dns.RR{oldKey.ToDS(dns.SHA256)}, nil); len(required) != 1 {
+		t.Fatalf("requiredAlgorithms returned wrong algorithms: %v", required)
+	}
+	if required := requiredAlgorithms(keyMap, []dns.RR{oldKey.ToDS(dns.SHA256), newKey.ToDS(dns.SHA256)}, []uint8{dns.ECDSAP256SHA256}); len(required) != 1 {
+		t.Fatalf("requiredAlgorithms included algorithm that isn't allowed: %v", required)
+	}
+
+	// stripping the signature for one of the required algorithms is caught
+	// whichever one is left
+	for _, sig := range []*dns.RRSIG{oldSig, newSig} {
+		err = verifyRRSIG(&dns.Msg{Answer: append(set, sig)}, keyMap, clock.Default(), nil, required)
+		ve, ok = err.(*ValidationError)
+		if !ok || len(ve.Failures) != 1 || ve.Failures[0].Err != ErrAlgorithmDowngrade {
+			t.Fatalf("verifyRRSIG didn't catch algorithm downgrade: %v", err)
+		}
+	}
+	if err := verifyRRSIG(&dns.Msg{Answer: append(set, newSig, oldSig)}, keyMap, clock.Default(), nil, required); err != nil {
+		t.Fatalf("verifyRRSIG failed with signatures for every required algorithm: %s", err)
+	}
+}
+
+func TestLookupDNSKEYSiblings(t *testing.T) {
+	good := newTestZone(t, "example.", "127.0.0.2", true, "")
+	broken := *good
+	broken.addr = "127.0.0.3"
+	broken.servfail = dns.TypeDNSKEY
+	defer startTestZones(t, good, &broken)()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	auth := &Nameserver{Name: "ns2.example.", Addr: broken.addr, Zone: "example."}
+	_, _, _, err := rr.lookupDNSKEY(context.Background(), auth, nil)
+	if err != ErrBadAnswer {
+		t.Fatalf("lookupDNSKEY didn't return ErrBadAnswer after SERVFAIL: %v", err)
+	}
+
+	siblings := []Nameserver{*auth, {Name: "ns1.example.", Addr: good.addr, Zone: "example."}}
+	keyMap, log, _, err := rr.lookupDNSKEY(context.Background(), auth, siblings)
+	if err != nil {
+		t.Fatalf("lookupDNSKEY failed with a working sibling nameserver: %s", err)
+	}
+	if _, present := keyMap[good.key.KeyTag()]; !present {
+		t.Fatal("lookupDNSKEY returned keyMap missing key from sibling nameserver")
+	}
+	if log.NS.Addr != good.addr || len(log.Composites) != 1 || log.Composites[0].NS.Addr != broken.addr {
+		t.Fatal("lookupDNSKEY log doesn't record failed attempt before sibling nameserver")
+	}
+}
+
+func TestLookupDNSKEYMissing(t *testing.T) {
+	withoutKeys := func(addr string, nsec bool) *testZone {
+		z := newTestZone(t, "example.", addr, true, "www.example. 300 IN A 1.2.3.4")
+		z.records = z.rrset("www.example.", dns.TypeA)
+		z.nsec = nsec
+		return z
+	}
+	denied := withoutKeys("127.0.0.2", true)
+	empty := withoutKeys("127.0.0.3", false)
+	servfail := newTestZone(t, "example.", "127.0.0.4", true, "")
+	servfail.servfail = dns.TypeDNSKEY
+	defer startTestZones(t, denied, empty, servfail)()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	for _, tc := range []struct {
+		addr string
+		err  error
+	}{
+		{denied.addr, ErrDNSKEYDenied},
+		{empty.addr, ErrNoDNSKEY},
+		{servfail.addr, ErrBadAnswer},
+	} {
+		auth := &Nameserver{Name: "ns.example.", Addr: tc.addr, Zone: "example."}
+		_, _, _, err := rr.lookupDNSKEY(context.Background(), auth, nil)
+		if err != tc.err {
+			t.Fatalf("lookupDNSKEY against %s returned wrong error, expected %q: %v", tc.addr, tc.err, err)
+		}
+	}
+
+	// nothing is listening, so the query fails with a transport error
+	auth := &Nameserver{Name: "ns.example.", Addr: "127.0.0.5", Zone: "example."}
+	_, _, _, err := rr.lookupDNSKEY(context.Background(), auth, nil)
+	if err == nil || err == ErrNoDNSKEY || err == ErrDNSKEYDenied || err == ErrBadAnswer {
+		t.Fatalf("lookupDNSKEY didn't return transport error: %v", err)
+	}
+	if errorCode(err, false) != CodeNetwork {
+		t.Fatalf("lookupDNSKEY transport error isn't a network error: %v", err)
+	}
+}
+
+func TestLookupDNSKEYTooMany(t *testing.T) {
+	z := newTestZone(t, "example.", "127.0.0.2", true, "")
+	for i := 0; i < 4; i++ {
+		k := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     256,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		if _, err := k.Generate(256); err != nil {
+			t.Fatalf("Failed to generate key: %s", err)
+		}
+		z.records = append(z.records, k)
+	}
+	defer startTestZones(t, z)()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	auth := &Nameserver{Name: "ns.example.", Addr: z.addr, Zone: "example."}
+	keyMap, log, _, err := rr.lookupDNSKEY(context.Background(), auth, nil)
+	if err != nil {
+		t.Fatalf("lookupDNSKEY failed with DNSKEY set under limit: %s", err)
+	}
+	if len(keyMap) != 5 || log.DNSKEYCount != 5 {
+		t.Fatalf("lookupDNSKEY returned wrong number of keys: %d, logged %d", len(keyMap), log.DNSKEYCount)
+	}
+
+	rr.MaxDNSKEYs = 4
+	_, log, _, err = rr.lookupDNSKEY(context.Background(), auth, nil)
+	if err != ErrTooManyDNSKEYs {
+		t.Fatalf("lookupDNSKEY didn't reject DNSKEY set over limit: %v", err)
+	}
+	if log.DNSKEYCount != 5 || log.Error != ErrTooManyDNSKEYs.Error() {
+		t.Fatalf("lookupDNSKEY didn't log oversized DNSKEY set: %d %q", log.DNSKEYCount, log.Error)
+	}
+}
+
+func TestSignalAlgorithms(t *testing.T) {
+	dnsPort = "9053"
+	mu := new(sync.Mutex)
+	var received []dns.EDNS0
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		received = nil
+		if opt := r.IsEdns0(); opt != nil {
+			received = opt.Option
+		}
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(4096, true)
+		w.WriteMsg(m)
+	}
+	s := &dns.Server{Addr: net.JoinHostPort("127.0.0.2", dnsPort), Net: "udp", Handler: dns.HandlerFunc(handler), ReadTimeout: time.Second}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	q := &Question{Name: "example.", Type: dns.TypeA}
+	auth := &Nameserver{Addr: "127.0.0.2", Zone: "."}
+	if _, _, err := rr.query(context.Background(), q, auth, LookupOptions{}); err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	mu.Lock()
+	if len(received) != 0 {
+		t.Fatalf("query sent options without SignalAlgorithms set: %s", received)
+	}
+	mu.Unlock()
+
+	rr.SignalAlgorithms = true
+	if _, _, err := rr.query(context.Background(), q, auth, LookupOptions{}); err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	mu.Lock()
+	expected := map[uint16]string{
+		dns.EDNS0DAU: "\x05\x07\x08\x0a\x0d\x0e\x0f",
+		dns.EDNS0DHU: "\x01\x02\x04",
+		dns.EDNS0N3U: "\x01",
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("query sent wrong options: %s", received)
+	}
+	for _, o := range received {
+		var codes []uint8
+		switch e := o.(type) {
+		case *dns.EDNS0_DAU:
+			codes = e.AlgCode
+		case *dns.EDNS0_DHU:
+			codes = e.AlgCode
+		case *dns.EDNS0_N3U:
+			codes = e.AlgCode
+		}
+		if string(codes) != expected[o.Option()] {
+			t.Fatalf("query sent wrong codes for option %d: %v", o.Option(), codes)
+		}
+	}
+	mu.Unlock()
+
+	// only the allowed algorithms are signalled
+	rr.AllowedAlgorithms = []uint8{dns.RSASHA1, dns.ECDSAP256SHA256, dns.RSAMD5}
+	if _, _, err := rr.query(context.Background(), q, auth, LookupOptions{}); err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var dau *dns.EDNS0_DAU
+	for _, o := range received {
+		if e, ok := o.(*dns.EDNS0_DAU); ok {
+			dau = e
+		}
+	}
+	if dau == nil || string(dau.AlgCode) != "\x05\x0d" {
+		t.Fatalf("query sent wrong DAU option with AllowedAlgorithms set: %v", dau)
+	}
+}
+
+func TestVerifyDS(t *testing.T) {
+	keys := map[string]*dns.DNSKEY{}
+	signers := map[string]crypto.Signer{}
+	for _, zone := range []string{".", "org."} {
+		k := &dns.DNSKEY{Hdr: dns.RR_Header{Name: zone, Class: dns.ClassINET}, Algorithm: dns.ECDSAP256SHA256, Protocol: 3}
+		pk, err := k.Generate(256)
+		if err != nil {
+			t.Fatalf("Failed to generate DNSKEY: %s", err)
+		}
+		keys[zone], signers[zone] = k, pk.(crypto.Signer)
+	}
+	sign := func(zone string, set ...dns.RR) *dns.RRSIG {
+		sig := &dns.RRSIG{
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			KeyTag:     keys[zone].KeyTag(),
+			SignerName: zone,
+			Algorithm:  dns.ECDSAP256SHA256,
+		}
+		if err := sig.Sign(signers[zone], set); err != nil {
+			t.Fatalf("Failed to sign RRset: %s", err)
+		}
+		return sig
+	}
+	orgKeys := map[uint16]*dns.DNSKEY{keys["org."].KeyTag(): keys["org."]}
+	rootKeys := map[uint16]*dns.DNSKEY{keys["."].KeyTag(): keys["."]}
+
+	ds := &dns.DS{Hdr: dns.RR_Header{Name: "child.org.", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 1, Algorithm: dns.ECDSAP256SHA256, DigestType: dns.SHA256, Digest: "aa"}
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: "child.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.child.org."}
+	if err := verifyDS(&dns.Msg{Ns: []dns.RR{ns, ds, sign("org.", ds)}}, "org.", orgKeys, clock.Default()); err != nil {
+		t.Fatalf("verifyDS failed for DS signed by the parent: %s", err)
+	}
+	// a referral without any DS records is left to verifyDelegation
+	if err := verifyDS(&dns.Msg{Ns: []dns.RR{ns}}, "org.", orgKeys, clock.Default()); err != nil {
+		t.Fatalf("verifyDS failed for referral without DS records: %s", err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		ns   []dns.RR
+		keys map[uint16]*dns.DNSKEY
+	}{
+		{"forged unsigned DS", []dns.RR{ns, ds}, orgKeys},
+		{"DS with invalid signature", []dns.RR{ns, ds, sign("org.", ns)}, orgKeys},
+		{"DS signed by a ancestor of the parent", []dns.RR{ns, ds, sign(".", ds)}, rootKeys},
+	} {
+		err := verifyDS(&dns.Msg{Ns: tc.ns}, "org.", tc.keys, clock.Default())
+		ve, ok := err.(*ValidationError)
+		if !ok || len(ve.Failures) != 1 || ve.Failures[0].Type != dns.TypeDS || ve.Failures[0].Err != ErrUnsignedDS {
+			t.Fatalf("verifyDS didn't reject %s: %v", tc.desc, err)
+		}
+	}
+}
+
+func TestLookupForgedDS(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	root.unsignedDS = true
+	defer startTestZones(t, root, example)()
+
+	_, ll, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Failures) == 0 || ve.Failures[0].Err != ErrUnsignedDS {
+		t.Fatalf("Lookup didn't reject unsigned DS in referral: %v", err)
+	}
+	if !ll.Bogus {
+		t.Fatal("Lookup with unsigned DS in referral wasn't marked bogus")
+	}
+}
+
+func TestLookupDSAlgorithms(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	// the zone publishes a key, and a DS record, for a second algorithm but
+	// only signs with the first
+	unused := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP384SHA384,
+	}
+	if _, err := unused.Generate(384); err != nil {
+		t.Fatalf("Failed to generate DNSKEY: %s", err)
+	}
+	example.records = append(example.records, unused)
+	root.delegate(example)
+	root.records = append(root.records, unused.ToDS(dns.SHA256))
+	defer startTestZones(t, root, example)()
+
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	if _, _, err := newTestResolver(root, nil).Lookup(context.Background(), q); err != nil {
+		t.Fatalf("Lookup without StrictAlgorithms failed: %s", err)
+	}
+
+	rr := newTestResolver(root, nil)
+	rr.StrictAlgorithms = true
+	_, _, err := rr.Lookup(context.Background(), q)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Failures) == 0 ||
+		(ve.Failures[0].Err != ErrAlgorithmDowngrade && ve.Failures[0].Err != ErrMissingAlgorithm) {
+		t.Fatalf("Lookup with StrictAlgorithms didn't catch missing algorithm: %v", err)
+	}
+}
+
+func TestLookupTrustAnchor(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	root.nsec = true
+	example := newTestZone(t, "example.", "127.0.0.3", false, "")
+	corp := newTestZone(t, "corp.example.", "127.0.0.4", true, "a.corp.example. 300 IN A 1.2.3.4")
+	other := newTestZone(t, "corp.example.", "127.0.0.4", true, "")
+	root.delegate(example)
+	example.delegate(corp)
+	defer startTestZones(t, root, example, corp)()
+
+	q := Question{Name: "a.corp.example.", Type: dns.TypeA}
+	rr := newTestResolver(root, nil)
+	answer, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup without trust anchor failed: %s", err)
+	}
+	if answer.Authenticated {
+		t.Fatal("Answer below insecure delegation was authenticated without trust anchor")
+	}
+
+	rr = newTestResolver(root, nil)
+	if err := rr.AddTrustAnchor("CORP.EXAMPLE", []dns.RR{corp.key.ToDS(dns.SHA256)}); err != nil {
+		t.Fatalf("AddTrustAnchor failed: %s", err)
+	}
+	answer, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup with trust anchor failed: %s", err)
+	}
+	if !answer.Authenticated || !ll.DNSSECValid {
+		t.Fatal("Answer from zone with trust anchor wasn't authenticated")
+	}
+
+	rr = newTestResolver(root, nil)
+	if err := rr.AddTrustAnchor("corp.example.", []dns.RR{other.key.ToDS(dns.SHA256)}); err != nil {
+		t.Fatalf("AddTrustAnchor failed: %s", err)
+	}
+	if _, _, err = rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup with trust anchor for a different key didn't fail validation")
+	}
+
+	if err := rr.AddTrustAnchor("example.", []dns.RR{corp.key.ToDS(dns.SHA256)}); err != ErrInvalidTrustAnchor {
+		t.Fatalf("AddTrustAnchor with DS for another zone didn't fail: %v", err)
+	}
+	if err := rr.AddTrustAnchor("corp.example.", []dns.RR{corp.key}); err != ErrInvalidTrustAnchor {
+		t.Fatalf("AddTrustAnchor with non-DS record didn't fail: %v", err)
+	}
+}
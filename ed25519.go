@@ -0,0 +1,147 @@
+package solvere
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// AlgorithmED25519 is the DNSSEC algorithm number for Ed25519 (RFC 8080),
+// which the dns package doesn't define or support
+const AlgorithmED25519 uint8 = 15
+
+// signatureRdata returns the uncompressed wire format RDATA of a record in
+// the canonical form used to construct signatures, with the names embedded
+// in the types listed in RFC 4034 Section 6.2, as corrected by RFC 6840
+// Section 5.1 to exclude NSEC, lowercased
+func signatureRdata(r dns.RR) []byte {
+	r = dns.Copy(r)
+	switch rr := r.(type) {
+	case *dns.NS:
+		rr.Ns = strings.ToLower(rr.Ns)
+	case *dns.MD:
+		rr.Md = strings.ToLower(rr.Md)
+	case *dns.MF:
+		rr.Mf = strings.ToLower(rr.Mf)
+	case *dns.CNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.SOA:
+		rr.Ns = strings.ToLower(rr.Ns)
+		rr.Mbox = strings.ToLower(rr.Mbox)
+	case *dns.MB:
+		rr.Mb = strings.ToLower(rr.Mb)
+	case *dns.MG:
+		rr.Mg = strings.ToLower(rr.Mg)
+	case *dns.MR:
+		rr.Mr = strings.ToLower(rr.Mr)
+	case *dns.PTR:
+		rr.Ptr = strings.ToLower(rr.Ptr)
+	case *dns.MINFO:
+		rr.Rmail = strings.ToLower(rr.Rmail)
+		rr.Email = strings.ToLower(rr.Email)
+	case *dns.MX:
+		rr.Mx = strings.ToLower(rr.Mx)
+	case *dns.RP:
+		rr.Mbox = strings.ToLower(rr.Mbox)
+		rr.Txt = strings.ToLower(rr.Txt)
+	case *dns.AFSDB:
+		rr.Hostname = strings.ToLower(rr.Hostname)
+	case *dns.RT:
+		rr.Host = strings.ToLower(rr.Host)
+	case *dns.SIG:
+		rr.SignerName = strings.ToLower(rr.SignerName)
+	case *dns.PX:
+		rr.Map822 = strings.ToLower(rr.Map822)
+		rr.Mapx400 = strings.ToLower(rr.Mapx400)
+	case *dns.NAPTR:
+		rr.Replacement = strings.ToLower(rr.Replacement)
+	case *dns.KX:
+		rr.Exchanger = strings.ToLower(rr.Exchanger)
+	case *dns.SRV:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.DNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.RRSIG:
+		rr.SignerName = strings.ToLower(rr.SignerName)
+	}
+	return packRdata(r)
+}
+
+// signedData reconstructs the data covered by sig from the RRSIG RDATA,
+// without the signature, followed by each of the records of rrset in
+// canonical form and order (RFC 4034 Section 3.1.8.1)
+func signedData(sig *dns.RRSIG, rrset []dns.RR) ([]byte, error) {
+	s := dns.Copy(sig).(*dns.RRSIG)
+	s.Signature = ""
+	data := signatureRdata(s)
+
+	wires := make([][]byte, 0, len(rrset))
+	for _, r := range rrset {
+		labels := dns.SplitDomainName(r.Header().Name)
+		if len(labels) < int(sig.Labels) {
+			return nil, dns.ErrRRset
+		}
+		owner := r.Header().Name
+		if len(labels) > int(sig.Labels) {
+			// the record was expanded from a wildcard
+			owner = "*." + strings.Join(labels[len(labels)-int(sig.Labels):], ".") + "."
+		}
+		name := make([]byte, 256)
+		off, err := dns.PackDomainName(dns.Fqdn(strings.ToLower(owner)), name, 0, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		rdata := signatureRdata(r)
+		wire := make([]byte, off+10, off+10+len(rdata))
+		copy(wire, name[:off])
+		binary.BigEndian.PutUint16(wire[off:], r.Header().Rrtype)
+		binary.BigEndian.PutUint16(wire[off+2:], r.Header().Class)
+		binary.BigEndian.PutUint32(wire[off+4:], sig.OrigTtl)
+		binary.BigEndian.PutUint16(wire[off+8:], uint16(len(rdata)))
+		wires = append(wires, append(wire, rdata...))
+	}
+	// every record has the same owner name, type, class, and TTL so they
+	// sort by their RDATA
+	sort.Slice(wires, func(i, j int) bool { return bytes.Compare(wires[i], wires[j]) < 0 })
+	for i, wire := range wires {
+		if i > 0 && bytes.Equal(wire, wires[i-1]) {
+			continue
+		}
+		data = append(data, wire...)
+	}
+	return data, nil
+}
+
+// verifyEd25519 checks that sig is a valid Ed25519 signature over rrset made
+// by key, performing the same checks as dns.RRSIG.Verify does for the
+// algorithms it supports. The validity period of sig isn't checked.
+func verifyEd25519(sig *dns.RRSIG, key *dns.DNSKEY, rrset []dns.RR) error {
+	if !dns.IsRRset(rrset) || rrset[0].Header().Class != sig.Hdr.Class || rrset[0].Header().Rrtype != sig.TypeCovered {
+		return dns.ErrRRset
+	}
+	if sig.KeyTag != key.KeyTag() || sig.Hdr.Class != key.Hdr.Class || sig.Algorithm != key.Algorithm ||
+		!strings.EqualFold(sig.SignerName, key.Hdr.Name) || key.Protocol != 3 {
+		return dns.ErrKey
+	}
+	pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return dns.ErrKey
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return dns.ErrSig
+	}
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, signature) {
+		return dns.ErrSig
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package solvere
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+// signEd25519 signs rrset with a Ed25519 key, which dns.RRSIG.Sign doesn't
+// support
+func signEd25519(t *testing.T, key *dns.DNSKEY, pk ed25519.PrivateKey, rrset []dns.RR) *dns.RRSIG {
+	t.Helper()
+	labels := uint8(dns.CountLabel(rrset[0].Header().Name))
+	if rrset[0].Header().Name[0] == '*' {
+		labels--
+	}
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		TypeCovered: rrset[0].Header().Rrtype,
+		Algorithm:   AlgorithmED25519,
+		Labels:      labels,
+		OrigTtl:     rrset[0].Header().Ttl,
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:      key.KeyTag(),
+		SignerName:  key.Hdr.Name,
+	}
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		t.Fatalf("Failed to build signed data: %s", err)
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(pk, data))
+	return sig
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	pub, pk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: AlgorithmED25519,
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+	keyMap := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+	set := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}},
+		&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 5}},
+	}
+	sig := signEd25519(t, key, pk, set)
+
+	// the records are verified in canonical order regardless of the order
+	// they are received in, and names are compared case insensitively
+	reordered := []dns.RR{dns.Copy(set[1]), dns.Copy(set[0])}
+	reordered[0].Header().Name = "A.Example."
+	reordered[1].Header().Name = "A.Example."
+	if err := verifyEd25519(sig, key, reordered); err != nil {
+		t.Fatalf("verifyEd25519 failed with reordered RRset: %s", err)
+	}
+
+	if err := verifyRRSIG(&dns.Msg{Answer: append(set, sig)}, keyMap, clock.Default(), nil, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed with every algorithm allowed: %s", err)
+	}
+	allowed := []uint8{dns.RSASHA256, dns.ECDSAP256SHA256, AlgorithmED25519}
+	if err := verifyRRSIG(&dns.Msg{Answer: append(set, sig)}, keyMap, clock.Default(), allowed, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed with Ed25519 allowed: %s", err)
+	}
+
+	err = verifyRRSIG(&dns.Msg{Answer: append(set, sig)}, keyMap, clock.Default(), []uint8{dns.RSASHA256, dns.ECDSAP256SHA256}, nil)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Failures) != 1 || ve.Failures[0].Err != ErrNoSupportedAlgorithm {
+		t.Fatalf("verifyRRSIG didn't fail with ErrNoSupportedAlgorithm with Ed25519 disallowed: %v", err)
+	}
+	if code, ok := ExtendedErrorCode(err); !ok || code != EDEUnsupportedDNSKEYAlgo {
+		t.Fatalf("ExtendedErrorCode returned wrong code: %d", code)
+	}
+
+	tampered := dns.Copy(set[0]).(*dns.A)
+	tampered.A = net.IP{1, 2, 3, 6}
+	err = verifyRRSIG(&dns.Msg{Answer: []dns.RR{tampered, set[1], sig}}, keyMap, clock.Default(), allowed, nil)
+	if !errors.As(err, &ve) || len(ve.Failures) != 1 || ve.Failures[0].Err != dns.ErrSig {
+		t.Fatalf("verifyRRSIG didn't fail with ErrSig for a modified RRset: %v", err)
+	}
+
+	// a answer expanded from a wildcard is verified against the wildcard
+	// owner name
+	wildcard := []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "*.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: []string{"hi"}}}
+	wildcardSig := signEd25519(t, key, pk, wildcard)
+	expanded := dns.Copy(wildcard[0])
+	expanded.Header().Name = "b.example."
+	if err := verifyEd25519(wildcardSig, key, []dns.RR{expanded}); err != nil {
+		t.Fatalf("verifyEd25519 failed with expanded wildcard: %s", err)
+	}
+}
+
+func TestSignatureRdata(t *testing.T) {
+	zone := `a.example. 300 IN NSEC B.Example. A RRSIG NSEC
+a.example. 300 IN RP Mbox.Example. Txt.Example.
+a.example. 300 IN NAPTR 100 10 "s" "sip+d2u" "" _Sip._Udp.Example.
+a.example. 300 IN KX 10 Kx.Example.
+a.example. 300 IN AFSDB 1 Afs.Example.
+a.example. 300 IN MX 10 Mail.Example.`
+	records, lowered := zoneToRecords(t, zone), zoneToRecords(t, strings.ToLower(zone))
+	for i, r := range records {
+		rdata, lowerRdata := signatureRdata(r), signatureRdata(lowered[i])
+		if r.Header().Rrtype == dns.TypeNSEC {
+			// the next domain name of NSEC records isn't lowercased (RFC
+			// 6840 Section 5.1)
+			if bytes.Equal(rdata, lowerRdata) {
+				t.Fatal("signatureRdata lowercased the next domain name of a NSEC record")
+			}
+			continue
+		}
+		if !bytes.Equal(rdata, lowerRdata) {
+			t.Fatalf("signatureRdata didn't lowercase the names in %s", r)
+		}
+	}
+}
+
+func TestVerifyRRSIGDisallowedAlgorithm(t *testing.T) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.RSASHA1,
+	}
+	pk, err := key.Generate(1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	pub, edPK, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	edKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: AlgorithmED25519,
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}
+	keyMap := map[uint16]*dns.DNSKEY{key.KeyTag(): key, edKey.KeyTag(): edKey}
+
+	set := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{1, 2, 3, 4}}}
+	sig := &dns.RRSIG{
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: "example.",
+		Algorithm:  dns.RSASHA1,
+	}
+	if err := sig.Sign(pk.(*rsa.PrivateKey), set); err != nil {
+		t.Fatalf("Failed to sign RRset: %s", err)
+	}
+	edSig := signEd25519(t, edKey, edPK, set)
+	allowed := []uint8{dns.RSASHA256, dns.ECDSAP256SHA256, AlgorithmED25519}
+
+	// the disallowed RSASHA1 signature is skipped in favour of the Ed25519
+	// one, even with StrictAlgorithms
+	m := &dns.Msg{Answer: append(set, sig, edSig)}
+	if err := verifyRRSIG(m, keyMap, clock.Default(), allowed, nil); err != nil {
+		t.Fatalf("verifyRRSIG failed with a allowed signature: %s", err)
+	}
+	if err := verifyAlgorithms(m, keyMap, clock.Default(), allowed); err != nil {
+		t.Fatalf("verifyAlgorithms required a disallowed algorithm: %s", err)
+	}
+
+	m = &dns.Msg{Answer: append(set, sig)}
+	err = verifyRRSIG(m, keyMap, clock.Default(), allowed, nil)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Failures) != 1 || ve.Failures[0].Err != ErrNoSupportedAlgorithm {
+		t.Fatalf("verifyRRSIG didn't fail with ErrNoSupportedAlgorithm: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package solvere
+
+import (
+	"github.com/miekg/dns"
+)
+
+// EDNS0EDE is the EDNS0 option code for extended DNS errors (RFC 8914)
+const EDNS0EDE = 15
+
+// Extended DNS error info codes (RFC 8914 Section 4)
+const (
+	EDEOther                 uint16 = 0
+	EDEUnsupportedDNSKEYAlgo uint16 = 1
+	EDEUnsupportedDSDigest   uint16 = 2
+	EDEStaleAnswer           uint16 = 3
+	EDEDNSSECIndeterminate   uint16 = 5
+	EDEDNSSECBogus           uint16 = 6
+	EDESignatureExpired      uint16 = 7
+	EDEDNSKEYMissing         uint16 = 9
+	EDERRSIGsMissing         uint16 = 10
+	EDENSECMissing           uint16 = 12
+	EDECachedError           uint16 = 13
+	EDENotAuthoritative      uint16 = 20
+	EDENoReachableAuthority  uint16 = 22
+	// EDEUnsupportedNSEC3Iterations is defined by RFC 9276 Section 3.2
+	EDEUnsupportedNSEC3Iterations uint16 = 27
+)
+
+// errorCodes maps the errors returned by validation and lookups to the
+// extended DNS error info code that best describes them
+var errorCodes = map[error]uint16{
+	ErrNoDNSKEY:               EDEDNSKEYMissing,
+	ErrMissingDNSKEY:          EDEDNSKEYMissing,
+	ErrMissingKSK:             EDEDNSKEYMissing,
+	ErrBadAnswer:              EDEDNSKEYMissing,
+	ErrFailedToConvertKSK:     EDEUnsupportedDSDigest,
+	ErrMismatchingDS:          EDEDNSSECBogus,
+	ErrMismatchingKeyTag:      EDEDNSSECBogus,
+	ErrNoSignatures:           EDERRSIGsMissing,
+	ErrMissingAlgorithm:       EDERRSIGsMissing,
+	ErrMissingSigned:          EDEDNSSECBogus,
+	ErrUntrustedSigner:        EDEDNSSECBogus,
+	ErrUnsignedDS:             EDEDNSSECBogus,
+	ErrNoSupportedAlgorithm:   EDEUnsupportedDNSKEYAlgo,
+	ErrDNSKEYDenied:           EDEDNSKEYMissing,
+	ErrTooManyDNSKEYs:         EDEDNSSECBogus,
+	ErrAlgorithmDowngrade:     EDEDNSSECBogus,
+	ErrKeysUnavailableOffline: EDEDNSSECIndeterminate,
+	// the validity period of a signature is only checked once it has been
+	// verified, so this is almost always a expired signature rather than one
+	// that isn't valid yet
+	ErrInvalidSignaturePeriod: EDESignatureExpired,
+	ErrEDNSDowngrade:          EDEDNSSECBogus,
+	dns.ErrSig:                EDEDNSSECBogus,
+	dns.ErrKey:                EDEDNSSECBogus,
+	dns.ErrAlg:                EDEUnsupportedDNSKEYAlgo,
+
+	ErrNSECMissingCoverage:    EDENSECMissing,
+	ErrNSECMismatch:           EDEDNSSECBogus,
+	ErrNSECTypeExists:         EDEDNSSECBogus,
+	ErrNSECMultipleCoverage:   EDEDNSSECBogus,
+	ErrNSECBadDelegation:      EDEDNSSECBogus,
+	ErrNSECNSMissing:          EDEDNSSECBogus,
+	ErrNSECOptOut:             EDEDNSSECBogus,
+	ErrMalformedNSEC3:         EDEDNSSECBogus,
+	ErrNSEC3IterationsTooHigh: EDEUnsupportedNSEC3Iterations,
+	ErrNSEC3UnknownHash:       EDEDNSSECIndeterminate,
+
+	ErrBogusCached:      EDECachedError,
+	ErrNotAuthoritative: EDENotAuthoritative,
+	ErrLameNameserver:   EDENotAuthoritative,
+}
+
+// ExtendedErrorCode returns the extended DNS error info code that describes
+// a error returned by Lookup, if there is one. A ResolveError is described by
+// the error it wraps. For a ValidationError the code describing its first
+// failure is returned.
+func ExtendedErrorCode(err error) (uint16, bool) {
+	switch e := err.(type) {
+	case *ResolveError:
+		return ExtendedErrorCode(e.Err)
+	case *AuthorityError:
+		return EDENoReachableAuthority, true
+	case *ValidationError:
+		if len(e.Failures) == 0 {
+			return EDEDNSSECBogus, true
+		}
+		if code, present := errorCodes[e.Failures[0].Err]; present {
+			return code, true
+		}
+		return EDEDNSSECBogus, true
+	}
+	code, present := errorCodes[err]
+	return code, present
+}
+
+// ExtendedError is a extended DNS error (RFC 8914), Text is the optional
+// extra text describing it
+type ExtendedError struct {
+	Code uint16
+	Text string `json:",omitempty"`
+}
+
+// extendedErrorText is the extra text sent with each info code, the
+// descriptions from RFC 8914 Section 4. The text of the error itself isn't
+// used since it can include details, such as the addresses of nameservers,
+// that shouldn't be exposed to clients.
+var extendedErrorText = map[uint16]string{
+	EDEOther:                      "Other Error",
+	EDEUnsupportedDNSKEYAlgo:      "Unsupported DNSKEY Algorithm",
+	EDEUnsupportedDSDigest:        "Unsupported DS Digest Type",
+	EDEStaleAnswer:                "Stale Answer",
+	EDEDNSSECIndeterminate:        "DNSSEC Indeterminate",
+	EDEDNSSECBogus:                "DNSSEC Bogus",
+	EDESignatureExpired:           "Signature Expired",
+	EDEDNSKEYMissing:              "DNSKEY Missing",
+	EDERRSIGsMissing:              "RRSIGs Missing",
+	EDENSECMissing:                "NSEC Missing",
+	EDECachedError:                "Cached Error",
+	EDENotAuthoritative:           "Not Authoritative",
+	EDENoReachableAuthority:       "No Reachable Authority",
+	EDEUnsupportedNSEC3Iterations: "Unsupported NSEC3 Iterations Value",
+}
+
+// newExtendedError returns a ExtendedError describing err, if it has a info
+// code, with the fixed description of the code as the extra text
+func newExtendedError(err error) *ExtendedError {
+	code, ok := ExtendedErrorCode(err)
+	if !ok {
+		return nil
+	}
+	return &ExtendedError{Code: code, Text: extendedErrorText[code]}
+}
+
+// Option returns the error as a EDNS0 option, see ExtendedErrorOption
+func (ee *ExtendedError) Option() dns.EDNS0 {
+	return ExtendedErrorOption(ee.Code, ee.Text)
+}
+
+// ExtendedErrorOption returns a EDNS0 option containing a extended DNS error
+// with the info code and extra text. The option is returned as a
+// dns.EDNS0_LOCAL since it isn't supported by the dns package.
+func ExtendedErrorOption(code uint16, text string) dns.EDNS0 {
+	return &dns.EDNS0_LOCAL{Code: EDNS0EDE, Data: append([]byte{byte(code >> 8), byte(code)}, text...)}
+}
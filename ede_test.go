@@ -0,0 +1,85 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExtendedErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code uint16
+	}{
+		{&AuthorityError{Zone: "example.", Err: ErrNoAuthorityAddress}, EDENoReachableAuthority},
+		{ErrNoDNSKEY, EDEDNSKEYMissing},
+		{ErrFailedToConvertKSK, EDEUnsupportedDSDigest},
+		{ErrMismatchingDS, EDEDNSSECBogus},
+		{ErrNoSignatures, EDERRSIGsMissing},
+		{ErrKeysUnavailableOffline, EDEDNSSECIndeterminate},
+		{ErrInvalidSignaturePeriod, EDESignatureExpired},
+		{dns.ErrAlg, EDEUnsupportedDNSKEYAlgo},
+		{ErrNSECMissingCoverage, EDENSECMissing},
+		{ErrNSECMultipleCoverage, EDEDNSSECBogus},
+		{ErrNSECOptOut, EDEDNSSECBogus},
+		{ErrBogusCached, EDECachedError},
+		{ErrNotAuthoritative, EDENotAuthoritative},
+		{&ValidationError{Failures: []RRSetError{{"example.", dns.TypeA, ErrInvalidSignaturePeriod}}}, EDESignatureExpired},
+		{&ValidationError{Failures: []RRSetError{{"example.", dns.TypeA, errors.New("unknown")}}}, EDEDNSSECBogus},
+	} {
+		code, ok := ExtendedErrorCode(tc.err)
+		if !ok {
+			t.Fatalf("ExtendedErrorCode didn't return a code for %q", tc.err)
+		}
+		if code != tc.code {
+			t.Fatalf("ExtendedErrorCode returned %d for %q, expected %d", code, tc.err, tc.code)
+		}
+	}
+
+	if _, ok := ExtendedErrorCode(errors.New("unknown")); ok {
+		t.Fatal("ExtendedErrorCode returned a code for a unknown error")
+	}
+
+	// every error in the mapping should have a code other than EDEOther,
+	// otherwise it is no more descriptive than not attaching one, and the
+	// code should have a description
+	for err, code := range errorCodes {
+		if code == EDEOther {
+			t.Fatalf("%q is mapped to EDEOther", err)
+		}
+		if extendedErrorText[code] == "" {
+			t.Fatalf("%q is mapped to code %d which has no text", err, code)
+		}
+	}
+}
+
+func TestLookupExtendedError(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.corrupt = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err == nil {
+		t.Fatal("Lookup in corrupt zone didn't fail validation")
+	}
+	if answer == nil || answer.Rcode != dns.RcodeServerFailure {
+		t.Fatal("Failed lookup didn't return a SERVFAIL answer")
+	}
+	code, _ := ExtendedErrorCode(err)
+	if answer.ExtendedError == nil || answer.ExtendedError.Code != code || answer.ExtendedError.Text != "DNSSEC Bogus" {
+		t.Fatalf("Failed lookup answer has wrong extended error: %+v", answer.ExtendedError)
+	}
+	if code != EDEDNSSECBogus {
+		t.Fatalf("Failed validation has wrong extended error code: %d", code)
+	}
+
+	opt, ok := answer.ExtendedError.Option().(*dns.EDNS0_LOCAL)
+	if !ok || opt.Code != EDNS0EDE || opt.Data[0] != 0 || opt.Data[1] != byte(EDEDNSSECBogus) || string(opt.Data[2:]) != "DNSSEC Bogus" {
+		t.Fatalf("ExtendedError returned wrong option: %+v", answer.ExtendedError.Option())
+	}
+}
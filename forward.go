@@ -0,0 +1,355 @@
+package solvere
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// DefaultForwardIdleTimeout is the amount of time a idle connection to a
+	// upstream server is kept open by a PooledExchanger if it doesn't set
+	// IdleTimeout
+	DefaultForwardIdleTimeout = 30 * time.Second
+
+	// DefaultPaddingBlockSize is the block size queries are padded to if
+	// PooledExchanger.PaddingBlockSize isn't set (RFC 8467 Section 4.1)
+	DefaultPaddingBlockSize = 128
+
+	ErrNoUpstreams = errors.New("solvere: No upstream servers configured")
+	// ErrForwardingLoop is returned by ForwardingResolver.Lookup when the
+	// upstream servers forward the query back to the resolver
+	ErrForwardingLoop = errors.New("solvere: Forwarded queries loop back to the resolver")
+)
+
+// edns0Padding is the EDNS0 option code for padding (RFC 7830)
+const edns0Padding = 12
+
+// pad returns a copy of m with a padding option added so that its wire
+// length is a multiple of blockSize. The option is added as a dns.EDNS0_LOCAL
+// since padding isn't supported by the dns package.
+func pad(m *dns.Msg, blockSize int) (*dns.Msg, error) {
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(4096, false)
+		opt = m.IsEdns0()
+	}
+	padding := &dns.EDNS0_LOCAL{Code: edns0Padding}
+	opt.Option = append(opt.Option, padding)
+	// pack with a empty option so the length includes its header
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if rem := len(packed) % blockSize; rem != 0 {
+		padding.Data = make([]byte, blockSize-rem)
+	}
+	return m, nil
+}
+
+// Exchanger sends a message to a server and returns its response
+type Exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error)
+}
+
+// clientExchanger sends messages over UDP, retrying over TCP if the response
+// is truncated
+type clientExchanger struct{}
+
+func (ce *clientExchanger) Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	r, err := ce.exchange(ctx, "udp", m, addr)
+	if err == dns.ErrTruncated {
+		r, err = ce.exchange(ctx, "tcp", m, addr)
+	}
+	return r, err
+}
+
+// exchange sends a message to addr over network, giving up when ctx is
+// cancelled or its deadline, or DefaultQueryTimeout, passes. dns.Client
+// doesn't take a context so the connection is managed directly.
+func (ce *clientExchanger) exchange(ctx context.Context, network string, m *dns.Msg, addr string) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(DefaultQueryTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn, err := dns.DialTimeout(network, addr, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if opt := m.IsEdns0(); network == "udp" && opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	// closing the connection unblocks the exchange if ctx is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	r, err := exchangeConn(conn, m, deadline)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r, err
+}
+
+// PooledExchanger sends messages over TCP, or TLS if TLSConfig is set (RFC
+// 7858), keeping a pool of idle connections for each server so they can be
+// reused by later messages
+type PooledExchanger struct {
+	// TLSConfig, if set, is used to establish DNS over TLS connections
+	TLSConfig *tls.Config
+	// IdleTimeout is how long a idle connection is kept open, if it is zero
+	// DefaultForwardIdleTimeout is used
+	IdleTimeout time.Duration
+	// Padding causes queries to be padded to a multiple of PaddingBlockSize
+	// bytes (RFC 7830), or DefaultPaddingBlockSize if it is zero. Padding
+	// only hides the size of queries from observers when TLS is used.
+	Padding          bool
+	PaddingBlockSize int
+	// MaxIdle is the maximum number of idle connections kept open to each
+	// server, if it is zero MaxIdleTCPConns is used
+	MaxIdle int
+
+	poolOnce sync.Once
+	pool     *tcpConnPool
+}
+
+// NewPooledExchanger returns a PooledExchanger that will keep at most maxIdle
+// idle connections open to each server
+func NewPooledExchanger(tlsConfig *tls.Config, maxIdle int) *PooledExchanger {
+	return &PooledExchanger{TLSConfig: tlsConfig, MaxIdle: maxIdle}
+}
+
+// connPool returns the pool of idle connections, creating it on first use so
+// that a PooledExchanger doesn't have to be created by NewPooledExchanger
+func (pe *PooledExchanger) connPool() *tcpConnPool {
+	pe.poolOnce.Do(func() {
+		pe.pool = &tcpConnPool{idle: make(map[string][]idleConn), maxIdle: pe.MaxIdle}
+	})
+	return pe.pool
+}
+
+func (pe *PooledExchanger) dial(addr string) (*dns.Conn, error) {
+	if pe.TLSConfig != nil {
+		return dns.DialTimeoutWithTLS("tcp", addr, pe.TLSConfig, tcpTimeout)
+	}
+	return dns.DialTimeout("tcp", addr, tcpTimeout)
+}
+
+// Exchange sends a message to addr using a idle connection from the pool if
+// one is available, and returns the connection to the pool afterwards
+func (pe *PooledExchanger) Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	deadline := time.Now().Add(tcpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	var r *dns.Msg
+	var err error
+	if pe.Padding {
+		blockSize := pe.PaddingBlockSize
+		if blockSize == 0 {
+			blockSize = DefaultPaddingBlockSize
+		}
+		m, err = pad(m, blockSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn := pe.connPool().get(addr)
+	if conn != nil {
+		r, err = exchangeConn(conn, m, deadline)
+		if err != nil {
+			// the server may have closed the connection between the health
+			// check and sending the message, try again with a fresh one
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn == nil {
+		conn, err = pe.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		r, err = exchangeConn(conn, m, deadline)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	timeout := pe.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultForwardIdleTimeout
+	}
+	pe.connPool().put(addr, conn, timeout)
+	return r, nil
+}
+
+// ForwardingResolver answers questions by forwarding them to a recursive
+// resolver instead of performing the resolution itself
+type ForwardingResolver struct {
+	upstreams []string
+	ex        Exchanger
+	useDNSSEC bool
+
+	loopMu sync.Mutex
+	// inflight are the randomly cased names of the queries being forwarded,
+	// and if they have been seen coming back to the resolver
+	inflight map[string]bool
+}
+
+// NewForwardingResolver returns a ForwardingResolver that sends questions to
+// the upstream addresses, in order, until one responds. If ex is nil messages
+// are sent over UDP. If useDNSSEC is set the DO bit is set on queries and
+// answers are considered authenticated if the upstream sets the AD bit, the
+// upstream and the path to it must be trusted for this to be meaningful.
+func NewForwardingResolver(upstreams []string, ex Exchanger, useDNSSEC bool) *ForwardingResolver {
+	if ex == nil {
+		ex = &clientExchanger{}
+	}
+	return &ForwardingResolver{upstreams: upstreams, ex: ex, useDNSSEC: useDNSSEC}
+}
+
+// CheckLoop checks if the upstream servers forward queries back to the
+// resolver by forwarding a query for a random name. Loops are also detected
+// when they are hit by Lookup, so this is only needed to find them before
+// clients do, such as when the resolver starts. The resolver must be serving
+// clients, such as through a dns.Server, while the check is performed for the
+// query to come back to it. If a loop is found ErrForwardingLoop is returned.
+func (fr *ForwardingResolver) CheckLoop(ctx context.Context) error {
+	name := fmt.Sprintf("%016x.%016x.loop-check.invalid.", mrand.Uint64(), mrand.Uint64())
+	if _, _, err := fr.forward(ctx, Question{Name: name, Type: dns.TypeHINFO}); errors.Is(err, ErrForwardingLoop) {
+		return ErrForwardingLoop
+	}
+	return nil
+}
+
+// randomCase returns name with the case of each letter chosen at random
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if mrand.Intn(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// startForward returns the name to send upstream for qname. The case of the
+// name is randomized so that, as long as the upstream servers preserve it,
+// it can be told apart from queries for the same name from other clients if
+// it comes back to the resolver. If a distinct name can't be found, such as
+// when qname has no letters, qname is returned and the query isn't tracked.
+func (fr *ForwardingResolver) startForward(qname string) (string, bool) {
+	fr.loopMu.Lock()
+	defer fr.loopMu.Unlock()
+	if fr.inflight == nil {
+		fr.inflight = make(map[string]bool)
+	}
+	for i := 0; i < 3; i++ {
+		name := randomCase(qname)
+		if _, present := fr.inflight[name]; name != qname && !present {
+			fr.inflight[name] = false
+			return name, true
+		}
+	}
+	return qname, false
+}
+
+// endForward stops tracking name and returns whether it came back to the
+// resolver
+func (fr *ForwardingResolver) endForward(name string) bool {
+	fr.loopMu.Lock()
+	defer fr.loopMu.Unlock()
+	looped := fr.inflight[name]
+	delete(fr.inflight, name)
+	return looped
+}
+
+// loopedBack checks if the query, with the exact case used, is one that is
+// being forwarded and marks it as having come back to the resolver
+func (fr *ForwardingResolver) loopedBack(q Question) bool {
+	fr.loopMu.Lock()
+	defer fr.loopMu.Unlock()
+	if _, present := fr.inflight[q.Name]; present {
+		fr.inflight[q.Name] = true
+		return true
+	}
+	return false
+}
+
+// Lookup forwards a Question to the upstream servers. If the query comes
+// back to the resolver, because the upstream servers forward to it, Lookup
+// fails with ErrForwardingLoop.
+func (fr *ForwardingResolver) Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	if fr.loopedBack(q) {
+		ll := newLookupLog(&q, nil)
+		ll.Error = ErrForwardingLoop.Error()
+		return nil, ll, newResolveError(ErrForwardingLoop, ll)
+	}
+	return fr.forward(ctx, q)
+}
+
+// forward sends q to each of the upstream servers until one responds
+func (fr *ForwardingResolver) forward(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	ll := newLookupLog(&q, nil)
+	defer func() {
+		ll.Latency = time.Since(ll.Started)
+	}()
+	name, tracked := fr.startForward(q.Name)
+	m := new(dns.Msg)
+	m.SetQuestion(name, q.Type)
+	m.SetEdns0(4096, fr.useDNSSEC)
+	err := ErrNoUpstreams
+	for _, upstream := range fr.upstreams {
+		log := newLookupLog(&q, &Nameserver{Addr: upstream})
+		ll.Composites = append(ll.Composites, log)
+		var r *dns.Msg
+		es := time.Now()
+		r, err = fr.ex.Exchange(ctx, m, upstream)
+		log.ExchangeLatency = time.Since(es)
+		log.Latency = log.ExchangeLatency
+		if tracked && fr.endForward(name) {
+			// try the next upstream with a new name, the query may only
+			// loop through some of them
+			err = ErrForwardingLoop
+			name, tracked = fr.startForward(q.Name)
+			m.Question[0].Name = name
+		}
+		if err != nil {
+			log.Error = err.Error()
+			continue
+		}
+		log.Rcode = r.Rcode
+		log.DNSSECValid = fr.useDNSSEC && r.AuthenticatedData
+		ll.Rcode = log.Rcode
+		ll.DNSSECValid = log.DNSSECValid
+		if tracked {
+			fr.endForward(name)
+		}
+		return extractAnswer(r, log.DNSSECValid), ll, nil
+	}
+	if tracked {
+		fr.endForward(name)
+	}
+	ll.Error = err.Error()
+	return nil, ll, newResolveError(err, ll)
+}
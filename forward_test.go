@@ -0,0 +1,209 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPooledExchangerReuse(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.5", "9053")
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	cl := &countingListener{Listener: l}
+	started := make(chan struct{})
+	s := &dns.Server{
+		Listener:          cl,
+		Handler:           dns.HandlerFunc(truncatingServer),
+		ReadTimeout:       time.Second,
+		IdleTimeout:       func() time.Duration { return time.Millisecond * 200 },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.ActivateAndServe()
+	<-started
+	defer s.Shutdown()
+
+	fr := NewForwardingResolver([]string{addr}, NewPooledExchanger(nil, 1), false)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		a, _, err := fr.Lookup(context.Background(), Question{Name: name, Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("Lookup failed: %s", err)
+		}
+		if len(a.Answer) != 1 {
+			t.Fatalf("Lookup returned wrong answer: %s", a.Answer)
+		}
+	}
+	if cl.count() != 1 {
+		t.Fatalf("Expected forwarded queries to use a single connection, %d were opened", cl.count())
+	}
+
+	// once the server has closed the idle connection a new one should be used
+	time.Sleep(time.Millisecond * 400)
+	_, _, err = fr.Lookup(context.Background(), Question{Name: "d.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed after server closed idle connection: %s", err)
+	}
+	if cl.count() != 2 {
+		t.Fatalf("Expected closed connection to be replaced, %d connections opened", cl.count())
+	}
+
+	// a PooledExchanger that wasn't created by NewPooledExchanger is usable
+	m := new(dns.Msg)
+	m.SetQuestion("e.example.", dns.TypeA)
+	if _, err := (&PooledExchanger{}).Exchange(context.Background(), m, addr); err != nil {
+		t.Fatalf("Exchange with zero value PooledExchanger failed: %s", err)
+	}
+}
+
+func TestClientExchangerContext(t *testing.T) {
+	// the server reads queries but never responds
+	pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.5", "9053"))
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer pc.Close()
+
+	ce := &clientExchanger{}
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+	start := time.Now()
+	if _, err := ce.Exchange(ctx, m, pc.LocalAddr().String()); err != context.Canceled {
+		t.Fatalf("Exchange didn't return context.Canceled after it was cancelled: %v", err)
+	}
+	if time.Since(start) >= DefaultQueryTimeout {
+		t.Fatal("Exchange didn't return until DefaultQueryTimeout passed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start = time.Now()
+	if _, err := ce.Exchange(ctx, m, pc.LocalAddr().String()); err == nil {
+		t.Fatal("Exchange didn't fail after the deadline passed")
+	}
+	if time.Since(start) >= DefaultQueryTimeout {
+		t.Fatal("Exchange didn't return until DefaultQueryTimeout passed")
+	}
+}
+
+func TestPooledExchangerPadding(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.5", "9053")
+	sizes := make(chan int, 1)
+	started := make(chan struct{})
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "tcp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			packed, err := r.Pack()
+			if err != nil {
+				t.Errorf("Failed to pack query: %s", err)
+			}
+			sizes <- len(packed)
+			truncatingServer(w, r)
+		}),
+		ReadTimeout:       time.Millisecond * 200,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	for _, blockSize := range []int{0, 468} {
+		pe := NewPooledExchanger(nil, 1)
+		pe.Padding = true
+		pe.PaddingBlockSize = blockSize
+		fr := NewForwardingResolver([]string{addr}, pe, false)
+		_, _, err := fr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("Lookup failed: %s", err)
+		}
+		if blockSize == 0 {
+			blockSize = DefaultPaddingBlockSize
+		}
+		if size := <-sizes; size != blockSize {
+			t.Fatalf("Padded query has wrong size: expected %d, got %d", blockSize, size)
+		}
+	}
+}
+
+func TestForwardingLoop(t *testing.T) {
+	addr := net.JoinHostPort("127.0.0.5", "9053")
+	fr := NewForwardingResolver([]string{addr}, nil, false)
+	// forward queries back to fr, as a misconfigured upstream would, until
+	// the loop is fixed
+	var fixed int32
+	started := make(chan struct{})
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if atomic.LoadInt32(&fixed) == 1 {
+				m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("1.2.3.4")}}
+				w.WriteMsg(m)
+				return
+			}
+			q := Question{Name: r.Question[0].Name, Type: r.Question[0].Qtype}
+			a, _, err := fr.Lookup(context.Background(), q)
+			if err != nil {
+				m.Rcode = dns.RcodeServerFailure
+			} else {
+				m.Answer = a.Answer
+			}
+			w.WriteMsg(m)
+		}),
+		ReadTimeout:       time.Second,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	if err := fr.CheckLoop(context.Background()); err != ErrForwardingLoop {
+		t.Fatalf("CheckLoop didn't find loop: %v", err)
+	}
+	_, _, err := fr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if !errors.Is(err, ErrForwardingLoop) {
+		t.Fatalf("Lookup that looped didn't fail with ErrForwardingLoop: %v", err)
+	}
+	if re, ok := err.(*ResolveError); !ok || re.Code != CodeLoop {
+		t.Fatalf("Lookup returned wrong error code for loop: %v", err)
+	}
+
+	atomic.StoreInt32(&fixed, 1)
+	if err := fr.CheckLoop(context.Background()); err != nil {
+		t.Fatalf("CheckLoop found loop after it was fixed: %s", err)
+	}
+	answer, _, err := fr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed after loop was fixed: %s", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %v", answer.Answer)
+	}
+}
+
+func TestForwardingConcurrentQueriesNotLoop(t *testing.T) {
+	fr := NewForwardingResolver(nil, nil, false)
+	name, tracked := fr.startForward("a.example.")
+	if !tracked || name == "a.example." {
+		t.Fatal("Forwarded query wasn't given a distinct name")
+	}
+	defer fr.endForward(name)
+	// a query for the same name from another client isn't a loop
+	if fr.loopedBack(Question{Name: "a.example.", Type: dns.TypeA}) {
+		t.Fatal("Query from a client was treated as a loop")
+	}
+	if !fr.loopedBack(Question{Name: name, Type: dns.TypeA}) {
+		t.Fatal("Forwarded query coming back wasn't treated as a loop")
+	}
+}
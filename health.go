@@ -0,0 +1,258 @@
+package solvere
+
+import (
+	mrand "math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// MaxNameserverFailures is the number of consecutive failed queries
+	// after which a nameserver address is considered dead
+	MaxNameserverFailures = 3
+
+	// DeadServerReprobeInterval is how long a dead nameserver address is
+	// skipped for before it will be tried again
+	DeadServerReprobeInterval = 30 * time.Second
+
+	// DefaultQueryTimeout is how long to wait for a UDP response from a
+	// nameserver address that hasn't responded to any queries yet
+	DefaultQueryTimeout = 2 * time.Second
+
+	// MinQueryTimeout and MaxQueryTimeout bound the timeout used for
+	// nameserver addresses with a known RTT, which is three times the RTT,
+	// so that a slow server can be abandoned in favour of another before
+	// the lookup deadline is reached
+	MinQueryTimeout = 50 * time.Millisecond
+	MaxQueryTimeout = 2 * time.Second
+
+	// FailurePenalty is added to the RTT of a nameserver address for each of
+	// its consecutive failures when picking which address to query, until
+	// DeadServerReprobeInterval has passed since the last failure, so that
+	// addresses that have recently failed are only preferred if all of the
+	// alternatives are much slower
+	FailurePenalty = 200 * time.Millisecond
+)
+
+// ServerHealth describes the recent behaviour of a nameserver address
+type ServerHealth struct {
+	Addr                string
+	ConsecutiveFailures int
+	LastSuccess         time.Time `json:",omitempty"`
+	LastFailure         time.Time `json:",omitempty"`
+	// RTT is a exponentially weighted moving average of the time taken for
+	// the server to respond to queries
+	RTT time.Duration
+}
+
+// dead checks if the server has failed too many times in a row and isn't due
+// to be tried again yet
+func (sh *ServerHealth) dead(now time.Time) bool {
+	return sh.ConsecutiveFailures >= MaxNameserverFailures && now.Sub(sh.LastFailure) < DeadServerReprobeInterval
+}
+
+// penalized returns the RTT of the server with FailurePenalty added for each
+// of its consecutive failures, if it has failed recently
+func (sh *ServerHealth) penalized(now time.Time) time.Duration {
+	if sh.ConsecutiveFailures == 0 || now.Sub(sh.LastFailure) >= DeadServerReprobeInterval {
+		return sh.RTT
+	}
+	return sh.RTT + time.Duration(sh.ConsecutiveFailures)*FailurePenalty
+}
+
+// InfraCache records the performance of nameserver addresses, which is used to
+// pick which address to query and how long to wait for a response. The
+// internal implementation can be bypassed using this interface.
+type InfraCache interface {
+	// Record records the result of a query sent to addr that completed at
+	// now, if the query failed err is the reason
+	Record(addr string, rtt time.Duration, err error, now time.Time)
+	// Get returns the health of addr, if it has been recorded
+	Get(addr string) (ServerHealth, bool)
+	// All returns the health of every address that has been recorded
+	All() []ServerHealth
+}
+
+// BasicInfraCache is a basic implementation of the InfraCache interface
+type BasicInfraCache struct {
+	mu      sync.Mutex
+	servers map[string]*ServerHealth
+}
+
+// NewBasicInfraCache returns an initialized BasicInfraCache
+func NewBasicInfraCache() *BasicInfraCache {
+	return &BasicInfraCache{servers: make(map[string]*ServerHealth)}
+}
+
+// Record updates the health of a nameserver address after a query has been
+// sent to it
+func (bic *BasicInfraCache) Record(addr string, rtt time.Duration, err error, now time.Time) {
+	bic.mu.Lock()
+	defer bic.mu.Unlock()
+	sh, present := bic.servers[addr]
+	if !present {
+		sh = &ServerHealth{Addr: addr}
+		bic.servers[addr] = sh
+	}
+	if err != nil {
+		sh.ConsecutiveFailures++
+		sh.LastFailure = now
+		return
+	}
+	sh.ConsecutiveFailures = 0
+	sh.LastSuccess = now
+	if sh.RTT == 0 {
+		sh.RTT = rtt
+	} else {
+		// same smoothing factor as the TCP SRTT (RFC 6298)
+		sh.RTT = (sh.RTT*7 + rtt) / 8
+	}
+}
+
+// Get returns a copy of the health of a nameserver address
+func (bic *BasicInfraCache) Get(addr string) (ServerHealth, bool) {
+	bic.mu.Lock()
+	defer bic.mu.Unlock()
+	sh, present := bic.servers[addr]
+	if !present {
+		return ServerHealth{}, false
+	}
+	return *sh, true
+}
+
+// All returns a copy of the health of each nameserver address that has been
+// queried, sorted by address
+func (bic *BasicInfraCache) All() []ServerHealth {
+	bic.mu.Lock()
+	defer bic.mu.Unlock()
+	table := make([]ServerHealth, 0, len(bic.servers))
+	for _, sh := range bic.servers {
+		table = append(table, *sh)
+	}
+	sort.Slice(table, func(i, j int) bool { return table[i].Addr < table[j].Addr })
+	return table
+}
+
+// recordHealth records the result of a query in the InfraCache of the
+// resolver, if it has one
+func (rr *RecursiveResolver) recordHealth(addr string, rtt time.Duration, err error) {
+	if rr.InfraCache == nil {
+		return
+	}
+	rr.InfraCache.Record(addr, rtt, err, rr.Clock.Now())
+}
+
+// pickServer picks which of servers to query, skipping any that are dead and
+// preferring the one with the lowest RTT, with penalties for recent failures.
+// Servers that haven't responded yet are preferred so that their RTT can be
+// measured. If all of the servers are dead, or the resolver doesn't have a
+// InfraCache, one is picked at random.
+func (rr *RecursiveResolver) pickServer(servers []Nameserver) *Nameserver {
+	if rr.InfraCache == nil {
+		return &servers[mrand.Intn(len(servers))]
+	}
+	now := rr.Clock.Now()
+	var best *Nameserver
+	var bestRTT time.Duration
+	// visit the servers in a random order so ties are broken randomly
+	for _, i := range mrand.Perm(len(servers)) {
+		var rtt time.Duration
+		if sh, present := rr.InfraCache.Get(servers[i].Addr); present {
+			if sh.dead(now) {
+				continue
+			}
+			rtt = sh.penalized(now)
+		}
+		if best == nil || rtt < bestRTT {
+			best, bestRTT = &servers[i], rtt
+		}
+	}
+	if best == nil {
+		best = &servers[mrand.Intn(len(servers))]
+	}
+	return best
+}
+
+// queryTimeout returns how long to wait for a response from the nameserver at
+// addr, based on its RTT
+func (rr *RecursiveResolver) queryTimeout(addr string) time.Duration {
+	if rr.InfraCache == nil {
+		return DefaultQueryTimeout
+	}
+	sh, present := rr.InfraCache.Get(addr)
+	if !present || sh.RTT == 0 {
+		return DefaultQueryTimeout
+	}
+	timeout := sh.RTT * 3
+	if timeout < MinQueryTimeout {
+		return MinQueryTimeout
+	} else if timeout > MaxQueryTimeout {
+		return MaxQueryTimeout
+	}
+	return timeout
+}
+
+// nextServer picks which of servers to query after the addresses in tried
+// have failed to respond, if there are no addresses left nil is returned
+func (rr *RecursiveResolver) nextServer(servers []Nameserver, tried map[string]struct{}) *Nameserver {
+	var remaining []Nameserver
+	for _, s := range servers {
+		if _, present := tried[s.Addr]; !present {
+			remaining = append(remaining, s)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+	return rr.pickServer(remaining)
+}
+
+// probeServers returns the addresses to query concurrently, starting with
+// authority and followed by up to ParallelQueries-1 of the other addresses in
+// servers that haven't been tried
+func (rr *RecursiveResolver) probeServers(authority *Nameserver, servers []Nameserver, tried map[string]struct{}) []*Nameserver {
+	candidates := []*Nameserver{authority}
+	picked := map[string]struct{}{authority.Addr: {}}
+	for a := range tried {
+		picked[a] = struct{}{}
+	}
+	for len(candidates) < rr.ParallelQueries {
+		next := rr.nextServer(servers, picked)
+		if next == nil {
+			break
+		}
+		candidates = append(candidates, next)
+		picked[next.Addr] = struct{}{}
+	}
+	return candidates
+}
+
+// otherFamily returns the addresses in servers for the same nameserver as ns
+// that are in the other address family to the address of ns
+func otherFamily(servers []Nameserver, ns *Nameserver) []Nameserver {
+	v4 := net.ParseIP(ns.Addr).To4() != nil
+	var other []Nameserver
+	for _, s := range servers {
+		if s.Name == ns.Name && (net.ParseIP(s.Addr).To4() != nil) != v4 {
+			other = append(other, s)
+		}
+	}
+	return other
+}
+
+// isTimeout checks if err is a network timeout
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// ServerHealth returns the health of each nameserver address that has been
+// queried, as recorded by the InfraCache of the resolver
+func (rr *RecursiveResolver) ServerHealth() []ServerHealth {
+	if rr.InfraCache == nil {
+		return nil
+	}
+	return rr.InfraCache.All()
+}
@@ -0,0 +1,418 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestPickServer(t *testing.T) {
+	fc := clock.NewFake()
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	rr.Clock = fc
+	servers := []Nameserver{{Addr: "1.1.1.1"}, {Addr: "2.2.2.2"}, {Addr: "3.3.3.3"}}
+
+	rr.recordHealth("1.1.1.1", time.Millisecond*10, nil)
+	rr.recordHealth("2.2.2.2", time.Millisecond*50, nil)
+	rr.recordHealth("3.3.3.3", time.Millisecond*100, nil)
+	if ns := rr.pickServer(servers); ns.Addr != "1.1.1.1" {
+		t.Fatalf("pickServer didn't pick fastest server: %s", ns.Addr)
+	}
+
+	for i := 0; i < MaxNameserverFailures; i++ {
+		rr.recordHealth("1.1.1.1", 0, errors.New("timeout"))
+	}
+	for i := 0; i < 10; i++ {
+		if ns := rr.pickServer(servers); ns.Addr != "2.2.2.2" {
+			t.Fatalf("pickServer didn't skip dead server: %s", ns.Addr)
+		}
+	}
+
+	// once the reprobe interval has passed the dead server can be tried again
+	fc.Add(DeadServerReprobeInterval)
+	if ns := rr.pickServer(servers); ns.Addr != "1.1.1.1" {
+		t.Fatalf("pickServer didn't reprobe dead server: %s", ns.Addr)
+	}
+	rr.recordHealth("1.1.1.1", time.Millisecond*10, errors.New("timeout"))
+	if ns := rr.pickServer(servers); ns.Addr != "2.2.2.2" {
+		t.Fatalf("pickServer didn't skip server that failed reprobe: %s", ns.Addr)
+	}
+
+	// with every server dead one should still be picked
+	for _, s := range servers {
+		for i := 0; i < MaxNameserverFailures; i++ {
+			rr.recordHealth(s.Addr, 0, errors.New("timeout"))
+		}
+	}
+	if ns := rr.pickServer(servers); ns == nil {
+		t.Fatal("pickServer didn't pick a server when all were dead")
+	}
+
+	table := rr.ServerHealth()
+	if len(table) != 3 || table[0].Addr != "1.1.1.1" || table[0].ConsecutiveFailures != MaxNameserverFailures*2+1 {
+		t.Fatalf("ServerHealth returned wrong table: %+v", table)
+	}
+	// the table is a copy
+	table[0].ConsecutiveFailures = 0
+	if rr.ServerHealth()[0].ConsecutiveFailures == 0 {
+		t.Fatal("Modifying the ServerHealth table modified the resolver")
+	}
+}
+
+func TestPickServerFailurePenalty(t *testing.T) {
+	fc := clock.NewFake()
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	rr.Clock = fc
+	servers := []Nameserver{{Addr: "1.1.1.1"}, {Addr: "2.2.2.2"}}
+	rr.recordHealth("1.1.1.1", time.Millisecond*10, nil)
+	rr.recordHealth("2.2.2.2", time.Millisecond*50, nil)
+
+	// a single failure isn't enough for the server to be dead but it should
+	// be penalized
+	rr.recordHealth("1.1.1.1", 0, errors.New("timeout"))
+	for i := 0; i < 10; i++ {
+		if ns := rr.pickServer(servers); ns.Addr != "2.2.2.2" {
+			t.Fatalf("pickServer didn't penalize recently failed server: %s", ns.Addr)
+		}
+	}
+	// unless the alternative is much slower
+	rr.recordHealth("3.3.3.3", FailurePenalty*2, nil)
+	if ns := rr.pickServer([]Nameserver{servers[0], {Addr: "3.3.3.3"}}); ns.Addr != "1.1.1.1" {
+		t.Fatalf("pickServer preferred much slower server over recently failed one: %s", ns.Addr)
+	}
+
+	// the penalty expires along with the failure
+	fc.Add(DeadServerReprobeInterval)
+	if ns := rr.pickServer(servers); ns.Addr != "1.1.1.1" {
+		t.Fatalf("pickServer still penalized server after failure expired: %s", ns.Addr)
+	}
+}
+
+// testInfraCache is a InfraCache that records the addresses it is told about
+type testInfraCache struct {
+	mu       sync.Mutex
+	recorded []string
+}
+
+func (tic *testInfraCache) Record(addr string, rtt time.Duration, err error, now time.Time) {
+	tic.mu.Lock()
+	defer tic.mu.Unlock()
+	tic.recorded = append(tic.recorded, addr)
+}
+
+func (tic *testInfraCache) Get(addr string) (ServerHealth, bool) { return ServerHealth{}, false }
+
+func (tic *testInfraCache) All() []ServerHealth { return nil }
+
+func TestLookupCustomInfraCache(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	defer startTestZones(t, root)()
+
+	rr := newTestResolver(root, nil)
+	tic := &testInfraCache{}
+	rr.InfraCache = tic
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	tic.mu.Lock()
+	defer tic.mu.Unlock()
+	if len(tic.recorded) != 1 || tic.recorded[0] != root.addr {
+		t.Fatalf("Lookup didn't record query in custom InfraCache: %v", tic.recorded)
+	}
+}
+
+func TestLookupSkipsDeadServer(t *testing.T) {
+	live := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	dead := newTestZone(t, ".", "127.0.0.7", false, "a.example. 300 IN A 1.2.3.4")
+	defer startTestZones(t, live)()
+
+	fc := clock.NewFake()
+	hints := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(live.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(dead.addr)},
+	}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.Clock = fc
+	// query a single server at a time so the dead server is queried alone
+	rr.ParallelQueries = 1
+	// without a penalty the dead server keeps being picked until it is
+	// considered dead, since it has never responded
+	defer func(penalty time.Duration) { FailurePenalty = penalty }(FailurePenalty)
+	FailurePenalty = 0
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	failures := 0
+	for i := 0; i < 20; i++ {
+		if _, _, err := rr.Lookup(context.Background(), q); err != nil {
+			failures++
+		}
+	}
+	if failures != MaxNameserverFailures {
+		t.Fatalf("Expected %d lookups to fail before the dead server was skipped, %d failed", MaxNameserverFailures, failures)
+	}
+	table := rr.ServerHealth()
+	if len(table) != 2 || table[1].Addr != dead.addr || table[1].ConsecutiveFailures != MaxNameserverFailures || !table[1].LastSuccess.IsZero() {
+		t.Fatalf("ServerHealth doesn't record dead server: %+v", table)
+	}
+
+	// once the server comes back it should be used again after it is reprobed
+	defer startTestZones(t, dead)()
+	fc.Add(DeadServerReprobeInterval)
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 1 || ll.Composites[0].NS.Addr != dead.addr {
+		t.Fatal("Lookup didn't reprobe server after reprobe interval passed")
+	}
+	if sh := rr.ServerHealth()[1]; sh.ConsecutiveFailures != 0 || sh.LastSuccess.IsZero() {
+		t.Fatalf("ServerHealth doesn't record recovered server: %+v", sh)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	if timeout := rr.queryTimeout("1.1.1.1"); timeout != DefaultQueryTimeout {
+		t.Fatalf("queryTimeout for unknown server was %s, expected default", timeout)
+	}
+	for _, tc := range []struct {
+		rtt      time.Duration
+		expected time.Duration
+	}{
+		{time.Millisecond, MinQueryTimeout},
+		{100 * time.Millisecond, 300 * time.Millisecond},
+		{time.Second, MaxQueryTimeout},
+	} {
+		rr.InfraCache = NewBasicInfraCache()
+		rr.recordHealth("1.1.1.1", tc.rtt, nil)
+		if timeout := rr.queryTimeout("1.1.1.1"); timeout != tc.expected {
+			t.Fatalf("queryTimeout for server with %s RTT was %s, expected %s", tc.rtt, timeout, tc.expected)
+		}
+	}
+}
+
+func TestLookupAbandonsSlowServer(t *testing.T) {
+	slow := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	slow.onQuery = func(dns.Question) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	fast := newTestZone(t, ".", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	defer startTestZones(t, slow, fast)()
+
+	hints := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(slow.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(fast.addr)},
+	}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.ParallelQueries = 1
+	// the slow server has previously been the quickest to respond, so it is
+	// tried first
+	rr.recordHealth(slow.addr, 10*time.Millisecond, nil)
+	rr.recordHealth(fast.addr, 20*time.Millisecond, nil)
+
+	s := time.Now()
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if took := time.Since(s); took > 400*time.Millisecond {
+		t.Fatalf("Lookup waited %s for slow server", took)
+	}
+	if len(a.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %v", a.Answer)
+	}
+	if len(ll.Composites) != 2 || ll.Composites[0].NS.Addr != slow.addr || ll.Composites[0].Error == "" || ll.Composites[1].NS.Addr != fast.addr {
+		t.Fatal("Lookup didn't abandon slow server and query sibling")
+	}
+}
+
+func TestLookupParallelQueries(t *testing.T) {
+	slow := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	slow.onQuery = func(dns.Question) {
+		time.Sleep(500 * time.Millisecond)
+	}
+	broken := newTestZone(t, ".", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	broken.servfail = dns.TypeA
+	fast := newTestZone(t, ".", "127.0.0.4", false, "a.example. 300 IN A 1.2.3.4")
+	// make sure the SERVFAIL arrives first
+	fast.onQuery = func(dns.Question) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer startTestZones(t, slow, broken, fast)()
+
+	hints := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(slow.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(broken.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "c.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(fast.addr)},
+	}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.ParallelQueries = 3
+	rr.ParallelQueryDelay = 0
+
+	s := time.Now()
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if took := time.Since(s); took > 400*time.Millisecond {
+		t.Fatalf("Lookup waited %s for slow server", took)
+	}
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %s %v", dns.RcodeToString[a.Rcode], a.Answer)
+	}
+	if len(ll.Composites) != 3 {
+		t.Fatalf("Lookup didn't record each query: %d composites", len(ll.Composites))
+	}
+	logs := map[string]*LookupLog{}
+	for _, l := range ll.Composites {
+		logs[l.NS.Addr] = l
+	}
+	if l := logs[slow.addr]; l == nil || l.Error != ErrQueryAbandoned.Error() {
+		t.Fatalf("Query to slow server wasn't abandoned: %+v", l)
+	}
+	if l := logs[broken.addr]; l == nil || l.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Query to broken server wasn't recorded: %+v", l)
+	}
+	if l := logs[fast.addr]; l == nil || l.Error != "" || l.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Query to fast server wasn't recorded: %+v", l)
+	}
+
+	// when every server fails the SERVFAIL is returned
+	brokenA := newTestZone(t, ".", "127.0.0.5", false, "")
+	brokenA.servfail = dns.TypeA
+	brokenB := newTestZone(t, ".", "127.0.0.6", false, "")
+	brokenB.servfail = dns.TypeA
+	defer startTestZones(t, brokenA, brokenB)()
+	rr = NewRecursiveResolver(false, false, []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(brokenA.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(brokenB.addr)},
+	}, nil, nil)
+	a, _, err = rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Lookup returned wrong rcode: %s", dns.RcodeToString[a.Rcode])
+	}
+}
+
+func TestLookupParallelQueryDelay(t *testing.T) {
+	var mu sync.Mutex
+	secondQueried := false
+	first := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	second := newTestZone(t, ".", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	second.onQuery = func(dns.Question) {
+		mu.Lock()
+		secondQueried = true
+		mu.Unlock()
+	}
+	defer startTestZones(t, first, second)()
+
+	hints := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(first.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(second.addr)},
+	}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.ParallelQueryDelay = 300 * time.Millisecond
+	// the first server has previously been the quickest to respond, so it
+	// is preferred
+	rr.recordHealth(first.addr, 10*time.Millisecond, nil)
+	rr.recordHealth(second.addr, 20*time.Millisecond, nil)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+
+	// when the preferred server responds quickly the other isn't queried
+	_, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(ll.Composites) != 1 || ll.Composites[0].NS.Addr != first.addr {
+		t.Fatalf("Lookup queried more than the preferred server: %d composites", len(ll.Composites))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if secondQueried {
+		t.Fatal("Second server was queried when the preferred server responded")
+	}
+}
+
+func TestLookupStaggersSlowServer(t *testing.T) {
+	var mu sync.Mutex
+	var secondQueried time.Time
+	delay := 200 * time.Millisecond
+	slow := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	slow.onQuery = func(dns.Question) {
+		time.Sleep(600 * time.Millisecond)
+	}
+	fast := newTestZone(t, ".", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	fast.onQuery = func(dns.Question) {
+		mu.Lock()
+		secondQueried = time.Now()
+		mu.Unlock()
+	}
+	defer startTestZones(t, slow, fast)()
+
+	hints := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(slow.addr)},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(fast.addr)},
+	}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.ParallelQueryDelay = delay
+	// the slow server is preferred, and its RTT is high enough that the
+	// query doesn't time out before the delay
+	rr.recordHealth(slow.addr, 300*time.Millisecond, nil)
+	rr.recordHealth(fast.addr, 400*time.Millisecond, nil)
+
+	s := time.Now()
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	took := time.Since(s)
+	if len(a.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %v", a.Answer)
+	}
+	mu.Lock()
+	waited := secondQueried.Sub(s)
+	mu.Unlock()
+	if waited < delay {
+		t.Fatalf("Second server was queried %s into the lookup, before the %s delay", waited, delay)
+	}
+	if took > 500*time.Millisecond {
+		t.Fatalf("Lookup waited %s for slow server", took)
+	}
+	if len(ll.Composites) != 2 || ll.Composites[0].NS.Addr != slow.addr || ll.Composites[0].Error != ErrQueryAbandoned.Error() || ll.Composites[1].NS.Addr != fast.addr {
+		t.Fatal("Lookup didn't abandon slow server and query the other after the delay")
+	}
+}
+
+func TestLookupRetriesOtherAddressFamily(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, `example. 3600 IN NS ns.example.
+ns.example. 3600 IN A 127.0.0.3
+ns.example. 3600 IN AAAA ::1`)
+	// nothing is listening on ::1 so queries over IPv6 are refused
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	defer startTestZones(t, root, example)()
+
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(root.addr)}}
+	rr := NewRecursiveResolver(true, false, hints, nil, nil)
+	// make sure the IPv6 address is tried first
+	rr.recordHealth("::1", time.Millisecond, nil)
+	rr.recordHealth(example.addr, 20*time.Millisecond, nil)
+
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %v", a.Answer)
+	}
+	if len(ll.Composites) != 3 || ll.Composites[1].NS.Addr != "::1" || ll.Composites[1].Error == "" || ll.Composites[2].NS.Addr != example.addr {
+		t.Fatal("Lookup didn't retry nameserver over IPv4 after IPv6 failed")
+	}
+}
@@ -0,0 +1,95 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoAddresses is returned by LookupHost when a name has no A or AAAA
+// records
+var ErrNoAddresses = errors.New("solvere: No addresses found for host")
+
+// AddressPreference controls the order LookupHost returns addresses in
+type AddressPreference int
+
+const (
+	// AddressesAsReceived returns the IPv4 addresses followed by the IPv6
+	// addresses, each in the order they were received
+	AddressesAsReceived AddressPreference = iota
+	// PreferIPv6 and PreferIPv4 interleave the addresses of each family,
+	// starting with the preferred family, so that clients which try each
+	// address in turn alternate between families (RFC 8305 Section 4)
+	PreferIPv6
+	PreferIPv4
+)
+
+// interleave alternates between the addresses in first and second, starting
+// with first, appending any left over once one runs out
+func interleave(first, second []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// orderAddresses orders the IPv4 and IPv6 addresses of a host according to
+// pref
+func orderAddresses(v4, v6 []net.IP, pref AddressPreference) []net.IP {
+	switch pref {
+	case PreferIPv6:
+		return interleave(v6, v4)
+	case PreferIPv4:
+		return interleave(v4, v6)
+	}
+	return append(append([]net.IP{}, v4...), v6...)
+}
+
+// LookupHost looks up the A and AAAA records for name concurrently and
+// returns the addresses, ordered according to the AddressPreference of the
+// resolver. Any aliases are followed. The returned bool indicates if both
+// answers were authenticated. If either lookup fails and the other returns no
+// addresses the error describes the failed lookups.
+func (rr *RecursiveResolver) LookupHost(ctx context.Context, name string) ([]net.IP, bool, error) {
+	name = dns.Fqdn(name)
+	answers := rr.LookupAll(ctx, name, []uint16{dns.TypeA, dns.TypeAAAA})
+	a, aaaa := answers[dns.TypeA], answers[dns.TypeAAAA]
+	var failures []string
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if rcode := answers[t].Rcode; rcode != dns.RcodeSuccess {
+			failures = append(failures, fmt.Sprintf("%s lookup returned %s", dns.TypeToString[t], dns.RcodeToString[rcode]))
+		}
+	}
+	if len(failures) == 2 {
+		return nil, false, fmt.Errorf("solvere: Host lookup failed for %s: %s", name, strings.Join(failures, ", "))
+	}
+	var v4, v6 []net.IP
+	for _, r := range a.Answer {
+		if addr, ok := r.(*dns.A); ok {
+			v4 = append(v4, addr.A)
+		}
+	}
+	for _, r := range aaaa.Answer {
+		if addr, ok := r.(*dns.AAAA); ok {
+			v6 = append(v6, addr.AAAA)
+		}
+	}
+	if len(v4) == 0 && len(v6) == 0 {
+		if len(failures) > 0 {
+			// the failed lookup may have had addresses
+			return nil, false, fmt.Errorf("solvere: Host lookup failed for %s: %s", name, failures[0])
+		}
+		return nil, false, ErrNoAddresses
+	}
+	return orderAddresses(v4, v6, rr.AddressPreference), a.Authenticated && aaaa.Authenticated, nil
+}
@@ -0,0 +1,64 @@
+package solvere
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLookupHost(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `
+a.example. 300 IN A 1.1.1.1
+a.example. 300 IN A 2.2.2.2
+a.example. 300 IN AAAA ::1
+a.example. 300 IN AAAA ::2
+a.example. 300 IN AAAA ::3
+alias.example. 300 IN CNAME a.example.
+big.example. 300 IN A 1.1.1.1
+big.example. 300 IN A 2.2.2.2
+big.example. 300 IN A 3.3.3.3
+`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	for _, tc := range []struct {
+		pref     AddressPreference
+		expected string
+	}{
+		{AddressesAsReceived, "[1.1.1.1 2.2.2.2 ::1 ::2 ::3]"},
+		{PreferIPv6, "[::1 1.1.1.1 ::2 2.2.2.2 ::3]"},
+		{PreferIPv4, "[1.1.1.1 ::1 2.2.2.2 ::2 ::3]"},
+	} {
+		rr.AddressPreference = tc.pref
+		for _, name := range []string{"a.example", "alias.example."} {
+			addrs, authenticated, err := rr.LookupHost(context.Background(), name)
+			if err != nil {
+				t.Fatalf("LookupHost failed for %s: %s", name, err)
+			}
+			if !authenticated {
+				t.Fatalf("LookupHost result for %s wasn't authenticated", name)
+			}
+			if fmt.Sprint(addrs) != tc.expected {
+				t.Fatalf("LookupHost returned wrong addresses for %s with preference %d: expected %s, got %s", name, tc.pref, tc.expected, addrs)
+			}
+		}
+	}
+
+	if _, _, err := rr.LookupHost(context.Background(), "example."); err != ErrNoAddresses {
+		t.Fatalf("LookupHost didn't return ErrNoAddresses for name without addresses: %v", err)
+	}
+	if _, _, err := rr.LookupHost(context.Background(), "missing.example."); err == nil {
+		t.Fatal("LookupHost didn't fail for name that doesn't exist")
+	}
+
+	// if only the A lookup fails the error reports it rather than the
+	// empty AAAA answer
+	rr.MaxRRsetSize = 2
+	_, _, err := rr.LookupHost(context.Background(), "big.example.")
+	if err == nil || err == ErrNoAddresses || !strings.Contains(err.Error(), "A lookup returned SERVFAIL") || strings.Contains(err.Error(), "AAAA") {
+		t.Fatalf("LookupHost didn't report failed A lookup: %v", err)
+	}
+}
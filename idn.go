@@ -0,0 +1,222 @@
+package solvere
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidIDN is returned when a internationalized domain name can't be
+// converted to its ASCII form
+var ErrInvalidIDN = errors.New("solvere: Invalid internationalized domain name")
+
+const (
+	acePrefix = "xn--"
+
+	// punycode parameters (RFC 3492 Section 5)
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyThreshold(k, bias int) int {
+	t := k - bias
+	if t < punyTMin {
+		return punyTMin
+	} else if t > punyTMax {
+		return punyTMax
+	}
+	return t
+}
+
+func punyEncodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDecodeDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
+
+// punyEncode encodes a label using punycode (RFC 3492 Section 6.3)
+func punyEncode(label string) (string, error) {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	h := b
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for h < len(runes) {
+		m := rune(math.MaxInt32)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (math.MaxInt32-delta)/(h+1) {
+			return "", ErrInvalidIDN
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyEncodeDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyEncodeDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes a punycode encoded label (RFC 3492 Section 6.2)
+func punyDecode(encoded string) (string, error) {
+	var out []rune
+	pos := 0
+	if d := strings.LastIndex(encoded, "-"); d >= 0 {
+		for i := 0; i < d; i++ {
+			if encoded[i] >= utf8.RuneSelf {
+				return "", ErrInvalidIDN
+			}
+			out = append(out, rune(encoded[i]))
+		}
+		pos = d + 1
+	}
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos < len(encoded) {
+		oldI, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(encoded) {
+				return "", ErrInvalidIDN
+			}
+			d, ok := punyDecodeDigit(encoded[pos])
+			pos++
+			if !ok || d > (math.MaxInt32-i)/w {
+				return "", ErrInvalidIDN
+			}
+			i += d * w
+			t := punyThreshold(k, bias)
+			if d < t {
+				break
+			}
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", ErrInvalidIDN
+			}
+			w *= punyBase - t
+		}
+		x := len(out) + 1
+		bias = punyAdapt(i-oldI, x, oldI == 0)
+		if i/x > int(utf8.MaxRune-n) {
+			return "", ErrInvalidIDN
+		}
+		n += rune(i / x)
+		i %= x
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = n
+		i++
+	}
+	return string(out), nil
+}
+
+// ToASCII converts a domain name containing Unicode labels into the A-label
+// form used on the wire, labels that only contain ASCII characters are left
+// as they are. Unicode labels are lowercased but not otherwise mapped or
+// normalized (UTS #46), so names should be passed in NFC form. If a label
+// can't be encoded ErrInvalidIDN is returned.
+func ToASCII(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", ErrInvalidIDN
+	}
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		ascii := true
+		for j := 0; j < len(l); j++ {
+			if l[j] >= utf8.RuneSelf {
+				ascii = false
+				break
+			}
+		}
+		if ascii {
+			continue
+		}
+		encoded, err := punyEncode(strings.ToLower(l))
+		if err != nil {
+			return "", err
+		}
+		encoded = acePrefix + encoded
+		if len(encoded) > 63 {
+			return "", ErrInvalidIDN
+		}
+		labels[i] = encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicode converts any A-labels in a domain name back into their Unicode
+// form for display, labels that can't be decoded are left as they are
+func ToUnicode(name string) string {
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if len(l) <= len(acePrefix) || !strings.EqualFold(l[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		if decoded, err := punyDecode(l[len(acePrefix):]); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
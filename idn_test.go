@@ -0,0 +1,66 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIDNConversion(t *testing.T) {
+	for _, tc := range []struct {
+		unicode string
+		ascii   string
+	}{
+		{"münchen.de.", "xn--mnchen-3ya.de."},
+		{"MÜNCHEN.de.", "xn--mnchen-3ya.de."},
+		{"example.com.", "example.com."},
+		{"bücher.example.", "xn--bcher-kva.example."},
+		{"例え.テスト.", "xn--r8jz45g.xn--zckzah."},
+		{"ليهمابتكلموشعربي؟.", "xn--egbpdaj6bu4bxfgehfvwxn."},
+	} {
+		ascii, err := ToASCII(tc.unicode)
+		if err != nil {
+			t.Fatalf("ToASCII failed for %q: %s", tc.unicode, err)
+		}
+		if ascii != tc.ascii {
+			t.Fatalf("ToASCII returned wrong name for %q: expected %q, got %q", tc.unicode, tc.ascii, ascii)
+		}
+		if unicode := ToUnicode(ascii); unicode != strings.ToLower(tc.unicode) {
+			t.Fatalf("ToUnicode returned wrong name for %q: expected %q, got %q", ascii, strings.ToLower(tc.unicode), unicode)
+		}
+	}
+
+	if _, err := ToASCII(strings.Repeat("ü", 64) + ".example."); err != ErrInvalidIDN {
+		t.Fatalf("ToASCII didn't reject label that is too long: %v", err)
+	}
+	if _, err := ToASCII("\xff.example."); err != ErrInvalidIDN {
+		t.Fatalf("ToASCII didn't reject invalid UTF-8: %v", err)
+	}
+	if name := ToUnicode("xn--a-9!.example."); name != "xn--a-9!.example." {
+		t.Fatalf("ToUnicode modified undecodable label: %q", name)
+	}
+}
+
+func TestLookupIDN(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "xn--mnchen-3ya.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	a, _, err := rr.Lookup(context.Background(), Question{Name: "münchen.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(extractRRSet(a.Answer, "xn--mnchen-3ya.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup returned wrong answer for Unicode name: %s", a.Answer)
+	}
+
+	_, _, err = rr.Lookup(context.Background(), Question{Name: strings.Repeat("ü", 64) + ".example.", Type: dns.TypeA})
+	if !errors.Is(err, ErrInvalidIDN) {
+		t.Fatalf("Lookup didn't reject invalid Unicode name: %v", err)
+	}
+}
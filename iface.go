@@ -0,0 +1,101 @@
+package solvere
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoInterfaceAddress is returned by BindToInterface when the interface
+// doesn't have a address that can be used as the source of queries
+var ErrNoInterfaceAddress = errors.New("solvere: Interface has no usable addresses")
+
+// interfaceAddrs returns the first IPv4 and IPv6 addresses of the named
+// interface that can be used as a source address, link-local addresses are
+// skipped since they can't be used to reach nameservers
+func interfaceAddrs(name string) (v4, v6 net.IP, err error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsMulticast() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if v4 == nil {
+				v4 = ip4
+			}
+		} else if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	return v4, v6, nil
+}
+
+// BindToInterface causes queries sent over UDP and TCP to use the addresses
+// of the named interface as their source address, so that they egress from
+// that interface on multi-homed hosts. The addresses of the interface are
+// looked up once, when this is called, and a error is returned if the
+// interface doesn't exist or doesn't have a address in each of the address
+// families the resolver uses. Queries sent using the TLSExchanger or
+// HTTPSExchanger aren't affected.
+func (rr *RecursiveResolver) BindToInterface(name string) error {
+	v4, v6, err := interfaceAddrs(name)
+	if err != nil {
+		return err
+	}
+	if v4 == nil || (rr.useIPv6 && v6 == nil) {
+		return ErrNoInterfaceAddress
+	}
+	rr.localV4, rr.localV6 = v4, v6
+	return nil
+}
+
+// dialer returns a net.Dialer for connecting to addr over network, if the
+// resolver is bound to a interface the local address of the dialer is set to
+// the address of the interface in the same family as addr
+func (rr *RecursiveResolver) dialer(network, addr string) *net.Dialer {
+	d := &net.Dialer{}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return d
+	}
+	local := rr.localV4
+	if ip.To4() == nil {
+		local = rr.localV6
+	}
+	if local == nil {
+		return d
+	}
+	switch network {
+	case "udp":
+		d.LocalAddr = &net.UDPAddr{IP: local}
+	case "tcp":
+		d.LocalAddr = &net.TCPAddr{IP: local}
+	}
+	return d
+}
+
+// dial connects to addr over network, using the local address of the
+// interface the resolver is bound to, if any
+func (rr *RecursiveResolver) dial(network, addr string, timeout time.Duration) (*dns.Conn, error) {
+	d := rr.dialer(network, addr)
+	d.Timeout = timeout
+	conn, err := d.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
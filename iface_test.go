@@ -0,0 +1,71 @@
+package solvere
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// loopbackInterface returns the name of a loopback interface with a IPv4
+// address
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Failed to list interfaces: %s", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		if v4, _, err := interfaceAddrs(iface.Name); err == nil && v4 != nil {
+			return iface.Name
+		}
+	}
+	t.Skip("No loopback interface with a IPv4 address")
+	return ""
+}
+
+func TestBindToInterface(t *testing.T) {
+	name := loopbackInterface(t)
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	if d := rr.dialer("udp", "127.0.0.2:53"); d.LocalAddr != nil {
+		t.Fatalf("Unbound dialer has local address %s", d.LocalAddr)
+	}
+	if err := rr.BindToInterface("solvere-missing0"); err == nil {
+		t.Fatal("BindToInterface didn't fail for a missing interface")
+	}
+	if err := rr.BindToInterface(name); err != nil {
+		t.Fatalf("BindToInterface failed: %s", err)
+	}
+	v4, _, _ := interfaceAddrs(name)
+	d := rr.dialer("udp", "127.0.0.2:53")
+	if addr, ok := d.LocalAddr.(*net.UDPAddr); !ok || !addr.IP.Equal(v4) {
+		t.Fatalf("UDP dialer has wrong local address: %v", d.LocalAddr)
+	}
+	d = rr.dialer("tcp", "127.0.0.2:53")
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); !ok || !addr.IP.Equal(v4) {
+		t.Fatalf("TCP dialer has wrong local address: %v", d.LocalAddr)
+	}
+}
+
+func TestLookupBoundToInterface(t *testing.T) {
+	name := loopbackInterface(t)
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	if err := rr.BindToInterface(name); err != nil {
+		t.Fatalf("BindToInterface failed: %s", err)
+	}
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %+v", answer)
+	}
+}
@@ -1,23 +1,75 @@
 package solvere
 
 import (
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	// "strings"
+	"strings"
 
 	"github.com/miekg/dns"
 )
 
 var (
-	ErrNSECMismatch         = errors.New("solvere: NSEC3 record doesn't match question")
-	ErrNSECTypeExists       = errors.New("solvere: NSEC3 record shows question type exists")
+	ErrNSECMismatch         = errors.New("solvere: NSEC/NSEC3 record doesn't match question")
+	ErrNSECTypeExists       = errors.New("solvere: NSEC/NSEC3 record shows question type exists")
 	ErrNSECMultipleCoverage = errors.New("solvere: Multiple NSEC3 records cover next closer/source of synthesis")
-	ErrNSECMissingCoverage  = errors.New("solvere: NSEC3 record missing for expected encloser")
-	ErrNSECBadDelegation    = errors.New("solvere: DS or SOA bit set in NSEC3 type map")
-	ErrNSECNSMissing        = errors.New("solvere: NS bit not set in NSEC3 type map")
+	ErrNSECMissingCoverage  = errors.New("solvere: NSEC/NSEC3 record missing for expected encloser")
+	ErrNSECBadDelegation    = errors.New("solvere: DS or SOA bit set in NSEC/NSEC3 type map")
+	ErrNSECNSMissing        = errors.New("solvere: NS bit not set in NSEC/NSEC3 type map")
 	ErrNSECOptOut           = errors.New("solvere: Opt-Out bit not set for NSEC3 record covering next closer")
+	ErrMalformedNSEC3       = errors.New("solvere: NSEC3 record salt or hash length doesn't match its contents")
+
+	ErrNSEC3IterationsTooHigh = errors.New("solvere: NSEC3 record iteration count is too high")
+	ErrNSEC3UnknownHash       = errors.New("solvere: NSEC3 record uses a unknown hash algorithm")
 )
 
+// DefaultMaxNSEC3Iterations is the highest NSEC3 iteration count accepted by
+// default (RFC 9276 Section 3.2)
+const DefaultMaxNSEC3Iterations = 100
+
+// checkNSEC3 checks that the declared salt and hash lengths of each NSEC3
+// record match the salt and next hashed owner name they contain, records that
+// don't could cause matching and covering checks to behave unexpectedly. If
+// maxIterations is non-zero the iteration count must not exceed it, since
+// each name checked against the records is hashed that many times. Records
+// using a hash algorithm other than SHA-1, the only one defined, are ignored
+// (RFC 5155 Section 8.1), the remaining records are returned, or
+// ErrNSEC3UnknownHash if there are none.
+func checkNSEC3(nsec []dns.RR, maxIterations int) ([]dns.RR, error) {
+	known := make([]dns.RR, 0, len(nsec))
+	for _, r := range nsec {
+		n, ok := r.(*dns.NSEC3)
+		if !ok {
+			known = append(known, r)
+			continue
+		}
+		if n.Hash != dns.SHA1 {
+			continue
+		}
+		if maxIterations > 0 && int(n.Iterations) > maxIterations {
+			return nil, ErrNSEC3IterationsTooHigh
+		}
+		salt := n.Salt
+		if salt == "-" {
+			// the dns package represents a empty salt as "-"
+			salt = ""
+		}
+		if decoded, err := hex.DecodeString(salt); err != nil || len(decoded) != int(n.SaltLength) {
+			return nil, ErrMalformedNSEC3
+		}
+		next, err := base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(n.NextDomain))
+		if err != nil || len(next) != int(n.HashLength) || n.HashLength == 0 {
+			return nil, ErrMalformedNSEC3
+		}
+		known = append(known, r)
+	}
+	if len(known) == 0 && len(nsec) > 0 {
+		return nil, ErrNSEC3UnknownHash
+	}
+	return known, nil
+}
+
 func typesSet(set []uint16, types ...uint16) bool {
 	tm := make(map[uint16]struct{}, len(types))
 	for _, t := range types {
@@ -31,131 +83,440 @@ func typesSet(set []uint16, types ...uint16) bool {
 	return false
 }
 
-// findClosestEncloser finds the Closest Encloser and Next Closers for a name
-// in a set of NSEC3 records
-func findClosestEncloser(name string, nsec []dns.RR) (string, string) {
-	// RFC 5155 Section 8.3 (ish)
+// DenialProof contains the NSEC or NSEC3 records that were used to prove the
+// non-existence of a name or type. For NSEC proofs NextCloser is the record
+// covering the name itself, since NSEC records don't prove the closest
+// encloser directly.
+type DenialProof struct {
+	// ClosestEncloser matches the closest encloser of the name, or the
+	// name itself if it was directly matched
+	ClosestEncloser dns.RR `json:",omitempty"`
+	// NextCloser covers the next closer name
+	NextCloser dns.RR `json:",omitempty"`
+	// Wildcard covers, or in the case of wildcard NODATA responses
+	// matches, the wildcard at the closest encloser
+	Wildcard dns.RR `json:",omitempty"`
+}
+
+// findClosestEncloser finds the Closest Encloser and Next Closer for a name
+// in a set of NSEC3 records, and the record that matches the Closest Encloser.
+// Each ancestor of the name is checked against every record, deepest first, so
+// the result doesn't depend on the order of the records. The deepest matching
+// ancestor is only returned if the next closer name is covered, proving there
+// is no closer encloser, and all of the records matching it agree.
+func findClosestEncloser(name string, nsec []dns.RR) (string, string, *dns.NSEC3) {
+	// RFC 5155 Section 8.3
 	labelIndices := dns.Split(name)
-	nc := name
 	for i := 0; i < len(labelIndices); i++ {
 		z := name[labelIndices[i]:]
-		_, err := findMatching(z, nsec)
-		if err != nil {
+		matches := findAllMatching(z, nsec)
+		if len(matches) == 0 {
 			continue
 		}
-		if i != 0 {
-			nc = name[labelIndices[i-1]:]
+		match := matches[0]
+		for _, m := range matches[1:] {
+			if !sameTypes(m.TypeBitMap, match.TypeBitMap) {
+				// conflicting records for the same name, neither can
+				// be trusted
+				return "", "", nil
+			}
 		}
-		return z, nc
+		if i == 0 {
+			return z, name, match
+		}
+		nc := name[labelIndices[i-1]:]
+		if _, err := findCoverer(nc, nsec); err != nil {
+			return "", "", nil
+		}
+		return z, nc, match
 	}
-	return "", ""
+	return "", "", nil
 }
 
-func findMatching(name string, nsec []dns.RR) ([]uint16, error) {
+func findMatching(name string, nsec []dns.RR) (*dns.NSEC3, error) {
 	for _, rr := range nsec {
 		n := rr.(*dns.NSEC3)
 		if n.Match(name) {
-			return n.TypeBitMap, nil
+			return n, nil
 		}
 	}
 	return nil, ErrNSECMissingCoverage
 }
 
-func findCoverer(name string, nsec []dns.RR) ([]uint16, bool, error) {
+func findAllMatching(name string, nsec []dns.RR) []*dns.NSEC3 {
+	var matches []*dns.NSEC3
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC3)
+		if n.Match(name) {
+			matches = append(matches, n)
+		}
+	}
+	return matches
+}
+
+func sameTypes(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, t := range a {
+		if !typesSet(b, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func findCoverer(name string, nsec []dns.RR) (*dns.NSEC3, error) {
 	for _, rr := range nsec {
 		n := rr.(*dns.NSEC3)
 		if n.Cover(name) {
-			return n.TypeBitMap, (n.Flags & 1) == 1, nil
+			return n, nil
 		}
 	}
-	return nil, false, ErrNSECMissingCoverage
+	return nil, ErrNSECMissingCoverage
+}
+
+func optOut(n *dns.NSEC3) bool {
+	return (n.Flags & 1) == 1
 }
 
 // RFC 5155 Section 8.4
-func verifyNameError(q *Question, nsec []dns.RR) error {
-	ce, _ := findClosestEncloser(q.Name, nsec)
+func verifyNameError(q *Question, nsec []dns.RR, maxIterations int) (*DenialProof, error) {
+	if usesNSEC(nsec) {
+		return verifyNSECNameError(q, nsec)
+	}
+	nsec, err := checkNSEC3(nsec, maxIterations)
+	if err != nil {
+		return nil, err
+	}
+	ce, nc, ceMatch := findClosestEncloser(q.Name, nsec)
 	if ce == "" {
-		return ErrNSECMissingCoverage
+		return nil, ErrNSECMissingCoverage
 	}
-	_, _, err := findCoverer(fmt.Sprintf("*.%s", ce), nsec)
+	ncCover, err := findCoverer(nc, nsec)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	wildcardCover, err := findCoverer(fmt.Sprintf("*.%s", ce), nsec)
+	if err != nil {
+		return nil, err
+	}
+	return &DenialProof{ClosestEncloser: ceMatch, NextCloser: ncCover, Wildcard: wildcardCover}, nil
 }
 
 // verifyNODATA verifies NSEC/NSEC3 records from a answer with a NOERROR (0) RCODE
 // and a empty Answer section
-func verifyNODATA(q *Question, nsec []dns.RR) error {
+func verifyNODATA(q *Question, nsec []dns.RR, maxIterations int) (*DenialProof, error) {
+	if usesNSEC(nsec) {
+		return verifyNSECNODATA(q, nsec)
+	}
+	nsec, err := checkNSEC3(nsec, maxIterations)
+	if err != nil {
+		return nil, err
+	}
 	// RFC5155 Section 8.5
-	types, err := findMatching(q.Name, nsec)
+	match, err := findMatching(q.Name, nsec)
 	if err != nil {
 		if q.Type != dns.TypeDS {
-			return err
+			return verifyWildcardNODATA(q, nsec, maxIterations)
 		}
 
 		// RFC5155 Section 8.6
-		ce, nc := findClosestEncloser(q.Name, nsec)
+		ce, nc, ceMatch := findClosestEncloser(q.Name, nsec)
 		if ce == "" {
-			return ErrNSECMissingCoverage
+			return nil, ErrNSECMissingCoverage
 		}
-		_, optOut, err := findCoverer(nc, nsec)
+		ncCover, err := findCoverer(nc, nsec)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if !optOut {
-			return ErrNSECOptOut
+		if !optOut(ncCover) {
+			return nil, ErrNSECOptOut
 		}
-		return nil
+		return &DenialProof{ClosestEncloser: ceMatch, NextCloser: ncCover}, nil
 	}
 
-	if typesSet(types, q.Type, dns.TypeCNAME) {
-		return ErrNSECTypeExists
+	if typesSet(match.TypeBitMap, q.Type, dns.TypeCNAME) {
+		return nil, ErrNSECTypeExists
 	}
-	// BUG(roland): pretty sure this is 100% incorrect, should prob be its own method...
-	// if strings.HasPrefix(q.Name, "*.") {
-	// 	// RFC 5155 Section 8.7
-	// 	ce, _ := findClosestEncloser(q.Name, nsec)
-	// 	if ce == "" {
-	// 		return ErrNSECMissingCoverage
-	// 	}
-	// 	matchTypes, err := findMatching(fmt.Sprintf("*.%s", ce), nsec)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	if typesSet(matchTypes, q.Type, dns.TypeCNAME) {
-	// 		return ErrNSECTypeExists
-	// 	}
-	// }
-	return nil
+	return &DenialProof{ClosestEncloser: match}, nil
 }
 
-// RFC 5155 Section 8.8
-// func verifyWildcardAnswer() {
-// }
+// RFC 5155 Section 8.7
+func verifyWildcardNODATA(q *Question, nsec []dns.RR, maxIterations int) (*DenialProof, error) {
+	nsec, err := checkNSEC3(nsec, maxIterations)
+	if err != nil {
+		return nil, err
+	}
+	ce, nc, ceMatch := findClosestEncloser(q.Name, nsec)
+	if ce == "" {
+		return nil, ErrNSECMissingCoverage
+	}
+	ncCover, err := findCoverer(nc, nsec)
+	if err != nil {
+		return nil, err
+	}
+	wildcardMatch, err := findMatching(fmt.Sprintf("*.%s", ce), nsec)
+	if err != nil {
+		return nil, err
+	}
+	if typesSet(wildcardMatch.TypeBitMap, q.Type, dns.TypeCNAME) {
+		return nil, ErrNSECTypeExists
+	}
+	return &DenialProof{ClosestEncloser: ceMatch, NextCloser: ncCover, Wildcard: wildcardMatch}, nil
+}
+
+// RFC 5155 Section 8.8, sigLabels is the label count of the RRSIG covering the
+// answer, which is the number of labels in the closest encloser of the name.
+// For NSEC the name must be covered, which also proves the closest encloser
+// (RFC 4035 Section 5.3.4).
+func verifyWildcardAnswer(q *Question, nsec []dns.RR, sigLabels uint8, maxIterations int) (*DenialProof, error) {
+	labels := dns.SplitDomainName(q.Name)
+	if int(sigLabels) >= len(labels) {
+		return nil, ErrNSECMismatch
+	}
+	ce := "."
+	if sigLabels > 0 {
+		ce = strings.Join(labels[len(labels)-int(sigLabels):], ".") + "."
+	}
+	if usesNSEC(nsec) {
+		cover, err := findNSECCoverer(q.Name, nsec)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(nsecClosestEncloser(q.Name, cover), ce) {
+			// there is a closer encloser than the wildcard, so it
+			// shouldn't have been used
+			return nil, ErrNSECMismatch
+		}
+		return &DenialProof{NextCloser: cover}, nil
+	}
+	nsec, err := checkNSEC3(nsec, maxIterations)
+	if err != nil {
+		return nil, err
+	}
+	nc := strings.Join(labels[len(labels)-int(sigLabels)-1:], ".") + "."
+	ncCover, err := findCoverer(nc, nsec)
+	if err != nil {
+		return nil, err
+	}
+	return &DenialProof{NextCloser: ncCover}, nil
+}
+
+// expandedSignatures returns the RRSIGs in a section that cover RRsets which
+// were synthesized from a wildcard, these have fewer labels than their owner
+// name (RFC 4035 Section 5.3.4). A leading "*" label isn't counted, so the
+// RRsets of a wildcard owner name that was queried directly aren't treated as
+// expansions (RFC 4035 Section 5.3.1).
+func expandedSignatures(section []dns.RR) []*dns.RRSIG {
+	var expanded []*dns.RRSIG
+	for _, r := range section {
+		sig, ok := r.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		labels := dns.CountLabel(sig.Hdr.Name)
+		if strings.HasPrefix(sig.Hdr.Name, "*.") {
+			labels--
+		}
+		if int(sig.Labels) < labels {
+			expanded = append(expanded, sig)
+		}
+	}
+	return expanded
+}
 
 // RFC 5155 Section 8.9
-func verifyDelegation(delegation string, nsec []dns.RR) error {
-	types, err := findMatching(delegation, nsec)
+func verifyDelegation(delegation string, nsec []dns.RR, maxIterations int) (*DenialProof, error) {
+	if usesNSEC(nsec) {
+		return verifyNSECDelegation(delegation, nsec)
+	}
+	nsec, err := checkNSEC3(nsec, maxIterations)
+	if err != nil {
+		return nil, err
+	}
+	match, err := findMatching(delegation, nsec)
 	if err != nil {
-		ce, nc := findClosestEncloser(delegation, nsec)
+		ce, nc, ceMatch := findClosestEncloser(delegation, nsec)
 		if ce == "" {
-			return ErrNSECMissingCoverage
+			return nil, ErrNSECMissingCoverage
 		}
-		_, optOut, err := findCoverer(nc, nsec)
+		ncCover, err := findCoverer(nc, nsec)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if !optOut(ncCover) {
+			return nil, ErrNSECOptOut
 		}
-		if !optOut {
-			return ErrNSECOptOut
+		return &DenialProof{ClosestEncloser: ceMatch, NextCloser: ncCover}, nil
+	}
+	if !typesSet(match.TypeBitMap, dns.TypeNS) {
+		return nil, ErrNSECNSMissing
+	}
+	if typesSet(match.TypeBitMap, dns.TypeDS, dns.TypeSOA) {
+		return nil, ErrNSECBadDelegation
+	}
+	return &DenialProof{ClosestEncloser: match}, nil
+}
+
+// denialRecords returns the NSEC3 records in a section, or the NSEC records if
+// there aren't any, since a zone uses one or the other
+func denialRecords(section []dns.RR) []dns.RR {
+	if nsec3 := extractRRSet(section, "", dns.TypeNSEC3); len(nsec3) > 0 {
+		return nsec3
+	}
+	return extractRRSet(section, "", dns.TypeNSEC)
+}
+
+// usesNSEC checks if a set of denial records contains NSEC rather than NSEC3
+// records
+func usesNSEC(nsec []dns.RR) bool {
+	if len(nsec) == 0 {
+		return false
+	}
+	_, ok := nsec[0].(*dns.NSEC)
+	return ok
+}
+
+// commonAncestor returns the longest name that both a and b are equal to or
+// below
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(strings.ToLower(a), strings.ToLower(b))
+	labels := dns.SplitDomainName(a)
+	if n == 0 || len(labels) == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+func wildcardName(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// nsecCovers checks if name sorts between the owner name and next domain name
+// of a NSEC record in canonical order. The last NSEC record in a zone has the
+// apex as its next domain name and covers every name in the zone that sorts
+// after its owner name (RFC 4034 Section 4.1.1). A NSEC record at a delegation
+// point, or with a DNAME, doesn't prove anything about names below it since
+// they are outside of the zone (RFC 6840 Section 4.1).
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Header().Name, n.NextDomain
+	if !canonicalNameLess(owner, name) {
+		return false
+	}
+	if dns.IsSubDomain(owner, name) && (typesSet(n.TypeBitMap, dns.TypeDNAME) || (typesSet(n.TypeBitMap, dns.TypeNS) && !typesSet(n.TypeBitMap, dns.TypeSOA))) {
+		return false
+	}
+	if canonicalNameLess(owner, next) {
+		return canonicalNameLess(name, next)
+	}
+	return dns.IsSubDomain(next, name)
+}
+
+// the dns package Cover and Match methods for NSEC records aren't implemented
+// so these are used instead
+
+func findNSECMatching(name string, nsec []dns.RR) (*dns.NSEC, error) {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if strings.EqualFold(n.Header().Name, name) {
+			return n, nil
 		}
-		return nil
 	}
-	if !typesSet(types, dns.TypeNS) {
-		return ErrNSECNSMissing
+	return nil, ErrNSECMissingCoverage
+}
+
+func findNSECCoverer(name string, nsec []dns.RR) (*dns.NSEC, error) {
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if nsecCovers(n, name) {
+			return n, nil
+		}
+	}
+	return nil, ErrNSECMissingCoverage
+}
+
+// nsecClosestEncloser returns the closest encloser of a name proven not to
+// exist by a covering NSEC record, which is the longest ancestor the name
+// shares with either the owner or next domain name of the record
+func nsecClosestEncloser(name string, cover *dns.NSEC) string {
+	ce := commonAncestor(name, cover.Header().Name)
+	if next := commonAncestor(name, cover.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+		ce = next
+	}
+	return ce
+}
+
+// verifyNSECNameError verifies that a NSEC record covers the name, and that
+// another, or the same, NSEC record covers the wildcard at its closest encloser
+// (RFC 4035 Section 5.4)
+func verifyNSECNameError(q *Question, nsec []dns.RR) (*DenialProof, error) {
+	cover, err := findNSECCoverer(q.Name, nsec)
+	if err != nil {
+		return nil, err
+	}
+	wildcardCover, err := findNSECCoverer(wildcardName(nsecClosestEncloser(q.Name, cover)), nsec)
+	if err != nil {
+		return nil, err
+	}
+	return &DenialProof{NextCloser: cover, Wildcard: wildcardCover}, nil
+}
+
+// verifyNSECNODATA verifies that a NSEC record matching the name doesn't have
+// the type in its type map, or that the name is a empty non-terminal, or that
+// the name is covered and the wildcard at its closest encloser doesn't have
+// the type (RFC 4035 Section 5.4)
+func verifyNSECNODATA(q *Question, nsec []dns.RR) (*DenialProof, error) {
+	if match, err := findNSECMatching(q.Name, nsec); err == nil {
+		if typesSet(match.TypeBitMap, q.Type, dns.TypeCNAME) {
+			return nil, ErrNSECTypeExists
+		}
+		// a NSEC record from the parent side of a zone cut can only prove
+		// the absence of DS records, and one from the child apex can't
+		// (RFC 6840 Section 4.4)
+		apex := typesSet(match.TypeBitMap, dns.TypeSOA)
+		if q.Type != dns.TypeDS && typesSet(match.TypeBitMap, dns.TypeNS) && !apex {
+			return nil, ErrNSECMismatch
+		}
+		if q.Type == dns.TypeDS && apex && q.Name != "." {
+			return nil, ErrNSECMismatch
+		}
+		return &DenialProof{ClosestEncloser: match}, nil
+	}
+	cover, err := findNSECCoverer(q.Name, nsec)
+	if err != nil {
+		return nil, err
+	}
+	if dns.IsSubDomain(q.Name, cover.NextDomain) {
+		// the name is a empty non-terminal
+		return &DenialProof{NextCloser: cover}, nil
+	}
+	wildcardMatch, err := findNSECMatching(wildcardName(nsecClosestEncloser(q.Name, cover)), nsec)
+	if err != nil {
+		return nil, err
+	}
+	if typesSet(wildcardMatch.TypeBitMap, q.Type, dns.TypeCNAME) {
+		return nil, ErrNSECTypeExists
+	}
+	return &DenialProof{NextCloser: cover, Wildcard: wildcardMatch}, nil
+}
+
+// verifyNSECDelegation verifies that a NSEC record matching the delegation
+// shows it has NS records but no DS records. Unlike NSEC3 there is no opt-out
+// so the record must match.
+func verifyNSECDelegation(delegation string, nsec []dns.RR) (*DenialProof, error) {
+	match, err := findNSECMatching(delegation, nsec)
+	if err != nil {
+		return nil, err
+	}
+	if !typesSet(match.TypeBitMap, dns.TypeNS) {
+		return nil, ErrNSECNSMissing
 	}
-	if typesSet(types, dns.TypeDS, dns.TypeSOA) {
-		return ErrNSECBadDelegation
+	if typesSet(match.TypeBitMap, dns.TypeDS, dns.TypeSOA) {
+		return nil, ErrNSECBadDelegation
 	}
-	return nil
+	return &DenialProof{ClosestEncloser: match}, nil
 }
@@ -1,6 +1,8 @@
 package solvere
 
 import (
+	"context"
+	"errors"
 	// "fmt"
 	"strings"
 	"testing"
@@ -47,7 +49,7 @@ func TestVerifyNameError(t *testing.T) {
 	records := []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err := verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	_, err := verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNameError failed for valid name error response: %s", err)
 	}
@@ -56,7 +58,7 @@ func TestVerifyNameError(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("org.", "", false, nil),
 	}
-	err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	_, err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNameError didn't fail for invalid name error response without CE")
 	}
@@ -65,7 +67,7 @@ func TestVerifyNameError(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("com.", "", false, nil),
 	}
-	err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	_, err = verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNameError didn't fail for invalid name error response without source of synthesis coverer")
 	}
@@ -74,18 +76,43 @@ func TestVerifyNameError(t *testing.T) {
 	records = zoneToRecords(t, `0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG
 b4um86eghhds6nea196smvmlo4ors995.example. 3600 IN NSEC3 1 1 12 aabbccdd gjeqe526plbf1g8mklp59enfd789njgi MX RRSIG
 35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd b4um86eghhds6nea196smvmlo4ors995 NS DS RRSIG`)
-	err = verifyNameError(&Question{Name: "a.c.x.w.example.", Type: dns.TypeA}, records)
+	_, err = verifyNameError(&Question{Name: "a.c.x.w.example.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNameError failed with RFC5155 Appendix B.1 example: %s", err)
 	}
 }
 
+func TestNameErrorDenialProof(t *testing.T) {
+	// RFC5155 Appendix B.1 example, next hashed owner names are upper case
+	// since NSEC3.Cover compares them against upper case hashes
+	records := zoneToRecords(t, `0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR MX DNSKEY NS SOA NSEC3PARAM RRSIG
+b4um86eghhds6nea196smvmlo4ors995.example. 3600 IN NSEC3 1 1 12 aabbccdd GJEQE526PLBF1G8MKLP59ENFD789NJGI MX RRSIG
+35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd B4UM86EGHHDS6NEA196SMVMLO4ORS995 NS DS RRSIG`)
+	proof, err := verifyNameError(&Question{Name: "a.c.x.w.example.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
+	if err != nil {
+		t.Fatalf("verifyNameError failed with RFC5155 Appendix B.1 example: %s", err)
+	}
+	for _, tc := range []struct {
+		field    string
+		got      dns.RR
+		expected dns.RR
+	}{
+		{"closest encloser", proof.ClosestEncloser, records[1]},
+		{"next closer", proof.NextCloser, records[0]},
+		{"wildcard", proof.Wildcard, records[2]},
+	} {
+		if tc.got != tc.expected {
+			t.Fatalf("verifyNameError returned the wrong %s record: expected %s, got %s", tc.field, tc.expected, tc.got)
+		}
+	}
+}
+
 func TestVerifyNODATA(t *testing.T) {
 	// Valid NODATA
 	records := []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err := verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	_, err := verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed for valid NODATA: %s", err)
 	}
@@ -94,7 +121,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, []uint16{dns.TypeA}),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	_, err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyNODATA didn't fail for invalid NODATA with question type bit set")
 	}
@@ -103,7 +130,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, []uint16{dns.TypeCNAME}),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records)
+	_, err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyNODATA didn't fail for invalid NODATA with CNAME bit set")
 	}
@@ -112,7 +139,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", true, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	_, err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed for valid NODATA with covered NC: %s", err)
 	}
@@ -121,7 +148,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeA}, records)
+	_, err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA with covered NC with non-DS question type")
 	}
@@ -130,7 +157,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	_, err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA without covered NC")
 	}
@@ -139,7 +166,7 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("org.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeDS}, records)
+	_, err = verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeDS}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA without CE")
 	}
@@ -148,26 +175,62 @@ func TestVerifyNODATA(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("example.com.", "", false, nil),
 	}
-	err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records)
+	_, err = verifyNODATA(&Question{Name: "a.example.com.", Type: dns.TypeDS}, records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatalf("verifyNODATA didn't fail for invalid NODATA with covered NC without opt-out set")
 	}
 
 	// RFC5155 Appendix B.2 example
 	records = zoneToRecords(t, `2t7b4g4vsa5smi47k61mv5bv1a22bojr.example. 3600 IN NSEC3 1 1 12 aabbccdd 2vptu5timamqttgl4luu9kg21e0aor3s A RRSIG`)
-	err = verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeMX}, records)
+	_, err = verifyNODATA(&Question{Name: "ns1.example.", Type: dns.TypeMX}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed with RFC5155 Appendix B.2 example: %s", err)
 	}
 
 	// RFC5155 Appendix B.2.1 example
 	records = zoneToRecords(t, `ji6neoaepv8b5o6k4ev33abha8ht9fgc.example. 3600 IN NSEC3 1 1 12 aabbccdd k8udemvp1j2f7eg6jebps17vp3n8i58h`)
-	err = verifyNODATA(&Question{Name: "y.w.example.", Type: dns.TypeA}, records)
+	_, err = verifyNODATA(&Question{Name: "y.w.example.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyNODATA failed with RFC5155 Appendix B.2.1 example: %s", err)
 	}
 }
 
+func TestVerifyWildcardNODATA(t *testing.T) {
+	// RFC5155 Appendix B.5 example, next hashed owner names are upper case
+	// since NSEC3.Cover compares them against upper case hashes
+	records := zoneToRecords(t, `k8udemvp1j2f7eg6jebps17vp3n8i58h.example. 3600 IN NSEC3 1 1 12 aabbccdd KOHAR7MBB8DC2CE8A9QVL8HON4K53UHI
+q04jkcevqvmu85r014c7dkba38o0ji5r.example. 3600 IN NSEC3 1 1 12 aabbccdd R53BQ7CC2UVMUBFU5OCMM6PERS9TK9EN A RRSIG
+r53bq7cc2uvmubfu5ocmm6pers9tk9en.example. 3600 IN NSEC3 1 1 12 aabbccdd T644EBQK9BIBCNA874GIVR6JOJ62MLHV MX RRSIG`)
+	_, err := verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, records, DefaultMaxNSEC3Iterations)
+	if err != nil {
+		t.Fatalf("verifyNODATA failed with RFC5155 Appendix B.5 example: %s", err)
+	}
+
+	// Invalid wildcard NODATA, question type bit set on wildcard
+	_, err = verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeMX}, records, DefaultMaxNSEC3Iterations)
+	if err != ErrNSECTypeExists {
+		t.Fatalf("verifyNODATA didn't fail for wildcard NODATA with question type bit set: %v", err)
+	}
+
+	// Invalid wildcard NODATA, no NSEC3 matching the wildcard
+	_, err = verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, records[:2], DefaultMaxNSEC3Iterations)
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail for wildcard NODATA without wildcard match")
+	}
+
+	// Invalid wildcard NODATA, next closer not covered
+	_, err = verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, []dns.RR{records[0], records[2]}, DefaultMaxNSEC3Iterations)
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail for wildcard NODATA without next closer coverage")
+	}
+
+	// Invalid wildcard NODATA, no closest encloser
+	_, err = verifyNODATA(&Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, records[1:], DefaultMaxNSEC3Iterations)
+	if err == nil {
+		t.Fatal("verifyNODATA didn't fail for wildcard NODATA without closest encloser")
+	}
+}
+
 // func TestVerifyWildcardAnswer(t *testing.T) {
 // }
 
@@ -176,7 +239,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records := []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS}),
 	}
-	err := verifyDelegation("a.b.com.", records)
+	_, err := verifyDelegation("a.b.com.", records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed for a direct delegation match: %s", err)
 	}
@@ -185,7 +248,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, nil),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	_, err = verifyDelegation("a.b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with NS bit not set")
 	}
@@ -194,7 +257,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS, dns.TypeDS}),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	_, err = verifyDelegation("a.b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with DS bit set")
 	}
@@ -203,7 +266,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("a.b.com.", "b.b.com.", false, []uint16{dns.TypeNS, dns.TypeSOA}),
 	}
-	err = verifyDelegation("a.b.com.", records)
+	_, err = verifyDelegation("a.b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with SOA bit set")
 	}
@@ -213,7 +276,7 @@ func TestVerifyDelegation(t *testing.T) {
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),  // CE
 		makeNSEC3("a.com.", "e.com.", true, []uint16{dns.TypeNS}), // NC coverer, e.com is a lucky hash, thats not how ordering works
 	}
-	err = verifyDelegation("b.com.", records)
+	_, err = verifyDelegation("b.com.", records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed for a opt-out delegation match: %s", err)
 	}
@@ -222,7 +285,7 @@ func TestVerifyDelegation(t *testing.T) {
 	records = []dns.RR{
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),
 	}
-	err = verifyDelegation("b.com.", records)
+	_, err = verifyDelegation("b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with no Next Closer")
 	}
@@ -232,14 +295,14 @@ func TestVerifyDelegation(t *testing.T) {
 		makeNSEC3("com.", "a.com.", false, []uint16{dns.TypeNS}),
 		makeNSEC3("a.com.", "e.com.", false, []uint16{dns.TypeNS}),
 	}
-	err = verifyDelegation("b.com.", records)
+	_, err = verifyDelegation("b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with Opt-Out bit not set on NC")
 	}
 
 	// Invalid Opt-Out delegation, empty NSEC3 set
 	records = []dns.RR{}
-	err = verifyDelegation("b.com.", records)
+	_, err = verifyDelegation("b.com.", records, DefaultMaxNSEC3Iterations)
 	if err == nil {
 		t.Fatal("verifyDelegation didn't fail for a direct delegation with empty NSEC3 set")
 	}
@@ -247,8 +310,341 @@ func TestVerifyDelegation(t *testing.T) {
 	// RFC5155 Appendix B.3 example
 	records = zoneToRecords(t, `35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd b4um86eghhds6nea196smvmlo4ors995 NS DS RRSIG
 0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG`)
-	err = verifyDelegation("c.example.", records)
+	_, err = verifyDelegation("c.example.", records, DefaultMaxNSEC3Iterations)
 	if err != nil {
 		t.Fatalf("verifyDelegation failed wtih opt out delegation example from RFC5155: %s", err)
 	}
 }
+
+func TestMalformedNSEC3(t *testing.T) {
+	valid := makeNSEC3("example.com.", "", false, nil)
+	if _, err := checkNSEC3([]dns.RR{valid}, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("checkNSEC3 rejected valid record: %s", err)
+	}
+	emptySalt := makeNSEC3("example.com.", "", false, nil)
+	emptySalt.Salt, emptySalt.SaltLength = "-", 0
+	if _, err := checkNSEC3([]dns.RR{emptySalt}, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("checkNSEC3 rejected record with empty salt: %s", err)
+	}
+
+	badSaltLength := makeNSEC3("example.com.", "", false, nil)
+	badSaltLength.SaltLength = 4
+	badSalt := makeNSEC3("example.com.", "", false, nil)
+	badSalt.Salt = "ZZZZ"
+	badHashLength := makeNSEC3("example.com.", "", false, nil)
+	badHashLength.HashLength = 32
+	badNext := makeNSEC3("example.com.", "", false, nil)
+	badNext.NextDomain = badNext.NextDomain[:30]
+	for _, n := range []*dns.NSEC3{badSaltLength, badSalt, badHashLength, badNext} {
+		records := []dns.RR{valid, n}
+		if _, err := verifyNameError(&Question{Name: "a.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations); err != ErrMalformedNSEC3 {
+			t.Fatalf("verifyNameError didn't reject malformed record %s: %v", n, err)
+		}
+		if _, err := verifyNODATA(&Question{Name: "example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations); err != ErrMalformedNSEC3 {
+			t.Fatalf("verifyNODATA didn't reject malformed record %s: %v", n, err)
+		}
+		if _, err := verifyDelegation("example.com.", records, DefaultMaxNSEC3Iterations); err != ErrMalformedNSEC3 {
+			t.Fatalf("verifyDelegation didn't reject malformed record %s: %v", n, err)
+		}
+	}
+}
+
+func TestFindClosestEncloser(t *testing.T) {
+	// covers every hash other than the two endpoints
+	coverAll := makeNSEC3("example.com.", "", false, nil)
+	coverAll.Hdr.Name = strings.Repeat("0", 32) + ".com"
+	coverAll.NextDomain = strings.Repeat("V", 32)
+
+	// example.com. is a encloser of a.b.example.com. but not the closest
+	// one, a scan that accepts the first matching record would pick it
+	apex := makeNSEC3("example.com.", "", false, []uint16{dns.TypeSOA, dns.TypeNS})
+	closest := makeNSEC3("b.example.com.", "", false, []uint16{dns.TypeA})
+	for _, records := range [][]dns.RR{
+		{apex, closest, coverAll},
+		{coverAll, closest, apex},
+	} {
+		ce, nc, match := findClosestEncloser("a.b.example.com.", records)
+		if ce != "b.example.com." || nc != "a.b.example.com." || match != closest {
+			t.Fatalf("findClosestEncloser returned wrong closest encloser: ce %q, nc %q, match %v", ce, nc, match)
+		}
+		proof, err := verifyNameError(&Question{Name: "a.b.example.com.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations)
+		if err != nil {
+			t.Fatalf("verifyNameError failed: %s", err)
+		}
+		if proof.ClosestEncloser != closest {
+			t.Fatalf("verifyNameError used wrong closest encloser: %s", proof.ClosestEncloser)
+		}
+	}
+
+	// next closer isn't covered, so there may be a closer encloser
+	if ce, _, _ := findClosestEncloser("a.b.example.com.", []dns.RR{apex, closest}); ce != "" {
+		t.Fatalf("findClosestEncloser returned %q without next closer coverage", ce)
+	}
+
+	// conflicting records for the closest encloser
+	conflicting := makeNSEC3("b.example.com.", "", false, []uint16{dns.TypeTXT})
+	if ce, _, _ := findClosestEncloser("a.b.example.com.", []dns.RR{closest, conflicting, coverAll}); ce != "" {
+		t.Fatalf("findClosestEncloser returned %q with conflicting matching records", ce)
+	}
+
+}
+
+// nsecExample is the NSEC chain of the RFC 4035 Appendix A example zone
+const nsecExample = `example. 3600 IN NSEC a.example. NS SOA MX RRSIG NSEC DNSKEY
+a.example. 3600 IN NSEC ai.example. NS DS RRSIG NSEC
+ai.example. 3600 IN NSEC b.example. A HINFO AAAA RRSIG NSEC
+b.example. 3600 IN NSEC ns1.example. NS RRSIG NSEC
+ns1.example. 3600 IN NSEC ns2.example. A RRSIG NSEC
+ns2.example. 3600 IN NSEC *.w.example. A RRSIG NSEC
+*.w.example. 3600 IN NSEC x.w.example. MX RRSIG NSEC
+x.w.example. 3600 IN NSEC x.y.w.example. MX RRSIG NSEC
+x.y.w.example. 3600 IN NSEC xx.example. MX RRSIG NSEC
+xx.example. 3600 IN NSEC example. A HINFO AAAA RRSIG NSEC`
+
+func TestVerifyNSECNameError(t *testing.T) {
+	records := zoneToRecords(t, nsecExample)
+
+	// RFC 4035 Appendix B.2 example
+	proof, err := verifyNameError(&Question{Name: "ml.example.", Type: dns.TypeA}, []dns.RR{records[3], records[0]}, DefaultMaxNSEC3Iterations)
+	if err != nil {
+		t.Fatalf("verifyNameError failed with RFC 4035 Appendix B.2 example: %s", err)
+	}
+	if proof.NextCloser != records[3] || proof.Wildcard != records[0] {
+		t.Fatalf("verifyNameError returned wrong proof: %+v", proof)
+	}
+
+	// the last record in the chain wraps around to the apex
+	if _, err := verifyNameError(&Question{Name: "zz.example.", Type: dns.TypeA}, []dns.RR{records[9], records[0]}, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("verifyNameError failed with name covered by last NSEC record: %s", err)
+	}
+
+	// wildcard isn't covered
+	if _, err := verifyNameError(&Question{Name: "ml.example.", Type: dns.TypeA}, []dns.RR{records[3]}, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyNameError didn't fail without wildcard coverage: %v", err)
+	}
+
+	// the name exists
+	if _, err := verifyNameError(&Question{Name: "ns1.example.", Type: dns.TypeA}, records, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyNameError didn't fail for existing name: %v", err)
+	}
+
+	// names below a delegation aren't covered by the NSEC record at the
+	// delegation point
+	if _, err := verifyNameError(&Question{Name: "mc.b.example.", Type: dns.TypeA}, []dns.RR{records[3], records[0]}, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyNameError accepted NSEC record from delegation point: %v", err)
+	}
+}
+
+func TestVerifyNSECNODATA(t *testing.T) {
+	records := zoneToRecords(t, nsecExample)
+
+	for _, tc := range []struct {
+		q   Question
+		err error
+	}{
+		// RFC 4035 Appendix B.3 example
+		{Question{Name: "ns1.example.", Type: dns.TypeMX}, nil},
+		// RFC 4035 Appendix B.7 wildcard NODATA example
+		{Question{Name: "a.z.w.example.", Type: dns.TypeAAAA}, nil},
+		// RFC 4035 Appendix B.8 DS NODATA example
+		{Question{Name: "ai.example.", Type: dns.TypeDS}, nil},
+		// empty non-terminal
+		{Question{Name: "y.w.example.", Type: dns.TypeA}, nil},
+		// insecure delegation, but not a DS question
+		{Question{Name: "b.example.", Type: dns.TypeA}, ErrNSECMismatch},
+		// type exists
+		{Question{Name: "ns1.example.", Type: dns.TypeA}, ErrNSECTypeExists},
+		// type exists at wildcard
+		{Question{Name: "a.z.w.example.", Type: dns.TypeMX}, ErrNSECTypeExists},
+		// DS question answered from the child apex
+		{Question{Name: "example.", Type: dns.TypeDS}, ErrNSECMismatch},
+	} {
+		if _, err := verifyNODATA(&tc.q, records, DefaultMaxNSEC3Iterations); err != tc.err {
+			t.Fatalf("verifyNODATA for %s %s returned %v, expected %v", tc.q.Name, dns.TypeToString[tc.q.Type], err, tc.err)
+		}
+	}
+}
+
+func TestVerifyNSECDelegation(t *testing.T) {
+	records := zoneToRecords(t, nsecExample)
+
+	// RFC 4035 Appendix B.4 example
+	if _, err := verifyDelegation("b.example.", records, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("verifyDelegation failed with RFC 4035 Appendix B.4 example: %s", err)
+	}
+	if _, err := verifyDelegation("a.example.", records, DefaultMaxNSEC3Iterations); err != ErrNSECBadDelegation {
+		t.Fatalf("verifyDelegation didn't fail for delegation with DS records: %v", err)
+	}
+	if _, err := verifyDelegation("ns1.example.", records, DefaultMaxNSEC3Iterations); err != ErrNSECNSMissing {
+		t.Fatalf("verifyDelegation didn't fail for name without NS records: %v", err)
+	}
+	if _, err := verifyDelegation("c.example.", records, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyDelegation didn't fail without matching record: %v", err)
+	}
+}
+
+func TestLookupNSECDenial(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `a.example. 300 IN A 1.2.3.4
+b.c.example. 300 IN A 1.2.3.4`)
+	example.nsec = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	for _, q := range []Question{
+		{Name: "missing.example.", Type: dns.TypeA},
+		{Name: "a.example.", Type: dns.TypeTXT},
+		{Name: "c.example.", Type: dns.TypeA},
+	} {
+		answer, ll, err := rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Lookup for %s failed: %s", q.Name, err)
+		}
+		if !answer.Authenticated {
+			t.Fatalf("Lookup for %s returned unauthenticated answer", q.Name)
+		}
+		if last := ll.Composites[len(ll.Composites)-1]; last.DenialProof == nil {
+			t.Fatalf("Lookup for %s didn't record denial proof", q.Name)
+		}
+	}
+}
+
+func TestVerifyWildcardAnswer(t *testing.T) {
+	// RFC5155 Appendix B.4 example, the NSEC3 record covers the next closer
+	// name z.w.example.
+	records := zoneToRecords(t, `q04jkcevqvmu85r014c7dkba38o0ji5r.example. 3600 IN NSEC3 1 1 12 aabbccdd R53BQ7CC2UVMUBFU5OCMM6PERS9TK9EN A RRSIG`)
+	q := &Question{Name: "a.z.w.example.", Type: dns.TypeMX}
+	proof, err := verifyWildcardAnswer(q, records, 2, DefaultMaxNSEC3Iterations)
+	if err != nil {
+		t.Fatalf("verifyWildcardAnswer failed with RFC5155 Appendix B.4 example: %s", err)
+	}
+	if proof.NextCloser != records[0] {
+		t.Fatalf("verifyWildcardAnswer returned the wrong next closer record: %s", proof.NextCloser)
+	}
+
+	// the record doesn't cover the next closer name of a different wildcard
+	if _, err := verifyWildcardAnswer(q, records, 1, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyWildcardAnswer didn't fail without next closer coverage: %v", err)
+	}
+	if _, err := verifyWildcardAnswer(q, nil, 2, DefaultMaxNSEC3Iterations); err != ErrNSECMissingCoverage {
+		t.Fatalf("verifyWildcardAnswer didn't fail without NSEC3 records: %v", err)
+	}
+	// not a wildcard answer
+	if _, err := verifyWildcardAnswer(q, records, 4, DefaultMaxNSEC3Iterations); err != ErrNSECMismatch {
+		t.Fatalf("verifyWildcardAnswer didn't fail for RRSIG with all labels: %v", err)
+	}
+
+	// RFC 4035 Appendix B.6 example
+	nsec := zoneToRecords(t, nsecExample)
+	if _, err := verifyWildcardAnswer(q, []dns.RR{nsec[8]}, 2, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("verifyWildcardAnswer failed with RFC 4035 Appendix B.6 example: %s", err)
+	}
+	// x.y.w.example. exists, so *.w.example. can't be used for names below it
+	if _, err := verifyWildcardAnswer(&Question{Name: "a.x.y.w.example.", Type: dns.TypeMX}, []dns.RR{nsec[8]}, 2, DefaultMaxNSEC3Iterations); err != ErrNSECMismatch {
+		t.Fatalf("verifyWildcardAnswer didn't fail for wildcard with closer encloser: %v", err)
+	}
+}
+
+func TestLookupWildcardAnswer(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `*.w.example. 300 IN A 1.2.3.4`)
+	example.nsec = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	answer, ll, err := rr.Lookup(context.Background(), Question{Name: "a.w.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !answer.Authenticated || len(extractRRSet(answer.Answer, "a.w.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %+v", answer)
+	}
+	if last := ll.Composites[len(ll.Composites)-1]; last.DenialProof == nil {
+		t.Fatal("Lookup didn't record wildcard proof")
+	}
+}
+
+func TestLookupLiteralWildcard(t *testing.T) {
+	// the wildcard owner name itself can be queried, the answer isn't a
+	// expansion so doesn't need proof that the name doesn't exist
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `*.w.example. 300 IN A 1.2.3.4`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "*.w.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup of wildcard owner name failed: %s", err)
+	}
+	if !answer.Authenticated || len(extractRRSet(answer.Answer, "*.w.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup of wildcard owner name returned wrong answer: %+v", answer)
+	}
+}
+
+func TestLookupUnprovenWildcardAnswer(t *testing.T) {
+	// without proof that the name doesn't exist the answer could have been
+	// replayed from another name covered by the wildcard
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `*.w.example. 300 IN A 1.2.3.4`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "a.w.example.", Type: dns.TypeA})
+	if !errors.Is(err, ErrNSECMissingCoverage) {
+		t.Fatalf("Lookup didn't fail for unproven wildcard answer: %v", err)
+	}
+	if !ll.Bogus {
+		t.Fatal("Lookup didn't mark unproven wildcard answer as bogus")
+	}
+}
+
+func TestNSEC3Limits(t *testing.T) {
+	q := &Question{Name: "a.example.com.", Type: dns.TypeA}
+	expensive := makeNSEC3("example.com.", "", false, nil)
+	expensive.Iterations = DefaultMaxNSEC3Iterations + 1
+	unknownHash := makeNSEC3("example.com.", "", false, nil)
+	unknownHash.Hash = 2
+
+	for _, tc := range []struct {
+		record dns.RR
+		err    error
+	}{
+		{expensive, ErrNSEC3IterationsTooHigh},
+		{unknownHash, ErrNSEC3UnknownHash},
+	} {
+		records := []dns.RR{tc.record}
+		if _, err := verifyNameError(q, records, DefaultMaxNSEC3Iterations); err != tc.err {
+			t.Fatalf("verifyNameError returned %v, expected %v", err, tc.err)
+		}
+		if _, err := verifyNODATA(q, records, DefaultMaxNSEC3Iterations); err != tc.err {
+			t.Fatalf("verifyNODATA returned %v, expected %v", err, tc.err)
+		}
+		if _, err := verifyDelegation("a.example.com.", records, DefaultMaxNSEC3Iterations); err != tc.err {
+			t.Fatalf("verifyDelegation returned %v, expected %v", err, tc.err)
+		}
+		if _, err := verifyWildcardAnswer(q, records, 2, DefaultMaxNSEC3Iterations); err != tc.err {
+			t.Fatalf("verifyWildcardAnswer returned %v, expected %v", err, tc.err)
+		}
+	}
+
+	// without a limit the iteration count isn't checked
+	if _, err := checkNSEC3([]dns.RR{expensive}, 0); err != nil {
+		t.Fatalf("checkNSEC3 without a limit failed: %s", err)
+	}
+	// records with a unknown hash algorithm are ignored rather than
+	// failing a proof made by the other records (RFC 5155 Section 8.1)
+	records := zoneToRecords(t, `35mthgpgcu1qg68fab165klnsnk3dpvl.example. 3600 IN NSEC3 1 1 12 aabbccdd b4um86eghhds6nea196smvmlo4ors995 NS DS RRSIG
+0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example. 3600 IN NSEC3 1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr MX DNSKEY NS SOA NSEC3PARAM RRSIG`)
+	records = append(records, unknownHash)
+	if _, err := verifyDelegation("c.example.", records, DefaultMaxNSEC3Iterations); err != nil {
+		t.Fatalf("verifyDelegation failed with a record with a unknown hash algorithm: %s", err)
+	}
+
+	if rr := NewRecursiveResolver(false, true, nil, nil, nil); rr.MaxNSEC3Iterations != DefaultMaxNSEC3Iterations {
+		t.Fatalf("NewRecursiveResolver set MaxNSEC3Iterations to %d", rr.MaxNSEC3Iterations)
+	}
+}
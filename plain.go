@@ -0,0 +1,64 @@
+package solvere
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PlainRecord is a resource record described using only basic types, Data is
+// the RDATA in presentation format
+type PlainRecord struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data string
+}
+
+// PlainAnswer is a Answer described using only basic types, so that it can be
+// used, or serialized, without depending on the dns package
+type PlainAnswer struct {
+	Rcode         string
+	Authenticated bool
+	Answer        []PlainRecord `json:",omitempty"`
+	Authority     []PlainRecord `json:",omitempty"`
+	Additional    []PlainRecord `json:",omitempty"`
+	Aliases       []PlainRecord `json:",omitempty"`
+	Delegations   []ZoneCut     `json:",omitempty"`
+}
+
+// plainRecords converts records to PlainRecords, OPT records are skipped
+func plainRecords(records []dns.RR) []PlainRecord {
+	var out []PlainRecord
+	for _, r := range records {
+		h := r.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, PlainRecord{
+			Name: h.Name,
+			Type: typeString(h.Rrtype),
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(r.String(), h.String()),
+		})
+	}
+	return out
+}
+
+// Plain returns the answer as a PlainAnswer
+func (a *Answer) Plain() *PlainAnswer {
+	rcode, present := dns.RcodeToString[a.Rcode]
+	if !present {
+		rcode = "RCODE" + strconv.Itoa(a.Rcode)
+	}
+	return &PlainAnswer{
+		Rcode:         rcode,
+		Authenticated: a.Authenticated,
+		Answer:        plainRecords(a.Answer),
+		Authority:     plainRecords(a.Authority),
+		Additional:    plainRecords(a.Additional),
+		Aliases:       plainRecords(a.Aliases),
+		Delegations:   a.Delegations,
+	}
+}
@@ -0,0 +1,59 @@
+package solvere
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnswerPlain(t *testing.T) {
+	records := zoneToRecords(t, `www.example. 300 IN CNAME example.
+example. 300 IN A 1.2.3.4
+example. 300 IN TXT "hello world"
+example. 3600 IN NS ns.example.
+ns.example. 3600 IN AAAA 2001:db8::1`)
+	a := &Answer{
+		Answer:        records[1:3],
+		Authority:     records[3:4],
+		Additional:    append(records[4:], &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}),
+		Aliases:       records[:1],
+		Rcode:         dns.RcodeSuccess,
+		Authenticated: true,
+	}
+	p := a.Plain()
+	if p.Rcode != "NOERROR" || !p.Authenticated {
+		t.Fatalf("Plain answer has wrong rcode or authentication: %+v", p)
+	}
+	expected := map[string][]PlainRecord{
+		"Answer": {
+			{Name: "example.", Type: "A", TTL: 300, Data: "1.2.3.4"},
+			{Name: "example.", Type: "TXT", TTL: 300, Data: `"hello world"`},
+		},
+		"Authority":  {{Name: "example.", Type: "NS", TTL: 3600, Data: "ns.example."}},
+		"Additional": {{Name: "ns.example.", Type: "AAAA", TTL: 3600, Data: "2001:db8::1"}},
+		"Aliases":    {{Name: "www.example.", Type: "CNAME", TTL: 300, Data: "example."}},
+	}
+	for section, records := range map[string][]PlainRecord{
+		"Answer":     p.Answer,
+		"Authority":  p.Authority,
+		"Additional": p.Additional,
+		"Aliases":    p.Aliases,
+	} {
+		if len(records) != len(expected[section]) {
+			t.Fatalf("Plain %s section has wrong records: expected %v, got %v", section, expected[section], records)
+		}
+		for i, r := range records {
+			if r != expected[section][i] {
+				t.Fatalf("Plain %s section has wrong record: expected %+v, got %+v", section, expected[section][i], r)
+			}
+		}
+	}
+
+	if _, err := json.Marshal(p); err != nil {
+		t.Fatalf("Failed to marshal plain answer: %s", err)
+	}
+	if p := (&Answer{Rcode: 3000}).Plain(); p.Rcode != "RCODE3000" {
+		t.Fatalf("Plain answer has wrong rcode for unknown rcode: %s", p.Rcode)
+	}
+}
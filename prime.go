@@ -0,0 +1,88 @@
+package solvere
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// roots returns the current root nameservers
+func (rr *RecursiveResolver) roots() []Nameserver {
+	rr.rootMu.RLock()
+	defer rr.rootMu.RUnlock()
+	return rr.rootNameservers
+}
+
+// primingNameservers returns the root nameservers listed in a response to a
+// priming query, using the addresses from the additional section.
+// Nameservers without addresses are skipped.
+func (rr *RecursiveResolver) primingNameservers(m *dns.Msg) ([]Nameserver, error) {
+	nsSet := extractRRSet(m.Answer, ".", dns.TypeNS)
+	if len(nsSet) == 0 {
+		return nil, ErrNoNSAuthorties
+	}
+	var roots []Nameserver
+	for _, r := range nsSet {
+		name := r.(*dns.NS).Ns
+		for _, a := range extractRRSet(m.Extra, name, dns.TypeA, dns.TypeAAAA) {
+			switch addr := a.(type) {
+			case *dns.A:
+				roots = append(roots, Nameserver{name, addr.A.String(), "."})
+			case *dns.AAAA:
+				if rr.useIPv6 {
+					roots = append(roots, Nameserver{name, addr.AAAA.String(), "."})
+				}
+			}
+		}
+	}
+	if len(roots) == 0 {
+		return nil, ErrNoAuthorityAddress
+	}
+	return roots, nil
+}
+
+// PrimeRoot sends a priming query (RFC 8109) for the root NS RRset to the
+// current root nameservers, initially those from the hints the resolver was
+// created with, and replaces them with the nameservers in the response. The
+// first root nameserver to respond successfully is used. If the resolver
+// validates responses the NS RRset must be signed by the root keys. If
+// priming fails the error is returned and the current root nameservers are
+// kept.
+func (rr *RecursiveResolver) PrimeRoot(ctx context.Context) error {
+	current := rr.roots()
+	if len(current) == 0 {
+		return ErrNoAuthorityAddress
+	}
+	q := &Question{Name: ".", Type: dns.TypeNS}
+	var err error
+	for i := range current {
+		auth := &current[i]
+		var m *dns.Msg
+		m, _, err = rr.query(ctx, q, auth, LookupOptions{NoCache: true})
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			continue
+		}
+		if m.Rcode != dns.RcodeSuccess {
+			err = ErrBadAnswer
+			continue
+		}
+		if rr.useDNSSEC && !rr.validationDisabled(".") {
+			anchor, _ := rr.trustAnchor(".")
+			if _, err = rr.checkSignatures(ctx, m, auth, current, anchor); err != nil {
+				continue
+			}
+		}
+		var roots []Nameserver
+		if roots, err = rr.primingNameservers(m); err != nil {
+			continue
+		}
+		rr.rootMu.Lock()
+		rr.rootNameservers = roots
+		rr.rootMu.Unlock()
+		return nil
+	}
+	return err
+}
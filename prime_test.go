@@ -0,0 +1,50 @@
+package solvere
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrimeRoot(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, `. 3600 IN NS k.root-servers.net.
+. 3600 IN NS l.root-servers.net.
+. 3600 IN NS m.root-servers.net.
+k.root-servers.net. 3600 IN A 127.0.0.2
+l.root-servers.net. 3600 IN AAAA ::1
+a. 300 IN A 1.2.3.4`)
+	corrupt := newTestZone(t, ".", "127.0.0.3", true, ". 3600 IN NS k.root-servers.net.\nk.root-servers.net. 3600 IN A 127.0.0.3")
+	corrupt.corrupt = true
+	defer startTestZones(t, root, corrupt)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	if err := rr.PrimeRoot(context.Background()); err != nil {
+		t.Fatalf("PrimeRoot failed: %s", err)
+	}
+	// nameservers without a address of a family the resolver uses are
+	// skipped
+	expected := []Nameserver{{Name: "k.root-servers.net.", Addr: "127.0.0.2", Zone: "."}}
+	if !reflect.DeepEqual(rr.roots(), expected) {
+		t.Fatalf("PrimeRoot set unexpected root nameservers: expected %v, got %v", expected, rr.roots())
+	}
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "a.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup after priming failed: %s", err)
+	}
+	if !answer.Authenticated {
+		t.Fatal("Lookup after priming wasn't authenticated")
+	}
+
+	// a priming response that fails validation is ignored and the hints
+	// are kept
+	rr = newTestResolver(corrupt, NewBasicCache())
+	hints := rr.roots()
+	if err := rr.PrimeRoot(context.Background()); err == nil {
+		t.Fatal("PrimeRoot with invalid signatures didn't fail")
+	}
+	if !reflect.DeepEqual(rr.roots(), hints) {
+		t.Fatalf("Failed PrimeRoot changed root nameservers: %v", rr.roots())
+	}
+}
@@ -0,0 +1,71 @@
+package solvere
+
+import (
+	"runtime"
+	"time"
+)
+
+// LookupProfile describes the resources used by a single call to Lookup or
+// LookupWithOptions, for tuning the resolver under load
+type LookupProfile struct {
+	Question Question
+	// Duration is the total time the lookup took
+	Duration time.Duration
+	// ExchangeTime is the time spent waiting on the network for responses,
+	// and ValidationTime the time spent validating them, summed across all
+	// of the queries made during the lookup
+	ExchangeTime   time.Duration
+	ValidationTime time.Duration
+	// Queries is the number of queries sent to nameservers
+	Queries int
+	// Failed indicates the lookup returned a error
+	Failed bool
+	// Allocs and AllocBytes are the number of heap allocations made, and
+	// bytes allocated, during the lookup, they are only recorded if
+	// ProfileAllocations is set. Since the memory statistics are process
+	// wide they include allocations made by anything else running at the
+	// same time, including concurrent lookups.
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// addLog adds the exchange and validation times and queries recorded in ll,
+// and its composites, to the profile
+func (lp *LookupProfile) addLog(ll *LookupLog) {
+	if ll == nil {
+		return
+	}
+	lp.ExchangeTime += ll.ExchangeLatency
+	lp.ValidationTime += ll.ValidationLatency
+	if ll.NS != nil && !ll.CacheHit {
+		lp.Queries++
+	}
+	for _, c := range ll.Composites {
+		lp.addLog(c)
+	}
+}
+
+// profileLookup calls lookup and passes a LookupProfile describing it to the
+// OnProfile hook, if it is set. Otherwise lookup is called without any
+// overhead.
+func (rr *RecursiveResolver) profileLookup(q Question, lookup func() (*Answer, *LookupLog, error)) (*Answer, *LookupLog, error) {
+	if rr.OnProfile == nil {
+		return lookup()
+	}
+	var before runtime.MemStats
+	if rr.ProfileAllocations {
+		runtime.ReadMemStats(&before)
+	}
+	s := time.Now()
+	answer, ll, err := lookup()
+	p := &LookupProfile{Question: q, Duration: time.Since(s), Failed: err != nil}
+	if rr.ProfileAllocations {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		p.Allocs = after.Mallocs - before.Mallocs
+		p.AllocBytes = after.TotalAlloc - before.TotalAlloc
+	}
+	p.addLog(ll)
+	rr.OnProfile(p)
+	return answer, ll, err
+}
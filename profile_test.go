@@ -0,0 +1,50 @@
+package solvere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupProfile(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	var profiles []*LookupProfile
+	rr.OnProfile = func(p *LookupProfile) { profiles = append(profiles, p) }
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	if _, _, err := rr.Lookup(context.Background(), q); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(profiles) != 1 {
+		t.Fatalf("OnProfile hook called %d times, expected once", len(profiles))
+	}
+	p := profiles[0]
+	if p.Question != q || p.Failed {
+		t.Fatalf("Profile describes the wrong lookup: %+v", p)
+	}
+	if p.Duration <= 0 || p.ExchangeTime <= 0 || p.ValidationTime <= 0 || p.Queries == 0 {
+		t.Fatalf("Profile is missing timings or queries: %+v", p)
+	}
+	if p.ExchangeTime+p.ValidationTime > p.Duration {
+		t.Fatalf("Profile exchange and validation times exceed the lookup duration: %+v", p)
+	}
+	if p.Allocs != 0 || p.AllocBytes != 0 {
+		t.Fatal("Profile recorded allocations without ProfileAllocations set")
+	}
+
+	rr.ProfileAllocations = true
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("OnProfile hook called %d times, expected twice", len(profiles))
+	}
+	if p := profiles[1]; p.Allocs == 0 || p.AllocBytes == 0 {
+		t.Fatalf("Profile didn't record allocations with ProfileAllocations set: %+v", p)
+	}
+}
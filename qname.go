@@ -0,0 +1,24 @@
+package solvere
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// minimizedQuestion returns the question to send to the nameservers for zone
+// when resolving q with QNAME minimization (RFC 7816), a NS query for the name
+// one label below zone towards the name of q. If that name is the name of q
+// itself q is returned and false, since the full question has to be sent.
+func minimizedQuestion(q Question, zone string) (Question, bool) {
+	if !dns.IsSubDomain(zone, q.Name) {
+		return q, false
+	}
+	labels := dns.SplitDomainName(q.Name)
+	// the number of labels of the name below zone to keep
+	keep := dns.CountLabel(zone) + 1
+	if keep >= len(labels) {
+		return q, false
+	}
+	return Question{Name: dns.Fqdn(strings.Join(labels[len(labels)-keep:], ".")), Type: dns.TypeNS}, true
+}
@@ -0,0 +1,129 @@
+package solvere
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMinimizedQuestion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		zone     string
+		expected string
+		probe    bool
+	}{
+		{"www.example.com.", ".", "com.", true},
+		{"www.example.com.", "com.", "example.com.", true},
+		{"www.example.com.", "example.com.", "www.example.com.", false},
+		{"example.com.", "example.com.", "example.com.", false},
+		{"www.example.com.", "example.org.", "www.example.com.", false},
+	} {
+		q := Question{Name: tc.name, Type: dns.TypeA}
+		mq, probe := minimizedQuestion(q, tc.zone)
+		if probe != tc.probe || mq.Name != tc.expected {
+			t.Fatalf("minimizedQuestion(%s, %s) returned %s %t, expected %s %t", tc.name, tc.zone, mq.Name, probe, tc.expected, tc.probe)
+		}
+		if probe && mq.Type != dns.TypeNS {
+			t.Fatalf("minimizedQuestion(%s, %s) returned type %s, expected NS", tc.name, tc.zone, dns.TypeToString[mq.Type])
+		}
+		if !probe && mq != q {
+			t.Fatalf("minimizedQuestion(%s, %s) changed the full question: %v", tc.name, tc.zone, mq)
+		}
+	}
+}
+
+// recordQuestions sets the onQuery hooks of the zones to record the questions
+// each is sent
+func recordQuestions(zones ...*testZone) func(z *testZone) []string {
+	var mu sync.Mutex
+	seen := map[*testZone][]string{}
+	for _, z := range zones {
+		z := z
+		z.onQuery = func(q dns.Question) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[z] = append(seen[z], q.Name+" "+dns.TypeToString[q.Qtype])
+		}
+	}
+	return func(z *testZone) []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return seen[z]
+	}
+}
+
+func TestLookupQNAMEMinimization(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.4", true, "www.sub.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	example.delegate(sub)
+	questions := recordQuestions(root, example, sub)
+	defer startTestZones(t, root, example, sub)()
+
+	rr := newTestResolver(root, nil)
+	rr.QNAMEMinimization = true
+	a, _, err := rr.Lookup(context.Background(), Question{Name: "www.sub.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) == 0 || !a.Authenticated {
+		t.Fatalf("Lookup returned wrong answer: %v", a)
+	}
+	// DNSKEY queries are sent to each zone to validate the responses
+	for _, e := range []struct {
+		zone     *testZone
+		expected []string
+	}{
+		{root, []string{"example. NS", ". DNSKEY"}},
+		{example, []string{"sub.example. NS", "example. DNSKEY"}},
+		{sub, []string{"www.sub.example. A", "sub.example. DNSKEY"}},
+	} {
+		if seen := questions(e.zone); !reflect.DeepEqual(seen, e.expected) {
+			t.Fatalf("%s was sent the wrong questions: expected %v, got %v", e.zone.name, e.expected, seen)
+		}
+	}
+}
+
+func TestLookupQNAMEMinimizationFallback(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	// b.example. is a empty non-terminal rather than a zone cut
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.b.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	questions := recordQuestions(root, example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	rr.QNAMEMinimization = true
+	a, _, err := rr.Lookup(context.Background(), Question{Name: "a.b.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 1 {
+		t.Fatalf("Lookup through empty non-terminal returned wrong answer: %v", a)
+	}
+	expected := []string{"b.example. NS", "a.b.example. A"}
+	if seen := questions(example); !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("example. was sent the wrong questions after NODATA: expected %v, got %v", expected, seen)
+	}
+
+	// the full question is also sent after a NXDOMAIN
+	a, _, err = rr.Lookup(context.Background(), Question{Name: "a.missing.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Rcode != dns.RcodeNameError {
+		t.Fatalf("Lookup of missing name returned wrong rcode: %s", dns.RcodeToString[a.Rcode])
+	}
+	expected = append(expected, "missing.example. NS", "a.missing.example. A")
+	if seen := questions(example); !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("example. was sent the wrong questions after NXDOMAIN: expected %v, got %v", expected, seen)
+	}
+	if seen := questions(root); !reflect.DeepEqual(seen, []string{"example. NS", "example. NS"}) {
+		t.Fatalf("Root was sent the full names: %v", seen)
+	}
+}
@@ -0,0 +1,46 @@
+package solvere
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// ErrLameNameserver is returned when every nameserver for a zone responds
+// with a rcode that the RcodePolicy treats as the server being lame
+var ErrLameNameserver = errors.New("solvere: Nameserver responded with a rcode indicating it can't answer for the zone")
+
+// RcodeAction is how a response with a particular rcode is handled
+type RcodeAction int
+
+const (
+	// ReturnRcode returns the response to the caller with its rcode, rcodes
+	// that aren't in the policy are handled this way
+	ReturnRcode RcodeAction = iota
+	// FailoverRcode treats the nameserver that sent the response as lame,
+	// recording it as a failed query, and tries the other nameservers for
+	// the zone. If they all respond the same way the lookup fails with
+	// ErrLameNameserver.
+	FailoverRcode
+)
+
+// DefaultRcodePolicy is used if RecursiveResolver.RcodePolicy isn't set.
+// NOTAUTH and NOTZONE are only meant for dynamic updates and zone transfers
+// (RFC 2136, RFC 8945), a nameserver sending them in response to a query
+// isn't serving the zone. YXDOMAIN is sent when a DNAME substitution creates a
+// name that is too long (RFC 6672 Section 2.2) and is a valid answer.
+var DefaultRcodePolicy = map[int]RcodeAction{
+	dns.RcodeYXDomain: ReturnRcode,
+	dns.RcodeNotAuth:  FailoverRcode,
+	dns.RcodeNotZone:  FailoverRcode,
+}
+
+// rcodeAction returns how a response with rcode is handled by the
+// RcodePolicy
+func (rr *RecursiveResolver) rcodeAction(rcode int) RcodeAction {
+	policy := rr.RcodePolicy
+	if policy == nil {
+		policy = DefaultRcodePolicy
+	}
+	return policy[rcode]
+}
@@ -0,0 +1,84 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupYXDOMAIN(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `
+alias.example. 300 IN CNAME x.long.example.
+long.example. 300 IN DNAME long-target.example.`)
+	example.rcodes = map[string]int{"x.long.example.": dns.RcodeYXDomain}
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "alias.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if answer.Rcode != dns.RcodeYXDomain {
+		t.Fatalf("Lookup returned wrong rcode: %s", dns.RcodeToString[answer.Rcode])
+	}
+	if len(answer.Answer) != 2 || answer.Answer[0].Header().Rrtype != dns.TypeCNAME || answer.Answer[1].Header().Rrtype != dns.TypeDNAME {
+		t.Fatalf("Lookup didn't return the alias chain with YXDOMAIN: %v", answer.Answer)
+	}
+}
+
+func TestLookupNOTAUTH(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	good := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(good)
+	// both servers are lame for b.example.
+	good.rcodes = map[string]int{"b.example.": dns.RcodeNotAuth}
+	lame := *good
+	lame.addr = "127.0.0.4"
+	lame.rcodes = map[string]int{"a.example.": dns.RcodeNotAuth, "b.example.": dns.RcodeNotAuth}
+	root.records = append(root.records, &dns.A{Hdr: dns.RR_Header{Name: "ns.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(lame.addr)})
+	queried := make(chan struct{}, 10)
+	lame.onQuery = func(dns.Question) { queried <- struct{}{} }
+	defer startTestZones(t, root, good, &lame)()
+
+	rr := newTestResolver(root, nil)
+	rr.ParallelQueries = 1
+	// the lame server hasn't been queried yet so it is preferred
+	rr.InfraCache.Record(good.addr, time.Second, nil, time.Now())
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup didn't fail over from lame nameserver: %s", err)
+	}
+	if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %+v", answer)
+	}
+	select {
+	case <-queried:
+	default:
+		t.Fatal("Lookup didn't query the lame nameserver first")
+	}
+	if sh, present := rr.InfraCache.Get(lame.addr); !present || sh.ConsecutiveFailures != 1 {
+		t.Fatalf("lame nameserver wasn't recorded as failing: %+v", sh)
+	}
+
+	_, _, err = rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA})
+	var re *ResolveError
+	if !errors.Is(err, ErrLameNameserver) || !errors.As(err, &re) || re.Code != CodeNoAuthority {
+		t.Fatalf("Lookup didn't fail with ErrLameNameserver when every nameserver is lame: %v", err)
+	}
+
+	// with the rcode removed from the policy NOTAUTH is returned
+	rr.RcodePolicy = map[int]RcodeAction{}
+	answer, _, err = rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if answer.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("Lookup returned wrong rcode: %s", dns.RcodeToString[answer.Rcode])
+	}
+}
@@ -0,0 +1,160 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ErrorCode is a stable, machine readable, reason for a lookup failing. Name
+// errors and other non-success rcodes aren't failures, they are returned in
+// the Rcode of the Answer.
+type ErrorCode int
+
+const (
+	// CodeOther is used for failures that don't match any other code
+	CodeOther ErrorCode = iota
+	// CodeNetwork is used when the nameservers couldn't be reached or the
+	// responses from them couldn't be read
+	CodeNetwork
+	// CodeTimeout is used when the context of the lookup was cancelled or
+	// its deadline was reached
+	CodeTimeout
+	// CodeBogus is used when a answer, or the delegation leading to it,
+	// failed DNSSEC validation or recently failed it
+	CodeBogus
+	// CodeNotValidated is used when a answer that must be validated couldn't
+	// be authenticated because it is from a unsigned zone
+	CodeNotValidated
+	// CodeTooManyReferrals is used when resolving a question took too many
+	// referrals
+	CodeTooManyReferrals
+	// CodeLoop is used when a alias chain loops back on itself, or
+	// forwarded queries loop back to the resolver
+	CodeLoop
+	// CodeNoAuthority is used when no nameserver for a zone could be found
+	CodeNoAuthority
+	// CodeBadResponse is used when a nameserver sent a response that is
+	// malformed or can't be trusted
+	CodeBadResponse
+	// CodeBusy is used when the resolver has too many lookups in progress
+	CodeBusy
+	// CodeInvalidQuestion is used when the question can't be sent
+	CodeInvalidQuestion
+	// CodeTransportUnavailable is used when a lookup requests a transport
+	// the resolver isn't configured for
+	CodeTransportUnavailable
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	CodeOther:                "other",
+	CodeNetwork:              "network",
+	CodeTimeout:              "timeout",
+	CodeBogus:                "bogus",
+	CodeNotValidated:         "not-validated",
+	CodeTooManyReferrals:     "too-many-referrals",
+	CodeLoop:                 "loop",
+	CodeNoAuthority:          "no-authority",
+	CodeBadResponse:          "bad-response",
+	CodeBusy:                 "busy",
+	CodeInvalidQuestion:      "invalid-question",
+	CodeTransportUnavailable: "transport-unavailable",
+}
+
+func (c ErrorCode) String() string {
+	if name, present := errorCodeNames[c]; present {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalText allows a ErrorCode to be included in JSON by name
+func (c ErrorCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// ResolveError is returned by Lookup when a lookup fails, Code describes why
+// so callers can branch on the reason without comparing the error against
+// each of the errors a lookup may fail with. Err is the original error, which
+// can still be checked for with errors.Is and errors.As.
+type ResolveError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (re *ResolveError) Error() string {
+	return re.Err.Error()
+}
+
+// Unwrap returns the original error
+func (re *ResolveError) Unwrap() error {
+	return re.Err
+}
+
+// errorCode returns the ErrorCode describing err, bogus indicates the lookup
+// that failed was marked bogus in its LookupLog
+func errorCode(err error, bogus bool) ErrorCode {
+	is := func(targets ...error) bool {
+		for _, t := range targets {
+			if errors.Is(err, t) {
+				return true
+			}
+		}
+		return false
+	}
+	var (
+		ae *AuthorityError
+		ve *ValidationError
+		ne net.Error
+		de *dns.Error
+	)
+	switch {
+	case is(context.Canceled, context.DeadlineExceeded):
+		return CodeTimeout
+	case is(ErrBogusCached):
+		return CodeBogus
+	case is(ErrNotValidated):
+		return CodeNotValidated
+	case is(ErrTooManyReferrals):
+		return CodeTooManyReferrals
+	case is(ErrAliasLoop, ErrForwardingLoop):
+		return CodeLoop
+	case errors.As(err, &ae), is(ErrNoNSAuthorties, ErrNoAuthorityAddress, ErrMissingGlue, ErrLameNameserver):
+		return CodeNoAuthority
+	case is(ErrOutOfBailiwick, ErrBadEDNSVersion, ErrNotAuthoritative, ErrRRsetTooLarge):
+		return CodeBadResponse
+	case is(ErrResolverBusy):
+		return CodeBusy
+	case is(ErrInvalidIDN):
+		return CodeInvalidQuestion
+	case is(ErrTransportUnavailable):
+		return CodeTransportUnavailable
+	case is(ErrQueryAbandoned):
+		return CodeNetwork
+	case errors.As(err, &ve):
+		return CodeBogus
+	case errors.As(err, &ne), errors.As(err, &de):
+		return CodeNetwork
+	}
+	if bogus {
+		return CodeBogus
+	}
+	// the remaining errors with extended error codes are DNSSEC failures
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if _, present := errorCodes[e]; present {
+			return CodeBogus
+		}
+	}
+	return CodeOther
+}
+
+// newResolveError wraps err in a ResolveError, the log of the failed lookup
+// is used to classify errors that don't identify the reason themselves
+func newResolveError(err error, ll *LookupLog) *ResolveError {
+	if re, ok := err.(*ResolveError); ok {
+		return re
+	}
+	return &ResolveError{Code: errorCode(err, ll != nil && ll.Bogus), Err: err}
+}
@@ -0,0 +1,93 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		bogus bool
+		code  ErrorCode
+	}{
+		{context.DeadlineExceeded, false, CodeTimeout},
+		{context.Canceled, false, CodeTimeout},
+		{ErrBogusCached, false, CodeBogus},
+		{&ValidationError{}, false, CodeBogus},
+		{ErrNSECMissingCoverage, true, CodeBogus},
+		{ErrNotValidated, false, CodeNotValidated},
+		{ErrTooManyReferrals, false, CodeTooManyReferrals},
+		{ErrAliasLoop, false, CodeLoop},
+		{&AuthorityError{Zone: "example.", Err: ErrMissingGlue}, false, CodeNoAuthority},
+		{ErrOutOfBailiwick, false, CodeBadResponse},
+		{ErrResolverBusy, false, CodeBusy},
+		{ErrInvalidIDN, false, CodeInvalidQuestion},
+		{ErrTransportUnavailable, false, CodeTransportUnavailable},
+		{&net.OpError{Op: "read", Err: errors.New("connection refused")}, false, CodeNetwork},
+		{dns.ErrTruncated, false, CodeNetwork},
+		{fmt.Errorf("lookup failed: %w", ErrTooManyReferrals), false, CodeTooManyReferrals},
+		{fmt.Errorf("lookup failed: %w", ErrMismatchingDS), false, CodeBogus},
+		{fmt.Errorf("lookup failed: %w", &ValidationError{}), false, CodeBogus},
+		{&AuthorityError{Zone: "example.", Err: &net.OpError{Op: "read", Err: errors.New("connection refused")}}, false, CodeNoAuthority},
+		{fmt.Errorf("lookup failed: %w", context.DeadlineExceeded), false, CodeTimeout},
+		{errors.New("unknown"), false, CodeOther},
+	} {
+		if code := errorCode(tc.err, tc.bogus); code != tc.code {
+			t.Fatalf("errorCode returned %s for %q, expected %s", code, tc.err, tc.code)
+		}
+	}
+}
+
+func TestLookupResolveError(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `a.example. 300 IN CNAME b.example.
+b.example. 300 IN CNAME a.example.`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	_, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	var re *ResolveError
+	if !errors.As(err, &re) || re.Code != CodeLoop || !errors.Is(err, ErrAliasLoop) {
+		t.Fatalf("Lookup of alias loop returned wrong error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = rr.Lookup(ctx, Question{Name: "a.example.", Type: dns.TypeA})
+	if !errors.As(err, &re) || re.Code != CodeTimeout || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Lookup with cancelled context returned wrong error: %v", err)
+	}
+
+	_, _, err = rr.Lookup(context.Background(), Question{Name: "\xff.example.", Type: dns.TypeA})
+	if !errors.As(err, &re) || re.Code != CodeInvalidQuestion {
+		t.Fatalf("Lookup of invalid name returned wrong error: %v", err)
+	}
+}
+
+func TestLookupResolveErrorBogus(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.corrupt = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	_, _, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	var re *ResolveError
+	if !errors.As(err, &re) || re.Code != CodeBogus {
+		t.Fatalf("Lookup of corrupt answer returned wrong error: %v", err)
+	}
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("ResolveError doesn't wrap ValidationError: %v", err)
+	}
+	if code, ok := ExtendedErrorCode(err); !ok || code != EDEDNSSECBogus {
+		t.Fatalf("ResolveError mapped to wrong extended error code: %d", code)
+	}
+}
@@ -13,9 +13,12 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
 )
 
 func init() {
@@ -39,14 +42,88 @@ var (
 	// MaxReferrals is the maximum number of referral responses before failing
 	MaxReferrals = 10
 
+	// MaxLookupAllConcurrency is the maximum number of lookups LookupAll will
+	// perform at once
+	MaxLookupAllConcurrency = 4
+
+	// MaxGluelessLookups is the maximum number of nameserver names that will
+	// be resolved concurrently when a referral doesn't contain any glue
+	MaxGluelessLookups = 3
+
+	// DefaultLookupAllTypes are the types looked up by LookupAll if none are
+	// provided
+	DefaultLookupAllTypes = []uint16{
+		dns.TypeA,
+		dns.TypeAAAA,
+		dns.TypeCNAME,
+		dns.TypeMX,
+		dns.TypeTXT,
+		dns.TypeNS,
+		dns.TypeSOA,
+		dns.TypeCAA,
+		dns.TypeSRV,
+		dns.TypeDS,
+		dns.TypeDNSKEY,
+	}
+
+	// DefaultRefusedTypes are the query types that are refused if
+	// RecursiveResolver.RefusedTypes isn't set, ANY queries are refused since
+	// their large answers can be used for amplification attacks
+	DefaultRefusedTypes = map[uint16]int{dns.TypeANY: dns.RcodeRefused}
+
+	// DefaultParallelQueryDelay is how long to wait for a response from a
+	// nameserver before querying another in parallel, the Connection
+	// Attempt Delay recommended by RFC 8305 Section 5
+	DefaultParallelQueryDelay = 250 * time.Millisecond
+
 	dnsPort = "53"
 
 	ErrTooManyReferrals   = errors.New("solvere: Too many referrals")
 	ErrNoNSAuthorties     = errors.New("solvere: No NS authority records found")
 	ErrNoAuthorityAddress = errors.New("solvere: No A/AAAA records found for the chosen authority")
 	ErrOutOfBailiwick     = errors.New("Out of bailiwick record in message")
+	ErrResolverBusy       = errors.New("solvere: Too many concurrent lookups")
+	ErrNotValidated       = errors.New("solvere: Answer could not be authenticated")
+	ErrBadEDNSVersion     = errors.New("solvere: Server doesn't support EDNS version 0")
+	ErrEDNSDowngrade      = errors.New("solvere: Nameserver for signed zone rejected query with EDNS")
+	ErrBogusCached        = errors.New("solvere: Answer recently failed validation")
+	ErrNotAuthoritative   = errors.New("solvere: Answer from nameserver didn't have the AA bit set")
+	ErrMissingGlue        = errors.New("solvere: Delegation to nameservers inside the delegated zone is missing glue")
+	ErrQueryAbandoned     = errors.New("solvere: Query abandoned after another nameserver responded")
+	ErrAliasLoop          = errors.New("solvere: Alias loop detected")
+	ErrNoRoots            = errors.New("solvere: Roots lookup option doesn't contain any nameservers")
 )
 
+// AuthorityError is returned when none of the authoritative nameservers for
+// a zone could be reached, either because a referral contained no usable NS
+// records or none of their addresses could be found. Err describes why.
+type AuthorityError struct {
+	Zone string
+	Err  error
+}
+
+func (ae *AuthorityError) Error() string {
+	return fmt.Sprintf("solvere: No reachable authority for %s: %s", ae.Zone, ae.Err)
+}
+
+// Unwrap returns the reason the authorities couldn't be reached
+func (ae *AuthorityError) Unwrap() error {
+	return ae.Err
+}
+
+// isUnreachable checks if err shows the authorities for a zone couldn't be
+// reached, rather than the lookup failing for some other reason like a
+// bogus answer while resolving their addresses
+func isUnreachable(err error) bool {
+	for _, e := range []error{ErrNoNSAuthorties, ErrNoAuthorityAddress, ErrMissingGlue, ErrLameNameserver} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
 // Question represents a DNS IN question
 type Question struct {
 	Name string
@@ -60,13 +137,46 @@ type LookupLog struct {
 	CacheHit    bool `json:",omitempty"`
 	DNSSECValid bool
 	Latency     time.Duration
-	Error       string `json:",omitempty"`
-	Truncated   bool   `json:",omitempty"`
-	Referral    bool   `json:",omitempty"`
-	Started     time.Time
+	// ExchangeLatency is the time spent waiting on the network for a
+	// response, and ValidationLatency the time spent validating it
+	ExchangeLatency   time.Duration `json:",omitempty"`
+	ValidationLatency time.Duration `json:",omitempty"`
+	Error             string        `json:",omitempty"`
+	Truncated         bool          `json:",omitempty"`
+	TCPFailed         bool          `json:",omitempty"`
+	Stale             bool          `json:",omitempty"`
+	BadEDNSVersion    bool          `json:",omitempty"`
+	DOIgnored         bool          `json:",omitempty"`
+	EDNSFallback      bool          `json:",omitempty"`
+	Bogus             bool          `json:",omitempty"`
+	Transport         Transport     `json:",omitempty"`
+	Referral          bool          `json:",omitempty"`
+	// CacheAge is how long the answer had been cached for, if it was served
+	// from a cache that implements AgeCache
+	CacheAge time.Duration `json:",omitempty"`
+	// RRsetTooLarge indicates the response contained a RRset with more
+	// than MaxRRsetSize records
+	RRsetTooLarge bool `json:",omitempty"`
+	// DNSKEYCount is the number of records in the DNSKEY RRset returned
+	// for a DNSKEY lookup made during validation
+	DNSKEYCount int `json:",omitempty"`
+	// Deduplicated indicates the answer was taken from a identical lookup
+	// that started within the DedupWindow
+	Deduplicated bool `json:",omitempty"`
+	// Expire is the zone expire timer returned by the nameserver in a EDNS
+	// EXPIRE option (RFC 7314), if one was requested and included
+	Expire  *uint32 `json:",omitempty"`
+	Started time.Time
 
 	NS *Nameserver `json:",omitempty"`
 
+	DenialProof        *DenialProof `json:",omitempty"`
+	ValidationFailures []RRSetError `json:",omitempty"`
+	// Unsigned lists the RRsets in a validated response that weren't
+	// signed because they aren't expected to be, such as the NS records
+	// of a delegation, so aren't authenticated
+	Unsigned []RRSetError `json:",omitempty"`
+
 	Composites []*LookupLog `json:",omitempty"`
 }
 
@@ -78,6 +188,18 @@ func newLookupLog(q *Question, ns *Nameserver) *LookupLog {
 	}
 }
 
+// addValidationLatency records the time spent validating the response for
+// a query since start, excluding any time spent exchanging messages for
+// composite queries such as DNSKEY lookups
+func (ll *LookupLog) addValidationLatency(start time.Time, composite *LookupLog) {
+	d := time.Since(start)
+	if composite != nil {
+		d -= composite.ExchangeLatency
+	}
+	ll.ValidationLatency += d
+	ll.Latency += d
+}
+
 // Answer contains the answer to a iterative resolution performed
 // by RecursiveResolver.Lookup
 type Answer struct {
@@ -86,6 +208,20 @@ type Answer struct {
 	Additional    []dns.RR
 	Rcode         int
 	Authenticated bool
+	// Delegations are the zones traversed to resolve the answer, starting
+	// at the root. It isn't set for answers served from the cache, the
+	// chain of a cached answer can be retrieved with DelegationChain.
+	Delegations []ZoneCut `json:",omitempty"`
+	// Aliases are the CNAME and DNAME records chased to reach the answer,
+	// if the SeparateAliases lookup option was used. Otherwise they are
+	// prepended to Answer.
+	Aliases []dns.RR `json:",omitempty"`
+	// ExtendedError, if set, describes why the lookup failed or a problem
+	// with the answer, such as it being stale
+	ExtendedError *ExtendedError `json:",omitempty"`
+	// Stale indicates the answer was served from the cache after it expired
+	// (RFC 8767), the TTLs of its records are set to StaleTTL
+	Stale bool `json:",omitempty"`
 }
 
 // Nameserver describes an authoritative nameserver
@@ -100,10 +236,271 @@ type RecursiveResolver struct {
 	useIPv6   bool
 	useDNSSEC bool
 
-	c *dns.Client
+	tcpConns *tcpConnPool
+
+	// source addresses set by BindToInterface
+	localV4 net.IP
+	localV6 net.IP
 
 	cache           QuestionAnswerCache
+	rootMu          sync.RWMutex
 	rootNameservers []Nameserver
+
+	// OnAnswer, if set, is called with each freshly resolved answer and the
+	// question it answers before the answer is cached and returned. The Answer
+	// returned by the hook is used in place of the original, allowing it to
+	// inspect, modify, or replace answers. If the hook returns nil the
+	// original answer is used. Answers served from the cache have
+	// already been passed through the hook and are not passed to it again.
+	// Any aliases chased while resolving the question are prepended to the
+	// answer, or set in Aliases, after the hook has been called.
+	OnAnswer func(q Question, a *Answer) *Answer
+
+	// OnProfile, if set, is called after each call to Lookup or
+	// LookupWithOptions with a LookupProfile describing where the time spent
+	// on the lookup went. If ProfileAllocations is also set the allocations
+	// made during the lookup are recorded, this requires stopping the world
+	// to read the memory statistics before and after each lookup so it
+	// should only be set while debugging.
+	OnProfile          func(p *LookupProfile)
+	ProfileAllocations bool
+
+	// MaxConcurrentLookups limits the number of calls to Lookup that may be
+	// in progress at once, if it is zero there is no limit. When the limit
+	// has been reached Lookup will return ErrResolverBusy, or if WaitWhenBusy
+	// is set wait until another lookup finishes or its context is done.
+	MaxConcurrentLookups int
+	WaitWhenBusy         bool
+
+	// ServeStale allows a expired answer to be returned if the cache
+	// implements StaleAnswerCache and a fresh answer can't be retrieved
+	// because of a transport failure, currently this is when a truncated
+	// response is received and retrying over TCP fails. The TCPFailed and
+	// Stale fields of the LookupLog record when this happens.
+	//
+	// RefreshStale, if ServeStale is also set, causes Lookup to return the
+	// cached answer for a question immediately if it has expired, but not
+	// for longer than the MaxStale window of the cache, and to fetch a fresh
+	// answer in the background (RFC 8767). If the refresh fails the stale
+	// answer continues to be returned. Stale answers have the Stale field
+	// set and a EDEStaleAnswer extended error.
+	ServeStale   bool
+	RefreshStale bool
+
+	// Clock is used to check the validity periods of signatures, it can be
+	// replaced in order to validate responses as of a specific time.
+	Clock clock.Clock
+
+	// StrictAlgorithms requires every RRset to be signed with each of the
+	// algorithms used by the zone's DNSKEY set, and each of the algorithms
+	// in its DS set, rather than just one, in order to detect broken
+	// algorithm rollovers and signatures being stripped (RFC 6840 Section
+	// 5.11).
+	StrictAlgorithms bool
+
+	// AllowedAlgorithms lists the DNSSEC algorithms whose signatures can be
+	// used for validation, so that weak algorithms such as RSASHA1 can be
+	// refused. Signatures using other algorithms are ignored, and RRsets
+	// that are only signed with them fail with ErrNoSupportedAlgorithm. If
+	// it is nil every supported algorithm is allowed.
+	AllowedAlgorithms []uint8
+
+	// Offline prevents DNSKEY records from being fetched from the network
+	// during validation, only keys already in the cache are used. Keys can
+	// be provided by adding them to the cache before validating. If the
+	// needed keys aren't present ErrKeysUnavailableOffline is returned.
+	Offline bool
+
+	// CanonicalOrder sorts the records in each section of freshly resolved
+	// answers into canonical order before they are passed to OnAnswer,
+	// cached, and returned, making the ordering of answers deterministic
+	// regardless of the order records were served in. In the answer section
+	// only the records within each RRset are sorted, so that any alias
+	// chain stays in the order it is followed.
+	CanonicalOrder bool
+
+	// NormalizeTTLs sets the TTLs of all of the records in each RRset of
+	// freshly resolved answers to the lowest TTL in the set before they are
+	// passed to OnAnswer, cached, and returned (RFC 2181 Section 5.2). Some
+	// nameservers return RRsets with mismatched TTLs, which otherwise are
+	// passed on to clients as received.
+	NormalizeTTLs bool
+
+	// AddressPreference controls the order LookupHost returns IPv4 and
+	// IPv6 addresses in, by default they are returned as received.
+	AddressPreference AddressPreference
+
+	// SignalAlgorithms adds the DAU, DHU, and N3U EDNS0 options to queries
+	// when DNSSEC is enabled, listing the DNSSEC algorithms, DS digest
+	// types, and NSEC3 hash algorithms that can be validated (RFC 6975).
+	// If AllowedAlgorithms is set only the algorithms in it are listed.
+	SignalAlgorithms bool
+
+	// DeduplicateRecords removes duplicate records from responses before
+	// they are validated, cached, or returned. Some servers include the
+	// same records, usually RRSIGs, in both the answer and authority
+	// sections, which would otherwise be validated twice and returned to
+	// clients twice.
+	DeduplicateRecords bool
+
+	// MaxRRsetSize, if non-zero, is the maximum number of records a RRset in
+	// a response may contain, limiting the memory used by, and the size of
+	// answers built from, responses containing huge RRsets such as a TXT
+	// RRset with thousands of records or a NS RRset with hundreds of names.
+	// RRsetSizePolicy controls whether responses with larger RRsets are
+	// rejected, the default, or have the RRsets truncated. The limit is
+	// applied before responses are validated or cached.
+	MaxRRsetSize    int
+	RRsetSizePolicy RRsetSizePolicy
+
+	// TLSExchanger and HTTPSExchanger are used to send queries when the
+	// TransportTLS or TransportHTTPS lookup options are used, a
+	// PooledExchanger with a TLSConfig can be used for DNS over TLS and a
+	// DoHExchanger for DNS over HTTPS. They are given the address of the
+	// nameserver with port 853 or 443.
+	TLSExchanger   Exchanger
+	HTTPSExchanger Exchanger
+
+	// RequireAuthoritative rejects answers, including name errors and NODATA
+	// responses, that don't have the AA bit set with ErrNotAuthoritative.
+	// Since only authoritative nameservers are queried a answer without the
+	// AA bit may have come from a lame server or a recursive resolver
+	// pretending to be authoritative.
+	RequireAuthoritative bool
+
+	// BogusTTL, if non-zero, is how long a question is remembered for after
+	// its answer fails DNSSEC validation. Lookups for the question during
+	// this period fail immediately with ErrBogusCached instead of resolving
+	// and validating the answer again. These verdicts are kept separately
+	// from the answer cache and are never served as data.
+	BogusTTL time.Duration
+
+	// RefusedTypes maps query types that shouldn't be resolved to the rcode,
+	// normally dns.RcodeRefused or dns.RcodeNotImplemented, that questions
+	// of the type are answered with without any queries being sent. If it
+	// is nil DefaultRefusedTypes is used, a empty map permits every type.
+	RefusedTypes map[uint16]int
+
+	// RcodePolicy maps rcodes to how responses with them are handled,
+	// rcodes that aren't in it are returned to the caller. If it is nil
+	// DefaultRcodePolicy is used.
+	RcodePolicy map[int]RcodeAction
+
+	// ParallelQueries is the number of addresses of the nameservers for a
+	// zone that are queried at once, the first successful response that
+	// isn't a SERVFAIL is used and the other queries are abandoned. This
+	// stops a single slow or dead server stalling a lookup. It is set to 2
+	// by NewRecursiveResolver, values below 2 query a single address at a
+	// time.
+	//
+	// To avoid multiplying the number of queries sent the queries are
+	// staggered, like Happy Eyeballs (RFC 8305), the preferred address is
+	// queried first and the next is only queried if there has been no
+	// response after ParallelQueryDelay, or the previous query failed. It is
+	// set to DefaultParallelQueryDelay by NewRecursiveResolver, if it is
+	// zero all of the queries are sent at once.
+	ParallelQueries    int
+	ParallelQueryDelay time.Duration
+
+	// QNAMEMinimization stops the full name being sent to nameservers other
+	// than the authoritative nameservers for it (RFC 7816). Each zone is
+	// instead sent a NS query for the name one label below it, until the
+	// zone containing the name is found. If one of these queries doesn't
+	// result in a referral, because there isn't a zone cut where one was
+	// expected, the full question is sent to the zone instead.
+	QNAMEMinimization bool
+
+	// InfraCache records the RTT and failures of the nameserver addresses
+	// that are queried, so the fastest working address for a zone can be
+	// picked. It is set to a BasicInfraCache by NewRecursiveResolver, if it
+	// is nil addresses are picked at random.
+	InfraCache InfraCache
+
+	// MaxNSEC3Iterations is the highest iteration count of NSEC3 records
+	// that will be used to prove the denial of a name or type, each name
+	// checked against a NSEC3 record is hashed this many times so a zone
+	// could use a huge count to exhaust the CPU of the resolver. Proofs
+	// using records with higher counts fail with ErrNSEC3IterationsTooHigh.
+	// It is set to DefaultMaxNSEC3Iterations by NewRecursiveResolver, if it
+	// is zero there is no limit.
+	MaxNSEC3Iterations int
+
+	// MaxDNSKEYs is the largest DNSKEY RRset that will be accepted from a
+	// zone, since each key in the set is considered when validating
+	// signatures a zone could publish a huge set to make validation slow.
+	// Larger sets fail with ErrTooManyDNSKEYs. It is set to DefaultMaxDNSKEYs
+	// by NewRecursiveResolver, if it is zero there is no limit.
+	MaxDNSKEYs int
+
+	// DedupWindow is how long after a lookup starts that identical lookups
+	// wait for its answer rather than sending their own queries, so that a
+	// burst of the same question that arrives before the first answer has
+	// been cached only results in one set of queries. Duplicates stop
+	// waiting once the window has passed, and resolve the question
+	// themselves if the first lookup fails. Lookups with NoCache set aren't
+	// deduplicated. If it is zero lookups aren't deduplicated.
+	DedupWindow time.Duration
+
+	// KeyRetention is how long the keys of a zone are kept after they were
+	// last fetched and authenticated. Signatures made by retained keys are
+	// accepted even if the keys are no longer in the DNSKEY RRset of the
+	// zone, so that validation doesn't fail while a key rollover propagates
+	// and nameservers, or cached answers, still have signatures made by the
+	// retiring key. Keys are only retained if the resolver has a cache. It
+	// is set to DefaultKeyRetention by NewRecursiveResolver, if it is zero
+	// only the current keys of a zone are used.
+	KeyRetention time.Duration
+
+	// DetectZoneApex allows answers signed by a zone below the zone that
+	// was delegated to be validated. This happens when the nameservers of a
+	// zone are also authoritative for a child zone, so they answer for it
+	// directly rather than sending a referral. A SOA query is sent to find
+	// the apex of the zone containing the signer name, and if the signer is
+	// a zone apex its DS RRset is fetched from the parent zone and used to
+	// authenticate its DNSKEYs. If the resolver has a cache the apex found
+	// for each signer name is cached for the TTL of the SOA record. Without
+	// it these answers fail validation with ErrUntrustedSigner.
+	DetectZoneApex bool
+
+	// MaxCachedZones limits the number of zones the resolver keeps cached
+	// delegations, zone apexes, and retained keys for, alongside the
+	// answers in its cache. Once the limit is reached expired entries are
+	// removed, followed by arbitrary entries if that doesn't free enough
+	// space. If it is zero DefaultMaxCachedZones is used.
+	MaxCachedZones int
+
+	bogusMu sync.Mutex
+	bogus   map[Question]time.Time
+
+	unvalidatedMu    sync.RWMutex
+	unvalidatedZones map[string]struct{}
+
+	trustAnchorsMu sync.RWMutex
+	trustAnchors   map[string][]dns.RR
+
+	delegationsMu sync.Mutex
+	delegations   map[string]*cachedDelegation
+
+	apexesMu sync.Mutex
+	apexes   map[string]cachedApex
+
+	retainedMu sync.Mutex
+	retained   map[string]map[uint16]retainedKey
+
+	recentMu sync.Mutex
+	recent   map[recentKey]*recentLookup
+
+	// refreshing are the questions whose stale answers are being refreshed
+	refreshingMu sync.Mutex
+	refreshing   map[Question]struct{}
+
+	rootKeys    []dns.RR
+	anchorsMu   sync.Mutex
+	anchors     []TrustAnchor
+	anchorStore AnchorStore
+
+	slotsOnce   sync.Once
+	lookupSlots chan struct{}
 }
 
 // NewRecursiveResolver returns an initialized RecursiveResolver. If cache is nil
@@ -112,8 +509,16 @@ func NewRecursiveResolver(useIPv6 bool, useDNSSEC bool, rootHints []dns.RR, root
 	rr := &RecursiveResolver{
 		useIPv6:   useIPv6,
 		useDNSSEC: useDNSSEC,
-		c:         new(dns.Client),
+		tcpConns:  newTCPConnPool(),
 		cache:     cache,
+		Clock:     clock.Default(),
+
+		ParallelQueries:    2,
+		ParallelQueryDelay: DefaultParallelQueryDelay,
+		InfraCache:         NewBasicInfraCache(),
+		MaxNSEC3Iterations: DefaultMaxNSEC3Iterations,
+		MaxDNSKEYs:         DefaultMaxDNSKEYs,
+		KeyRetention:       DefaultKeyRetention,
 	}
 	// Initialize root nameservers
 	addrs := extractRRSet(rootHints, "", dns.TypeA)
@@ -128,40 +533,123 @@ func NewRecursiveResolver(useIPv6 bool, useDNSSEC bool, rootHints []dns.RR, root
 			rr.rootNameservers = append(rr.rootNameservers, Nameserver{a.Header().Name, r.AAAA.String(), "."})
 		}
 	}
-	// Add root DNSSEC keys to cache indefinitely
-	// XXX: if these keys are expired (how to tell?) should block on fetching
-	//      new ones + verifying the roll-over
+	// Add root DNSSEC keys to cache indefinitely, StartRootRefresh keeps them
+	// up to date as the root keys are rolled over
+	rr.rootKeys = rootKeys
 	if rr.cache != nil {
-		rr.cache.Add(&Question{Name: ".", Type: dns.TypeDNSKEY}, &Answer{rootKeys, nil, nil, dns.RcodeSuccess, true}, true)
+		rr.cache.Add(&Question{Name: ".", Type: dns.TypeDNSKEY}, &Answer{Answer: rootKeys, Rcode: dns.RcodeSuccess, Authenticated: true}, true)
+	}
+	if bc, ok := cache.(*BasicCache); ok && bc.OnPrefetch == nil {
+		bc.OnPrefetch = func(q Question) { rr.refresh(q, LookupOptions{}) }
 	}
 	return rr
 }
 
-func (rr *RecursiveResolver) query(ctx context.Context, q *Question, auth *Nameserver) (*dns.Msg, *LookupLog, error) {
+// cachedResponse returns a response built from the cached answer to q, if
+// there is one
+func (rr *RecursiveResolver) cachedResponse(q *Question, opts LookupOptions) (*dns.Msg, *LookupLog, bool) {
+	if rr.cache == nil || opts.NoCache || opts.refresh {
+		return nil, nil, false
+	}
+	answer := rr.cache.Get(q)
+	if answer == nil {
+		return nil, nil, false
+	}
+	ql := newLookupLog(q, nil)
+	m := new(dns.Msg)
+	m.SetEdns0(4096, rr.useDNSSEC)
+	m.Question = []dns.Question{{Name: q.Name, Qtype: q.Type, Qclass: dns.ClassINET}}
+	m.Rcode = answer.Rcode
+	m.Answer = answer.Answer
+	m.Ns = answer.Authority
+	m.Extra = answer.Additional
+	ql.CacheHit = true
+	ql.CacheAge = rr.cacheAge(q)
+	ql.DNSSECValid = answer.Authenticated
+	ql.Rcode = answer.Rcode
+	ql.Latency = time.Since(ql.Started)
+	return m, ql, true
+}
+
+// cacheAge returns how long the answer to q has been cached for, if the cache
+// implements AgeCache
+func (rr *RecursiveResolver) cacheAge(q *Question) time.Duration {
+	ac, ok := rr.cache.(AgeCache)
+	if !ok {
+		return 0
+	}
+	age, _ := ac.Age(q)
+	return age
+}
+
+func (rr *RecursiveResolver) query(ctx context.Context, q *Question, auth *Nameserver, opts LookupOptions) (*dns.Msg, *LookupLog, error) {
+	if m, ql, ok := rr.cachedResponse(q, opts); ok {
+		return m, ql, nil
+	}
 	ql := newLookupLog(q, auth)
 	s := time.Now()
 	defer func() { ql.Latency = time.Since(s) }()
 	m := new(dns.Msg)
 	m.SetEdns0(4096, rr.useDNSSEC)
+	if rr.useDNSSEC && rr.SignalAlgorithms {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, understoodOptions(rr.AllowedAlgorithms)...)
+	}
+	if opts.RequestExpire {
+		// the EXPIRE option is empty in queries, the dns package always
+		// packs a value for EDNS0_EXPIRE so a EDNS0_LOCAL is used instead
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0EXPIRE})
+	}
 	m.Question = []dns.Question{{Name: q.Name, Qtype: q.Type, Qclass: dns.ClassINET}}
-	if rr.cache != nil {
-		if answer := rr.cache.Get(q); answer != nil {
-			m.Rcode = dns.RcodeSuccess
-			m.Answer = answer.Answer
-			m.Ns = answer.Authority
-			m.Extra = answer.Additional
-			ql.CacheHit = true
-			ql.NS = nil
-			ql.DNSSECValid = answer.Authenticated
-			ql.Rcode = dns.RcodeSuccess
-			return m, ql, nil
-		}
-	}
-	r, _, err := rr.c.Exchange(m, net.JoinHostPort(auth.Addr, dnsPort))
+	m.CheckingDisabled = opts.CheckingDisabled
+	ql.Transport = opts.Transport
+	es := time.Now()
+	r, err := rr.exchange(ctx, m, auth.Addr, opts.Transport, ql)
+	if err == nil && r.Rcode == dns.RcodeFormatError && r.IsEdns0() == nil {
+		// some old or broken servers reject queries containing a OPT record
+		// with FORMERR, retry without EDNS (RFC 6891 Section 7)
+		ql.EDNSFallback = true
+		m.Extra = nil
+		r, err = rr.exchange(ctx, m, auth.Addr, opts.Transport, ql)
+	}
+	ql.ExchangeLatency = time.Since(es)
+	if err == nil && rr.rcodeAction(r.Rcode) == FailoverRcode {
+		// the server is lame, so it is recorded as failing to respond
+		ql.Rcode = r.Rcode
+		err = ErrLameNameserver
+	}
+	rr.recordHealth(auth.Addr, ql.ExchangeLatency, err)
 	if err != nil {
 		return nil, ql, err
 	}
 	ql.Rcode = r.Rcode
+	if opt := r.IsEdns0(); opt != nil {
+		// the dns package doesn't combine the extended rcode from the OPT
+		// record with the header rcode
+		if rcode := int(opt.Hdr.Ttl>>24)<<4 | r.Rcode; rcode == dns.RcodeBadVers || opt.Version() != 0 {
+			ql.Rcode = rcode
+			ql.BadEDNSVersion = true
+			return nil, ql, ErrBadEDNSVersion
+		}
+		ql.DOIgnored = rr.useDNSSEC && !opt.Do()
+		if expire, present := expireOption(opt); present {
+			ql.Expire = &expire
+		}
+	} else {
+		ql.DOIgnored = rr.useDNSSEC
+	}
+
+	if rr.DeduplicateRecords {
+		dedupMsg(r)
+	}
+	if rr.MaxRRsetSize > 0 {
+		capped, err := rr.limitRRsets(r)
+		ql.RRsetTooLarge = capped
+		if err != nil {
+			return nil, ql, err
+		}
+	}
 
 	// check all returned records are in-bailiwick, ignore extra section?
 	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
@@ -174,16 +662,142 @@ func (rr *RecursiveResolver) query(ctx context.Context, q *Question, auth *Names
 	return r, ql, nil
 }
 
-func (rr *RecursiveResolver) lookupNS(ctx context.Context, name string) (*Nameserver, *LookupLog, error) {
+// queryServers sends q to servers, starting with the first and then starting
+// a query to the next every ParallelQueryDelay until one responds, or
+// immediately if a query fails. The first successful response that isn't a
+// SERVFAIL is returned and any other queries in progress are abandoned. The
+// logs of each query that was started are also returned, in the order they
+// were started, with the queries that were abandoned recorded as failing with
+// ErrQueryAbandoned. If none of the servers respond successfully the result
+// of the first server is returned.
+func (rr *RecursiveResolver) queryServers(ctx context.Context, q *Question, servers []*Nameserver, opts LookupOptions) (*dns.Msg, *LookupLog, []*LookupLog, error) {
+	r, log, cached := rr.cachedResponse(q, opts)
+	if !cached && len(servers) == 1 {
+		var err error
+		r, log, err = rr.query(ctx, q, servers[0], opts)
+		if err != nil {
+			log.Error = err.Error()
+		}
+		return r, log, []*LookupLog{log}, err
+	}
+	if cached {
+		return r, log, []*LookupLog{log}, nil
+	}
+
+	// the vendored dns.Client can't be interrupted, so abandoned queries run
+	// until they time out but their results are dropped
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i   int
+		r   *dns.Msg
+		log *LookupLog
+		err error
+	}
+	// buffered so that abandoned queries don't block when they finish
+	results := make(chan result, len(servers))
+	started := 0
+	startNext := func() {
+		go func(i int, s *Nameserver) {
+			r, log, err := rr.query(ctx, q, s, opts)
+			if err != nil {
+				log.Error = err.Error()
+			}
+			results <- result{i, r, log, err}
+		}(started, servers[started])
+		started++
+	}
+	startNext()
+	for rr.ParallelQueryDelay <= 0 && started < len(servers) {
+		startNext()
+	}
+	// staggered is nil once every query has been started, so that it
+	// blocks forever
+	var staggered <-chan time.Time
+	var timer *time.Timer
+	if started < len(servers) {
+		timer = time.NewTimer(rr.ParallelQueryDelay)
+		defer timer.Stop()
+		staggered = timer.C
+	}
+	finished := make([]*result, len(servers))
+	var winner *result
+	for pending := started; winner == nil && pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			finished[res.i] = &res
+			if res.err == nil && res.r.Rcode != dns.RcodeServerFailure {
+				winner = &res
+				break
+			}
+			if started < len(servers) {
+				// don't wait for the delay when a query has failed
+				startNext()
+				pending++
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(rr.ParallelQueryDelay)
+			}
+		case <-staggered:
+			startNext()
+			pending++
+			if started < len(servers) {
+				timer.Reset(rr.ParallelQueryDelay)
+			} else {
+				staggered = nil
+			}
+		}
+		if started == len(servers) {
+			staggered = nil
+		}
+	}
+	logs := make([]*LookupLog, started)
+	for i := range logs {
+		if finished[i] == nil {
+			logs[i] = newLookupLog(q, servers[i])
+			logs[i].Error = ErrQueryAbandoned.Error()
+			continue
+		}
+		logs[i] = finished[i].log
+	}
+	if winner == nil {
+		winner = finished[0]
+	}
+	return winner.r, winner.log, logs, winner.err
+}
+
+// expireOption returns the value of the EDNS EXPIRE option in a OPT record, if
+// there is one
+func expireOption(opt *dns.OPT) (uint32, bool) {
+	for _, o := range opt.Option {
+		switch e := o.(type) {
+		case *dns.EDNS0_EXPIRE:
+			return e.Expire, true
+		case *dns.EDNS0_LOCAL:
+			// the dns package doesn't unpack EXPIRE options itself
+			if e.Code == dns.EDNS0EXPIRE && len(e.Data) == 4 {
+				return binary.BigEndian.Uint32(e.Data), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (rr *RecursiveResolver) lookupNS(ctx context.Context, name string, roots []Nameserver) (*Nameserver, *LookupLog, error) {
 	// XXX: There is no maximum depth to Lookup -> lookupNS -> Lookup calls, looping is possible
 	// XXX: I'm not sure how the lookup of a NS addr should be taken into account in terms of the
 	//      dnssec chain (probably if not signed the chain cannot be considered authenticated?)
-	r, log, err := rr.Lookup(ctx, Question{Name: name, Type: dns.TypeA})
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	r, log, err := rr.lookup(ctx, Question{Name: name, Type: dns.TypeA}, LookupOptions{NoCache: roots != nil, Roots: roots})
 	if err != nil {
 		return nil, log, err
 	}
 	if r.Rcode != dns.RcodeSuccess {
-		return nil, log, fmt.Errorf("Authority lookup failed for %s: %s", name, dns.RcodeToString[r.Rcode])
+		return nil, log, fmt.Errorf("%w: lookup of %s returned %s", ErrNoAuthorityAddress, name, dns.RcodeToString[r.Rcode])
 	}
 	if len(r.Answer) == 0 {
 		return nil, log, ErrNoAuthorityAddress
@@ -192,7 +806,11 @@ func (rr *RecursiveResolver) lookupNS(ctx context.Context, name string) (*Namese
 	if len(addresses) == 0 {
 		return nil, log, ErrNoAuthorityAddress
 	}
-	return &Nameserver{Name: name, Addr: addresses[mrand.Intn(len(addresses))].(*dns.A).A.String()}, log, nil
+	servers := make([]Nameserver, len(addresses))
+	for i, a := range addresses {
+		servers[i] = Nameserver{Name: name, Addr: a.(*dns.A).A.String()}
+	}
+	return rr.pickServer(servers), log, nil
 }
 
 func splitAuthsByZone(auths []dns.RR, extras []dns.RR, useIPv6 bool) (map[string][]string, map[string]string) {
@@ -223,36 +841,184 @@ func splitAuthsByZone(auths []dns.RR, extras []dns.RR, useIPv6 bool) (map[string
 	return zones, nsToZone
 }
 
-func (rr *RecursiveResolver) pickAuthority(ctx context.Context, auths []dns.RR, extras []dns.RR) (*Nameserver, *LookupLog, error) {
-	// XXX: this ignores general concept of an 'infrastructure' cache which
-	//      tracks authority performance and uses it as a metric to pick a
-	//      authority. may want to get fancier at some point...
+// zoneNameservers returns each of the nameservers for zone in a referral that
+// has a address in the additional section
+func zoneNameservers(auths []dns.RR, extras []dns.RR, zone string, useIPv6 bool) []Nameserver {
+	var servers []Nameserver
+	for _, r := range extractRRSet(auths, zone, dns.TypeNS) {
+		name := r.(*dns.NS).Ns
+		for _, e := range extractRRSet(extras, name, dns.TypeA, dns.TypeAAAA) {
+			switch a := e.(type) {
+			case *dns.A:
+				servers = append(servers, Nameserver{name, a.A.String(), zone})
+			case *dns.AAAA:
+				if useIPv6 {
+					servers = append(servers, Nameserver{name, a.AAAA.String(), zone})
+				}
+			}
+		}
+	}
+	return servers
+}
+
+func (rr *RecursiveResolver) pickAuthority(ctx context.Context, auths []dns.RR, extras []dns.RR, roots []Nameserver) (*Nameserver, *LookupLog, error) {
 	zones, nsToZone := splitAuthsByZone(auths, extras, rr.useIPv6)
 	if len(zones) == 0 {
 		if len(nsToZone) == 0 {
 			return nil, nil, ErrNoNSAuthorties
 		}
-		var ns, z string
-		// abuse how ranging over maps works to select a 'random' element
-		for ns, z = range nsToZone {
-			break
+		resolvable := make(map[string]string, len(nsToZone))
+		for ns, z := range nsToZone {
+			// the address of a nameserver inside the zone it serves can
+			// only come from glue, looking it up would require querying
+			// the zone it is needed to reach
+			if !dns.IsSubDomain(z, ns) {
+				resolvable[ns] = z
+			}
 		}
-		a, log, err := rr.lookupNS(ctx, ns)
-		if err != nil {
-			return nil, log, err
+		if len(resolvable) == 0 {
+			return nil, nil, ErrMissingGlue
 		}
-		a.Zone = z
-		return a, log, nil
+		return rr.lookupGlueless(ctx, resolvable, roots)
 	}
-	// abuse how ranging over maps works to select a 'random' element
-	for ns, z := range nsToZone {
-		if len(zones[z]) > 0 {
-			return &Nameserver{ns, zones[z][mrand.Intn(len(zones[z]))], z}, nil, nil
+	for _, z := range nsToZone {
+		if servers := zoneNameservers(auths, extras, z, rr.useIPv6); len(servers) > 0 {
+			return rr.pickServer(servers), nil, nil
 		}
 	}
 	return nil, nil, ErrNoNSAuthorties
 }
 
+// lookupGlueless resolves the addresses of up to MaxGluelessLookups of the
+// nameservers concurrently and returns the first one found, cancelling the
+// other lookups. If none of the addresses can be resolved the first error is
+// returned.
+func (rr *RecursiveResolver) lookupGlueless(ctx context.Context, nsToZone map[string]string, roots []Nameserver) (*Nameserver, *LookupLog, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		ns  *Nameserver
+		log *LookupLog
+		err error
+	}
+	// buffered so that lookups finishing after a winner is picked don't block
+	results := make(chan result, len(nsToZone))
+	started := 0
+	// abuse how ranging over maps works to select 'random' elements
+	for ns, z := range nsToZone {
+		if started > 0 && started >= MaxGluelessLookups {
+			break
+		}
+		started++
+		go func(ns, z string) {
+			a, log, err := rr.lookupNS(ctx, ns, roots)
+			if err == nil {
+				a.Zone = z
+			}
+			results <- result{a, log, err}
+		}(ns, z)
+	}
+	var first *result
+	for i := 0; i < started; i++ {
+		res := <-results
+		if res.err == nil {
+			return res.ns, res.log, nil
+		}
+		if first == nil {
+			first = &res
+		}
+	}
+	return nil, first.log, first.err
+}
+
+// processAnswer normalizes the TTLs of a freshly resolved answer if
+// NormalizeTTLs is set, sorts it if CanonicalOrder is set, and passes it
+// through the OnAnswer hook, if one is set, keeping the original answer if the
+// hook returns nil
+func (rr *RecursiveResolver) processAnswer(q Question, a *Answer) *Answer {
+	if rr.NormalizeTTLs {
+		normalizeAnswer(a)
+	}
+	if rr.CanonicalOrder {
+		sortAnswer(a)
+	}
+	if rr.OnAnswer == nil {
+		return a
+	}
+	if hooked := rr.OnAnswer(q, a); hooked != nil {
+		return hooked
+	}
+	return a
+}
+
+// staleAnswer returns a expired answer for q from the cache if serving stale
+// answers is enabled
+func (rr *RecursiveResolver) staleAnswer(q Question) *Answer {
+	if !rr.ServeStale {
+		return nil
+	}
+	sc, ok := rr.cache.(StaleAnswerCache)
+	if !ok {
+		return nil
+	}
+	return sc.GetStale(&q)
+}
+
+// isReferral checks if a response is a referral to the nameservers of a child
+// zone. Referrals always contain the NS records for the delegation and never a
+// SOA record.
+func isReferral(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 &&
+		len(extractRRSet(m.Ns, "", dns.TypeNS)) > 0 && len(extractRRSet(m.Ns, "", dns.TypeSOA)) == 0
+}
+
+// isBogus checks if the answer for q recently failed validation
+func (rr *RecursiveResolver) isBogus(q Question) bool {
+	if rr.BogusTTL == 0 {
+		return false
+	}
+	rr.bogusMu.Lock()
+	defer rr.bogusMu.Unlock()
+	expires, present := rr.bogus[q]
+	if !present {
+		return false
+	}
+	if !rr.Clock.Now().Before(expires) {
+		delete(rr.bogus, q)
+		return false
+	}
+	return true
+}
+
+// addBogus records that the answer for q failed validation, removing any
+// verdicts that have expired
+func (rr *RecursiveResolver) addBogus(q Question) {
+	if rr.BogusTTL == 0 {
+		return
+	}
+	rr.bogusMu.Lock()
+	defer rr.bogusMu.Unlock()
+	now := rr.Clock.Now()
+	if rr.bogus == nil {
+		rr.bogus = make(map[Question]time.Time)
+	}
+	for bq, expires := range rr.bogus {
+		if !now.Before(expires) {
+			delete(rr.bogus, bq)
+		}
+	}
+	rr.bogus[q] = now.Add(rr.BogusTTL)
+}
+
+// cacheNegative caches name error and NODATA answers (RFC 2308), other
+// failure responses aren't cached
+func (rr *RecursiveResolver) cacheNegative(q Question, a *Answer) {
+	if rr.cache == nil || !isNegative(a) {
+		return
+	}
+	go rr.cache.Add(&q, &Answer{a.Answer, a.Authority, a.Additional, a.Rcode, a.Authenticated, a.Delegations, a.Aliases, nil, false}, false)
+}
+
 func extractAnswer(m *dns.Msg, authenticated bool) *Answer {
 	return &Answer{
 		Answer:        m.Answer,
@@ -336,14 +1102,265 @@ func isAlias(answer []dns.RR, q Question) (bool, string, []dns.RR, error) {
 	return false, "", nil, nil
 }
 
+// acquireSlot reserves one of the MaxConcurrentLookups slots, the returned
+// function must be called to release it
+func (rr *RecursiveResolver) acquireSlot(ctx context.Context) (func(), error) {
+	if rr.MaxConcurrentLookups <= 0 {
+		return func() {}, nil
+	}
+	rr.slotsOnce.Do(func() {
+		rr.lookupSlots = make(chan struct{}, rr.MaxConcurrentLookups)
+	})
+	release := func() { <-rr.lookupSlots }
+	select {
+	case rr.lookupSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if !rr.WaitWhenBusy {
+		return nil, ErrResolverBusy
+	}
+	select {
+	case rr.lookupSlots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LookupOptions changes how a single call to LookupWithOptions is performed
+type LookupOptions struct {
+	// RequireValidated causes ErrNotValidated to be returned if the answer
+	// couldn't be authenticated using DNSSEC
+	RequireValidated bool
+	// NoCache causes the cache to be bypassed for the question, forcing the
+	// answer to be fetched from the network, and prevents the answer from
+	// being cached. Lookups performed in order to resolve the question, such
+	// as for nameserver addresses or DNSSEC keys, still use the cache.
+	NoCache bool
+	// Transport overrides how queries for the question are sent, if it is
+	// TransportTLS or TransportHTTPS the resolver must have a TLSExchanger
+	// or HTTPSExchanger configured, otherwise ErrTransportUnavailable is
+	// returned.
+	Transport Transport
+	// RequestExpire causes the EDNS EXPIRE option (RFC 7314) to be included
+	// in queries for the question, the expire timer returned by each
+	// nameserver is recorded in the Expire field of the LookupLog for the
+	// query. Answers from the cache don't include the timer so this is
+	// normally used with NoCache.
+	RequestExpire bool
+	// SeparateAliases causes the CNAME and DNAME records chased to resolve
+	// the question to be returned in the Aliases field of the Answer,
+	// leaving only the records for the final name in Answer, rather than
+	// being prepended to Answer.
+	SeparateAliases bool
+	// CheckingDisabled causes the answer to be returned without being
+	// validated, like the CD bit (RFC 4035 Section 3.2.2), so that a bogus
+	// answer can still be retrieved. The CD bit is set in queries for the
+	// question and the answer is never authenticated. Since the answer
+	// isn't validated it isn't cached, and cached answers aren't used, as
+	// if NoCache were set.
+	CheckingDisabled bool
+	// Roots, if not nil, are the root nameservers resolution starts from
+	// instead of those the resolver was created with, allowing a alternate
+	// root, such as a private root for a internal namespace, to be used. If
+	// it is empty ErrNoRoots is returned. Responses are still validated
+	// using the trust anchors of the resolver. Since the answers from the
+	// alternate root may differ they aren't cached, and cached answers and
+	// delegations aren't used, as if NoCache were set. DNSSEC keys are
+	// still cached.
+	Roots []Nameserver
+
+	// trace, if set, is sent each step of the lookup as it completes
+	trace chan<- *QueryStep
+	// refresh causes the cache not to be used for the question, but the
+	// answer to still be cached, so that the cached answer is replaced
+	refresh bool
+}
+
 // Lookup a Question iteratively. All upstream responses are validated
 // and a DNSSEC chain is built if the RecursiveResolver was initialized to do so.
 // If responses are found in the question/answer cache they will be used instead
-// of sending messages to remote nameservers.
+// of sending messages to remote nameservers. If the lookup fails the error is a
+// *ResolveError, and a SERVFAIL answer is returned with a ExtendedError
+// describing the failure, if it can be described.
 func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *LookupLog, error) {
+	return rr.LookupWithOptions(ctx, q, LookupOptions{})
+}
+
+// LookupWithOptions performs a Lookup using the provided options. If the
+// question name contains Unicode labels they are converted to A-labels
+// before the lookup is performed.
+func (rr *RecursiveResolver) LookupWithOptions(ctx context.Context, q Question, opts LookupOptions) (*Answer, *LookupLog, error) {
+	answer, ll, err := rr.profileLookup(q, func() (*Answer, *LookupLog, error) {
+		return rr.lookupWithOptions(ctx, q, opts)
+	})
+	if err != nil {
+		re := newResolveError(err, ll)
+		return &Answer{Rcode: dns.RcodeServerFailure, ExtendedError: newExtendedError(re)}, ll, re
+	}
+	return answer, ll, nil
+}
+
+func (rr *RecursiveResolver) lookupWithOptions(ctx context.Context, q Question, opts LookupOptions) (*Answer, *LookupLog, error) {
+	name, err := ToASCII(q.Name)
+	if err != nil {
+		ll := newLookupLog(&q, nil)
+		ll.Error = err.Error()
+		return nil, ll, err
+	}
+	q.Name = name
+	if opts.Roots != nil {
+		if len(opts.Roots) == 0 {
+			ll := newLookupLog(&q, nil)
+			ll.Error = ErrNoRoots.Error()
+			return nil, ll, ErrNoRoots
+		}
+		roots := make([]Nameserver, len(opts.Roots))
+		for i, ns := range opts.Roots {
+			roots[i] = Nameserver{Name: ns.Name, Addr: ns.Addr, Zone: "."}
+		}
+		opts.Roots = roots
+	}
+	if opts.CheckingDisabled || opts.Roots != nil {
+		opts.NoCache = true
+	}
+	if rcode, refused := rr.refusedType(q.Type); refused {
+		ll := newLookupLog(&q, nil)
+		ll.Rcode = rcode
+		return &Answer{Rcode: rcode}, ll, nil
+	}
+	if err := rr.checkTransport(opts.Transport); err != nil {
+		ll := newLookupLog(&q, nil)
+		ll.Error = err.Error()
+		return nil, ll, err
+	}
+	if !opts.NoCache && rr.isBogus(q) && !rr.validationDisabled(q.Name) {
+		ll := newLookupLog(&q, nil)
+		ll.CacheHit = true
+		ll.Bogus = true
+		ll.Error = ErrBogusCached.Error()
+		return nil, ll, ErrBogusCached
+	}
+	if rr.RefreshStale && rr.cache != nil && !opts.NoCache && opts.trace == nil {
+		if answer, ll, ok := rr.refreshStale(q, opts); ok {
+			return answer, ll, nil
+		}
+	}
+	if rr.DedupWindow > 0 && !opts.NoCache && opts.trace == nil {
+		rl, first := rr.claimLookup(q, opts)
+		if first {
+			answer, ll, err := rr.resolve(ctx, q, opts)
+			rl.finish(answer)
+			return answer, ll, err
+		}
+		if answer, ll, ok := rr.awaitLookup(ctx, &q, rl); ok {
+			return answer, ll, nil
+		}
+	}
+	return rr.resolve(ctx, q, opts)
+}
+
+// resolve performs a lookup once one of the MaxConcurrentLookups slots is
+// available
+func (rr *RecursiveResolver) resolve(ctx context.Context, q Question, opts LookupOptions) (*Answer, *LookupLog, error) {
+	release, err := rr.acquireSlot(ctx)
+	if err != nil {
+		ll := newLookupLog(&q, nil)
+		ll.Error = err.Error()
+		return nil, ll, err
+	}
+	defer release()
+	answer, ll, err := rr.lookup(ctx, q, opts)
+	if err != nil {
+		// the verdict for a lookup from other roots says nothing about the
+		// answer from the resolver's own roots
+		if ll.Bogus && opts.Roots == nil {
+			rr.addBogus(q)
+		}
+		return nil, ll, err
+	}
+	if opts.RequireValidated && !answer.Authenticated {
+		ll.Error = ErrNotValidated.Error()
+		return nil, ll, ErrNotValidated
+	}
+	return answer, ll, nil
+}
+
+// refusedType checks if questions of type t are refused by the RefusedTypes
+// policy, and if so which rcode they should be answered with
+func (rr *RecursiveResolver) refusedType(t uint16) (int, bool) {
+	refused := rr.RefusedTypes
+	if refused == nil {
+		refused = DefaultRefusedTypes
+	}
+	rcode, present := refused[t]
+	return rcode, present
+}
+
+// PeekCache returns the cached answer for a question, if there is one,
+// without resolving it on a miss
+func (rr *RecursiveResolver) PeekCache(q Question) (*Answer, bool) {
+	if rr.cache == nil {
+		return nil, false
+	}
+	if name, err := ToASCII(q.Name); err == nil {
+		q.Name = name
+	}
+	answer := rr.cache.Get(&q)
+	return answer, answer != nil
+}
+
+// LookupAll looks up each of the types for name concurrently and returns the
+// answers keyed by type. If types is nil DefaultLookupAllTypes is used. If
+// the lookup for a type fails it is given the SERVFAIL answer returned by
+// Lookup.
+func (rr *RecursiveResolver) LookupAll(ctx context.Context, name string, types []uint16) map[uint16]*Answer {
+	if types == nil {
+		types = DefaultLookupAllTypes
+	}
+	results := make(map[uint16]*Answer, len(types))
+	mu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	limit := make(chan struct{}, MaxLookupAllConcurrency)
+	for _, t := range types {
+		wg.Add(1)
+		acquired := true
+		select {
+		case limit <- struct{}{}:
+		case <-ctx.Done():
+			// the lookup will be answered from the cache or fail
+			// immediately, so it doesn't need to wait for a slot
+			acquired = false
+		}
+		go func(t uint16, acquired bool) {
+			defer func() {
+				if acquired {
+					<-limit
+				}
+				wg.Done()
+			}()
+			answer, _, _ := rr.Lookup(ctx, Question{Name: name, Type: t})
+			mu.Lock()
+			results[t] = answer
+			mu.Unlock()
+		}(t, acquired)
+	}
+	wg.Wait()
+	return results
+}
+
+func (rr *RecursiveResolver) lookup(ctx context.Context, q Question, opts LookupOptions) (*Answer, *LookupLog, error) {
 	ll := newLookupLog(&q, nil)
 
-	authority := &rr.rootNameservers[mrand.Intn(len(rr.rootNameservers))]
+	// servers contains all of the known nameservers for the zone of the
+	// current authority
+	//
+	// secure tracks whether there is an unbroken chain of trust from the
+	// root to the current authority, once a insecure delegation is followed
+	// nothing below it can be validated
+	servers, cuts, secure, parentDSSet := rr.startingPoint(q.Name, opts.Roots)
+	authority := rr.pickServer(servers)
 
 	defer func() {
 		ll.Latency = time.Since(ll.Started)
@@ -351,66 +1368,225 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 
 	aliases := map[string]struct{}{}
 	var chased []dns.RR
-	var parentDSSet []dns.RR
+	// aliasesValid tracks whether all of the aliases chased so far were
+	// authenticated
+	aliasesValid := true
+	// unchecked tracks whether validation was skipped for a response, in
+	// which case the delegations followed may be wrongly marked insecure
+	unchecked := false
+	// minimize tracks whether the question sent to the current zone should
+	// be minimized
+	minimize := rr.QNAMEMinimization
 	// XXX: This whole loop could be split off into its own function in order
 	//      to pass through the i when we need to do things like lookupNS which
 	//      are prone to infinitely looping
 	for i := 0; i < MaxReferrals; i++ {
-		r, log, err := rr.query(ctx, &q, authority)
-		ll.Composites = append(ll.Composites, log)
-		if err != nil && err != dns.ErrTruncated { // if truncated still try...
+		if err := ctx.Err(); err != nil {
+			ll.Error = err.Error()
+			return nil, ll, err
+		}
+		var r *dns.Msg
+		var log *LookupLog
+		var err error
+		sent, qopts, probing := q, opts, false
+		if minimize {
+			if sent, probing = minimizedQuestion(q, authority.Zone); probing {
+				// the answers to probes are discarded so they shouldn't
+				// come from the cache either
+				qopts.NoCache = true
+			}
+		}
+		tried := map[string]struct{}{}
+		for {
+			candidates := rr.probeServers(authority, servers, tried)
+			var logs []*LookupLog
+			r, log, logs, err = rr.queryServers(ctx, &sent, candidates, qopts)
+			for _, l := range logs {
+				ll.Composites = append(ll.Composites, l)
+				opts.traceStep(ctx, StepQuery, l)
+			}
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			for _, l := range logs {
+				if l.NS != nil {
+					tried[l.NS.Addr] = struct{}{}
+				}
+			}
+			var next *Nameserver
+			if isTimeout(err) || err == ErrLameNameserver {
+				// try the other nameservers for the zone before giving up
+				next = rr.nextServer(servers, tried)
+			} else if _, ok := err.(net.Error); ok {
+				// the address may be unreachable over its address
+				// family, so try the nameserver over the other one
+				next = rr.nextServer(otherFamily(servers, authority), tried)
+			}
+			if next == nil {
+				break
+			}
+			authority = next
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				ll.Error = ctxErr.Error()
+				return nil, ll, ctxErr
+			}
+			if log.TCPFailed {
+				// the server has the answer but it couldn't be transported,
+				// so a stale answer is better than none
+				if answer := rr.staleAnswer(q); answer != nil {
+					ll.Stale = true
+					stale := *answer
+					stale.ExtendedError = &ExtendedError{Code: EDEStaleAnswer}
+					if opts.SeparateAliases {
+						stale.Aliases = chased
+					} else {
+						stale.Answer = append(append([]dns.RR{}, chased...), answer.Answer...)
+					}
+					return &stale, ll, nil
+				}
+			}
+			return nil, ll, err
+		}
+
+		if probing && !isReferral(r) {
+			// there isn't a zone cut where one was expected, the name may
+			// be a empty non-terminal, not exist, or be in a zone served by
+			// the same nameservers, so the full question is sent instead
+			minimize = false
+			continue
+		}
+
+		if rr.RequireAuthoritative && !log.CacheHit && !r.Authoritative && !isReferral(r) &&
+			(r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+			err = ErrNotAuthoritative
 			log.Error = err.Error()
 			return nil, ll, err
-		} else if err == dns.ErrTruncated {
-			log.Truncated = true
 		}
 
 		// validate
 		validated := false
 		if log.CacheHit {
 			validated = log.DNSSECValid
-		}
-		if (i == 0 || len(parentDSSet) > 0) && !log.CacheHit {
-			dkLog, err := rr.checkSignatures(ctx, r, authority, parentDSSet)
-			log.Composites = append(log.Composites, dkLog)
+		} else if log.EDNSFallback {
+			// the response can't contain signatures without EDNS, a zone
+			// the parent says is signed can't be downgraded to insecure
+			// this way since anyone on path could forge the FORMERR
+			if secure {
+				err = ErrEDNSDowngrade
+				log.Error = err.Error()
+				ll.Bogus = true
+				opts.traceStep(ctx, StepValidation, log)
+				return nil, ll, err
+			}
+			// the delegations in the response can't be checked either, so
+			// they aren't cached
+			unchecked = true
+		} else if secure && (opts.CheckingDisabled || rr.validationDisabled(q.Name)) {
+			// the caller asked for the answer not to be validated, or
+			// the name is covered by a negative trust anchor, so the
+			// response is used without being validated
+			secure = false
+			unchecked = true
+		} else if secure {
+			vs := time.Now()
+			dkLog, err := rr.checkSignatures(ctx, r, authority, servers, parentDSSet)
+			log.addValidationLatency(vs, dkLog)
+			if dkLog != nil {
+				log.Composites = append(log.Composites, dkLog)
+			}
 			if err != nil {
+				if ve, ok := err.(*ValidationError); ok {
+					log.ValidationFailures = ve.Failures
+				}
+				// a failure to fetch the keys doesn't make the answer bogus
+				if isBogusError(err) {
+					ll.Bogus = true
+				}
 				log.Error = err.Error()
+				opts.traceStep(ctx, StepValidation, log)
 				return nil, ll, err
 			}
 			validated = true
+			log.DNSSECValid = true
+			log.Unsigned = unsignedRRSets(r)
+			opts.traceStep(ctx, StepValidation, log)
 		}
 		log.DNSSECValid = validated
+		// the answer is only authenticated if all of the aliases leading
+		// to it were too
+		validated = validated && aliasesValid
 		ll.DNSSECValid = validated
 
 		if r.Rcode != dns.RcodeSuccess {
-			// XXX: cache name error?
 			if r.Rcode == dns.RcodeNameError {
-				nsecSet := extractRRSet(r.Ns, "", dns.TypeNSEC3)
-				if len(nsecSet) != 0 { // if the zone is signed and this is missing its a failure...
-					err = verifyNameError(&q, nsecSet)
+				nsecSet := denialRecords(r.Ns)
+				if len(nsecSet) != 0 && !opts.CheckingDisabled && !rr.validationDisabled(q.Name) { // if the zone is signed and this is missing its a failure...
+					vs := time.Now()
+					log.DenialProof, err = verifyNameError(&q, nsecSet, rr.MaxNSEC3Iterations)
+					log.addValidationLatency(vs, nil)
 					if err != nil {
 						log.Error = err.Error()
 						log.DNSSECValid = false
 						ll.DNSSECValid = false
+						ll.Bogus = true
 						return nil, ll, err
 					}
 				}
 			}
-			return extractAnswer(r, validated), ll, nil
+			answer := extractAnswer(r, validated)
+			if !log.CacheHit {
+				answer.Delegations = cuts
+				answer = rr.processAnswer(q, answer)
+				if !opts.NoCache {
+					rr.cacheNegative(q, answer)
+				}
+			}
+			// the aliases leading to the name are part of the answer,
+			// such as the DNAME that caused a YXDOMAIN
+			if opts.SeparateAliases {
+				answer.Aliases = chased
+			} else if len(chased) > 0 {
+				answer.Answer = append(chased, answer.Answer...)
+			}
+			return answer, ll, nil
 		}
 
 		// good response
 		if len(r.Answer) > 0 {
+			if log.DNSSECValid && !log.CacheHit {
+				// answers synthesized from a wildcard need proof that
+				// the name itself doesn't exist
+				for _, sig := range expandedSignatures(r.Answer) {
+					vs := time.Now()
+					log.DenialProof, err = verifyWildcardAnswer(&Question{Name: sig.Hdr.Name, Type: sig.TypeCovered}, denialRecords(r.Ns), sig.Labels, rr.MaxNSEC3Iterations)
+					log.addValidationLatency(vs, nil)
+					if err != nil {
+						log.Error = err.Error()
+						log.DNSSECValid = false
+						ll.DNSSECValid = false
+						ll.Bogus = true
+						return nil, ll, err
+					}
+				}
+			}
 			if ok, canonicalName, chasedRR, err := isAlias(r.Answer, q); ok {
 				if _, ok := aliases[canonicalName]; ok {
-					err = errors.New("Alias loop detected, aborting")
+					err = ErrAliasLoop
 					log.Error = err.Error()
 					return nil, ll, err
 				}
 				aliases[canonicalName] = struct{}{}
 
-				authority = &rr.rootNameservers[mrand.Intn(len(rr.rootNameservers))]
+				// the canonical name is resolved from the root, or the
+				// closest cached delegation, so the chain of trust has
+				// to be rebuilt from there
+				aliasesValid = validated
 				q.Name = canonicalName
+				servers, cuts, secure, parentDSSet = rr.startingPoint(q.Name, opts.Roots)
+				authority = rr.pickServer(servers)
+				minimize = rr.QNAMEMinimization
 				chased = append(chased, chasedRR...)
 				// XXX: cache alias answer
 				continue
@@ -418,64 +1594,122 @@ func (rr *RecursiveResolver) Lookup(ctx context.Context, q Question) (*Answer, *
 				log.Error = err.Error()
 				return nil, ll, err
 			}
-			if !log.CacheHit && rr.cache != nil {
-				go rr.cache.Add(&q, &Answer{r.Answer, r.Ns, r.Extra, r.Rcode, validated}, false)
+			answer := extractAnswer(r, validated)
+			if !log.CacheHit {
+				answer.Delegations = cuts
+				answer = rr.processAnswer(q, answer)
+				if rr.cache != nil && !opts.NoCache {
+					go rr.cache.Add(&q, &Answer{answer.Answer, answer.Authority, answer.Additional, answer.Rcode, answer.Authenticated, answer.Delegations, answer.Aliases, nil, false}, false)
+				}
 			}
 
-			if len(chased) > 0 {
+			if opts.SeparateAliases {
+				answer.Aliases = chased
+			} else if len(chased) > 0 {
 				// put aliases at the front of the answer
-				r.Answer = append(chased, r.Answer...)
+				answer.Answer = append(chased, answer.Answer...)
 			}
-			return extractAnswer(r, validated), ll, nil
+			return answer, ll, nil
 		}
 
-		nsecSet := extractRRSet(r.Ns, "", dns.TypeNSEC3)
+		nsecSet := denialRecords(r.Ns)
 
 		// NODATA response
-		if len(r.Ns) == 0 || len(nsecSet) == len(r.Ns) {
-			if len(nsecSet) != 0 {
+		if !isReferral(r) {
+			if len(nsecSet) != 0 && !opts.CheckingDisabled && !rr.validationDisabled(q.Name) {
 				// check for proper coverage
-				err = verifyNODATA(&q, nsecSet)
+				vs := time.Now()
+				log.DenialProof, err = verifyNODATA(&q, nsecSet, rr.MaxNSEC3Iterations)
+				log.addValidationLatency(vs, nil)
 				if err != nil {
 					log.Error = err.Error()
 					log.DNSSECValid = false
 					ll.DNSSECValid = false
+					ll.Bogus = true
 					return nil, ll, err
 				}
 			}
 			// ignore anything in additional section (?)
-			return &Answer{Rcode: dns.RcodeSuccess, Authenticated: validated}, ll, nil
+			answer := &Answer{Authority: r.Ns, Rcode: dns.RcodeSuccess, Authenticated: validated}
+			if !log.CacheHit {
+				answer.Delegations = cuts
+				answer = rr.processAnswer(q, answer)
+				if !opts.NoCache {
+					rr.cacheNegative(q, answer)
+				}
+			}
+			return answer, ll, nil
 		}
 
 		// Referral response
 		log.Referral = true
+		parent := authority.Zone
 		var authLog *LookupLog
-		authority, authLog, err = rr.pickAuthority(ctx, r.Ns, r.Extra)
+		authority, authLog, err = rr.pickAuthority(ctx, r.Ns, r.Extra, opts.Roots)
 		if authLog != nil {
 			log.Composites = append(log.Composites, authLog)
+			opts.traceStep(ctx, StepAuthority, authLog)
 		}
 		if err != nil {
-			log.Error = err.Error()
-			return nil, ll, err
-		}
-		if len(nsecSet) != 0 {
-			err = verifyDelegation(authority.Zone, nsecSet)
-			if err != nil {
-				log.Error = err.Error()
-				log.DNSSECValid = false
-				ll.DNSSECValid = false
-				return nil, ll, err
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				// the deadline was hit while finding the authority
+				ll.Error = ctxErr.Error()
+				return nil, ll, ctxErr
+			}
+			if _, ok := err.(*AuthorityError); !ok && isUnreachable(err) {
+				zone := q.Name
+				if ns := extractRRSet(r.Ns, "", dns.TypeNS); len(ns) > 0 {
+					zone = ns[0].Header().Name
+				}
+				err = &AuthorityError{Zone: zone, Err: err}
 			}
-		} else if len(parentDSSet) > 0 {
-			err := errors.New("unsigned delegation in signed zone without NSEC records")
 			log.Error = err.Error()
 			return nil, ll, err
 		}
-		if i == 0 || len(parentDSSet) > 0 {
+		servers = zoneNameservers(r.Ns, r.Extra, authority.Zone, rr.useIPv6)
+		if len(servers) == 0 {
+			// the authority was found without glue
+			servers = []Nameserver{*authority}
+		}
+		if secure && rr.validationDisabled(authority.Zone) {
+			// the child zone is treated as insecure without requiring the
+			// parent to prove it is
+			secure = false
+		}
+		if anchor, present := rr.trustAnchor(authority.Zone); present {
+			// the configured trust anchor is used instead of the DS
+			// RRset from the parent, which may not be signed
+			secure = true
+			parentDSSet = anchor
+		} else if secure {
 			parentDSSet = extractRRSet(r.Ns, authority.Zone, dns.TypeDS)
-		} else if i > 0 { // XXX: is this right?
-			parentDSSet = nil
+			if len(parentDSSet) == 0 {
+				// the delegation is insecure, this needs to be proven by
+				// NSEC records from the parent
+				if len(nsecSet) == 0 {
+					err := errors.New("unsigned delegation in signed zone without NSEC records")
+					log.Error = err.Error()
+					ll.Bogus = true
+					return nil, ll, err
+				}
+				vs := time.Now()
+				log.DenialProof, err = verifyDelegation(authority.Zone, nsecSet, rr.MaxNSEC3Iterations)
+				log.addValidationLatency(vs, nil)
+				if err != nil {
+					log.Error = err.Error()
+					log.DNSSECValid = false
+					ll.DNSSECValid = false
+					ll.Bogus = true
+					return nil, ll, err
+				}
+				secure = false
+			}
+		}
+		cuts = append(cuts, ZoneCut{Zone: authority.Zone, Nameservers: servers, Secure: secure})
+		if rr.cache != nil && !unchecked && opts.Roots == nil {
+			rr.cacheDelegation(r, parent, cuts, parentDSSet)
 		}
+		minimize = rr.QNAMEMinimization
 	}
 	return nil, ll, ErrTooManyReferrals
 }
@@ -494,17 +1728,35 @@ func filterRRSet(in []dns.RR, rrTypes ...uint16) []dns.RR {
 	return out
 }
 
+// extractRRSet returns the records in in that have one of the types t, and if
+// name isn't empty are owned by name. Since it is called for most responses
+// it avoids allocating anything other than the returned slice, which is sized
+// by counting the matching records first.
 func extractRRSet(in []dns.RR, name string, t ...uint16) []dns.RR {
-	out := []dns.RR{}
-	tMap := make(map[uint16]struct{}, len(t))
-	for _, t := range t {
-		tMap[t] = struct{}{}
+	matches := func(r dns.RR) bool {
+		h := r.Header()
+		if name != "" && name != h.Name {
+			return false
+		}
+		for _, rt := range t {
+			if h.Rrtype == rt {
+				return true
+			}
+		}
+		return false
 	}
+	n := 0
 	for _, r := range in {
-		if _, present := tMap[r.Header().Rrtype]; present {
-			if name != "" && name != r.Header().Name {
-				continue
-			}
+		if matches(r) {
+			n++
+		}
+	}
+	if n == 0 {
+		return []dns.RR{}
+	}
+	out := make([]dns.RR, 0, n)
+	for _, r := range in {
+		if matches(r) {
 			out = append(out, r)
 		}
 	}
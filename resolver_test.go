@@ -1,12 +1,384 @@
 package solvere
 
 import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
 )
 
+// testZone is a mock authoritative nameserver for a single zone. If the zone
+// is signed all of the authoritative RRsets it serves are signed with a single
+// ECDSA key.
+type testZone struct {
+	name    string
+	addr    string
+	records []dns.RR
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	// corrupt causes the signatures for all RRsets other than the
+	// DNSKEY RRset to be invalid
+	corrupt bool
+	// onQuery, if set, is called with each question before it is answered
+	onQuery func(q dns.Question)
+	// servfail, if set, causes queries of this type to be answered with
+	// SERVFAIL
+	servfail uint16
+	// rcodes maps names to the rcode questions for them are answered with,
+	// any DNAME owned by the parent of the name is included in the answer
+	rcodes map[string]int
+	// rejectEDNS causes queries containing a OPT record to be answered
+	// with FORMERR
+	rejectEDNS bool
+	// duplicateSigs causes the signatures in the answer section to be
+	// repeated in both the answer and authority sections
+	duplicateSigs bool
+	// notAuthoritative causes the AA bit to be unset on all responses
+	notAuthoritative bool
+	// unsignedDS causes the DS records in referrals to be served without
+	// signatures
+	unsignedDS bool
+	// nsec causes name errors, NODATA responses, and insecure referrals to
+	// include NSEC records proving the denial
+	nsec bool
+	// oldKey and oldSigner, if set, are used to sign the RRsets other than
+	// the DNSKEY RRset, simulating a nameserver still serving signatures
+	// made by a key that has been removed from the DNSKEY RRset
+	oldKey    *dns.DNSKEY
+	oldSigner crypto.Signer
+	// hosted are child zones served by the same nameserver, questions for
+	// names in them are answered by the child zone, other than DS questions
+	// for the child apex
+	hosted []*testZone
+}
+
+func newTestZone(t *testing.T, name, addr string, signed bool, records string) *testZone {
+	z := &testZone{name: name, addr: addr, records: zoneToRecords(t, records)}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		pk, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatalf("Failed to generate DNSKEY for %s: %s", name, err)
+		}
+		z.signer = pk.(crypto.Signer)
+		z.records = append(z.records, z.key)
+	}
+	return z
+}
+
+// delegate adds a delegation, and glue for the nameserver, for child to the
+// zone. If child is signed a DS record for its key is also added.
+func (z *testZone) delegate(child *testZone) {
+	nsName := "ns." + child.name
+	z.records = append(
+		z.records,
+		&dns.NS{Hdr: dns.RR_Header{Name: child.name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: nsName},
+		&dns.A{Hdr: dns.RR_Header{Name: nsName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(child.addr)},
+	)
+	if child.key != nil {
+		z.records = append(z.records, child.key.ToDS(dns.SHA256))
+	}
+}
+
+// rrset returns copies of the records of type t owned by name, since packing
+// records modifies them they can't be shared between concurrent responses
+func (z *testZone) rrset(name string, t uint16) []dns.RR {
+	set := extractRRSet(z.records, name, t)
+	for i, r := range set {
+		set[i] = dns.Copy(r)
+	}
+	return set
+}
+
+func (z *testZone) sign(set []dns.RR) []dns.RR {
+	if z.key == nil || len(set) == 0 {
+		return set
+	}
+	key, signer := z.key, z.signer
+	if z.oldKey != nil && set[0].Header().Rrtype != dns.TypeDNSKEY {
+		key, signer = z.oldKey, z.oldSigner
+	}
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: set[0].Header().Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  key.Algorithm,
+	}
+	if err := sig.Sign(signer, set); err != nil {
+		panic(err)
+	}
+	if z.corrupt && set[0].Header().Rrtype != dns.TypeDNSKEY {
+		sig.Signature = exampleKeySig.Signature
+	}
+	return append(set, sig)
+}
+
+// cut returns the closest delegation point at or above name, if there is one
+func (z *testZone) cut(name string) string {
+	for _, r := range z.records {
+		if r.Header().Rrtype != dns.TypeNS || r.Header().Name == z.name {
+			continue
+		}
+		if dns.IsSubDomain(r.Header().Name, name) {
+			return r.Header().Name
+		}
+	}
+	return ""
+}
+
+// nsecChain returns the NSEC records for the zone in canonical order,
+// names below zone cuts are left out since they are glue
+func (z *testZone) nsecChain() []*dns.NSEC {
+	types := map[string][]uint16{z.name: {dns.TypeSOA, dns.TypeDNSKEY}}
+	for _, r := range z.records {
+		name := strings.ToLower(r.Header().Name)
+		if cut := z.cut(name); cut != "" && cut != name {
+			continue
+		}
+		types[name] = append(types[name], r.Header().Rrtype)
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalNameLess(names[i], names[j]) })
+	chain := make([]*dns.NSEC, len(names))
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeRRSIG, dns.TypeNSEC)
+		sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+		chain[i] = &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap,
+		}
+	}
+	return chain
+}
+
+// nsecProof returns the signed NSEC records matching name, or covering it and
+// the wildcard at its closest encloser if it doesn't exist
+func (z *testZone) nsecProof(name string, nxdomain bool) []dns.RR {
+	chain := z.nsecChain()
+	find := func(name string) *dns.NSEC {
+		for _, n := range chain {
+			if strings.EqualFold(n.Hdr.Name, name) || nsecCovers(n, name) {
+				return n
+			}
+		}
+		return nil
+	}
+	n := find(name)
+	if n == nil {
+		return nil
+	}
+	proof := z.sign([]dns.RR{n})
+	if nxdomain {
+		if w := find(wildcardName(nsecClosestEncloser(name, n))); w != nil && w != n {
+			proof = append(proof, z.sign([]dns.RR{w})...)
+		}
+	}
+	return proof
+}
+
+// wildcardAnswer synthesizes a answer to q from the wildcard at the closest
+// encloser of the name, if there is one, signing the wildcard RRset before
+// its owner name is replaced
+func (z *testZone) wildcardAnswer(q dns.Question) []dns.RR {
+	labels := dns.SplitDomainName(q.Name)
+	for i := 1; i < len(labels); i++ {
+		ce := strings.Join(labels[i:], ".") + "."
+		if !z.exists(ce) {
+			continue
+		}
+		answer := z.sign(z.rrset("*."+ce, q.Qtype))
+		for _, r := range answer {
+			r.Header().Name = q.Name
+		}
+		return answer
+	}
+	return nil
+}
+
+func (z *testZone) exists(name string) bool {
+	for _, r := range z.records {
+		if dns.IsSubDomain(name, r.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	q := r.Question[0]
+	if z.onQuery != nil {
+		z.onQuery(q)
+	}
+	for _, child := range z.hosted {
+		if dns.IsSubDomain(child.name, q.Name) && !(q.Name == child.name && q.Qtype == dns.TypeDS) {
+			child.ServeDNS(w, r)
+			return
+		}
+	}
+	if z.rejectEDNS && r.IsEdns0() != nil {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	if z.servfail != 0 && q.Qtype == z.servfail {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	if rcode, present := z.rcodes[q.Name]; present {
+		m.Authoritative = true
+		m.Rcode = rcode
+		m.Answer = z.sign(z.rrset(strings.SplitN(q.Name, ".", 2)[1], dns.TypeDNAME))
+		w.WriteMsg(m)
+		return
+	}
+	apex := strings.TrimPrefix(z.name, ".")
+	soa := []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns." + apex,
+		Mbox:   "hostmaster." + apex,
+		Serial: 1,
+		Minttl: 300,
+	}}
+	if cut := z.cut(q.Name); cut != "" && !(q.Name == cut && q.Qtype == dns.TypeDS) {
+		m.Ns = append(m.Ns, z.rrset(cut, dns.TypeNS)...)
+		if z.unsignedDS {
+			m.Ns = append(m.Ns, z.rrset(cut, dns.TypeDS)...)
+		} else {
+			m.Ns = append(m.Ns, z.sign(z.rrset(cut, dns.TypeDS))...)
+		}
+		if z.nsec && len(z.rrset(cut, dns.TypeDS)) == 0 {
+			m.Ns = append(m.Ns, z.nsecProof(cut, false)...)
+		}
+		for _, ns := range z.rrset(cut, dns.TypeNS) {
+			m.Extra = append(m.Extra, z.rrset(ns.(*dns.NS).Ns, dns.TypeA)...)
+			m.Extra = append(m.Extra, z.rrset(ns.(*dns.NS).Ns, dns.TypeAAAA)...)
+		}
+	} else if q.Name == z.name && q.Qtype == dns.TypeSOA {
+		m.Authoritative = true
+		m.Answer = z.sign(soa)
+	} else if answer := z.rrset(q.Name, q.Qtype); len(answer) > 0 {
+		m.Authoritative = true
+		m.Answer = z.sign(answer)
+		if q.Name == z.name && q.Qtype == dns.TypeNS {
+			// include the addresses of the nameservers of the zone, like
+			// a response to a priming query
+			for _, ns := range answer {
+				m.Extra = append(m.Extra, z.rrset(ns.(*dns.NS).Ns, dns.TypeA)...)
+				m.Extra = append(m.Extra, z.rrset(ns.(*dns.NS).Ns, dns.TypeAAAA)...)
+			}
+		}
+		if z.duplicateSigs {
+			sigs := extractRRSet(m.Answer, "", dns.TypeRRSIG)
+			m.Answer = append(m.Answer, sigs...)
+			m.Ns = append(m.Ns, sigs...)
+		}
+	} else if cname := z.rrset(q.Name, dns.TypeCNAME); len(cname) > 0 {
+		m.Authoritative = true
+		m.Answer = z.sign(cname)
+	} else if z.exists(q.Name) {
+		m.Authoritative = true
+		m.Ns = z.sign(soa)
+		if z.nsec {
+			m.Ns = append(m.Ns, z.nsecProof(q.Name, false)...)
+		}
+	} else if answer := z.wildcardAnswer(q); len(answer) > 0 {
+		m.Authoritative = true
+		m.Answer = answer
+		if z.nsec {
+			m.Ns = append(m.Ns, z.nsecProof(q.Name, false)...)
+		}
+	} else {
+		m.Authoritative = true
+		m.Rcode = dns.RcodeNameError
+		m.Ns = z.sign(soa)
+		if z.nsec {
+			m.Ns = append(m.Ns, z.nsecProof(q.Name, true)...)
+		}
+	}
+	if z.notAuthoritative {
+		m.Authoritative = false
+	}
+	w.WriteMsg(m)
+}
+
+// startTestZones starts a mock nameserver for each of the zones and returns a
+// function that stops them all
+func startTestZones(t *testing.T, zones ...*testZone) func() {
+	dnsPort = "9053"
+	servers := []*dns.Server{}
+	for _, z := range zones {
+		started := make(chan struct{})
+		server := &dns.Server{
+			Addr:              net.JoinHostPort(z.addr, dnsPort),
+			Net:               "udp",
+			Handler:           z,
+			ReadTimeout:       time.Second,
+			WriteTimeout:      time.Second,
+			NotifyStartedFunc: func() { close(started) },
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				t.Errorf("DNS test server failed: %s", err)
+			}
+		}()
+		select {
+		case <-started:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("DNS test server for %s failed to start", z.name)
+		}
+		servers = append(servers, server)
+	}
+	return func() {
+		for _, s := range servers {
+			if err := s.Shutdown(); err != nil {
+				t.Errorf("Failed to shutdown DNS test server: %s", err)
+			}
+		}
+	}
+}
+
+// newTestResolver returns a RecursiveResolver using root as its only root
+// nameserver, and the key for root as its trust anchor
+func newTestResolver(root *testZone, cache QuestionAnswerCache) *RecursiveResolver {
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP(root.addr)}}
+	keys := []dns.RR{}
+	if root.key != nil {
+		keys = append(keys, root.key)
+	}
+	return NewRecursiveResolver(false, root.key != nil, hints, keys, cache)
+}
+
 func TestAllType(t *testing.T) {
 	for _, tc := range []struct {
 		set      []dns.RR
@@ -217,3 +589,1223 @@ func TestIsAlias(t *testing.T) {
 		}
 	}
 }
+
+func TestOnAnswer(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `a.example. 300 IN A 10.1.2.3
+a.example. 300 IN A 1.2.3.4
+a.example. 300 IN A 172.16.0.1
+a.example. 300 IN A 192.168.1.1`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	private := []*net.IPNet{}
+	for _, c := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("Failed to parse CIDR: %s", err)
+		}
+		private = append(private, n)
+	}
+	stripPrivate := func(q Question, a *Answer) *Answer {
+		filtered := []dns.RR{}
+		for _, r := range a.Answer {
+			if addr, ok := r.(*dns.A); ok {
+				isPrivate := false
+				for _, n := range private {
+					if n.Contains(addr.A) {
+						isPrivate = true
+						break
+					}
+				}
+				if isPrivate {
+					continue
+				}
+			}
+			filtered = append(filtered, r)
+		}
+		a.Answer = filtered
+		return a
+	}
+
+	cache := NewBasicCache()
+	rr := newTestResolver(root, cache)
+	rr.OnAnswer = stripPrivate
+
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	a, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !a.Authenticated {
+		t.Fatal("Lookup returned unauthenticated answer for signed zone")
+	}
+	addrs := extractRRSet(a.Answer, "a.example.", dns.TypeA)
+	if len(addrs) != 1 || addrs[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("OnAnswer hook didn't strip private addresses from answer: %s", a.Answer)
+	}
+
+	// the hooked answer should be what was cached
+	var cached *Answer
+	for i := 0; i < 100 && cached == nil; i++ {
+		cached = cache.Get(&q)
+		time.Sleep(time.Millisecond * 10)
+	}
+	if cached == nil {
+		t.Fatal("Answer wasn't cached")
+	}
+	if addrs := extractRRSet(cached.Answer, "a.example.", dns.TypeA); len(addrs) != 1 {
+		t.Fatalf("Cached answer wasn't passed through OnAnswer hook: %s", cached.Answer)
+	}
+
+	// a hook that returns nil leaves the answer as it was
+	rr = newTestResolver(root, nil)
+	rr.OnAnswer = func(q Question, a *Answer) *Answer { return nil }
+	a, _, err = rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup with hook returning nil failed: %s", err)
+	}
+	if addrs := extractRRSet(a.Answer, "a.example.", dns.TypeA); len(addrs) != 4 {
+		t.Fatalf("Lookup with hook returning nil returned wrong answer: %v", a)
+	}
+}
+
+func TestLookupChainOfTrust(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.4", true, "a.sub.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	example.delegate(sub)
+	stop := startTestZones(t, root, example, sub)
+	defer func() { stop() }()
+
+	q := Question{Name: "a.sub.example.", Type: dns.TypeA}
+	a, log, err := newTestResolver(root, nil).Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !a.Authenticated || !log.DNSSECValid {
+		t.Fatal("Lookup didn't authenticate answer from a signed zone three levels deep")
+	}
+	for i, l := range log.Composites {
+		if !l.DNSSECValid {
+			t.Fatalf("Lookup didn't validate response %d in the chain of trust", i)
+		}
+	}
+	stop()
+
+	// a bad signature in the deepest zone should be caught
+	sub.corrupt = true
+	stop = startTestZones(t, root, example, sub)
+	_, log, err = newTestResolver(root, nil).Lookup(context.Background(), q)
+	if err == nil {
+		t.Fatal("Lookup didn't fail with a bad signature in a signed zone three levels deep")
+	}
+	failures := log.Composites[len(log.Composites)-1].ValidationFailures
+	if len(failures) != 1 || failures[0].Name != "a.sub.example." || failures[0].Type != dns.TypeA {
+		t.Fatalf("Lookup didn't log the RRset that failed validation: %s", failures)
+	}
+}
+
+func TestLookupAliasChainOfTrust(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN CNAME b.other.")
+	other := newTestZone(t, "other.", "127.0.0.4", true, "b.other. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	root.delegate(other)
+	defer startTestZones(t, root, example, other)()
+
+	// the chain of trust for the canonical name should be built from the
+	// root rather than from the zone the alias was found in
+	a, _, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !a.Authenticated {
+		t.Fatal("Lookup didn't authenticate answer for alias between signed zones")
+	}
+	if len(extractRRSet(a.Answer, "", dns.TypeCNAME, dns.TypeA)) != 2 {
+		t.Fatalf("Lookup returned unexpected answer: %s", a.Answer)
+	}
+}
+
+func TestLookupNODATA(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	// the SOA record in the authority section of a NODATA response
+	// distinguishes it from a referral
+	a, _, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeTXT})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) != 0 {
+		t.Fatalf("Lookup returned wrong NODATA answer: %d %s", a.Rcode, a.Answer)
+	}
+	if !a.Authenticated {
+		t.Fatal("Lookup didn't authenticate NODATA answer from a signed zone")
+	}
+	if len(extractRRSet(a.Authority, "example.", dns.TypeSOA)) != 1 {
+		t.Fatalf("NODATA answer doesn't include the SOA record: %s", a.Authority)
+	}
+}
+
+func TestMaxConcurrentLookups(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "a.example. 300 IN A 1.2.3.4")
+	started, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	root.onQuery = func(dns.Question) {
+		once.Do(func() { close(started) })
+		<-unblock
+	}
+	defer startTestZones(t, root)()
+
+	rr := newTestResolver(root, nil)
+	rr.MaxConcurrentLookups = 1
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	done := make(chan error)
+	go func() {
+		_, _, err := rr.Lookup(context.Background(), q)
+		done <- err
+	}()
+	<-started
+
+	_, _, err := rr.Lookup(context.Background(), q)
+	if !errors.Is(err, ErrResolverBusy) {
+		t.Fatalf("Lookup over the concurrency limit didn't return ErrResolverBusy: %v", err)
+	}
+
+	rr.WaitWhenBusy = true
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	_, _, err = rr.Lookup(ctx, q)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Lookup waiting for a free slot didn't respect context deadline: %v", err)
+	}
+
+	// once the first lookup finishes a waiting lookup should proceed
+	waiting := make(chan error)
+	go func() {
+		_, _, err := rr.Lookup(context.Background(), q)
+		waiting <- err
+	}()
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatalf("Waiting Lookup failed: %s", err)
+	}
+}
+
+func TestLookupContextDeadline(t *testing.T) {
+	// the referral to example. has no glue so its nameserver has to be
+	// looked up, the context is cancelled before that can happen
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := newTestZone(t, ".", "127.0.0.2", false, `example. 3600 IN NS ns.other.
+other. 3600 IN NS ns.other.
+ns.other. 3600 IN A 127.0.0.4`)
+	root.onQuery = func(q dns.Question) {
+		if q.Name == "a.example." {
+			cancel()
+		}
+	}
+	other := newTestZone(t, "other.", "127.0.0.4", false, "ns.other. 300 IN A 127.0.0.3")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	queried := false
+	other.onQuery = func(dns.Question) { queried = true }
+	defer startTestZones(t, root, other, example)()
+
+	_, ll, err := newTestResolver(root, nil).Lookup(ctx, Question{Name: "a.example.", Type: dns.TypeA})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Lookup didn't return the context error: %v", err)
+	}
+	if ll == nil || ll.Error != err.Error() {
+		t.Fatalf("LookupLog doesn't contain the context error: %#v", ll)
+	}
+	if len(ll.Composites) != 1 {
+		t.Fatalf("LookupLog doesn't contain the partial queries: %d composites", len(ll.Composites))
+	}
+	if queried {
+		t.Fatal("Nameserver lookup was made after the context was cancelled")
+	}
+}
+
+func TestLookupUnknownType(t *testing.T) {
+	// CSYNC (62) isn't supported by the dns package, so like any other
+	// unknown type it is handled as a RFC 3597 record
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `a.example. 300 IN TYPE65280 \# 4 01020304
+a.example. 300 IN TYPE62 \# 9 000000010003000140`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
+	rr := newTestResolver(root, cache)
+	for _, tc := range []struct {
+		t     uint16
+		rdata string
+	}{
+		{65280, "01020304"},
+		{62, "000000010003000140"},
+	} {
+		q := Question{Name: "a.example.", Type: tc.t}
+		check := func(a *Answer, source string) {
+			if !a.Authenticated {
+				t.Fatalf("%s answer containing unknown type %d wasn't authenticated", source, tc.t)
+			}
+			unknown := extractRRSet(a.Answer, "a.example.", tc.t)
+			if len(unknown) != 1 {
+				t.Fatalf("Unknown type %d record not returned in %s answer: %s", tc.t, source, a.Answer)
+			}
+			if r, ok := unknown[0].(*dns.RFC3597); !ok || r.Rdata != tc.rdata {
+				t.Fatalf("Unknown type %d record in %s answer mangled: %s", tc.t, source, unknown[0])
+			}
+			sigs := extractRRSet(a.Answer, "a.example.", dns.TypeRRSIG)
+			if len(sigs) != 1 || sigs[0].(*dns.RRSIG).TypeCovered != tc.t {
+				t.Fatalf("RRSIG for unknown type %d not returned in %s answer: %s", tc.t, source, a.Answer)
+			}
+		}
+		a, ll, err := rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Lookup of unknown type %d failed: %s", tc.t, err)
+		}
+		check(a, "resolved")
+		if ll.Composites[len(ll.Composites)-1].CacheHit {
+			t.Fatalf("First lookup of unknown type %d was a cache hit", tc.t)
+		}
+
+		var cached *Answer
+		for i := 0; i < 100 && cached == nil; i++ {
+			cached = cache.Get(&q)
+			time.Sleep(time.Millisecond * 10)
+		}
+		if cached == nil {
+			t.Fatalf("Answer containing unknown type %d wasn't cached", tc.t)
+		}
+		check(cached, "cached")
+		a, ll, err = rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Cached lookup of unknown type %d failed: %s", tc.t, err)
+		}
+		check(a, "cached")
+		if !ll.Composites[len(ll.Composites)-1].CacheHit {
+			t.Fatalf("Second lookup of unknown type %d wasn't a cache hit", tc.t)
+		}
+	}
+}
+
+func TestLookupLatencyBreakdown(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	for _, log := range ll.Composites {
+		if log.ExchangeLatency == 0 || log.ValidationLatency == 0 {
+			t.Fatalf("Query log is missing latency breakdown: exchange %s, validation %s", log.ExchangeLatency, log.ValidationLatency)
+		}
+		sum := log.ExchangeLatency + log.ValidationLatency
+		if sum > log.Latency || log.Latency-sum > time.Millisecond*50 {
+			t.Fatalf("Latency breakdown doesn't add up: exchange %s + validation %s, total %s", log.ExchangeLatency, log.ValidationLatency, log.Latency)
+		}
+	}
+}
+
+func TestLookupRequireValidated(t *testing.T) {
+	opts := LookupOptions{RequireValidated: true}
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	for _, signed := range []bool{false, true} {
+		root := newTestZone(t, ".", "127.0.0.2", signed, "")
+		example := newTestZone(t, "example.", "127.0.0.3", signed, "a.example. 300 IN A 1.2.3.4")
+		root.delegate(example)
+		stop := startTestZones(t, root, example)
+
+		rr := newTestResolver(root, nil)
+		_, _, err := rr.Lookup(context.Background(), q)
+		if err != nil {
+			stop()
+			t.Fatalf("Lookup failed: %s", err)
+		}
+		_, _, err = rr.LookupWithOptions(context.Background(), q, opts)
+		stop()
+		if signed && err != nil {
+			t.Fatalf("Lookup of signed answer failed with RequireValidated: %s", err)
+		}
+		if !signed && !errors.Is(err, ErrNotValidated) {
+			t.Fatalf("Lookup of unsigned answer didn't return ErrNotValidated: %v", err)
+		}
+	}
+}
+
+func TestLookupNoCache(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := NewBasicCache()
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	cached := &Answer{Answer: []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IP{5, 6, 7, 8},
+	}}}
+	cache.Add(&q, cached, false)
+
+	rr := newTestResolver(root, cache)
+	a, ll, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{NoCache: true})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if ll.Composites[len(ll.Composites)-1].CacheHit {
+		t.Fatal("Lookup with NoCache used cached answer")
+	}
+	if len(a.Answer) == 0 || a.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Fatalf("Lookup with NoCache returned wrong answer: %s", a.Answer)
+	}
+
+	// give any background cache update a chance to happen
+	time.Sleep(time.Millisecond * 50)
+	a = cache.Get(&q)
+	if a == nil || len(a.Answer) != 1 || a.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Fatalf("Lookup with NoCache updated the cache: %v", a)
+	}
+}
+
+func TestLookupEDNSFallback(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.rejectEDNS = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	// a signed zone can't be downgraded to insecure by rejecting EDNS
+	rr := newTestResolver(root, nil)
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if !errors.Is(err, ErrEDNSDowngrade) {
+		t.Fatalf("Lookup in signed zone rejecting EDNS didn't fail with ErrEDNSDowngrade: %v", err)
+	}
+	if !ll.Bogus {
+		t.Fatal("Lookup in signed zone rejecting EDNS wasn't marked bogus")
+	}
+	last := ll.Composites[len(ll.Composites)-1]
+	if !last.EDNSFallback {
+		t.Fatal("Lookup log doesn't record fallback to plain DNS")
+	}
+}
+
+func TestLookupEDNSFallbackInsecure(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	root.rejectEDNS = true
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
+	rr := newTestResolver(root, cache)
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(extractRRSet(a.Answer, "a.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %s", a.Answer)
+	}
+	if a.Authenticated {
+		t.Fatal("Lookup returned authenticated answer after falling back to plain DNS")
+	}
+	if !ll.Composites[0].EDNSFallback || ll.Composites[0].DNSSECValid {
+		t.Fatal("Lookup log doesn't record fallback to plain DNS")
+	}
+	// the referral received without EDNS isn't used for later lookups
+	if d := rr.closestDelegation("example."); d != nil {
+		t.Fatalf("Delegation received without EDNS was cached: %v", d.chain)
+	}
+}
+
+func TestLookupBogusTTL(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.corrupt = true
+	mu := new(sync.Mutex)
+	queries := 0
+	example.onQuery = func(dns.Question) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := newTestResolver(root, nil)
+	rr.Clock = fc
+	rr.BogusTTL = time.Second * 5
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	_, ll, err := rr.Lookup(context.Background(), q)
+	if err == nil || errors.Is(err, ErrBogusCached) || !ll.Bogus {
+		t.Fatalf("Lookup didn't fail validation for corrupt zone: %v", err)
+	}
+	sent := count()
+
+	_, ll, err = rr.Lookup(context.Background(), q)
+	if !errors.Is(err, ErrBogusCached) {
+		t.Fatalf("Lookup didn't return cached bogus verdict: %v", err)
+	}
+	if !ll.Bogus || !ll.CacheHit || len(ll.Composites) != 0 {
+		t.Fatal("Lookup log doesn't record cached bogus verdict")
+	}
+	if count() != sent {
+		t.Fatal("Lookup with cached bogus verdict queried the zone again")
+	}
+
+	// once the verdict expires the answer should be resolved and validated
+	// again
+	fc.Add(time.Second * 6)
+	_, _, err = rr.Lookup(context.Background(), q)
+	if err == nil || errors.Is(err, ErrBogusCached) {
+		t.Fatalf("Lookup after bogus verdict expired didn't fail validation: %v", err)
+	}
+	if count() == sent {
+		t.Fatal("Lookup after bogus verdict expired didn't query the zone again")
+	}
+}
+
+func TestLookupKeysUnavailableNotBogus(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.servfail = dns.TypeDNSKEY
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	rr.BogusTTL = time.Minute
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	_, ll, err := rr.Lookup(context.Background(), q)
+	if err == nil {
+		t.Fatal("Lookup didn't fail when the zone's keys couldn't be fetched")
+	}
+	if ll.Bogus {
+		t.Fatalf("Lookup was marked bogus when the zone's keys couldn't be fetched: %s", err)
+	}
+	if _, _, err := rr.Lookup(context.Background(), q); errors.Is(err, ErrBogusCached) {
+		t.Fatal("Failure to fetch the zone's keys was remembered as a bogus verdict")
+	}
+}
+
+func TestLookupDisableValidationFor(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	// signatures from the zone would fail validation if they were checked
+	example.corrupt = true
+	mu := new(sync.Mutex)
+	dnskeyQueries := 0
+	example.onQuery = func(q dns.Question) {
+		if q.Qtype == dns.TypeDNSKEY {
+			mu.Lock()
+			dnskeyQueries++
+			mu.Unlock()
+		}
+	}
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	rr.DisableValidationFor("EXAMPLE")
+	answer, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup in zone with validation disabled failed: %s", err)
+	}
+	if answer.Authenticated || ll.DNSSECValid || ll.Bogus {
+		t.Fatal("Answer from zone with validation disabled was treated as authenticated or bogus")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dnskeyQueries != 0 {
+		t.Fatalf("Lookup sent %d DNSKEY queries to zone with validation disabled", dnskeyQueries)
+	}
+}
+
+func TestLookupNegativeTrustAnchor(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `a.sub.example. 300 IN A 1.2.3.4
+b.example. 300 IN A 1.2.3.4`)
+	example.corrupt = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	q := Question{Name: "a.sub.example.", Type: dns.TypeA}
+	if _, _, err := rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup in corrupt zone didn't fail validation")
+	}
+
+	// the anchor isn't at a zone cut, so it applies to names in the
+	// example. zone
+	rr.AddNegativeTrustAnchor("SUB.example")
+	answer, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup below negative trust anchor failed: %s", err)
+	}
+	if answer.Authenticated || ll.DNSSECValid || ll.Bogus {
+		t.Fatal("Answer below negative trust anchor was treated as authenticated or bogus")
+	}
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA}); err == nil {
+		t.Fatal("Lookup outside of negative trust anchor didn't fail validation")
+	}
+	if anchors := rr.NegativeTrustAnchors(); len(anchors) != 1 || anchors[0] != "sub.example." {
+		t.Fatalf("NegativeTrustAnchors returned unexpected anchors: %v", anchors)
+	}
+
+	if !rr.RemoveNegativeTrustAnchor("sub.example.") {
+		t.Fatal("RemoveNegativeTrustAnchor didn't find anchor")
+	}
+	if rr.RemoveNegativeTrustAnchor("sub.example.") {
+		t.Fatal("RemoveNegativeTrustAnchor found anchor that was already removed")
+	}
+	if len(rr.NegativeTrustAnchors()) != 0 {
+		t.Fatal("NegativeTrustAnchors returned removed anchor")
+	}
+	if _, _, err := rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup after negative trust anchor was removed didn't fail validation")
+	}
+}
+
+func TestLookupNegativeTrustAnchorDelegations(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `a.sub.example. 300 IN A 1.2.3.4
+b.example. 300 IN A 1.2.3.4`)
+	example.corrupt = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: clock.Default()}
+	rr := newTestResolver(root, cache)
+	rr.AddNegativeTrustAnchor("sub.example.")
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup below negative trust anchor failed: %s", err)
+	}
+	// the delegation to example. followed without validation mustn't be
+	// reused for names outside of the anchor
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA})
+	if err == nil {
+		t.Fatal("Lookup outside of negative trust anchor didn't fail validation")
+	}
+	if !ll.Bogus {
+		t.Fatal("Lookup outside of negative trust anchor wasn't marked bogus")
+	}
+}
+
+func TestLookupCheckingDisabled(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.corrupt = true
+	root.delegate(example)
+	defer startTestZones(t, root)()
+
+	// wrap the zone to record the CD bit of the queries sent to it
+	mu := new(sync.Mutex)
+	cd := []bool{}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Addr: net.JoinHostPort(example.addr, dnsPort),
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			cd = append(cd, r.CheckingDisabled)
+			mu.Unlock()
+			example.ServeDNS(w, r)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	<-started
+
+	cache := NewBasicCache()
+	rr := newTestResolver(root, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	answer, ll, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{CheckingDisabled: true})
+	if err != nil {
+		t.Fatalf("Lookup with checking disabled failed: %s", err)
+	}
+	if answer.Authenticated || ll.DNSSECValid || ll.Bogus {
+		t.Fatal("Answer with checking disabled was treated as authenticated or bogus")
+	}
+	mu.Lock()
+	if len(cd) == 0 || !cd[len(cd)-1] {
+		t.Fatalf("Query sent with checking disabled didn't have the CD bit set: %v", cd)
+	}
+	mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	if cache.Get(&q) != nil {
+		t.Fatal("Answer with checking disabled was cached")
+	}
+
+	if _, _, err := rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup without checking disabled didn't fail validation")
+	}
+}
+
+func TestLookupRoots(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	// the root hints of the resolver point at a address without a server,
+	// so the lookup can only succeed if it starts from the mock root
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP("127.0.0.9")}}
+	cache := NewBasicCache()
+	rr := NewRecursiveResolver(false, true, hints, []dns.RR{root.key}, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	answer, _, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Roots: []Nameserver{{Name: "mock.", Addr: root.addr}}})
+	if err != nil {
+		t.Fatalf("Lookup from mock root failed: %s", err)
+	}
+	if !answer.Authenticated || len(extractRRSet(answer.Answer, "a.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup from mock root returned unexpected answer: %s", answer.Answer)
+	}
+	if len(answer.Delegations) == 0 || answer.Delegations[0].Nameservers[0].Addr != root.addr {
+		t.Fatalf("Lookup didn't start from mock root: %v", answer.Delegations)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if cache.Get(&q) != nil {
+		t.Fatal("Answer from mock root was cached")
+	}
+	if d := rr.closestDelegation("a.example."); d != nil {
+		t.Fatal("Delegation from mock root was cached")
+	}
+
+	if _, _, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Roots: []Nameserver{}}); !errors.Is(err, ErrNoRoots) {
+		t.Fatalf("Lookup with empty roots didn't fail with ErrNoRoots: %v", err)
+	}
+}
+
+func TestLookupRootsBogus(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	// the mock root is signed with a key that doesn't match the trust
+	// anchor, so lookups starting from it are bogus
+	mock := newTestZone(t, ".", "127.0.0.4", true, "")
+	mock.delegate(example)
+	defer startTestZones(t, root, mock, example)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	rr.BogusTTL = time.Minute
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	_, ll, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Roots: []Nameserver{{Name: "mock.", Addr: mock.addr}}})
+	if err == nil || !ll.Bogus {
+		t.Fatalf("Lookup from mock root with mismatching keys wasn't bogus: %v", err)
+	}
+	answer, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup after bogus lookup from mock root failed: %s", err)
+	}
+	if !answer.Authenticated {
+		t.Fatal("Lookup after bogus lookup from mock root returned unauthenticated answer")
+	}
+}
+
+func TestLookupRefusedTypes(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "a. 300 IN A 1.2.3.4")
+	mu := new(sync.Mutex)
+	queries := 0
+	root.onQuery = func(dns.Question) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+	}
+	defer startTestZones(t, root)()
+
+	rr := newTestResolver(root, nil)
+	a, ll, err := rr.Lookup(context.Background(), Question{Name: "a.", Type: dns.TypeANY})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if a.Rcode != dns.RcodeRefused || ll.Rcode != dns.RcodeRefused {
+		t.Fatalf("ANY query wasn't refused by default, got %s", dns.RcodeToString[a.Rcode])
+	}
+	mu.Lock()
+	if queries != 0 {
+		t.Fatalf("Refused question sent %d queries", queries)
+	}
+	mu.Unlock()
+
+	rr.RefusedTypes = map[uint16]int{dns.TypeTXT: dns.RcodeNotImplemented}
+	if a, _, err = rr.Lookup(context.Background(), Question{Name: "a.", Type: dns.TypeTXT}); err != nil || a.Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("TXT query wasn't answered with NOTIMP: %v", err)
+	}
+	if a, _, err = rr.Lookup(context.Background(), Question{Name: "a.", Type: dns.TypeANY}); err != nil || a.Rcode == dns.RcodeRefused {
+		t.Fatalf("ANY query was refused when permitted: %v", err)
+	}
+}
+
+func TestLookupDeduplicateRecords(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	example.duplicateSigs = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	rr := newTestResolver(root, nil)
+	if _, _, err := rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup didn't fail with signatures that don't cover anything in the authority section")
+	}
+
+	rr.DeduplicateRecords = true
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !a.Authenticated {
+		t.Fatal("Lookup returned unauthenticated answer for signed zone")
+	}
+	if len(a.Answer) != 2 || len(extractRRSet(a.Answer, "a.example.", dns.TypeRRSIG)) != 1 {
+		t.Fatalf("Lookup returned duplicate records in answer: %s", a.Answer)
+	}
+	if len(a.Authority) != 0 {
+		t.Fatalf("Lookup returned duplicate records in authority: %s", a.Authority)
+	}
+	if last := ll.Composites[len(ll.Composites)-1]; len(last.ValidationFailures) != 0 {
+		t.Fatalf("Lookup logged validation failures: %s", last.ValidationFailures)
+	}
+}
+
+func TestPeekCache(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	mu := new(sync.Mutex)
+	queries := 0
+	for _, z := range []*testZone{root, example} {
+		z.onQuery = func(dns.Question) {
+			mu.Lock()
+			queries++
+			mu.Unlock()
+		}
+	}
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	cache := NewBasicCache()
+	rr := newTestResolver(root, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	if a, present := rr.PeekCache(q); present || a != nil {
+		t.Fatalf("PeekCache returned answer for uncached question: %v", a)
+	}
+	mu.Lock()
+	if queries != 0 {
+		t.Fatalf("PeekCache sent %d queries on a cache miss", queries)
+	}
+	mu.Unlock()
+
+	if _, _, err := rr.Lookup(context.Background(), q); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	var a *Answer
+	present := false
+	for i := 0; i < 100 && !present; i++ {
+		a, present = rr.PeekCache(q)
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !present || len(a.Answer) != 1 {
+		t.Fatalf("PeekCache didn't return cached answer: %v", a)
+	}
+
+	if a, present := newTestResolver(root, nil).PeekCache(q); present || a != nil {
+		t.Fatal("PeekCache returned answer for resolver without a cache")
+	}
+}
+
+func TestLookupRequireAuthoritative(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	example.notAuthoritative = true
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	for _, name := range []string{"a.example.", "missing.example."} {
+		q := Question{Name: name, Type: dns.TypeA}
+		rr.RequireAuthoritative = false
+		if _, _, err := rr.Lookup(context.Background(), q); err != nil {
+			t.Fatalf("Lookup of non-authoritative answer for %s failed without RequireAuthoritative: %s", name, err)
+		}
+		rr.RequireAuthoritative = true
+		_, ll, err := rr.Lookup(context.Background(), q)
+		if !errors.Is(err, ErrNotAuthoritative) {
+			t.Fatalf("Lookup of non-authoritative answer for %s didn't fail with RequireAuthoritative: %v", name, err)
+		}
+		// the referral from the root doesn't have the AA bit set either
+		// but should have been followed
+		if len(ll.Composites) != 2 {
+			t.Fatalf("Lookup failed at the wrong step: %d", len(ll.Composites))
+		}
+	}
+}
+
+func TestLookupParentSigner(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, `
+a.example. 300 IN A 1.2.3.4
+a.sub.example. 300 IN A 1.2.3.5
+`)
+	// delegate sub.example. to the nameserver for example., which isn't
+	// aware of the delegation and answers with records signed by example.
+	subKey := *example.key
+	subKey.Hdr.Name = "sub.example."
+	root.records = append(
+		root.records,
+		&dns.NS{Hdr: dns.RR_Header{Name: "sub.example.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns.sub.example."},
+		&dns.A{Hdr: dns.RR_Header{Name: "ns.sub.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600}, A: net.ParseIP(example.addr)},
+		subKey.ToDS(dns.SHA256),
+	)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	q := Question{Name: "a.sub.example.", Type: dns.TypeA}
+	_, _, err := rr.Lookup(context.Background(), q)
+	if !errors.Is(err, ErrUntrustedSigner) {
+		t.Fatalf("Lookup signed by parent zone with unauthenticated keys didn't return ErrUntrustedSigner: %v", err)
+	}
+
+	// authenticate the keys for example. by following the chain of trust
+	// through it
+	_, _, err = rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	a, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup signed by parent zone failed: %s", err)
+	}
+	if !a.Authenticated {
+		t.Fatal("Answer signed by parent zone wasn't authenticated")
+	}
+}
+
+func TestLookupNoReachableAuthority(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "example. 3600 IN NS ns.nowhere.")
+	defer startTestZones(t, root)()
+
+	rr := newTestResolver(root, nil)
+	_, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	var ae *AuthorityError
+	if !errors.As(err, &ae) {
+		t.Fatalf("Lookup with unresolvable nameservers didn't return a AuthorityError: %v", err)
+	}
+	if ae.Zone != "example." {
+		t.Fatalf("AuthorityError has wrong zone: %s", ae.Zone)
+	}
+	if code, ok := ExtendedErrorCode(err); !ok || code != EDENoReachableAuthority {
+		t.Fatalf("AuthorityError mapped to wrong extended error code: %d", code)
+	}
+}
+
+func TestLookupAuthorityAddressBogus(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "example. 3600 IN NS host.other.")
+	root.nsec = true
+	other := newTestZone(t, "other.", "127.0.0.4", true, "host.other. 300 IN A 127.0.0.3")
+	other.corrupt = true
+	root.delegate(other)
+	defer startTestZones(t, root, other)()
+
+	rr := newTestResolver(root, nil)
+	_, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err == nil {
+		t.Fatal("Lookup with bogus nameserver address didn't fail")
+	}
+	// the nameserver was reachable as far as the resolver knows, its
+	// address just couldn't be trusted
+	var ae *AuthorityError
+	if errors.As(err, &ae) {
+		t.Fatalf("Lookup with bogus nameserver address returned a AuthorityError: %v", err)
+	}
+	var re *ResolveError
+	if !errors.As(err, &re) || re.Code != CodeBogus {
+		t.Fatalf("Lookup with bogus nameserver address returned wrong error: %v", err)
+	}
+}
+
+func TestLookupGlueless(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, `
+example. 3600 IN NS ns.nowhere.
+example. 3600 IN NS ns.example.other.
+`)
+	other := newTestZone(t, "other.", "127.0.0.4", false, "ns.example.other. 300 IN A 127.0.0.3")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(other)
+	defer startTestZones(t, root, other, example)()
+
+	// whichever nameserver is picked first, the unresolvable one shouldn't
+	// cause the lookup to fail
+	for i := 0; i < 10; i++ {
+		a, _, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+		if err != nil {
+			t.Fatalf("Lookup with one unresolvable nameserver failed: %s", err)
+		}
+		if len(extractRRSet(a.Answer, "a.example.", dns.TypeA)) != 1 {
+			t.Fatalf("Lookup returned wrong answer: %s", a.Answer)
+		}
+	}
+}
+
+func TestLookupSeparateAliases(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `a.example. 300 IN CNAME b.example.
+b.example. 300 IN CNAME c.example.
+c.example. 300 IN A 1.2.3.4`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	a, _, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{SeparateAliases: true})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 1 || a.Answer[0].Header().Rrtype != dns.TypeA || a.Answer[0].Header().Name != "c.example." {
+		t.Fatalf("Lookup returned wrong answer: %v", a.Answer)
+	}
+	if len(a.Aliases) != 2 || a.Aliases[0].(*dns.CNAME).Target != "b.example." || a.Aliases[1].(*dns.CNAME).Target != "c.example." {
+		t.Fatalf("Lookup returned wrong aliases: %v", a.Aliases)
+	}
+
+	// by default the aliases are prepended to the answer
+	a, _, err = rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) != 3 || len(a.Aliases) != 0 || a.Answer[2].Header().Rrtype != dns.TypeA {
+		t.Fatalf("Lookup returned wrong answer without SeparateAliases: %v %v", a.Answer, a.Aliases)
+	}
+}
+
+func TestLookupMissingGlue(t *testing.T) {
+	// the nameserver is inside the zone it serves but the referral has no
+	// glue for it
+	root := newTestZone(t, ".", "127.0.0.2", false, "example. 3600 IN NS ns.example.")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `ns.example. 300 IN A 127.0.0.3
+a.example. 300 IN A 1.2.3.4`)
+	defer startTestZones(t, root, example)()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var ae *AuthorityError
+		if !errors.As(err, &ae) || ae.Err != ErrMissingGlue || ae.Zone != "example." {
+			t.Fatalf("Lookup didn't fail with ErrMissingGlue: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup of delegation missing in-bailiwick glue didn't return")
+	}
+}
+
+func TestLookupAll(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, `
+a.example. 300 IN A 1.2.3.4
+a.example. 300 IN AAAA ::1
+a.example. 300 IN MX 10 mail.example.
+a.example. 300 IN TXT "hello"
+`)
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, NewBasicCache())
+	types := []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX, dns.TypeTXT, dns.TypeSRV}
+	results := rr.LookupAll(context.Background(), "a.example.", types)
+	if len(results) != len(types) {
+		t.Fatalf("LookupAll returned %d results, expected %d", len(results), len(types))
+	}
+	for _, rrType := range types {
+		a := results[rrType]
+		if a == nil || a.Rcode != dns.RcodeSuccess {
+			t.Fatalf("LookupAll returned bad result for %s: %#v", dns.TypeToString[rrType], a)
+		}
+		expected := 1
+		if rrType == dns.TypeSRV {
+			expected = 0
+		}
+		if len(extractRRSet(a.Answer, "a.example.", rrType)) != expected {
+			t.Fatalf("LookupAll returned wrong answer for %s: %s", dns.TypeToString[rrType], a.Answer)
+		}
+	}
+
+	// once the context is cancelled the remaining lookups fail without
+	// waiting for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	types = append(types, dns.TypeNS, dns.TypeSOA, dns.TypeCAA, dns.TypePTR)
+	results = rr.LookupAll(ctx, "b.example.", types)
+	for _, rrType := range types {
+		if a := results[rrType]; a == nil || a.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("LookupAll with cancelled context returned bad result for %s: %#v", dns.TypeToString[rrType], a)
+		}
+	}
+}
+
+func TestQueryEDNS(t *testing.T) {
+	dnsPort = "9053"
+	mu := new(sync.Mutex)
+	var badVersion, dropOPT bool
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if !dropOPT {
+			m.SetEdns0(4096, false)
+			if badVersion {
+				// BADVERS is 16, the upper 8 bits of which are in the OPT TTL
+				m.Extra[0].Header().Ttl |= 1 << 24
+			}
+		}
+		w.WriteMsg(m)
+	}
+	s := &dns.Server{Addr: net.JoinHostPort("127.0.0.2", dnsPort), Net: "udp", Handler: dns.HandlerFunc(handler), ReadTimeout: time.Second}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	q := &Question{Name: "example.", Type: dns.TypeA}
+	auth := &Nameserver{Addr: "127.0.0.2", Zone: "."}
+
+	_, log, err := rr.query(context.Background(), q, auth, LookupOptions{})
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if !log.DOIgnored {
+		t.Fatal("query didn't record DO bit being ignored")
+	}
+
+	mu.Lock()
+	dropOPT = true
+	mu.Unlock()
+	_, log, err = rr.query(context.Background(), q, auth, LookupOptions{})
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if !log.DOIgnored {
+		t.Fatal("query didn't record DO bit being ignored when OPT was dropped")
+	}
+
+	mu.Lock()
+	dropOPT, badVersion = false, true
+	mu.Unlock()
+	_, log, err = rr.query(context.Background(), q, auth, LookupOptions{})
+	if err != ErrBadEDNSVersion {
+		t.Fatalf("query didn't return ErrBadEDNSVersion for BADVERS response: %v", err)
+	}
+	if !log.BadEDNSVersion || log.Rcode != dns.RcodeBadVers {
+		t.Fatal("query didn't record BADVERS response")
+	}
+}
+
+func TestQueryExpire(t *testing.T) {
+	dnsPort = "9053"
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(4096, false)
+		for _, o := range r.IsEdns0().Option {
+			if o.Option() == dns.EDNS0EXPIRE {
+				opt := m.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 1209600})
+			}
+		}
+		w.WriteMsg(m)
+	}
+	s := &dns.Server{Addr: net.JoinHostPort("127.0.0.2", dnsPort), Net: "udp", Handler: dns.HandlerFunc(handler), ReadTimeout: time.Second}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	q := &Question{Name: "example.", Type: dns.TypeSOA}
+	auth := &Nameserver{Addr: "127.0.0.2", Zone: "."}
+
+	_, log, err := rr.query(context.Background(), q, auth, LookupOptions{})
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if log.Expire != nil {
+		t.Fatalf("query recorded expire timer that wasn't requested: %d", *log.Expire)
+	}
+
+	_, log, err = rr.query(context.Background(), q, auth, LookupOptions{RequestExpire: true})
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if log.Expire == nil || *log.Expire != 1209600 {
+		t.Fatalf("query didn't record expire timer: %v", log.Expire)
+	}
+}
+
+func TestExtractRRSet(t *testing.T) {
+	records := zoneToRecords(t, `a.example. 300 IN A 1.2.3.4
+a.example. 300 IN AAAA ::1
+b.example. 300 IN A 1.2.3.5
+a.example. 300 IN TXT "hello"`)
+	for _, tc := range []struct {
+		name     string
+		types    []uint16
+		expected []dns.RR
+	}{
+		{"", []uint16{dns.TypeA}, []dns.RR{records[0], records[2]}},
+		{"a.example.", []uint16{dns.TypeA}, []dns.RR{records[0]}},
+		{"a.example.", []uint16{dns.TypeA, dns.TypeTXT}, []dns.RR{records[0], records[3]}},
+		{"", []uint16{dns.TypeA, dns.TypeAAAA}, []dns.RR{records[0], records[1], records[2]}},
+		{"c.example.", []uint16{dns.TypeA}, []dns.RR{}},
+		{"", nil, []dns.RR{}},
+	} {
+		out := extractRRSet(records, tc.name, tc.types...)
+		if out == nil || !reflect.DeepEqual(out, tc.expected) {
+			t.Fatalf("extractRRSet(%q, %v) returned %v, expected %v", tc.name, tc.types, out, tc.expected)
+		}
+	}
+}
+
+func BenchmarkExtractRRSet(b *testing.B) {
+	var records []dns.RR
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("%d.example.", i)
+		records = append(records,
+			&dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS}, Ns: "ns." + name},
+			&dns.DS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDS}},
+			&dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG}, TypeCovered: dns.TypeDS},
+		)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extractRRSet(records, "", dns.TypeNSEC3)
+		extractRRSet(records, "3.example.", dns.TypeDS)
+		extractRRSet(records, "", dns.TypeNS, dns.TypeDS)
+	}
+}
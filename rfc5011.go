@@ -0,0 +1,315 @@
+package solvere
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+var (
+	// ErrNoTrustAnchors is returned by RefreshRoot when none of the root
+	// trust anchors are valid, so the fetched DNSKEY RRset can't be
+	// authenticated
+	ErrNoTrustAnchors = errors.New("solvere: No valid root trust anchors")
+	// ErrAnchorsNotLoaded is returned by RefreshRoot when it is called
+	// before StartRootRefresh has loaded the trust anchor state
+	ErrAnchorsNotLoaded = errors.New("solvere: Trust anchor state hasn't been loaded")
+)
+
+var (
+	// RFC5011HoldDown is how long a new root KSK must be continuously
+	// published and signed for before it is trusted (RFC 5011 Section 2.4.1)
+	RFC5011HoldDown = 30 * 24 * time.Hour
+
+	// DefaultRootRefreshInterval is how often the root DNSKEY RRset is
+	// fetched if StartRootRefresh is called with a zero interval, it is
+	// well below the active refresh limit of 15 days (RFC 5011 Section
+	// 2.3) so that a revocation is noticed quickly
+	DefaultRootRefreshInterval = 12 * time.Hour
+)
+
+// AnchorState is the RFC 5011 state of a root trust anchor
+type AnchorState int
+
+const (
+	// AnchorAddPending is a key that has been seen in the root DNSKEY RRset
+	// but the hold-down period hasn't passed yet, so it isn't trusted
+	AnchorAddPending AnchorState = iota
+	// AnchorValid is a trusted key
+	AnchorValid
+	// AnchorRevoked is a key that has been revoked by publishing it with
+	// the REVOKE bit set, signed by itself, and is no longer trusted
+	AnchorRevoked
+)
+
+// TrustAnchor is a root KSK tracked for RFC 5011 rollover
+type TrustAnchor struct {
+	Key   *dns.DNSKEY
+	State AnchorState
+	// FirstSeen is when the key was first seen in the root DNSKEY RRset,
+	// which is when the hold-down period for a new key starts
+	FirstSeen time.Time
+	// LastSeen is the last time the key was seen in the root DNSKEY RRset
+	LastSeen time.Time
+}
+
+// AnchorStore persists the state of the root trust anchors, so that pending
+// keys and revocations survive restarts
+type AnchorStore interface {
+	// Load returns the stored trust anchors, if nothing has been stored
+	// yet it should return no anchors and no error
+	Load() ([]TrustAnchor, error)
+	// Save replaces the stored trust anchors
+	Save(anchors []TrustAnchor) error
+}
+
+// FileAnchorStore is a AnchorStore that stores the trust anchors as JSON in a
+// file
+type FileAnchorStore struct {
+	Path string
+}
+
+// storedAnchor is the JSON format used by FileAnchorStore, the key is stored
+// in presentation format
+type storedAnchor struct {
+	Key       string
+	State     AnchorState
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Load reads the trust anchors from the file, if it doesn't exist no anchors
+// are returned
+func (fas *FileAnchorStore) Load() ([]TrustAnchor, error) {
+	data, err := ioutil.ReadFile(fas.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var stored []storedAnchor
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	anchors := make([]TrustAnchor, len(stored))
+	for i, s := range stored {
+		r, err := dns.NewRR(s.Key)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := r.(*dns.DNSKEY)
+		if !ok {
+			return nil, ErrNoDNSKEY
+		}
+		anchors[i] = TrustAnchor{Key: key, State: s.State, FirstSeen: s.FirstSeen, LastSeen: s.LastSeen}
+	}
+	return anchors, nil
+}
+
+// Save writes the trust anchors to the file, replacing it atomically
+func (fas *FileAnchorStore) Save(anchors []TrustAnchor) error {
+	stored := make([]storedAnchor, len(anchors))
+	for i, a := range anchors {
+		stored[i] = storedAnchor{Key: a.Key.String(), State: a.State, FirstSeen: a.FirstSeen, LastSeen: a.LastSeen}
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fas.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fas.Path)
+}
+
+// sameKey checks if a and b are the same key, ignoring their flags since
+// setting the REVOKE bit changes them, along with the key tag
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.PublicKey == b.PublicKey
+}
+
+// trustedKeys returns the valid trust anchors indexed by key tag
+func trustedKeys(anchors []TrustAnchor) map[uint16]*dns.DNSKEY {
+	keyMap := map[uint16]*dns.DNSKEY{}
+	for _, a := range anchors {
+		if a.State == AnchorValid {
+			keyMap[a.Key.KeyTag()] = a.Key
+		}
+	}
+	return keyMap
+}
+
+// selfSigned checks if the DNSKEY RRset in section has a valid signature made
+// by key
+func selfSigned(key *dns.DNSKEY, section []dns.RR, clk clock.Clock) bool {
+	keyMap := map[uint16]*dns.DNSKEY{key.KeyTag(): key}
+	for _, sigRR := range extractRRSet(section, ".", dns.TypeRRSIG) {
+		sig := sigRR.(*dns.RRSIG)
+		if sig.TypeCovered == dns.TypeDNSKEY && sig.KeyTag == key.KeyTag() && verifySignature(sig, section, keyMap, clk) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAnchors applies the RFC 5011 state transitions to anchors for the
+// root DNSKEY RRset in m, which must be signed by one of the valid anchors.
+// New SEP keys are added as pending and become valid once they have been
+// seen for RFC5011HoldDown, pending keys that disappear are forgotten, and
+// keys published with the REVOKE bit set and signed by themselves are
+// revoked. Keys that are already valid stay valid if they disappear, since
+// only a revocation removes trust.
+func (rr *RecursiveResolver) updateAnchors(anchors []TrustAnchor, m *dns.Msg) ([]TrustAnchor, error) {
+	keyMap := trustedKeys(anchors)
+	if len(keyMap) == 0 {
+		return nil, ErrNoTrustAnchors
+	}
+	if err := verifyRRSIG(m, keyMap, rr.Clock, rr.AllowedAlgorithms, nil); err != nil {
+		return nil, err
+	}
+	now := rr.Clock.Now()
+	updated := append([]TrustAnchor{}, anchors...)
+	seen := map[int]bool{}
+	for _, r := range extractRRSet(m.Answer, ".", dns.TypeDNSKEY) {
+		key := r.(*dns.DNSKEY)
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		i := -1
+		for j := range updated {
+			if sameKey(updated[j].Key, key) {
+				i = j
+				break
+			}
+		}
+		if key.Flags&dns.REVOKE != 0 {
+			if i >= 0 && selfSigned(key, m.Answer, rr.Clock) {
+				updated[i].State = AnchorRevoked
+				updated[i].LastSeen = now
+				seen[i] = true
+			}
+			continue
+		}
+		if i < 0 {
+			updated = append(updated, TrustAnchor{Key: key, State: AnchorAddPending, FirstSeen: now})
+			i = len(updated) - 1
+		}
+		seen[i] = true
+		updated[i].LastSeen = now
+		if updated[i].State == AnchorAddPending && now.Sub(updated[i].FirstSeen) >= RFC5011HoldDown {
+			updated[i].State = AnchorValid
+		}
+	}
+	kept := updated[:0]
+	for i, a := range updated {
+		if a.State == AnchorAddPending && !seen[i] {
+			// the key must be seen continuously for the hold-down period
+			continue
+		}
+		kept = append(kept, a)
+	}
+	return kept, nil
+}
+
+// StartRootRefresh loads the root trust anchors from store, or uses the root
+// keys the resolver was created with if it is empty, and starts a goroutine
+// that calls RefreshRoot every interval until ctx is cancelled. If interval is
+// zero DefaultRootRefreshInterval is used. Errors from the background
+// refreshes are passed to onError, if it isn't nil.
+func (rr *RecursiveResolver) StartRootRefresh(ctx context.Context, store AnchorStore, interval time.Duration, onError func(error)) error {
+	anchors, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if len(anchors) == 0 {
+		now := rr.Clock.Now()
+		for _, r := range extractRRSet(rr.rootKeys, "", dns.TypeDNSKEY) {
+			anchors = append(anchors, TrustAnchor{Key: r.(*dns.DNSKEY), State: AnchorValid, FirstSeen: now, LastSeen: now})
+		}
+	}
+	rr.anchorsMu.Lock()
+	rr.anchors = anchors
+	rr.anchorStore = store
+	rr.anchorsMu.Unlock()
+	if interval == 0 {
+		interval = DefaultRootRefreshInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := rr.RefreshRoot(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// RefreshRoot fetches the root DNSKEY RRset, authenticates it using the valid
+// trust anchors, and updates the anchors following RFC 5011. The new anchor
+// state is saved to the AnchorStore passed to StartRootRefresh, and the
+// authenticated DNSKEY RRset, without any revoked keys, replaces the root keys
+// in the cache.
+func (rr *RecursiveResolver) RefreshRoot(ctx context.Context) error {
+	rr.anchorsMu.Lock()
+	defer rr.anchorsMu.Unlock()
+	if rr.anchorStore == nil {
+		return ErrAnchorsNotLoaded
+	}
+	roots := rr.roots()
+	if len(roots) == 0 {
+		return ErrNoAuthorityAddress
+	}
+	q := &Question{Name: ".", Type: dns.TypeDNSKEY}
+	m, _, err := rr.query(ctx, q, rr.pickServer(roots), LookupOptions{NoCache: true})
+	if err != nil {
+		return err
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		return ErrBadAnswer
+	}
+	anchors, err := rr.updateAnchors(rr.anchors, m)
+	if err != nil {
+		return err
+	}
+	if err := rr.anchorStore.Save(anchors); err != nil {
+		return err
+	}
+	rr.anchors = anchors
+
+	if rr.cache != nil {
+		var keys []dns.RR
+		for _, r := range m.Answer {
+			if key, ok := r.(*dns.DNSKEY); ok && key.Flags&dns.REVOKE != 0 {
+				continue
+			}
+			if strings.EqualFold(r.Header().Name, ".") {
+				keys = append(keys, r)
+			}
+		}
+		rr.cache.Add(q, &Answer{Answer: keys, Rcode: dns.RcodeSuccess, Authenticated: true}, true)
+	}
+	return nil
+}
+
+// TrustAnchors returns a copy of the current state of the root trust anchors
+func (rr *RecursiveResolver) TrustAnchors() []TrustAnchor {
+	rr.anchorsMu.Lock()
+	defer rr.anchorsMu.Unlock()
+	return append([]TrustAnchor{}, rr.anchors...)
+}
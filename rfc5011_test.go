@@ -0,0 +1,227 @@
+package solvere
+
+import (
+	"context"
+	"crypto"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+func TestUpdateAnchors(t *testing.T) {
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	rr.Clock = fc
+
+	newKey := func() (*dns.DNSKEY, crypto.Signer) {
+		k := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		pk, err := k.Generate(256)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %s", err)
+		}
+		return k, pk.(crypto.Signer)
+	}
+	type signer struct {
+		key *dns.DNSKEY
+		pk  crypto.Signer
+	}
+	keySet := func(signers []signer, keys ...*dns.DNSKEY) *dns.Msg {
+		set := make([]dns.RR, len(keys))
+		for i, k := range keys {
+			set[i] = k
+		}
+		m := &dns.Msg{Answer: set}
+		for _, s := range signers {
+			sig := &dns.RRSIG{
+				Inception:  uint32(fc.Now().Add(-time.Hour).Unix()),
+				Expiration: uint32(fc.Now().Add(time.Hour).Unix()),
+				KeyTag:     s.key.KeyTag(),
+				SignerName: ".",
+				Algorithm:  s.key.Algorithm,
+			}
+			if err := sig.Sign(s.pk, set); err != nil {
+				t.Fatalf("Failed to sign DNSKEY RRset: %s", err)
+			}
+			m.Answer = append(m.Answer, sig)
+		}
+		return m
+	}
+	k1, pk1 := newKey()
+	k2, pk2 := newKey()
+	anchors := []TrustAnchor{{Key: k1, State: AnchorValid}}
+
+	// a new key is pending until the hold-down period has passed
+	anchors, err := rr.updateAnchors(anchors, keySet([]signer{{k1, pk1}}, k1, k2))
+	if err != nil {
+		t.Fatalf("updateAnchors failed: %s", err)
+	}
+	if len(anchors) != 2 || anchors[1].State != AnchorAddPending || !anchors[1].FirstSeen.Equal(fc.Now()) {
+		t.Fatalf("updateAnchors didn't add new key as pending: %+v", anchors)
+	}
+	fc.Add(RFC5011HoldDown - 24*time.Hour)
+	anchors, err = rr.updateAnchors(anchors, keySet([]signer{{k1, pk1}}, k1, k2))
+	if err != nil {
+		t.Fatalf("updateAnchors failed: %s", err)
+	}
+	if anchors[1].State != AnchorAddPending {
+		t.Fatal("updateAnchors trusted new key before the hold-down period passed")
+	}
+	fc.Add(48 * time.Hour)
+	anchors, err = rr.updateAnchors(anchors, keySet([]signer{{k1, pk1}}, k1, k2))
+	if err != nil {
+		t.Fatalf("updateAnchors failed: %s", err)
+	}
+	if anchors[1].State != AnchorValid {
+		t.Fatal("updateAnchors didn't trust new key after the hold-down period")
+	}
+
+	// a pending key that disappears is forgotten
+	k3, _ := newKey()
+	pending, err := rr.updateAnchors(anchors, keySet([]signer{{k1, pk1}}, k1, k2, k3))
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("updateAnchors didn't add new key: %v", err)
+	}
+	pending, err = rr.updateAnchors(pending, keySet([]signer{{k1, pk1}}, k1, k2))
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("updateAnchors didn't forget pending key that disappeared: %v", err)
+	}
+
+	// a revoked key must be signed by itself
+	revoked := dns.Copy(k1).(*dns.DNSKEY)
+	revoked.Flags |= dns.REVOKE
+	unrevoked, err := rr.updateAnchors(anchors, keySet([]signer{{k2, pk2}}, revoked, k2))
+	if err != nil {
+		t.Fatalf("updateAnchors failed: %s", err)
+	}
+	if unrevoked[0].State != AnchorValid {
+		t.Fatal("updateAnchors revoked key without a self-signature")
+	}
+	anchors, err = rr.updateAnchors(anchors, keySet([]signer{{revoked, pk1}, {k2, pk2}}, revoked, k2))
+	if err != nil {
+		t.Fatalf("updateAnchors failed: %s", err)
+	}
+	if anchors[0].State != AnchorRevoked {
+		t.Fatal("updateAnchors didn't revoke key")
+	}
+	if trusted := trustedKeys(anchors); len(trusted) != 1 || trusted[k2.KeyTag()] == nil {
+		t.Fatalf("revoked key is still trusted: %v", trusted)
+	}
+
+	// the RRset must be signed by a valid anchor
+	if _, err := rr.updateAnchors(anchors, keySet([]signer{{k1, pk1}}, k1, k2)); err == nil {
+		t.Fatal("updateAnchors accepted DNSKEY RRset signed by revoked key")
+	}
+	if _, err := rr.updateAnchors(nil, keySet([]signer{{k2, pk2}}, k2)); err != ErrNoTrustAnchors {
+		t.Fatalf("updateAnchors didn't fail without trust anchors: %v", err)
+	}
+}
+
+func TestRefreshRoot(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	standby := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := standby.Generate(256); err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	root.records = append(root.records, standby)
+	defer startTestZones(t, root)()
+
+	cache := NewBasicCache()
+	rr := newTestResolver(root, cache)
+	if err := rr.RefreshRoot(context.Background()); err != ErrAnchorsNotLoaded {
+		t.Fatalf("RefreshRoot didn't fail before the anchors were loaded: %v", err)
+	}
+
+	store := &FileAnchorStore{Path: filepath.Join(t.TempDir(), "anchors.json")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	if err := rr.StartRootRefresh(ctx, store, time.Hour, func(err error) { errs <- err }); err != nil {
+		t.Fatalf("StartRootRefresh failed: %s", err)
+	}
+	// wait for the first background refresh, which finds the standby key,
+	// so it isn't still querying the zone once the test has finished
+	for deadline := time.Now().Add(5 * time.Second); len(rr.TrustAnchors()) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for background refresh")
+		}
+	}
+	if err := rr.RefreshRoot(context.Background()); err != nil {
+		t.Fatalf("RefreshRoot failed: %s", err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("background refresh failed: %s", err)
+	default:
+	}
+
+	anchors := rr.TrustAnchors()
+	if len(anchors) != 2 || anchors[0].State != AnchorValid || anchors[1].State != AnchorAddPending || !sameKey(anchors[1].Key, standby) {
+		t.Fatalf("RefreshRoot didn't track standby key: %+v", anchors)
+	}
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatalf("Failed to load stored anchors: %s", err)
+	}
+	if len(stored) != 2 || stored[1].State != AnchorAddPending || !sameKey(stored[1].Key, standby) || !stored[1].FirstSeen.Equal(anchors[1].FirstSeen) {
+		t.Fatalf("RefreshRoot didn't save anchors: %+v", stored)
+	}
+	cached := cache.Get(&Question{Name: ".", Type: dns.TypeDNSKEY})
+	if cached == nil || len(extractRRSet(cached.Answer, ".", dns.TypeDNSKEY)) != 2 {
+		t.Fatal("RefreshRoot didn't cache the root DNSKEY RRset")
+	}
+
+	// the stored state is used instead of the root keys on restart
+	restarted := newTestResolver(root, nil)
+	if err := restarted.StartRootRefresh(ctx, store, time.Hour, nil); err != nil {
+		t.Fatalf("StartRootRefresh failed: %s", err)
+	}
+	if anchors := restarted.TrustAnchors(); len(anchors) != 2 {
+		t.Fatalf("StartRootRefresh didn't load stored anchors: %+v", anchors)
+	}
+	// wait for the first background refresh of the restarted resolver too
+	for deadline := time.Now().Add(5 * time.Second); !restarted.TrustAnchors()[0].LastSeen.After(stored[0].LastSeen); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for background refresh")
+		}
+	}
+}
+
+func TestLookupReplacedRootKeys(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	// the resolver starts with a root key that has since been rolled over
+	rolled := newTestZone(t, ".", "127.0.0.2", true, "")
+	cache := NewBasicCache()
+	rr := newTestResolver(rolled, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	if _, _, err := rr.Lookup(context.Background(), q); err == nil {
+		t.Fatal("Lookup validated using the old root key")
+	}
+
+	cache.Add(&Question{Name: ".", Type: dns.TypeDNSKEY}, &Answer{Answer: []dns.RR{root.key}, Rcode: dns.RcodeSuccess, Authenticated: true}, true)
+	a, _, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed after replacing the root key: %s", err)
+	}
+	if !a.Authenticated {
+		t.Fatal("Answer wasn't authenticated using the replaced root key")
+	}
+}
@@ -0,0 +1,146 @@
+package solvere
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultKeyRetention is the KeyRetention used by NewRecursiveResolver
+var DefaultKeyRetention = time.Hour
+
+// retainedKey is a authenticated key of a zone that is kept for
+// KeyRetention after it was last seen in the DNSKEY RRset of the zone
+type retainedKey struct {
+	key *dns.DNSKEY
+	// dsSet is the DS RRset from the parent zone the key was
+	// authenticated with
+	dsSet   []dns.RR
+	expires time.Time
+}
+
+// sameDS checks if a and b are the same DS record
+func sameDS(a, b *dns.DS) bool {
+	return a.KeyTag == b.KeyTag && a.Algorithm == b.Algorithm && a.DigestType == b.DigestType && strings.EqualFold(a.Digest, b.Digest)
+}
+
+// dsOverlap checks if a and b have a DS record in common, or are both
+// empty, which is the case for zones whose keys are trust anchors
+func dsOverlap(a, b []dns.RR) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	for _, ra := range a {
+		for _, rb := range b {
+			dsA, okA := ra.(*dns.DS)
+			dsB, okB := rb.(*dns.DS)
+			if okA && okB && sameDS(dsA, dsB) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revokedIn checks if keyMap contains key with the REVOKE bit set (RFC 5011
+// Section 2.1)
+func revokedIn(keyMap map[uint16]*dns.DNSKEY, key *dns.DNSKEY) bool {
+	for _, k := range keyMap {
+		if k.Flags&dns.REVOKE != 0 && sameKey(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// retainKeys records the authenticated keys in keyMap as the keys of zone,
+// authenticated using dsSet from the parent zone. Keys that were retained
+// previously are kept until they expire, unless keyMap shows they have been
+// revoked. Once keys are retained for MaxCachedZones zones they are pruned.
+func (rr *RecursiveResolver) retainKeys(zone string, keyMap map[uint16]*dns.DNSKEY, dsSet []dns.RR) {
+	if rr.KeyRetention <= 0 {
+		return
+	}
+	rr.retainedMu.Lock()
+	defer rr.retainedMu.Unlock()
+	now := rr.Clock.Now()
+	if rr.retained == nil {
+		rr.retained = make(map[string]map[uint16]retainedKey)
+	}
+	if max := rr.maxCachedZones(); len(rr.retained) >= max {
+		for z, keys := range rr.retained {
+			if !anyRetained(keys, now) {
+				delete(rr.retained, z)
+			}
+		}
+		for z := range rr.retained {
+			if len(rr.retained) < pruneSize(max) {
+				break
+			}
+			delete(rr.retained, z)
+		}
+	}
+	zone = strings.ToLower(zone)
+	keys := rr.retained[zone]
+	if keys == nil {
+		keys = make(map[uint16]retainedKey)
+		rr.retained[zone] = keys
+	}
+	for tag, rk := range keys {
+		if !now.Before(rk.expires) || revokedIn(keyMap, rk.key) {
+			delete(keys, tag)
+		}
+	}
+	for tag, key := range keyMap {
+		if key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		keys[tag] = retainedKey{key: key, dsSet: dsSet, expires: now.Add(rr.KeyRetention)}
+	}
+}
+
+// anyRetained checks if any of keys are still retained at now
+func anyRetained(keys map[uint16]retainedKey, now time.Time) bool {
+	for _, rk := range keys {
+		if now.Before(rk.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetainedKeys returns the union of keyMap, the current keys of zone, and
+// the keys retained for it that haven't expired. If a retained key has the
+// same key tag as a current key the current key is used. Retained keys are
+// only used if they were authenticated with a DS record that is still in
+// dsSet, the current DS RRset for the zone, and keyMap doesn't show they
+// have been revoked.
+func (rr *RecursiveResolver) withRetainedKeys(zone string, keyMap map[uint16]*dns.DNSKEY, dsSet []dns.RR) map[uint16]*dns.DNSKEY {
+	if rr.KeyRetention <= 0 {
+		return keyMap
+	}
+	rr.retainedMu.Lock()
+	defer rr.retainedMu.Unlock()
+	now := rr.Clock.Now()
+	var union map[uint16]*dns.DNSKEY
+	for tag, rk := range rr.retained[strings.ToLower(zone)] {
+		if _, present := keyMap[tag]; present || !now.Before(rk.expires) {
+			continue
+		}
+		if !dsOverlap(rk.dsSet, dsSet) || revokedIn(keyMap, rk.key) {
+			continue
+		}
+		if union == nil {
+			union = make(map[uint16]*dns.DNSKEY, len(keyMap)+1)
+			for t, k := range keyMap {
+				union[t] = k
+			}
+		}
+		union[tag] = rk.key
+	}
+	if union == nil {
+		return keyMap
+	}
+	return union
+}
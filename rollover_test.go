@@ -0,0 +1,110 @@
+package solvere
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+func TestLookupRetainedKeys(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	stop := startTestZones(t, root, example)
+
+	// the test zones sign records for an hour either side of now, start the
+	// clock just inside that window so the cached keys and delegation can
+	// expire before the signatures do
+	fc := clock.NewFake()
+	fc.Set(time.Now().Add(-59 * time.Minute))
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc}
+	rr := newTestResolver(root, cache)
+	rr.Clock = fc
+	rr.KeyRetention = 61 * time.Minute
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA}); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	stop()
+
+	// the zone rolls over to a new key which is the only key in its
+	// DNSKEY RRset, but the answers are still signed by the old key. The
+	// parent still publishes the DS record for the old key.
+	newRoot := newTestZone(t, ".", "127.0.0.2", false, "")
+	newRoot.key, newRoot.signer = root.key, root.signer
+	newRoot.records = append(newRoot.records, root.key, example.key.ToDS(dns.SHA256))
+	rolled := newTestZone(t, "example.", "127.0.0.3", true, `b.example. 300 IN A 1.2.3.4
+c.example. 300 IN A 1.2.3.4`)
+	rolled.oldKey, rolled.oldSigner = example.key, example.signer
+	newRoot.delegate(rolled)
+	defer startTestZones(t, newRoot, rolled)()
+
+	// once the cached keys and delegation for example. have expired the new
+	// DNSKEY RRset is used along with the retained key
+	fc.Add(time.Hour + time.Second)
+	answer, _, err := rr.Lookup(context.Background(), Question{Name: "b.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup of answer signed by retained key failed: %s", err)
+	}
+	if !answer.Authenticated {
+		t.Fatal("Answer signed by retained key wasn't authenticated")
+	}
+
+	fc.Add(time.Minute)
+	if _, _, err := rr.Lookup(context.Background(), Question{Name: "c.example.", Type: dns.TypeA}); err == nil {
+		t.Fatal("Lookup of answer signed by key that is no longer retained didn't fail validation")
+	}
+}
+
+func TestWithRetainedKeysDSAndRevoke(t *testing.T) {
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	rr.KeyRetention = time.Hour
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY}, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256, PublicKey: "AAAA"}
+	other := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeDNSKEY}, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256, PublicKey: "BBBB"}
+	keyDS := []dns.RR{key.ToDS(dns.SHA256)}
+	otherDS := []dns.RR{other.ToDS(dns.SHA256)}
+	rr.retainKeys("example.", map[uint16]*dns.DNSKEY{key.KeyTag(): key}, keyDS)
+
+	current := map[uint16]*dns.DNSKEY{other.KeyTag(): other}
+	if keys := rr.withRetainedKeys("example.", current, append(otherDS, keyDS...)); keys[key.KeyTag()] == nil {
+		t.Fatal("Retained key wasn't used while its DS record was still published")
+	}
+	if keys := rr.withRetainedKeys("example.", current, otherDS); keys[key.KeyTag()] != nil {
+		t.Fatal("Retained key was used after its DS record was removed")
+	}
+
+	revoked := *key
+	revoked.Flags |= dns.REVOKE
+	current[revoked.KeyTag()] = &revoked
+	if keys := rr.withRetainedKeys("example.", current, append(otherDS, keyDS...)); keys[key.KeyTag()] != nil {
+		t.Fatal("Retained key was used after it was revoked")
+	}
+	rr.retainKeys("example.", current, append(otherDS, keyDS...))
+	if _, present := rr.retained["example."][key.KeyTag()]; present {
+		t.Fatal("Revoked key is still retained")
+	}
+	if _, present := rr.retained["example."][revoked.KeyTag()]; present {
+		t.Fatal("Revoked key was retained")
+	}
+}
+
+func TestRetainKeysLimit(t *testing.T) {
+	rr := NewRecursiveResolver(false, true, nil, nil, nil)
+	rr.KeyRetention = time.Hour
+	rr.MaxCachedZones = 8
+	for i := 0; i < 100; i++ {
+		zone := fmt.Sprintf("z%d.", i)
+		key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY}, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		rr.retainKeys(zone, map[uint16]*dns.DNSKEY{1: key}, nil)
+		if len(rr.retained) > rr.MaxCachedZones {
+			t.Fatalf("Keys retained for %d zones, more than MaxCachedZones", len(rr.retained))
+		}
+		if keys := rr.withRetainedKeys(zone, nil, nil); len(keys) != 1 {
+			t.Fatalf("Keys for %s weren't retained", zone)
+		}
+	}
+}
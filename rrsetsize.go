@@ -0,0 +1,65 @@
+package solvere
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// ErrRRsetTooLarge is returned when a response contains a RRset with more
+// than MaxRRsetSize records and RRsetSizePolicy is RejectLargeRRsets
+var ErrRRsetTooLarge = errors.New("solvere: Response contains a RRset with too many records")
+
+// RRsetSizePolicy controls how responses containing RRsets with more than
+// MaxRRsetSize records are handled
+type RRsetSizePolicy int
+
+const (
+	// RejectLargeRRsets fails the query with ErrRRsetTooLarge, so that
+	// another nameserver is tried
+	RejectLargeRRsets RRsetSizePolicy = iota
+	// TruncateLargeRRsets removes the records past the limit from each
+	// RRset, keeping the records in the order they were received. Since
+	// RRSIGs cover the whole RRset a truncated signed RRset will fail
+	// validation.
+	TruncateLargeRRsets
+)
+
+// capRRsets removes the records past the max'th record of each RRset in
+// records, the returned bool indicates if any were removed. RRSIGs are
+// counted separately from the RRset they cover and OPT records are ignored.
+func capRRsets(records []dns.RR, max int) ([]dns.RR, bool) {
+	counts := map[setKey]int{}
+	out := make([]dns.RR, 0, len(records))
+	capped := false
+	for _, r := range records {
+		if r.Header().Rrtype != dns.TypeOPT {
+			k := setKeyOf(r)
+			if counts[k] >= max {
+				capped = true
+				continue
+			}
+			counts[k]++
+		}
+		out = append(out, r)
+	}
+	return out, capped
+}
+
+// limitRRsets applies MaxRRsetSize to each section of a response, according
+// to RRsetSizePolicy. The returned bool indicates if any RRset was over the
+// limit, if the policy is RejectLargeRRsets the response isn't modified and
+// ErrRRsetTooLarge is returned.
+func (rr *RecursiveResolver) limitRRsets(m *dns.Msg) (bool, error) {
+	answer, answerCapped := capRRsets(m.Answer, rr.MaxRRsetSize)
+	ns, nsCapped := capRRsets(m.Ns, rr.MaxRRsetSize)
+	extra, extraCapped := capRRsets(m.Extra, rr.MaxRRsetSize)
+	if !answerCapped && !nsCapped && !extraCapped {
+		return false, nil
+	}
+	if rr.RRsetSizePolicy == RejectLargeRRsets {
+		return true, ErrRRsetTooLarge
+	}
+	m.Answer, m.Ns, m.Extra = answer, ns, extra
+	return true, nil
+}
@@ -0,0 +1,75 @@
+package solvere
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCapRRsets(t *testing.T) {
+	var records []dns.RR
+	for i := 0; i < 4; i++ {
+		records = append(records,
+			&dns.TXT{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{fmt.Sprint(i)}},
+			&dns.A{Hdr: dns.RR_Header{Name: "b.example.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IP{1, 2, 3, byte(i)}},
+		)
+	}
+	records = append(records, &dns.RRSIG{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET}, TypeCovered: dns.TypeTXT})
+	records = append(records, &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}})
+
+	if out, capped := capRRsets(records, 4); capped || len(out) != len(records) {
+		t.Fatalf("capRRsets removed records from RRsets within the limit: %v", out)
+	}
+	out, capped := capRRsets(records, 2)
+	if !capped {
+		t.Fatal("capRRsets didn't report capping oversized RRsets")
+	}
+	// two TXT, two A, the RRSIG, and the OPT record
+	if len(out) != 6 {
+		t.Fatalf("capRRsets returned wrong number of records: %v", out)
+	}
+	if out[0].(*dns.TXT).Txt[0] != "0" || out[2].(*dns.TXT).Txt[0] != "1" {
+		t.Fatalf("capRRsets didn't keep the first records of the RRset: %v", out)
+	}
+}
+
+func TestLookupLargeNSRRset(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	for i := 0; i < 100; i++ {
+		root.records = append(root.records, &dns.NS{
+			Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+			Ns:  fmt.Sprintf("ns%d.other.", i),
+		})
+	}
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	rr.MaxRRsetSize = 5
+	_, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err == nil {
+		t.Fatal("Lookup didn't reject oversized NS RRset")
+	}
+	if len(ll.Composites) == 0 || !ll.Composites[0].RRsetTooLarge {
+		t.Fatal("Lookup didn't record oversized NS RRset")
+	}
+
+	rr.RRsetSizePolicy = TruncateLargeRRsets
+	answer, ll, err := rr.Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(answer.Answer) != 1 {
+		t.Fatalf("Lookup returned wrong answer: %+v", answer)
+	}
+	if !ll.Composites[0].RRsetTooLarge {
+		t.Fatal("Lookup didn't record truncated NS RRset")
+	}
+	if len(answer.Delegations) != 2 || len(answer.Delegations[1].Nameservers) > 5 {
+		t.Fatalf("Lookup didn't truncate NS RRset: %+v", answer.Delegations)
+	}
+}
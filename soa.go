@@ -0,0 +1,49 @@
+package solvere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoSOA is returned by LookupSOA when no SOA record can be found for a
+// zone
+var ErrNoSOA = errors.New("solvere: No SOA record found for zone")
+
+// LookupSOA returns the SOA record for the zone containing name, allowing
+// the zone serial to be checked. If name is below the apex of its zone the
+// owner of the SOA record in the authority section of the negative answer is
+// looked up instead. The returned bool indicates if the SOA record was
+// authenticated.
+func (rr *RecursiveResolver) LookupSOA(ctx context.Context, name string) (*dns.SOA, bool, error) {
+	name = dns.Fqdn(name)
+	for {
+		answer, _, err := rr.Lookup(ctx, Question{Name: name, Type: dns.TypeSOA})
+		if err != nil {
+			return nil, false, err
+		}
+		if answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError {
+			return nil, false, fmt.Errorf("solvere: SOA lookup failed for %s: %s", name, dns.RcodeToString[answer.Rcode])
+		}
+		for _, r := range answer.Answer {
+			if soa, ok := r.(*dns.SOA); ok {
+				return soa, answer.Authenticated, nil
+			}
+		}
+		apex := ""
+		for _, r := range answer.Authority {
+			if soa, ok := r.(*dns.SOA); ok {
+				apex = soa.Hdr.Name
+				break
+			}
+		}
+		// only follow the SOA owner upwards so a broken server can't cause
+		// a loop
+		if apex == "" || apex == name || !dns.IsSubDomain(apex, name) {
+			return nil, false, ErrNoSOA
+		}
+		name = apex
+	}
+}
@@ -0,0 +1,27 @@
+package solvere
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLookupSOA(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.b.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	rr := newTestResolver(root, nil)
+	for _, name := range []string{"example", "a.b.example.", "missing.example."} {
+		soa, authenticated, err := rr.LookupSOA(context.Background(), name)
+		if err != nil {
+			t.Fatalf("LookupSOA failed for %s: %s", name, err)
+		}
+		if !authenticated {
+			t.Fatalf("LookupSOA result for %s wasn't authenticated", name)
+		}
+		if soa.Hdr.Name != "example." || soa.Serial != 1 {
+			t.Fatalf("LookupSOA returned wrong record for %s: %s", name, soa)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package solvere
+
+import (
+	mrand "math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// PickSRVTarget selects a target from a set of SRV records as described in
+// RFC 2782. Records with the lowest priority are used first, and a record is
+// picked from them at random weighted by their weights using a running sum
+// of the weights. Records with a weight of zero are placed first, so they
+// have a small chance of being picked when other records have weights.
+// Records with the target "." indicate the service is unavailable and are
+// never picked. If there are no usable records nil is returned.
+func PickSRVTarget(records []*dns.SRV) *dns.SRV {
+	var candidates []*dns.SRV
+	for _, r := range records {
+		if r.Target == "." {
+			continue
+		}
+		if len(candidates) > 0 && r.Priority > candidates[0].Priority {
+			continue
+		}
+		if len(candidates) > 0 && r.Priority < candidates[0].Priority {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// the records may be in any order, other than those with a weight of
+	// zero being first, shuffling them means that if all the weights are
+	// zero each record is equally likely to be picked
+	ordered := make([]*dns.SRV, 0, len(candidates))
+	total := 0
+	perm := mrand.Perm(len(candidates))
+	for _, i := range perm {
+		if candidates[i].Weight == 0 {
+			ordered = append(ordered, candidates[i])
+		}
+	}
+	for _, i := range perm {
+		if w := candidates[i].Weight; w != 0 {
+			ordered = append(ordered, candidates[i])
+			total += int(w)
+		}
+	}
+	n := mrand.Intn(total + 1)
+	sum := 0
+	for _, r := range ordered {
+		sum += int(r.Weight)
+		if sum >= n {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package solvere
+
+import (
+	"math"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPickSRVTarget(t *testing.T) {
+	if PickSRVTarget(nil) != nil {
+		t.Fatal("PickSRVTarget returned a target from a empty set")
+	}
+	if PickSRVTarget([]*dns.SRV{{Target: "."}}) != nil {
+		t.Fatal("PickSRVTarget returned a unavailable target")
+	}
+
+	records := []*dns.SRV{
+		{Priority: 0, Weight: 100, Target: "."},
+		{Priority: 1, Weight: 10, Target: "a.example."},
+		{Priority: 1, Weight: 30, Target: "b.example."},
+		{Priority: 1, Weight: 60, Target: "c.example."},
+		{Priority: 2, Weight: 100, Target: "d.example."},
+	}
+	draws := 10000
+	picked := map[string]int{}
+	for i := 0; i < draws; i++ {
+		picked[PickSRVTarget(records).Target]++
+	}
+	for target, weight := range map[string]float64{"a.example.": 0.1, "b.example.": 0.3, "c.example.": 0.6} {
+		share := float64(picked[target]) / float64(draws)
+		if math.Abs(share-weight) > 0.03 {
+			t.Fatalf("%s picked with wrong frequency: expected %.2f, got %.2f", target, weight, share)
+		}
+	}
+	if picked["."] != 0 || picked["d.example."] != 0 {
+		t.Fatalf("PickSRVTarget picked unavailable or lower priority target: %v", picked)
+	}
+
+	// if all the weights are zero each target is equally likely
+	records = []*dns.SRV{{Target: "a.example."}, {Target: "b.example."}}
+	picked = map[string]int{}
+	for i := 0; i < draws; i++ {
+		picked[PickSRVTarget(records).Target]++
+	}
+	if share := float64(picked["a.example."]) / float64(draws); math.Abs(share-0.5) > 0.03 {
+		t.Fatalf("a.example. picked with wrong frequency: expected 0.50, got %.2f", share)
+	}
+
+	// a record with a weight of zero is picked when the random number is
+	// zero, one time in the sum of the weights plus one
+	records = []*dns.SRV{{Weight: 3, Target: "a.example."}, {Target: "b.example."}}
+	picked = map[string]int{}
+	for i := 0; i < draws; i++ {
+		picked[PickSRVTarget(records).Target]++
+	}
+	if share := float64(picked["b.example."]) / float64(draws); math.Abs(share-0.25) > 0.03 {
+		t.Fatalf("b.example. picked with wrong frequency: expected 0.25, got %.2f", share)
+	}
+}
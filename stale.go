@@ -0,0 +1,60 @@
+package solvere
+
+import (
+	"context"
+	"time"
+)
+
+// StaleRefreshTimeout is how long the background lookups started to refresh a
+// stale answer, or prefetch a answer that is about to expire, have to complete
+var StaleRefreshTimeout = 10 * time.Second
+
+// refreshStale returns a stale answer for q from the cache, if it has expired
+// within the MaxStale window of the cache, and starts a lookup in the
+// background to replace it (RFC 8767 Section 5). If the refresh fails the
+// stale answer stays in the cache, so it continues to be served until a
+// refresh succeeds or it has been expired for longer than MaxStale.
+func (rr *RecursiveResolver) refreshStale(q Question, opts LookupOptions) (*Answer, *LookupLog, bool) {
+	if rr.cache.Get(&q) != nil {
+		return nil, nil, false
+	}
+	answer := rr.staleAnswer(q)
+	if answer == nil || !answer.Stale {
+		return nil, nil, false
+	}
+	rr.refresh(q, opts)
+	ll := newLookupLog(&q, nil)
+	ll.CacheHit = true
+	ll.CacheAge = rr.cacheAge(&q)
+	ll.Stale = true
+	ll.Rcode = answer.Rcode
+	ll.DNSSECValid = answer.Authenticated
+	answer.ExtendedError = &ExtendedError{Code: EDEStaleAnswer}
+	return answer, ll, true
+}
+
+// refresh starts a lookup for q in the background, which doesn't use the
+// cached answer for q, so that the answer is replaced in the cache. Only one
+// refresh for a question is performed at a time.
+func (rr *RecursiveResolver) refresh(q Question, opts LookupOptions) {
+	rr.refreshingMu.Lock()
+	defer rr.refreshingMu.Unlock()
+	if rr.refreshing == nil {
+		rr.refreshing = make(map[Question]struct{})
+	}
+	if _, inProgress := rr.refreshing[q]; inProgress {
+		return
+	}
+	rr.refreshing[q] = struct{}{}
+	opts.refresh = true
+	go func() {
+		defer func() {
+			rr.refreshingMu.Lock()
+			delete(rr.refreshing, q)
+			rr.refreshingMu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), StaleRefreshTimeout)
+		defer cancel()
+		rr.resolve(ctx, q, opts)
+	}()
+}
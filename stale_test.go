@@ -0,0 +1,138 @@
+package solvere
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmhodges/clock"
+	"github.com/miekg/dns"
+)
+
+func TestLookupRefreshStale(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	stop := startTestZones(t, root, example)
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc, MaxStale: time.Hour}
+	rr := newTestResolver(root, cache)
+	rr.ServeStale = true
+	rr.RefreshStale = true
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+
+	waitFor := func(what string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+		}
+	}
+	refreshed := func() bool {
+		rr.refreshingMu.Lock()
+		defer rr.refreshingMu.Unlock()
+		return len(rr.refreshing) == 0
+	}
+	checkAnswer := func(a *Answer, ll *LookupLog, stale bool, addr net.IP) {
+		t.Helper()
+		if len(a.Answer) != 1 || !a.Answer[0].(*dns.A).A.Equal(addr) {
+			t.Fatalf("Lookup returned wrong answer: %s", a.Answer)
+		}
+		if a.Stale != stale || ll.Stale != stale {
+			t.Fatalf("Answer has wrong stale flag, expected %t", stale)
+		}
+		if stale && (a.Answer[0].Header().Ttl != StaleTTL || a.ExtendedError == nil || a.ExtendedError.Code != EDEStaleAnswer) {
+			t.Fatal("Stale answer doesn't have stale TTLs and a stale answer extended error")
+		}
+	}
+
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	checkAnswer(a, ll, false, net.IP{1, 2, 3, 4})
+	waitFor("answer to be cached", func() bool { return cache.Get(&q) != nil })
+	stop()
+
+	// the nameservers are unreachable so the refresh fails, but the stale
+	// answer continues to be served
+	fc.Add(301 * time.Second)
+	for i := 0; i < 2; i++ {
+		a, ll, err = rr.Lookup(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Lookup of expired answer failed: %s", err)
+		}
+		checkAnswer(a, ll, true, net.IP{1, 2, 3, 4})
+		waitFor("refresh to finish", refreshed)
+	}
+
+	changed := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 300 IN A 5.6.7.8")
+	root.delegate(changed)
+	defer startTestZones(t, root, changed)()
+	a, ll, err = rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup of expired answer failed: %s", err)
+	}
+	checkAnswer(a, ll, true, net.IP{1, 2, 3, 4})
+	waitFor("refreshed answer to be cached", func() bool { return cache.Get(&q) != nil })
+	a, ll, err = rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup after refresh failed: %s", err)
+	}
+	checkAnswer(a, ll, false, net.IP{5, 6, 7, 8})
+
+	// expired answers outside of the MaxStale window aren't served
+	fc.Add(301*time.Second + time.Hour)
+	if answer := cache.GetStale(&q); answer != nil {
+		t.Fatal("GetStale returned answer expired for longer than MaxStale")
+	}
+}
+
+func TestLookupPrefetch(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", false, "")
+	example := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 100 IN A 1.2.3.4")
+	root.delegate(example)
+	stop := startTestZones(t, root, example)
+
+	fc := clock.NewFake()
+	fc.Set(time.Now())
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc, Prefetch: true}
+	rr := newTestResolver(root, cache)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	cachedAddr := func() net.IP {
+		if a := cache.Get(&q); a != nil && len(a.Answer) == 1 {
+			return a.Answer[0].(*dns.A).A
+		}
+		return nil
+	}
+	if _, _, err := rr.Lookup(context.Background(), q); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); cachedAddr() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for answer to be cached")
+		}
+	}
+	stop()
+
+	changed := newTestZone(t, "example.", "127.0.0.3", false, "a.example. 100 IN A 5.6.7.8")
+	root.delegate(changed)
+	defer startTestZones(t, root, changed)()
+	fc.Add(95 * time.Second)
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if !ll.Composites[0].CacheHit || !a.Answer[0].(*dns.A).A.Equal(net.IP{1, 2, 3, 4}) {
+		t.Fatal("Lookup of answer close to expiring wasn't answered from the cache")
+	}
+	for deadline := time.Now().Add(5 * time.Second); !cachedAddr().Equal(net.IP{5, 6, 7, 8}); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for prefetched answer to be cached")
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package solvere
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// MaxIdleTCPConns is the maximum number of idle TCP connections that
+	// will be kept open to a single nameserver address
+	MaxIdleTCPConns = 2
+
+	tcpTimeout = 2 * time.Second
+)
+
+type idleConn struct {
+	conn    *dns.Conn
+	expires time.Time
+}
+
+// tcpConnPool holds idle TCP connections to nameservers that have agreed
+// to keep them open using the edns-tcp-keepalive option (RFC 7828), or
+// to upstream servers used for forwarding
+type tcpConnPool struct {
+	mu   sync.Mutex
+	idle map[string][]idleConn
+	// maxIdle is the maximum number of idle connections kept per address,
+	// if it is zero MaxIdleTCPConns is used
+	maxIdle int
+}
+
+func newTCPConnPool() *tcpConnPool {
+	return &tcpConnPool{idle: make(map[string][]idleConn)}
+}
+
+// healthy checks that the remote end of a idle connection hasn't closed
+// it. Since nothing should be sent on a idle connection a read should time
+// out, if it returns anything else the connection can't be used.
+func healthy(conn *dns.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := conn.Conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// get returns an idle connection to addr if one exists, its keepalive
+// timeout hasn't passed, and it is still open, closing any that aren't
+func (p *tcpConnPool) get(addr string) *dns.Conn {
+	for {
+		ic, ok := p.pop(addr)
+		if !ok {
+			return nil
+		}
+		// the health check blocks briefly, so it is done without holding
+		// the lock
+		if time.Now().Before(ic.expires) && healthy(ic.conn) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+}
+
+// pop removes the most recently added idle connection to addr from the pool
+func (p *tcpConnPool) pop(addr string) (idleConn, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[addr]
+	if len(conns) == 0 {
+		return idleConn{}, false
+	}
+	ic := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, addr)
+	} else {
+		p.idle[addr] = conns[:len(conns)-1]
+	}
+	return ic, true
+}
+
+// put returns a connection to the pool for reuse until timeout has passed,
+// if the pool for addr is full the connection is closed instead
+func (p *tcpConnPool) put(addr string, conn *dns.Conn, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	max := p.maxIdle
+	if max == 0 {
+		max = MaxIdleTCPConns
+	}
+	if len(p.idle[addr]) >= max {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], idleConn{conn, time.Now().Add(timeout)})
+}
+
+// keepaliveTimeout returns the idle timeout a server sent in the
+// edns-tcp-keepalive option of a response, or zero if it wasn't present
+func keepaliveTimeout(m *dns.Msg) time.Duration {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		// the keepalive option is unpacked as a EDNS0_LOCAL option
+		if ka, ok := o.(*dns.EDNS0_LOCAL); ok && ka.Code == dns.EDNS0TCPKEEPALIVE && len(ka.Data) == 2 {
+			// timeout is in units of 100 milliseconds
+			return time.Duration(binary.BigEndian.Uint16(ka.Data)) * time.Millisecond * 100
+		}
+	}
+	return 0
+}
+
+func exchangeConn(conn *dns.Conn, m *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	conn.SetDeadline(deadline)
+	if err := conn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	r, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return r, nil
+}
+
+// contextDone returns the error of ctx if it has been cancelled or its
+// deadline has passed, which a connection using the same deadline may notice
+// before ctx does
+func contextDone(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// exchangeTCP sends a message to addr over TCP, signalling that the connection
+// may be kept open. If the server responds with a keepalive timeout the
+// connection is kept for reuse by subsequent queries to the same address. The
+// response is waited for until tcpTimeout or the deadline of ctx passes,
+// whichever is sooner.
+func (rr *RecursiveResolver) exchangeTCP(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	if err := contextDone(ctx); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(tcpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	m = m.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		// dns.EDNS0_TCP_KEEPALIVE doesn't pack correctly, so use a
+		// EDNS0_LOCAL option with the keepalive code and no timeout instead
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	var r *dns.Msg
+	var err error
+	conn := rr.tcpConns.get(addr)
+	if conn != nil {
+		r, err = exchangeConn(conn, m, deadline)
+		if err != nil {
+			// the server may have closed the idle connection without us
+			// noticing, try again with a fresh one
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn == nil {
+		conn, err = rr.dial("tcp", addr, time.Until(deadline))
+		if err != nil {
+			if err := contextDone(ctx); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+		r, err = exchangeConn(conn, m, deadline)
+		if err != nil {
+			conn.Close()
+			if err := contextDone(ctx); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+	}
+
+	if timeout := keepaliveTimeout(r); timeout > 0 {
+		rr.tcpConns.put(addr, conn, timeout)
+	} else {
+		conn.Close()
+	}
+	return r, nil
+}
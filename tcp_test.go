@@ -0,0 +1,348 @@
+package solvere
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/jmhodges/clock"
+)
+
+type countingListener struct {
+	net.Listener
+	mu       sync.Mutex
+	accepted int
+}
+
+func (cl *countingListener) Accept() (net.Conn, error) {
+	c, err := cl.Listener.Accept()
+	if err == nil {
+		cl.mu.Lock()
+		cl.accepted++
+		cl.mu.Unlock()
+	}
+	return c, err
+}
+
+func (cl *countingListener) count() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.accepted
+}
+
+// truncatingServer truncates all UDP responses and answers TCP queries with
+// a edns-tcp-keepalive option
+func truncatingServer(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncated = true
+		w.WriteMsg(m)
+		return
+	}
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{1, 2, 3, 4},
+	}}
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				m.SetEdns0(4096, false)
+				m.Extra[0].(*dns.OPT).Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{0, 2}}}
+			}
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	dnsPort = "9053"
+	addr := net.JoinHostPort("127.0.0.4", dnsPort)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	cl := &countingListener{Listener: l}
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(truncatingServer), ReadTimeout: time.Second},
+		{Listener: cl, Handler: dns.HandlerFunc(truncatingServer), ReadTimeout: time.Second},
+	}
+	for _, s := range servers {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go func(s *dns.Server) {
+			if s.Listener != nil {
+				s.ActivateAndServe()
+			} else {
+				s.ListenAndServe()
+			}
+		}(s)
+		<-started
+		defer s.Shutdown()
+	}
+
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	auth := &Nameserver{Addr: "127.0.0.4", Zone: "."}
+	for _, name := range []string{"a.example.", "b.example."} {
+		r, log, err := rr.query(context.Background(), &Question{Name: name, Type: dns.TypeA}, auth, LookupOptions{})
+		if err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+		if !log.Truncated {
+			t.Fatal("query didn't mark truncated response in log")
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("query returned wrong answer after TCP retry: %s", r.Answer)
+		}
+	}
+	if cl.count() != 1 {
+		t.Fatalf("Expected both TCP queries to use a single connection, %d were opened", cl.count())
+	}
+
+	// once the keepalive timeout has passed the connection shouldn't be reused
+	time.Sleep(time.Millisecond * 300)
+	_, _, err = rr.query(context.Background(), &Question{Name: "c.example.", Type: dns.TypeA}, auth, LookupOptions{})
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if cl.count() != 2 {
+		t.Fatalf("Expected expired connection to be replaced, %d connections opened", cl.count())
+	}
+}
+
+func TestServeStaleAfterTCPFailure(t *testing.T) {
+	dnsPort = "9053"
+	// only listen on UDP so the TCP retry fails
+	s := &dns.Server{Addr: net.JoinHostPort("127.0.0.6", dnsPort), Net: "udp", Handler: dns.HandlerFunc(truncatingServer), ReadTimeout: time.Second}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ListenAndServe()
+	<-started
+	defer s.Shutdown()
+
+	fc := clock.NewFake()
+	cache := &BasicCache{cache: make(map[[sha1.Size]byte]*cacheEntry), clk: fc, MaxStale: time.Hour}
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	cached := &Answer{Answer: []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.IP{1, 2, 3, 4},
+	}}}
+	cache.Add(&q, cached, false)
+	fc.Add(time.Minute)
+
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP("127.0.0.6")}}
+	rr := NewRecursiveResolver(false, false, hints, nil, cache)
+	_, ll, err := rr.Lookup(context.Background(), q)
+	if err == nil {
+		t.Fatal("Lookup succeeded without serving stale answers enabled")
+	}
+	if !ll.Composites[0].Truncated || !ll.Composites[0].TCPFailed {
+		t.Fatal("Lookup log doesn't record failed TCP retry")
+	}
+
+	rr.ServeStale = true
+	a, ll, err := rr.Lookup(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Lookup failed with serving stale answers enabled: %s", err)
+	}
+	if !ll.Stale || !ll.Composites[0].TCPFailed {
+		t.Fatal("Lookup log doesn't record stale answer served after failed TCP retry")
+	}
+	if len(a.Answer) != 1 || a.Answer[0].Header().Ttl != StaleTTL {
+		t.Fatalf("Lookup returned wrong stale answer: %s", a.Answer)
+	}
+	if a.ExtendedError == nil || a.ExtendedError.Code != EDEStaleAnswer {
+		t.Fatal("Stale answer doesn't have a stale answer extended error")
+	}
+	if cached.Answer[0].Header().Ttl != 10 {
+		t.Fatal("Serving stale answer modified the cached records")
+	}
+}
+
+func TestExchangeTCPContext(t *testing.T) {
+	// the server accepts connections but never responds
+	l, err := net.Listen("tcp", "127.0.0.5:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	rr := NewRecursiveResolver(false, false, nil, nil, nil)
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rr.exchangeTCP(ctx, m, l.Addr().String()); err != context.Canceled {
+		t.Fatalf("exchangeTCP didn't return context.Canceled for a cancelled context: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if _, err := rr.exchangeTCP(ctx, m, l.Addr().String()); err != context.DeadlineExceeded {
+		t.Fatalf("exchangeTCP didn't return context.DeadlineExceeded after the deadline passed: %v", err)
+	}
+	if time.Since(start) >= tcpTimeout {
+		t.Fatal("exchangeTCP didn't return until tcpTimeout passed")
+	}
+}
+
+func TestLookupTransport(t *testing.T) {
+	dnsPort = "9053"
+	mu := new(sync.Mutex)
+	protocols := map[string]int{}
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		protocols[w.RemoteAddr().Network()]++
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		w.WriteMsg(m)
+	}
+	addr := net.JoinHostPort("127.0.0.5", dnsPort)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(handler), ReadTimeout: time.Second},
+		{Addr: addr, Net: "tcp", Handler: dns.HandlerFunc(handler), ReadTimeout: time.Second},
+	}
+	for _, s := range servers {
+		started := make(chan struct{})
+		s.NotifyStartedFunc = func() { close(started) }
+		go s.ListenAndServe()
+		<-started
+		defer s.Shutdown()
+	}
+	count := func(network string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return protocols[network]
+	}
+
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP("127.0.0.5")}}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	_, ll, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Transport: TransportTCP})
+	if err != nil {
+		t.Fatalf("Lookup over TCP failed: %s", err)
+	}
+	if count("tcp") != 1 || count("udp") != 0 {
+		t.Fatalf("Lookup with TCP transport sent %d TCP and %d UDP queries", count("tcp"), count("udp"))
+	}
+	if ll.Composites[0].Transport != TransportTCP {
+		t.Fatal("Lookup log doesn't record transport used")
+	}
+
+	// the transport only applies to a single lookup
+	if _, _, err = rr.Lookup(context.Background(), q); err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if count("tcp") != 1 || count("udp") != 1 {
+		t.Fatalf("Lookup with default transport sent %d TCP and %d UDP queries", count("tcp"), count("udp"))
+	}
+
+	for _, transport := range []Transport{TransportTLS, TransportHTTPS} {
+		_, _, err = rr.LookupWithOptions(context.Background(), q, LookupOptions{Transport: transport})
+		if !errors.Is(err, ErrTransportUnavailable) {
+			t.Fatalf("Lookup with %s transport and no Exchanger didn't fail: %v", transport, err)
+		}
+	}
+}
+
+func TestLookupDoH(t *testing.T) {
+	var ids []uint16
+	mu := new(sync.Mutex)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != "/dns-query" || req.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		ids = append(ids, r.Id)
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		packed, err := m.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	})
+	l, err := net.Listen("tcp", "127.0.0.5:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	s := httptest.NewUnstartedServer(handler)
+	s.Listener.Close()
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	oldPort := dohPort
+	dohPort = port
+	defer func() { dohPort = oldPort }()
+
+	hints := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "a.root-servers.net.", Rrtype: dns.TypeA}, A: net.ParseIP("127.0.0.5")}}
+	rr := NewRecursiveResolver(false, false, hints, nil, nil)
+	rr.HTTPSExchanger = NewDoHExchanger("http://{host}/dns-query", nil)
+	q := Question{Name: "a.example.", Type: dns.TypeA}
+	a, ll, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Transport: TransportHTTPS})
+	if err != nil {
+		t.Fatalf("Lookup over HTTPS failed: %s", err)
+	}
+	if len(extractRRSet(a.Answer, "a.example.", dns.TypeA)) != 1 {
+		t.Fatalf("Lookup over HTTPS returned wrong answer: %s", a.Answer)
+	}
+	if ll.Composites[0].Transport != TransportHTTPS {
+		t.Fatal("Lookup log doesn't record transport used")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 1 || ids[0] != 0 {
+		t.Fatalf("DNS over HTTPS queries had wrong IDs: %v", ids)
+	}
+
+	// errors from the HTTP server are returned
+	rr.HTTPSExchanger = NewDoHExchanger("http://{host}/wrong-path", nil)
+	if _, _, err := rr.LookupWithOptions(context.Background(), q, LookupOptions{Transport: TransportHTTPS, NoCache: true}); err == nil {
+		t.Fatal("Lookup didn't fail when DNS over HTTPS server returned a error")
+	}
+}
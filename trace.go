@@ -0,0 +1,97 @@
+package solvere
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// StepType describes what a QueryStep represents
+type StepType string
+
+const (
+	// StepQuery is a query sent to a nameserver, or answered from the cache
+	StepQuery StepType = "query"
+	// StepValidation is the DNSSEC validation of the response to a query
+	StepValidation StepType = "validation"
+	// StepAuthority is the lookup of the address of the next authority
+	// when a referral doesn't contain glue
+	StepAuthority StepType = "authority"
+)
+
+// QueryStep describes a single step of a lookup as it completes
+type QueryStep struct {
+	Type StepType
+	// Log is a copy of the log for the step at the time it completed
+	Log LookupLog
+}
+
+// traceStep sends a copy of log to the trace channel, if one is set. If the
+// context is done before the step can be sent it is dropped.
+func (opts LookupOptions) traceStep(ctx context.Context, t StepType, log *LookupLog) {
+	if opts.trace == nil {
+		return
+	}
+	select {
+	case opts.trace <- &QueryStep{Type: t, Log: *log}:
+	case <-ctx.Done():
+	}
+}
+
+// LookupWithTrace performs a Lookup, sending each query, validation, and
+// authority lookup step to traceCh as it completes. The lookup blocks until
+// each step is received, or the context is done, so traceCh must be read
+// from concurrently. traceCh is closed once the lookup is finished.
+func (rr *RecursiveResolver) LookupWithTrace(ctx context.Context, q Question, traceCh chan<- *QueryStep) (*Answer, *LookupLog, error) {
+	defer close(traceCh)
+	return rr.LookupWithOptions(ctx, q, LookupOptions{trace: traceCh})
+}
+
+// traceNode is a node in the tree form of a LookupLog produced by MarshalTree
+type traceNode struct {
+	Query string `json:"query"`
+	// Source is the address of the nameserver that was queried, or "cache"
+	// if the answer came from the cache, it is empty for the lookup itself
+	Source string `json:"source,omitempty"`
+	Rcode  string `json:"rcode"`
+	DNSSEC bool   `json:"dnssec"`
+	// Latency is in milliseconds
+	Latency  float64      `json:"latency"`
+	Error    string       `json:"error,omitempty"`
+	Children []*traceNode `json:"children,omitempty"`
+}
+
+func (ll *LookupLog) traceNode() *traceNode {
+	n := &traceNode{
+		Rcode:    dns.RcodeToString[ll.Rcode],
+		DNSSEC:   ll.DNSSECValid,
+		Latency:  float64(ll.Latency) / float64(time.Millisecond),
+		Error:    ll.Error,
+		Children: make([]*traceNode, 0, len(ll.Composites)),
+	}
+	if ll.Query != nil {
+		n.Query = ll.Query.Name + " " + typeString(ll.Query.Type)
+	}
+	if ll.CacheHit {
+		n.Source = "cache"
+	} else if ll.NS != nil {
+		n.Source = ll.NS.Addr
+	}
+	for _, c := range ll.Composites {
+		if c != nil {
+			n.Children = append(n.Children, c.traceNode())
+		}
+	}
+	return n
+}
+
+// MarshalTree returns the log as a JSON tree, each node has the query, the
+// source of the response, the rcode, whether it was DNSSEC validated, the
+// latency in milliseconds, and any error, with the logs of the composite
+// queries as its children. Unlike the default JSON form of LookupLog the
+// format only contains these fields so is suitable for visualization tools.
+func (ll *LookupLog) MarshalTree() ([]byte, error) {
+	return json.Marshal(ll.traceNode())
+}
@@ -0,0 +1,130 @@
+package solvere
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupWithTrace(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "")
+	sub := newTestZone(t, "sub.example.", "127.0.0.4", true, "a.sub.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	example.delegate(sub)
+	defer startTestZones(t, root, example, sub)()
+
+	traceCh := make(chan *QueryStep)
+	done := make(chan []*QueryStep)
+	go func() {
+		var steps []*QueryStep
+		for step := range traceCh {
+			steps = append(steps, step)
+		}
+		done <- steps
+	}()
+	a, ll, err := newTestResolver(root, nil).LookupWithTrace(context.Background(), Question{Name: "a.sub.example.", Type: dns.TypeA}, traceCh)
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	if len(a.Answer) == 0 {
+		t.Fatal("Lookup returned empty answer")
+	}
+	steps := <-done
+
+	expected := []struct {
+		t    StepType
+		addr string
+	}{
+		{StepQuery, root.addr},
+		{StepValidation, root.addr},
+		{StepQuery, example.addr},
+		{StepValidation, example.addr},
+		{StepQuery, sub.addr},
+		{StepValidation, sub.addr},
+	}
+	if len(steps) != len(expected) {
+		t.Fatalf("Expected %d steps, got %d", len(expected), len(steps))
+	}
+	for i, e := range expected {
+		if steps[i].Type != e.t || steps[i].Log.NS == nil || steps[i].Log.NS.Addr != e.addr {
+			t.Fatalf("Step %d is wrong: expected %s to %s, got %s to %v", i, e.t, e.addr, steps[i].Type, steps[i].Log.NS)
+		}
+		if e.t == StepValidation && !steps[i].Log.DNSSECValid {
+			t.Fatalf("Validation step %d isn't marked valid", i)
+		}
+	}
+	if len(ll.Composites) != 3 {
+		t.Fatalf("Lookup returned wrong number of composite logs: %d", len(ll.Composites))
+	}
+}
+
+func TestMarshalTree(t *testing.T) {
+	root := newTestZone(t, ".", "127.0.0.2", true, "")
+	example := newTestZone(t, "example.", "127.0.0.3", true, "a.example. 300 IN A 1.2.3.4")
+	root.delegate(example)
+	defer startTestZones(t, root, example)()
+
+	_, ll, err := newTestResolver(root, nil).Lookup(context.Background(), Question{Name: "a.example.", Type: dns.TypeA})
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	j, err := ll.MarshalTree()
+	if err != nil {
+		t.Fatalf("MarshalTree failed: %s", err)
+	}
+
+	type node struct {
+		Query    string
+		Source   string
+		Rcode    string
+		DNSSEC   bool
+		Latency  *float64
+		Children []node
+	}
+	var tree node
+	if err := json.Unmarshal(j, &tree); err != nil {
+		t.Fatalf("Failed to unmarshal tree: %s", err)
+	}
+	// strip the latencies after checking they are present so the rest of
+	// the tree can be compared
+	var strip func(n *node)
+	strip = func(n *node) {
+		if n.Latency == nil {
+			t.Fatalf("Node for %s is missing latency", n.Query)
+		}
+		n.Latency = nil
+		for i := range n.Children {
+			strip(&n.Children[i])
+		}
+	}
+	strip(&tree)
+	// each query has a child for the DNSKEY lookup made to validate it
+	expected := node{Query: "a.example. A", Rcode: "NOERROR", DNSSEC: true, Children: []node{
+		{Query: "a.example. A", Source: root.addr, Rcode: "NOERROR", DNSSEC: true, Children: []node{
+			{Query: ". DNSKEY", Source: root.addr, Rcode: "NOERROR", DNSSEC: true},
+		}},
+		{Query: "a.example. A", Source: example.addr, Rcode: "NOERROR", DNSSEC: true, Children: []node{
+			{Query: "example. DNSKEY", Source: example.addr, Rcode: "NOERROR", DNSSEC: true},
+		}},
+	}}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("Unexpected tree: %s", j)
+	}
+
+	// the default JSON form shouldn't be affected
+	j, err = json.Marshal(ll)
+	if err != nil {
+		t.Fatalf("Failed to marshal log: %s", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(j, &fields); err != nil {
+		t.Fatalf("Failed to unmarshal log: %s", err)
+	}
+	if _, present := fields["Composites"]; !present {
+		t.Fatal("Default JSON form of log is missing Composites")
+	}
+}
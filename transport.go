@@ -0,0 +1,195 @@
+package solvere
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dotPort = "853"
+	dohPort = "443"
+
+	ErrTransportUnavailable = errors.New("solvere: No Exchanger configured for requested transport")
+)
+
+// dohMediaType is the media type of DNS messages sent over HTTPS (RFC 8484
+// Section 6)
+const dohMediaType = "application/dns-message"
+
+// DefaultDoHTemplate is the URL template used by a DoHExchanger if Template
+// isn't set
+var DefaultDoHTemplate = "https://{host}/dns-query"
+
+// Transport selects how queries are sent to nameservers
+type Transport int
+
+const (
+	// TransportDefault sends queries over UDP, retrying over TCP if the
+	// response is truncated
+	TransportDefault Transport = iota
+	// TransportUDP only sends queries over UDP, truncated responses cause
+	// the query to fail
+	TransportUDP
+	// TransportTCP only sends queries over TCP
+	TransportTCP
+	// TransportTLS sends queries using the TLSExchanger of the resolver
+	TransportTLS
+	// TransportHTTPS sends queries using the HTTPSExchanger of the resolver
+	TransportHTTPS
+)
+
+var transportNames = map[Transport]string{
+	TransportDefault: "default",
+	TransportUDP:     "udp",
+	TransportTCP:     "tcp",
+	TransportTLS:     "tls",
+	TransportHTTPS:   "https",
+}
+
+func (t Transport) String() string {
+	if name, present := transportNames[t]; present {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalText allows a Transport to be included in the JSON form of a
+// LookupLog by name
+func (t Transport) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// checkTransport returns ErrTransportUnavailable if a Exchanger isn't
+// configured for a transport that requires one
+func (rr *RecursiveResolver) checkTransport(t Transport) error {
+	if (t == TransportTLS && rr.TLSExchanger == nil) || (t == TransportHTTPS && rr.HTTPSExchanger == nil) {
+		return ErrTransportUnavailable
+	}
+	return nil
+}
+
+// exchangeUDP sends a message to the nameserver at addr over UDP, waiting for
+// a response for the query timeout of the address or until the deadline of
+// ctx, whichever is sooner
+func (rr *RecursiveResolver) exchangeUDP(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	timeout := rr.queryTimeout(addr)
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ctx.Err()
+		}
+		if remaining < timeout {
+			timeout = remaining
+		}
+	}
+	conn, err := rr.dial("udp", net.JoinHostPort(addr, dnsPort), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	return exchangeConn(conn, m, time.Now().Add(timeout))
+}
+
+// exchange sends a message to the nameserver at addr using the requested
+// transport. When using the default transport a truncated response is
+// retried over TCP, which is recorded in ql.
+func (rr *RecursiveResolver) exchange(ctx context.Context, m *dns.Msg, addr string, t Transport, ql *LookupLog) (*dns.Msg, error) {
+	switch t {
+	case TransportUDP:
+		r, err := rr.exchangeUDP(ctx, m, addr)
+		ql.Truncated = err == dns.ErrTruncated
+		return r, err
+	case TransportTCP:
+		return rr.exchangeTCP(ctx, m, net.JoinHostPort(addr, dnsPort))
+	case TransportTLS:
+		return rr.TLSExchanger.Exchange(ctx, m, net.JoinHostPort(addr, dotPort))
+	case TransportHTTPS:
+		return rr.HTTPSExchanger.Exchange(ctx, m, net.JoinHostPort(addr, dohPort))
+	}
+	r, err := rr.exchangeUDP(ctx, m, addr)
+	if err == dns.ErrTruncated {
+		// retry over TCP to get the full response
+		ql.Truncated = true
+		r, err = rr.exchangeTCP(ctx, m, net.JoinHostPort(addr, dnsPort))
+		ql.TCPFailed = err != nil
+	}
+	return r, err
+}
+
+// DoHExchanger sends messages using DNS over HTTPS (RFC 8484), POSTing them
+// to the URL built from Template by replacing "{host}" with the address the
+// message is sent to
+type DoHExchanger struct {
+	// Template is the URL template messages are sent to, if it is empty
+	// DefaultDoHTemplate is used
+	Template string
+	// Client is used to send requests, if it is nil http.DefaultClient is
+	// used
+	Client *http.Client
+}
+
+// NewDoHExchanger returns a DoHExchanger that sends messages to the URLs
+// built from template using client
+func NewDoHExchanger(template string, client *http.Client) *DoHExchanger {
+	return &DoHExchanger{Template: template, Client: client}
+}
+
+// Exchange sends a message to the DNS over HTTPS server at addr. The ID of
+// the message is set to zero when it is sent so responses can be cached by
+// HTTP caches (RFC 8484 Section 4.1), and restored in the response.
+func (de *DoHExchanger) Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	template := de.Template
+	if template == "" {
+		template = DefaultDoHTemplate
+	}
+	client := de.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	url := strings.Replace(template, "{host}", addr, -1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("solvere: DNS over HTTPS server returned status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("solvere: DNS over HTTPS server returned unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	r.Id = m.Id
+	return r, nil
+}
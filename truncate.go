@@ -0,0 +1,29 @@
+package solvere
+
+import (
+	"github.com/miekg/dns"
+)
+
+// TruncateReply checks if a reply to request would be larger than the UDP
+// payload size advertised by the client, or 512 bytes if the client didn't
+// include a OPT record (RFC 6891 Section 6.2.5). If it would be, the answer,
+// authority, and additional records are removed, keeping any OPT record, and
+// the TC bit is set so that the client retries over TCP (RFC 2181 Section
+// 9). The size is calculated with the compression setting of the reply. The
+// returned bool indicates if the reply was truncated.
+func TruncateReply(reply, request *dns.Msg) bool {
+	size := dns.MinMsgSize
+	if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if reply.Len() <= size {
+		return false
+	}
+	var extra []dns.RR
+	if opt := reply.IsEdns0(); opt != nil {
+		extra = []dns.RR{opt}
+	}
+	reply.Answer, reply.Ns, reply.Extra = nil, nil, extra
+	reply.Truncated = true
+	return true
+}
@@ -0,0 +1,46 @@
+package solvere
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTruncateReply(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeNS)
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	for i := 0; i < 20; i++ {
+		reply.Ns = append(reply.Ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+			Ns:  fmt.Sprintf("ns%d.some-long-nameserver-name.example.net.", i),
+		})
+	}
+	reply.SetEdns0(4096, false)
+
+	// fits in the advertised buffer
+	request.SetEdns0(4096, false)
+	if TruncateReply(reply, request) || reply.Truncated || len(reply.Ns) != 20 {
+		t.Fatal("TruncateReply truncated reply that fits in the advertised buffer")
+	}
+
+	// too large for a client without EDNS
+	request.Extra = nil
+	if !TruncateReply(reply, request) {
+		t.Fatal("TruncateReply didn't truncate oversized reply")
+	}
+	if !reply.Truncated {
+		t.Fatal("TruncateReply didn't set TC bit")
+	}
+	if len(reply.Answer) != 0 || len(reply.Ns) != 0 {
+		t.Fatal("TruncateReply didn't remove records from oversized reply")
+	}
+	if reply.IsEdns0() == nil {
+		t.Fatal("TruncateReply removed OPT record")
+	}
+	if reply.Len() > dns.MinMsgSize {
+		t.Fatalf("Truncated reply is still %d bytes", reply.Len())
+	}
+}